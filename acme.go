@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// acmeRenewBefore is how long before it expires a certificate is renewed
+	acmeRenewBefore = 30 * 24 * time.Hour
+	// acmeCheckInterval is how often the certificate's expiry is checked
+	acmeCheckInterval = 12 * time.Hour
+	// acmeTimeout limits how long obtaining a certificate may take,
+	// including the wait for DNS records to propagate
+	acmeTimeout = 10 * time.Minute
+
+	acmeAccountKey = "acme_dns01_account+key"
+)
+
+// dnsCertManager obtains a single certificate for all letsencrypt hosts with
+// the ACME DNS-01 challenge, which works for wildcard hosts and for proxies
+// that Let's Encrypt can't connect to. The certificate is kept in the cache
+// dir and renewed in the background.
+type dnsCertManager struct {
+	hosts        []string
+	email        string
+	cache        autocert.Cache
+	dns          dnsProvider
+	delay        time.Duration
+	directoryURL string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newDNSCertManager(o *Options) *dnsCertManager {
+	return &dnsCertManager{
+		hosts: o.LetsEncryptHosts,
+		email: o.LetsEncryptAdminEmail,
+		cache: autocert.DirCache(o.LetsEncryptCacheDir),
+		dns:   o.dnsProvider,
+		delay: o.LetsEncryptDNSDelay,
+	}
+}
+
+// GetCertificate returns the certificate for every client, for use as
+// tls.Config.GetCertificate
+func (m *dnsCertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("no certificate has been obtained yet")
+	}
+	return m.cert, nil
+}
+
+func (m *dnsCertManager) current() *tls.Certificate {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cert
+}
+
+// Start loads the certificate from the cache, obtaining a new one if there
+// is none for the current hosts, then renews it in the background until
+// done is closed
+func (m *dnsCertManager) Start(done <-chan bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+	data, err := m.cache.Get(ctx, m.cacheKey())
+	cancel()
+	if err == nil {
+		cert, err := parseCachedCert(data)
+		if err != nil {
+			log.Printf("ignoring cached certificate %s: %s", m.cacheKey(), err)
+		} else if certCovers(cert.Leaf, m.hosts) {
+			m.mu.Lock()
+			m.cert = cert
+			m.mu.Unlock()
+		}
+	} else if err != autocert.ErrCacheMiss {
+		return err
+	}
+	if m.needsRenewal(time.Now()) {
+		if err := m.renew(); err != nil && m.current() == nil {
+			return err
+		} else if err != nil {
+			log.Printf("ERROR: renewing certificate for %s: %s", strings.Join(m.hosts, ","), err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(acmeCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if !m.needsRenewal(now) {
+					continue
+				}
+				if err := m.renew(); err != nil {
+					log.Printf("ERROR: renewing certificate for %s: %s", strings.Join(m.hosts, ","), err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *dnsCertManager) needsRenewal(now time.Time) bool {
+	cert := m.current()
+	return cert == nil || now.Add(acmeRenewBefore).After(cert.Leaf.NotAfter)
+}
+
+func (m *dnsCertManager) renew() error {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+	defer cancel()
+	cert, err := m.obtain(ctx)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+	log.Printf("obtained certificate for %s valid until %s", strings.Join(m.hosts, ","), cert.Leaf.NotAfter)
+	return nil
+}
+
+// cacheKey names the certificate in the cache after the first host, with
+// the wildcard replaced so that it is a valid file name
+func (m *dnsCertManager) cacheKey() string {
+	return "dns01+" + strings.Replace(m.hosts[0], "*", "_", -1)
+}
+
+// obtain orders a certificate for the hosts, answering a DNS-01 challenge
+// for each of them, and stores it in the cache
+func (m *dnsCertManager) obtain(ctx context.Context) (*tls.Certificate, error) {
+	client, err := m.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.hosts...))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range order.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		if z.Status == acme.StatusValid {
+			continue
+		}
+		if err := m.authorize(ctx, client, z); err != nil {
+			return nil, err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.hosts}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := encodeECKey(&buf, key); err != nil {
+		return nil, err
+	}
+	for _, b := range der {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	}
+	cert, err := parseCachedCert(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if err := m.cache.Put(ctx, m.cacheKey(), buf.Bytes()); err != nil {
+		log.Printf("ERROR: caching certificate %s: %s", m.cacheKey(), err)
+	}
+	return cert, nil
+}
+
+// authorize publishes the TXT record for the authorization's DNS-01
+// challenge and waits for the CA to validate it
+func (m *dnsCertManager) authorize(ctx context.Context, client *acme.Client, z *acme.Authorization) error {
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %s", z.Identifier.Value)
+	}
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + strings.TrimPrefix(z.Identifier.Value, "*.")
+	if err := m.dns.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("creating TXT record %s: %s", fqdn, err)
+	}
+	defer func() {
+		if err := m.dns.CleanUp(ctx, fqdn, value); err != nil {
+			log.Printf("ERROR: removing TXT record %s: %s", fqdn, err)
+		}
+	}()
+
+	if m.delay > 0 {
+		select {
+		case <-time.After(m.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// client returns an ACME client for the account kept in the cache, creating
+// and registering the account the first time
+func (m *dnsCertManager) client(ctx context.Context) (*acme.Client, error) {
+	var key crypto.Signer
+	data, err := m.cache.Get(ctx, acmeAccountKey)
+	switch err {
+	case nil:
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "EC PRIVATE KEY" {
+			return nil, fmt.Errorf("invalid account key %s", acmeAccountKey)
+		}
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	case autocert.ErrCacheMiss:
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := encodeECKey(&buf, ecKey); err != nil {
+			return nil, err
+		}
+		if err := m.cache.Put(ctx, acmeAccountKey, buf.Bytes()); err != nil {
+			return nil, err
+		}
+		key = ecKey
+	default:
+		return nil, err
+	}
+
+	client := &acme.Client{Key: key, DirectoryURL: m.directoryURL}
+	acct := &acme.Account{Contact: []string{"mailto:" + m.email}}
+	if _, err := client.Register(ctx, acct, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, err
+	}
+	return client, nil
+}
+
+func encodeECKey(buf *bytes.Buffer, key *ecdsa.PrivateKey) error {
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return pem.Encode(buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+}
+
+// parseCachedCert parses a private key and certificate chain stored
+// together as PEM
+func parseCachedCert(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// certCovers reports whether the certificate was issued for all of hosts
+func certCovers(leaf *x509.Certificate, hosts []string) bool {
+	for _, h := range hosts {
+		var found bool
+		for _, name := range leaf.DNSNames {
+			if strings.EqualFold(name, h) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
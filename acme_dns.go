@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/bitly/oauth2_proxy/api"
+)
+
+// dnsProvider publishes the TXT records of ACME DNS-01 challenges. fqdn is
+// the record name without a trailing dot, such as
+// "_acme-challenge.example.com".
+type dnsProvider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// dnsProviders create the provider named by letsencrypt-dns-provider
+var dnsProviders = map[string]func(o *Options) (dnsProvider, error){
+	"cloudflare": newCloudflareDNS,
+	"exec":       newExecDNS,
+}
+
+func dnsProviderNames() string {
+	var names []string
+	for name := range dnsProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// execDNS runs letsencrypt-dns-exec with the arguments "present" or
+// "cleanup", the record name and its value, so that any DNS API can be
+// scripted
+type execDNS struct {
+	command string
+}
+
+func newExecDNS(o *Options) (dnsProvider, error) {
+	if o.LetsEncryptDNSExec == "" {
+		return nil, errors.New("missing setting: letsencrypt-dns-exec")
+	}
+	return &execDNS{command: o.LetsEncryptDNSExec}, nil
+}
+
+func (d *execDNS) Present(ctx context.Context, fqdn, value string) error {
+	return d.run(ctx, "present", fqdn, value)
+}
+
+func (d *execDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	return d.run(ctx, "cleanup", fqdn, value)
+}
+
+func (d *execDNS) run(ctx context.Context, action, fqdn, value string) error {
+	out, err := exec.CommandContext(ctx, d.command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s %s: %s %s", d.command, action, fqdn, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// cloudflareDNS manages records through the Cloudflare API with an API token
+// that has the Zone.DNS edit permission
+type cloudflareDNS struct {
+	token   string
+	baseURL string
+}
+
+func newCloudflareDNS(o *Options) (dnsProvider, error) {
+	if o.LetsEncryptDNSAPIToken == "" {
+		return nil, errors.New("missing setting: letsencrypt-dns-api-token")
+	}
+	return &cloudflareDNS{token: o.LetsEncryptDNSAPIToken, baseURL: "https://api.cloudflare.com/client/v4"}, nil
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+func (d *cloudflareDNS) request(ctx context.Context, method, path string, body interface{}, result interface{}) error {
+	var b bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&b).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, d.baseURL+path, &b)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+d.token)
+	req.Header.Set("Content-Type", "application/json")
+	var resp cloudflareResponse
+	if err := api.RequestJson(req, &resp); err != nil {
+		return err
+	}
+	if !resp.Success {
+		var msgs []string
+		for _, e := range resp.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return fmt.Errorf("cloudflare %s %s failed: %s", method, path, strings.Join(msgs, "; "))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// zoneID finds the zone of fqdn, the longest of its parent domains that
+// is a zone in the account
+func (d *cloudflareDNS) zoneID(ctx context.Context, fqdn string) (string, error) {
+	labels := strings.Split(fqdn, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		name := strings.Join(labels[i:], ".")
+		if err := d.request(ctx, "GET", "/zones?name="+url.QueryEscape(name), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) != 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("no cloudflare zone found for %s", fqdn)
+}
+
+func (d *cloudflareDNS) Present(ctx context.Context, fqdn, value string) error {
+	zone, err := d.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	record := cloudflareRecord{Type: "TXT", Name: fqdn, Content: value, TTL: 120}
+	return d.request(ctx, "POST", "/zones/"+zone+"/dns_records", record, nil)
+}
+
+func (d *cloudflareDNS) CleanUp(ctx context.Context, fqdn, value string) error {
+	zone, err := d.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	var records []cloudflareRecord
+	q := url.Values{"type": {"TXT"}, "name": {fqdn}, "content": {value}}
+	if err := d.request(ctx, "GET", "/zones/"+zone+"/dns_records?"+q.Encode(), nil, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := d.request(ctx, "DELETE", "/zones/"+zone+"/dns_records/"+r.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
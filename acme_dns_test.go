@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestExecDNS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme_dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "dns.sh")
+	out := filepath.Join(dir, "calls")
+	ioutil.WriteFile(script, []byte(fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\n", out)), 0700)
+
+	o := NewOptions()
+	o.LetsEncryptDNSExec = script
+	d, err := newExecDNS(o)
+	assert.Equal(t, nil, err)
+	ctx := context.Background()
+	assert.Equal(t, nil, d.Present(ctx, "_acme-challenge.example.com", "value"))
+	assert.Equal(t, nil, d.CleanUp(ctx, "_acme-challenge.example.com", "value"))
+	calls, _ := ioutil.ReadFile(out)
+	assert.Equal(t, "present _acme-challenge.example.com value\n"+
+		"cleanup _acme-challenge.example.com value\n", string(calls))
+
+	d = &execDNS{command: filepath.Join(dir, "missing.sh")}
+	assert.NotEqual(t, nil, d.Present(ctx, "_acme-challenge.example.com", "value"))
+}
+
+func TestCloudflareDNS(t *testing.T) {
+	var calls []string
+	records := map[string]cloudflareRecord{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.RequestURI())
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		var result interface{}
+		switch {
+		case r.URL.Path == "/zones":
+			result = []interface{}{}
+			if r.URL.Query().Get("name") == "example.com" {
+				result = []map[string]string{{"id": "zone1"}}
+			}
+		case r.Method == "POST":
+			var record cloudflareRecord
+			json.NewDecoder(r.Body).Decode(&record)
+			record.ID = "record1"
+			records[record.ID] = record
+		case r.Method == "GET":
+			var found []cloudflareRecord
+			for _, record := range records {
+				if record.Name == r.URL.Query().Get("name") && record.Content == r.URL.Query().Get("content") {
+					found = append(found, record)
+				}
+			}
+			result = found
+		case r.Method == "DELETE":
+			delete(records, "record1")
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": result})
+	}))
+	defer api.Close()
+
+	d := &cloudflareDNS{token: "token", baseURL: api.URL}
+	ctx := context.Background()
+	assert.Equal(t, nil, d.Present(ctx, "_acme-challenge.auth.example.com", "value"))
+	assert.Equal(t, cloudflareRecord{
+		ID: "record1", Type: "TXT", Name: "_acme-challenge.auth.example.com", Content: "value", TTL: 120,
+	}, records["record1"])
+	assert.Equal(t, nil, d.CleanUp(ctx, "_acme-challenge.auth.example.com", "value"))
+	assert.Equal(t, 0, len(records))
+	assert.Equal(t, []string{
+		"GET /zones?name=auth.example.com",
+		"GET /zones?name=example.com",
+		"POST /zones/zone1/dns_records",
+		"GET /zones?name=auth.example.com",
+		"GET /zones?name=example.com",
+		"GET /zones/zone1/dns_records?content=value&name=_acme-challenge.auth.example.com&type=TXT",
+		"DELETE /zones/zone1/dns_records/record1",
+	}, calls)
+
+	err := d.Present(ctx, "_acme-challenge.example.org", "value")
+	assert.Equal(t, "no cloudflare zone found for _acme-challenge.example.org", err.Error())
+}
+
+func TestCloudflareDNSErrors(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success": false, "errors": [{"code": 9109, "message": "Invalid access token"}]}`))
+	}))
+	defer api.Close()
+
+	d := &cloudflareDNS{token: "token", baseURL: api.URL}
+	err := d.Present(context.Background(), "_acme-challenge.example.com", "value")
+	assert.Equal(t, "cloudflare GET /zones?name=example.com failed: Invalid access token", err.Error())
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestLetsEncryptChallengeOptions(t *testing.T) {
+	o := testOptions()
+	o.LetsEncryptEnabled = true
+	o.LetsEncryptAdminEmail = "admin@example.com"
+	o.LetsEncryptHosts = []string{"*.example.com"}
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`letsencrypt-host "*.example.com" requires letsencrypt-challenge=dns-01`,
+	}), err.Error())
+
+	o.LetsEncryptChallenge = "dns-01"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`invalid letsencrypt-dns-provider="" expected one of cloudflare, exec`,
+	}), err.Error())
+
+	o.LetsEncryptDNSProvider = "cloudflare"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"letsencrypt-dns-provider cloudflare missing setting: letsencrypt-dns-api-token",
+	}), err.Error())
+
+	o.LetsEncryptDNSAPIToken = "token"
+	o.CanonicalURL = "https://auth.example.com"
+	assert.Equal(t, nil, o.Validate())
+	assert.NotEqual(t, nil, o.dnsProvider)
+
+	o.LetsEncryptChallenge = "http-01"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`invalid letsencrypt-challenge="http-01" expected one of tls-alpn-01, dns-01`,
+	}), err.Error())
+}
+
+func TestMatchLetsEncryptHost(t *testing.T) {
+	assert.Equal(t, true, matchLetsEncryptHost("auth.example.com", "Auth.example.com"))
+	assert.Equal(t, true, matchLetsEncryptHost("*.example.com", "auth.example.com"))
+	assert.Equal(t, false, matchLetsEncryptHost("*.example.com", "example.com"))
+	assert.Equal(t, false, matchLetsEncryptHost("*.example.com", "a.b.example.com"))
+}
+
+func TestDNSCertManagerUsesCachedCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hosts := []string{"example.com", "*.example.com"}
+	certPEM, keyPEM := serverCertificatePEM(t, hosts, time.Now().Add(60*24*time.Hour))
+	m := &dnsCertManager{hosts: hosts, cache: autocert.DirCache(dir)}
+	assert.Equal(t, "dns01+example.com", m.cacheKey())
+	err = m.cache.Put(context.Background(), m.cacheKey(), append(keyPEM, certPEM...))
+	assert.Equal(t, nil, err)
+
+	done := make(chan bool)
+	defer close(done)
+	assert.Equal(t, nil, m.Start(done))
+	cert, err := m.GetCertificate(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, hosts, cert.Leaf.DNSNames)
+	assert.Equal(t, false, m.needsRenewal(time.Now()))
+	assert.Equal(t, true, m.needsRenewal(time.Now().Add(31*24*time.Hour)))
+}
+
+func TestDNSCertManagerObtainsMissingCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a cached certificate for other hosts isn't used
+	certPEM, keyPEM := serverCertificatePEM(t, []string{"example.com"}, time.Now().Add(60*24*time.Hour))
+	ioutil.WriteFile(filepath.Join(dir, "dns01+example.com"), append(keyPEM, certPEM...), 0600)
+
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer directory.Close()
+	m := &dnsCertManager{
+		hosts:        []string{"example.com", "*.example.com"},
+		email:        "admin@example.com",
+		cache:        autocert.DirCache(dir),
+		directoryURL: directory.URL,
+	}
+	err = m.Start(make(chan bool))
+	assert.NotEqual(t, nil, err)
+	_, err = m.GetCertificate(nil)
+	assert.NotEqual(t, nil, err)
+	_, err = os.Stat(filepath.Join(dir, acmeAccountKey))
+	assert.Equal(t, nil, err)
+}
+
+func TestParseCachedCertificate(t *testing.T) {
+	certPEM, keyPEM := serverCertificatePEM(t, []string{"example.com"}, time.Now().Add(time.Hour))
+	cert, err := parseCachedCert(append(keyPEM, certPEM...))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, certCovers(cert.Leaf, []string{"EXAMPLE.com"}))
+	assert.Equal(t, false, certCovers(cert.Leaf, []string{"example.com", "*.example.com"}))
+
+	_, err = parseCachedCert(certPEM)
+	assert.Equal(t, true, strings.Contains(err.Error(), "private key"))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation
+const listenFDsStart = 3
+
+// activatedListener is a listening socket passed in by the service manager
+// along with its FileDescriptorName
+type activatedListener struct {
+	name string
+	net.Listener
+}
+
+// activatedListeners returns the sockets passed in by systemd socket
+// activation, as described in sd_listen_fds(3). The environment variables
+// are cleared so they aren't inherited by child processes.
+func activatedListeners() ([]activatedListener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	n, names, err := listenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"),
+		os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), names[i])
+	}
+	return fileListeners(files)
+}
+
+// listenFDs parses the socket activation environment, returning the number
+// of sockets passed to pid and their names. No sockets are returned when
+// they were meant for another process.
+func listenFDs(listenPID, listenFDs, listenFDNames string, pid int) (int, []string, error) {
+	if listenPID == "" {
+		return 0, nil, nil
+	}
+	if p, err := strconv.Atoi(listenPID); err != nil || p != pid {
+		return 0, nil, nil
+	}
+	n, err := strconv.Atoi(listenFDs)
+	if err != nil || n < 0 {
+		return 0, nil, fmt.Errorf("invalid LISTEN_FDS=%q", listenFDs)
+	}
+	names := make([]string, n)
+	given := strings.Split(listenFDNames, ":")
+	for i := range names {
+		names[i] = "unknown"
+		if i < len(given) && given[i] != "" {
+			names[i] = given[i]
+		}
+	}
+	return n, names, nil
+}
+
+// fileListeners makes a listener of each file, named after the file. The
+// listeners hold duplicates of the sockets, so the files are closed.
+func fileListeners(files []*os.File) ([]activatedListener, error) {
+	var listeners []activatedListener
+	var err error
+	for _, f := range files {
+		var ln net.Listener
+		if err == nil {
+			ln, err = net.FileListener(f)
+			if err != nil {
+				err = fmt.Errorf("socket %d (%s): %s", f.Fd(), f.Name(), err)
+			} else {
+				listeners = append(listeners, activatedListener{name: f.Name(), Listener: ln})
+			}
+		}
+		f.Close()
+	}
+	if err != nil {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		return nil, err
+	}
+	return listeners, nil
+}
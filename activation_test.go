@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestListenFDs(t *testing.T) {
+	n, names, err := listenFDs("", "", "", 100)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, n)
+
+	n, _, err = listenFDs("99", "2", "", 100)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, n)
+
+	n, names, err = listenFDs("100", "3", "https::http", 100)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []string{"https", "unknown", "http"}, names)
+
+	_, _, err = listenFDs("100", "two", "", 100)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestListenAddresses(t *testing.T) {
+	assert.Equal(t, []string{"127.0.0.1:4180", "[::1]:4180"},
+		listenAddresses("127.0.0.1:4180, [::1]:4180"))
+	assert.Equal(t, []string{":443"}, listenAddresses(":443"))
+	assert.Equal(t, []string(nil), listenAddresses(""))
+
+	network, addr, err := parseHTTPAddress("unix:///var/run/oauth2_proxy.sock")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/var/run/oauth2_proxy.sock", addr)
+
+	network, addr, err = parseHTTPAddress("http://[::1]:4180")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "[::1]:4180", addr)
+}
+
+func TestServeActivatedListeners(t *testing.T) {
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Equal(t, nil, err)
+		f, err := ln.(*net.TCPListener).File()
+		assert.Equal(t, nil, err)
+		ln.Close()
+		files = append(files, f)
+		addrs = append(addrs, ln.Addr().String())
+	}
+	activated, err := fileListeners(files)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(activated))
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("activated"))
+	})
+	s := &Server{Handler: handler, Opts: NewOptions()}
+	go s.ServeActivated(activated)
+	defer s.Shutdown()
+
+	for _, addr := range addrs {
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "activated", string(body))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// AdminHandler serves the session administration API. Every request must
+// carry token as a bearer token.
+//
+//	GET    /sessions         lists the sessions seen by this instance
+//	DELETE /sessions/<user>  revokes the sessions of a user, by email or name
+//	DELETE /sessions         revokes every session
+//	GET    /maintenance      reports whether maintenance mode is switched on
+//	PUT    /maintenance      switches maintenance mode on, with an optional
+//	                         {"message": "..."} body to show on the page
+//	DELETE /maintenance      switches maintenance mode off
+func AdminHandler(registry *sessionRegistry, maintenance *maintenanceState, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(registry.List())
+		case "DELETE":
+			registry.RevokeAll()
+			log.Printf("admin: revoked all sessions")
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			rw.Header().Set("Allow", "GET, DELETE")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/sessions/", func(rw http.ResponseWriter, req *http.Request) {
+		id := strings.TrimPrefix(req.URL.Path, "/sessions/")
+		if id == "" || strings.Contains(id, "/") {
+			http.NotFound(rw, req)
+			return
+		}
+		if req.Method != "DELETE" {
+			rw.Header().Set("Allow", "DELETE")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		known := registry.Revoke(id)
+		log.Printf("admin: revoked sessions for %s (active session found: %v)", id, known)
+		rw.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/maintenance", func(rw http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Enabled bool   `json:"enabled"`
+			Message string `json:"message,omitempty"`
+		}
+		switch req.Method {
+		case "GET":
+			body.Enabled, body.Message = maintenance.Get()
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(body)
+		case "PUT":
+			if req.ContentLength != 0 {
+				if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+					http.Error(rw, "invalid request body: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			maintenance.Set(true, body.Message)
+			log.Printf("admin: maintenance mode on")
+			rw.WriteHeader(http.StatusNoContent)
+		case "DELETE":
+			maintenance.Set(false, "")
+			log.Printf("admin: maintenance mode off")
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			rw.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="oauth2_proxy admin"`)
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(rw, req)
+	})
+}
+
+func (s *Server) ServeAdmin() {
+	ln, err := s.listen("tcp", s.Opts.AdminAddress)
+	if err != nil {
+		log.Fatalf("FATAL: listen (%s) failed - %s", s.Opts.AdminAddress, err)
+	}
+	log.Printf("admin: listening on %s", ln.Addr())
+
+	srv := &http.Server{Handler: AdminHandler(registeredSessions, maintenanceSwitch, s.Opts.AdminToken)}
+	if err := s.serve(srv, ln); err != nil {
+		log.Printf("ERROR: admin.Serve() - %s", err)
+	}
+}
+
+// RevokeSessionsOnSignal revokes every session whenever one of sigs is
+// received
+func RevokeSessionsOnSignal(registry *sessionRegistry, sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	go func() {
+		for sig := range c {
+			registry.RevokeAll()
+			log.Printf("received %s, revoked all sessions", sig)
+		}
+	}()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func testSessionRegistry() (*sessionRegistry, *time.Time) {
+	now := time.Date(2015, time.March, 19, 17, 20, 19, 500000000, time.UTC)
+	r := newSessionRegistry()
+	r.now = func() time.Time { return now }
+	return r, &now
+}
+
+func TestSessionRegistryRevoke(t *testing.T) {
+	r, now := testSessionRegistry()
+	alice := &providers.SessionState{User: "alice", Email: "alice@example.com"}
+	bob := &providers.SessionState{User: "bob", Email: "bob@example.com"}
+	issued := now.Add(-time.Hour).Truncate(time.Second)
+	r.Seen(alice, issued)
+	r.Seen(bob, issued)
+	assert.Equal(t, 2, len(r.List()))
+
+	assert.Equal(t, true, r.Revoke("alice"))
+	assert.Equal(t, true, r.IsRevoked(alice, issued))
+	assert.Equal(t, false, r.IsRevoked(bob, issued))
+	assert.Equal(t, []SessionEntry{{
+		User: "bob", Email: "bob@example.com", IssuedAt: issued, LastSeen: *now,
+	}}, r.List())
+
+	// cookies issued in the same second as the revocation are rejected, and
+	// later ones accepted
+	assert.Equal(t, true, r.IsRevoked(alice, now.Truncate(time.Second)))
+	assert.Equal(t, false, r.IsRevoked(alice, now.Truncate(time.Second).Add(time.Second)))
+	assert.Equal(t, false, r.Revoke("carol@example.com"))
+}
+
+func TestSessionRegistryRevokeAll(t *testing.T) {
+	r, now := testSessionRegistry()
+	alice := &providers.SessionState{Email: "alice@example.com"}
+	issued := now.Add(-time.Minute)
+	r.Seen(alice, issued)
+	r.RevokeAll()
+	assert.Equal(t, 0, len(r.List()))
+	assert.Equal(t, true, r.IsRevoked(alice, issued))
+	assert.Equal(t, false, r.IsRevoked(alice, now.Add(time.Second)))
+}
+
+func TestSessionRegistryExpires(t *testing.T) {
+	r, now := testSessionRegistry()
+	r.SetTTL(time.Hour)
+	r.Seen(&providers.SessionState{Email: "alice@example.com"}, now.Add(-2*time.Hour))
+	r.Seen(&providers.SessionState{Email: "bob@example.com"}, now.Add(-time.Minute))
+	r.Revoke("carol@example.com")
+	*now = now.Add(2 * time.Hour)
+	assert.Equal(t, 0, len(r.List()))
+	assert.Equal(t, 0, len(r.revoked))
+}
+
+func TestSessionRegistrySharedStore(t *testing.T) {
+	store := &memorySessionStore{sessions: make(map[string]string)}
+	r1, now := testSessionRegistry()
+	r2, _ := testSessionRegistry()
+	r2.now = r1.now
+	r1.SetStore(store)
+	r2.SetStore(store)
+	alice := &providers.SessionState{User: "alice", Email: "alice@example.com"}
+	bob := &providers.SessionState{User: "bob", Email: "bob@example.com"}
+	issued := now.Add(-time.Hour)
+	assert.Equal(t, false, r2.IsRevoked(alice, issued))
+
+	// revocations made on another instance are read again once the cached
+	// answer is older than revocationRefresh
+	r1.Revoke("alice@example.com")
+	assert.Equal(t, true, r1.IsRevoked(alice, issued))
+	assert.Equal(t, false, r2.IsRevoked(alice, issued))
+	*now = now.Add(revocationRefresh)
+	assert.Equal(t, true, r2.IsRevoked(alice, issued))
+	assert.Equal(t, false, r2.IsRevoked(bob, issued))
+
+	r1.RevokeAll()
+	*now = now.Add(revocationRefresh)
+	assert.Equal(t, true, r2.IsRevoked(bob, issued))
+	assert.Equal(t, false, r2.IsRevoked(bob, now.Add(time.Second)))
+
+	// a restarted instance reads them from the store
+	r3, _ := testSessionRegistry()
+	r3.now = r1.now
+	r3.SetStore(store)
+	assert.Equal(t, true, r3.IsRevoked(alice, issued))
+}
+
+func TestAdminHandler(t *testing.T) {
+	r, _ := testSessionRegistry()
+	r.Seen(&providers.SessionState{User: "alice", Email: "alice@example.com"}, time.Now())
+	h := AdminHandler(r, &maintenanceState{}, "s3cr3t")
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/sessions", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/sessions", "wrong").Code)
+
+	rw := do("GET", "/sessions", "s3cr3t")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var entries []SessionEntry
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &entries))
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "alice@example.com", entries[0].Email)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, do("GET", "/sessions/alice", "s3cr3t").Code)
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/sessions/alice@example.com", "s3cr3t").Code)
+	assert.Equal(t, 0, len(r.List()))
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/sessions", "s3cr3t").Code)
+	assert.Equal(t, false, r.revokedAll.IsZero())
+}
+
+func TestAuthenticateRevokedSession(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.sessions, _ = testSessionRegistry()
+	pc_test.proxy.sessions.now = time.Now
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(session, time.Now().Add(-time.Minute))
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, 1, len(pc_test.proxy.sessions.List()))
+
+	pc_test.proxy.sessions.Revoke("michael.bland@gsa.gov")
+	pc_test.rw = httptest.NewRecorder()
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	cookies := pc_test.rw.Result().Cookies()
+	assert.Equal(t, 1, len(cookies))
+	assert.Equal(t, "", cookies[0].Value)
+}
+
+func TestInvalidAdminOptions(t *testing.T) {
+	o := testOptions()
+	o.AdminAddress = "127.0.0.1:4181"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"missing setting: admin-token"}), err.Error())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ApplicationOptions describes an application from an [[application]] table
+// in the config file. Requests for its hosts are served with its own
+// upstreams and provider settings; any setting left empty is inherited from
+// the top level of the config.
+type ApplicationOptions struct {
+	Hosts                   []string `toml:"hosts" yaml:"hosts"`
+	Upstreams               []string `toml:"upstreams" yaml:"upstreams"`
+	Provider                string   `toml:"provider" yaml:"provider"`
+	OIDCIssuerURL           string   `toml:"oidc_issuer_url" yaml:"oidc_issuer_url"`
+	ClientID                string   `toml:"client_id" yaml:"client_id"`
+	ClientSecret            string   `toml:"client_secret" yaml:"client_secret"`
+	RedirectURL             string   `toml:"redirect_url" yaml:"redirect_url"`
+	CookieName              string   `toml:"cookie_name" yaml:"cookie_name"`
+	CookieDomain            string   `toml:"cookie_domain" yaml:"cookie_domain"`
+	CookieSecret            string   `toml:"cookie_secret" yaml:"cookie_secret"`
+	EmailDomains            []string `toml:"email_domains" yaml:"email_domains"`
+	AuthenticatedEmailsFile string   `toml:"authenticated_emails_file" yaml:"authenticated_emails_file"`
+}
+
+type application struct {
+	hosts []string
+	opts  *Options
+}
+
+// loadApplications reads the [[application]] tables from a config file
+func loadApplications(path string) ([]ApplicationOptions, error) {
+	var cfg struct {
+		Applications []ApplicationOptions `toml:"application"`
+	}
+	_, err := toml.DecodeFile(path, &cfg)
+	return cfg.Applications, err
+}
+
+// options returns a copy of base with the application's settings applied.
+// base must not have been validated, as validation fills in internal
+// values that would be shared with the copy.
+func (a ApplicationOptions) options(base Options) *Options {
+	o := &base
+	o.Applications = nil
+	o.Routes = nil
+	o.Policies = nil
+	o.Providers = nil
+	o.Upstreams = a.Upstreams
+	for _, s := range []struct {
+		dst *string
+		src string
+	}{
+		{&o.Provider, a.Provider},
+		{&o.OIDCIssuerURL, a.OIDCIssuerURL},
+		{&o.ClientID, a.ClientID},
+		{&o.ClientSecret, a.ClientSecret},
+		{&o.RedirectURL, a.RedirectURL},
+		{&o.CookieName, a.CookieName},
+		{&o.AuthenticatedEmailsFile, a.AuthenticatedEmailsFile},
+	} {
+		if s.src != "" {
+			*s.dst = s.src
+		}
+	}
+	if a.CookieSecret != "" {
+		o.CookieSecret, o.CookieSecrets = a.CookieSecret, nil
+		o.CookieSecretFile, o.CookieSecretKMSURL = "", ""
+	}
+	if a.CookieDomain != "" {
+		o.CookieDomains = []string{a.CookieDomain}
+	}
+	if len(a.EmailDomains) != 0 {
+		o.EmailDomains = a.EmailDomains
+	}
+	return o
+}
+
+func parseApplications(o *Options, base Options, msgs []string) []string {
+	o.applications = nil
+	owners := make(map[string]int)
+	for i, a := range o.Applications {
+		name := fmt.Sprintf("application[%d]", i)
+		if len(a.Hosts) == 0 {
+			msgs = append(msgs, fmt.Sprintf("%s missing setting: hosts", name))
+			continue
+		}
+		app := &application{}
+		for _, host := range a.Hosts {
+			host = strings.ToLower(host)
+			if host == "" || strings.ContainsAny(host, "/:") {
+				msgs = append(msgs, fmt.Sprintf(
+					"%s host must be a bare hostname: %q", name, host))
+				continue
+			}
+			if j, ok := owners[host]; ok {
+				msgs = append(msgs, fmt.Sprintf(
+					"%s host %q is already used by application[%d]", name, host, j))
+				continue
+			}
+			owners[host] = i
+			app.hosts = append(app.hosts, host)
+		}
+
+		app.opts = a.options(base)
+		appMsgs := app.opts.validate()
+		// session revocations are kept for the whole proxy, with the top
+		// level's cookie-expire and session store
+		if app.opts.CookieExpire != o.CookieExpire {
+			appMsgs = append(appMsgs, "cookie-expire must be the same as the top level's")
+		}
+		if strings.Join(app.opts.SessionMemcachedServers, " ") != strings.Join(o.SessionMemcachedServers, " ") {
+			appMsgs = append(appMsgs, "session-memcached-server must be the same as the top level's")
+		}
+		for _, msg := range appMsgs {
+			msgs = append(msgs, name+" "+msg)
+		}
+		if len(appMsgs) == 0 {
+			o.applications = append(o.applications, app)
+		}
+	}
+	return msgs
+}
+
+// virtualHostHandler dispatches requests to an application by their Host
+// header, serving requests for any other host with the default handler
+type virtualHostHandler struct {
+	hosts    map[string]http.Handler
+	fallback http.Handler
+}
+
+func (v *virtualHostHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if h, ok := v.hosts[strings.ToLower(host)]; ok {
+		h.ServeHTTP(rw, req)
+		return
+	}
+	v.fallback.ServeHTTP(rw, req)
+}
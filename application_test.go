@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestApplicationOptionsInherit(t *testing.T) {
+	base := *testOptions()
+	base.CookieSecretFile = "/etc/oauth2_proxy/cookie_secret"
+	o := ApplicationOptions{
+		Hosts:        []string{"wiki.example.com"},
+		Upstreams:    []string{"http://127.0.0.1:9000/"},
+		ClientID:     "wiki",
+		CookieSecret: "wikisecret",
+		EmailDomains: []string{"example.com"},
+	}.options(base)
+
+	assert.Equal(t, []string{"http://127.0.0.1:9000/"}, o.Upstreams)
+	assert.Equal(t, "wiki", o.ClientID)
+	assert.Equal(t, base.ClientSecret, o.ClientSecret)
+	assert.Equal(t, base.CookieName, o.CookieName)
+	assert.Equal(t, "wikisecret", o.CookieSecret)
+	assert.Equal(t, "", o.CookieSecretFile)
+	assert.Equal(t, []string{"example.com"}, o.EmailDomains)
+	assert.Equal(t, []string{"*"}, base.EmailDomains)
+}
+
+func TestApplicationsReplaceUpstreams(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = nil
+	o.Applications = []ApplicationOptions{{
+		Hosts: []string{"Wiki.example.com"}, Upstreams: []string{"http://127.0.0.1:9000/"}}}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 1, len(o.applications))
+	assert.Equal(t, []string{"wiki.example.com"}, o.applications[0].hosts)
+	assert.Equal(t, "http://127.0.0.1:9000/", o.applications[0].opts.proxyURLs[0].String())
+}
+
+func TestInvalidApplications(t *testing.T) {
+	o := testOptions()
+	o.Applications = []ApplicationOptions{
+		{Upstreams: []string{"http://127.0.0.1:9000/"}},
+		{Hosts: []string{"wiki.example.com:8080"}, Upstreams: []string{"http://127.0.0.1:9000/"}},
+		{Hosts: []string{"wiki.example.com"}},
+		{Hosts: []string{"wiki.example.com"}, Upstreams: []string{"http://127.0.0.1:9000/"}, Provider: "oidc"},
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"application[0] missing setting: hosts",
+		"application[1] host must be a bare hostname: \"wiki.example.com:8080\"",
+		"application[2] missing setting: upstream",
+		"application[3] host \"wiki.example.com\" is already used by application[2]",
+		"application[3] missing setting: oidc-issuer-url",
+	}), err.Error())
+}
+
+func TestLoadApplications(t *testing.T) {
+	file, err := ioutil.TempFile("", "oauth2_proxy.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`
+client_id = "default"
+
+[[application]]
+hosts = ["wiki.example.com", "docs.example.com"]
+upstreams = ["http://127.0.0.1:9000/"]
+client_id = "wiki"
+client_secret = "wikisecret"
+cookie_domain = ".example.com"
+email_domains = ["example.com"]
+`)
+	file.Close()
+
+	apps, err := loadApplications(file.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []ApplicationOptions{{
+		Hosts:        []string{"wiki.example.com", "docs.example.com"},
+		Upstreams:    []string{"http://127.0.0.1:9000/"},
+		ClientID:     "wiki",
+		ClientSecret: "wikisecret",
+		CookieDomain: ".example.com",
+		EmailDomains: []string{"example.com"},
+	}}, apps)
+}
+
+func TestVirtualHostsDispatchByHost(t *testing.T) {
+	o := testOptions()
+	o.Applications = []ApplicationOptions{
+		{Hosts: []string{"wiki.example.com"}, Upstreams: []string{"http://127.0.0.1:9000/"}, ClientID: "wiki"},
+		{Hosts: []string{"ci.example.com"}, Upstreams: []string{"http://127.0.0.1:9001/"}, ClientID: "ci"},
+	}
+	assert.Equal(t, nil, o.Validate())
+	done := make(chan bool)
+	defer close(done)
+	h, err := newProxyHandler(o, done)
+	assert.Equal(t, nil, err)
+
+	clientID := func(host string) string {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://"+host+"/oauth2/start", nil)
+		h.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusFound, rw.Code)
+		location, _ := url.Parse(rw.HeaderMap.Get("Location"))
+		return location.Query().Get("client_id")
+	}
+
+	assert.Equal(t, "wiki", clientID("wiki.example.com"))
+	assert.Equal(t, "ci", clientID("CI.example.com:4180"))
+	assert.Equal(t, o.ClientID, clientID("other.example.com"))
+
+	// the session registry follows the top level, whichever application was
+	// built last
+	registeredSessions.mu.Lock()
+	assert.Equal(t, o.CookieExpire, registeredSessions.ttl)
+	assert.Equal(t, o.sessionStore, registeredSessions.store)
+	registeredSessions.mu.Unlock()
+}
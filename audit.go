@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// Audit events record authentication decisions for compliance review. They
+// are written to their own sink, apart from the auth and request logs, so
+// that they can be kept and shipped on a different schedule.
+const (
+	auditLoginSuccess          = "login_success"
+	auditLoginFailure          = "login_failure"
+	auditSessionRefresh        = "session_refresh"
+	auditSessionRefreshFailure = "session_refresh_failure"
+	auditSignOut               = "sign_out"
+	auditSessionRevoked        = "session_revoked"
+	auditAuthorizationDenied   = "authorization_denied"
+)
+
+// auditQueueSize is the number of events a webhook sink buffers while a
+// delivery is in flight. Events are dropped, and logged, beyond this.
+const auditQueueSize = 1024
+
+type auditEvent struct {
+	Time      string `json:"time"`
+	Event     string `json:"event"`
+	User      string `json:"user"`
+	Provider  string `json:"provider"`
+	ClientIP  string `json:"client_ip"`
+	RequestID string `json:"request_id,omitempty"`
+	Method    string `json:"method"`
+	Host      string `json:"host"`
+	Path      string `json:"path"`
+	Message   string `json:"message,omitempty"`
+}
+
+// auditSink receives each event as a single line of JSON, without the
+// trailing newline
+type auditSink interface {
+	Emit(line []byte) error
+}
+
+type auditLog struct {
+	sink auditSink
+	now  func() time.Time
+}
+
+// newAuditLog returns an audit log writing to dest, which is a file path,
+// a syslog:// URL or an http(s):// webhook URL. file opens the writer for a
+// path. Sinks connect lazily so that validating the options again on reload
+// doesn't open anything.
+func newAuditLog(dest string, file func(filename string) io.Writer) (*auditLog, error) {
+	var sink auditSink
+	u, err := url.Parse(dest)
+	switch {
+	case err == nil && (u.Scheme == "http" || u.Scheme == "https"):
+		if u.Host == "" {
+			return nil, fmt.Errorf("webhook URL has no host: %q", dest)
+		}
+		sink = newWebhookAuditSink(dest)
+	case err == nil && (u.Scheme == "syslog" || u.Scheme == "syslog+tcp"):
+		sink, err = newSyslogAuditSink(u)
+		if err != nil {
+			return nil, err
+		}
+	case strings.Contains(dest, "://"):
+		return nil, fmt.Errorf("expected a file path, syslog:// or http(s):// URL: %q", dest)
+	default:
+		sink = &writerAuditSink{w: file(dest)}
+	}
+	return &auditLog{sink: sink, now: time.Now}, nil
+}
+
+// Record writes an event to the sink. Delivery errors are logged rather than
+// returned, as the request has already been decided.
+func (a *auditLog) Record(e auditEvent) {
+	e.Time = a.now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("error encoding audit event: %s", err)
+		return
+	}
+	if err := a.sink.Emit(line); err != nil {
+		log.Printf("error writing audit event %s: %s", e.Event, err)
+	}
+}
+
+// audit records an authentication event for the request when an audit log
+// is configured
+func (p *OAuthProxy) audit(req *http.Request, event, user, format string, a ...interface{}) {
+	p.auditFor(req, p.provider, event, user, format, a...)
+}
+
+// auditFor records an event for a user of a provider other than the default
+func (p *OAuthProxy) auditFor(req *http.Request, signInProvider providers.Provider, event, user, format string, a ...interface{}) {
+	if p.auditLog == nil {
+		return
+	}
+	var provider string
+	if d := signInProvider.Data(); d != nil {
+		provider = d.ProviderName
+	}
+	var ip string
+	if addr := clientIP(req, p.trustedProxies); addr != nil {
+		ip = addr.String()
+	}
+	p.auditLog.Record(auditEvent{
+		Event:     event,
+		User:      user,
+		Provider:  provider,
+		ClientIP:  ip,
+		RequestID: req.Header.Get("X-Request-Id"),
+		Method:    req.Method,
+		Host:      req.Host,
+		Path:      req.URL.Path,
+		Message:   fmt.Sprintf(format, a...),
+	})
+}
+
+// writerAuditSink writes one event per line to a file
+type writerAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerAuditSink) Emit(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(append(line, '\n'))
+	return err
+}
+
+// webhookAuditSink POSTs each event to a URL from a background goroutine,
+// so that a slow receiver doesn't hold up authentication
+type webhookAuditSink struct {
+	url       string
+	client    *http.Client
+	once      sync.Once
+	queue     chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newWebhookAuditSink(url string) *webhookAuditSink {
+	return &webhookAuditSink{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan []byte, auditQueueSize),
+		closed: make(chan struct{}),
+	}
+}
+
+func (s *webhookAuditSink) Emit(line []byte) error {
+	s.once.Do(func() { go s.run() })
+	select {
+	case <-s.closed:
+		return fmt.Errorf("webhook is closed, dropping event")
+	default:
+	}
+	select {
+	case s.queue <- line:
+		return nil
+	default:
+		return fmt.Errorf("webhook queue is full, dropping event")
+	}
+}
+
+// Close stops delivering events once the ones already queued are sent
+func (s *webhookAuditSink) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (s *webhookAuditSink) run() {
+	for {
+		select {
+		case line := <-s.queue:
+			s.deliver(line)
+		case <-s.closed:
+			for {
+				select {
+				case line := <-s.queue:
+					s.deliver(line)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *webhookAuditSink) deliver(line []byte) {
+	if err := s.post(line); err != nil {
+		log.Printf("error delivering audit event to %s: %s", s.url, err)
+	}
+}
+
+func (s *webhookAuditSink) post(line []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log/syslog"
+	"net/url"
+	"sync"
+)
+
+// syslogAuditSink sends events to syslog with the auth facility. A URL
+// without a host uses the local syslog daemon, otherwise events are sent
+// over UDP, or TCP for syslog+tcp URLs.
+type syslogAuditSink struct {
+	network string
+	addr    string
+
+	mu sync.Mutex
+	w  *syslog.Writer
+}
+
+func newSyslogAuditSink(u *url.URL) (auditSink, error) {
+	s := &syslogAuditSink{addr: u.Host}
+	if u.Host != "" {
+		s.network = "udp"
+		if u.Scheme == "syslog+tcp" {
+			s.network = "tcp"
+		}
+	}
+	return s, nil
+}
+
+func (s *syslogAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w = nil
+	return err
+}
+
+func (s *syslogAuditSink) Emit(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		w, err := syslog.Dial(s.network, s.addr, syslog.LOG_INFO|syslog.LOG_AUTH, "oauth2_proxy")
+		if err != nil {
+			return err
+		}
+		s.w = w
+	}
+	return s.w.Info(string(line))
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+	"net/url"
+)
+
+func newSyslogAuditSink(u *url.URL) (auditSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
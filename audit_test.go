@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+type memoryAuditSink struct {
+	mu     sync.Mutex
+	events []auditEvent
+}
+
+func (s *memoryAuditSink) Emit(line []byte) error {
+	var e auditEvent
+	if err := json.Unmarshal(line, &e); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *memoryAuditSink) Events() []auditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]auditEvent(nil), s.events...)
+}
+
+func openAuditFile(filename string) io.Writer {
+	f, _ := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	return f
+}
+
+func TestAuditLogDestinations(t *testing.T) {
+	a, err := newAuditLog("/var/log/oauth2_proxy/audit.log", openAuditFile)
+	assert.Equal(t, nil, err)
+	_, ok := a.sink.(*writerAuditSink)
+	assert.Equal(t, true, ok)
+
+	a, err = newAuditLog("https://audit.example.com/events", openAuditFile)
+	assert.Equal(t, nil, err)
+	_, ok = a.sink.(*webhookAuditSink)
+	assert.Equal(t, true, ok)
+
+	_, err = newAuditLog("https:///events", openAuditFile)
+	assert.NotEqual(t, nil, err)
+	_, err = newAuditLog("ftp://audit.example.com/events", openAuditFile)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestAuditLogOption(t *testing.T) {
+	o := testOptions()
+	o.AuditLog = "syslog+udp://localhost"
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`audit-log: expected a file path, syslog:// or http(s):// URL: "syslog+udp://localhost"`}),
+		err.Error())
+
+	o.AuditLog = "syslog://localhost:514"
+	assert.Equal(t, nil, o.Validate())
+	assert.NotEqual(t, (*auditLog)(nil), o.auditLog)
+}
+
+func TestAuditFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.log")
+
+	a, err := newAuditLog(filename, openAuditFile)
+	assert.Equal(t, nil, err)
+	a.now = func() time.Time { return time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC) }
+	a.Record(auditEvent{Event: auditSignOut, User: "user@example.com", ClientIP: "10.0.0.1"})
+
+	b, err := ioutil.ReadFile(filename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"time":"2018-03-01T12:00:00Z","event":"sign_out","user":"user@example.com",`+
+		`"provider":"","client_ip":"10.0.0.1","method":"","host":"","path":""}`+"\n", string(b))
+}
+
+func TestAuditWebhookSink(t *testing.T) {
+	received := make(chan auditEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e auditEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		received <- e
+	}))
+	defer server.Close()
+
+	a, err := newAuditLog(server.URL, openAuditFile)
+	assert.Equal(t, nil, err)
+	a.Record(auditEvent{Event: auditLoginFailure, User: "user@example.com"})
+
+	select {
+	case e := <-received:
+		assert.Equal(t, auditLoginFailure, e.Event)
+		assert.Equal(t, "user@example.com", e.User)
+	case <-time.After(5 * time.Second):
+		t.Fatal("audit event wasn't delivered to the webhook")
+	}
+}
+
+func TestAuditLoginAndSignOut(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer provider.Close()
+
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	providerURL, _ := url.Parse(provider.URL)
+	opts.provider = NewTestProvider(providerURL, "michael.bland@gsa.gov")
+	sink := &memoryAuditSink{}
+	opts.auditLog = &auditLog{sink: sink, now: time.Now}
+	proxy := NewOAuthProxy(opts, func(email string) bool { return email == "michael.bland@gsa.gov" })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.RemoteAddr = "10.0.0.1:4321"
+	req.Header.Set("X-Request-Id", "req-1")
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	var session *http.Cookie
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == proxy.CookieName {
+			session = c
+		}
+	}
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/sign_out", nil)
+	req.RemoteAddr = "10.0.0.1:4321"
+	req.AddCookie(session)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	events := sink.Events()
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, auditLoginSuccess, events[0].Event)
+	assert.Equal(t, "michael.bland@gsa.gov", events[0].User)
+	assert.Equal(t, "Test Provider", events[0].Provider)
+	assert.Equal(t, "10.0.0.1", events[0].ClientIP)
+	assert.Equal(t, "req-1", events[0].RequestID)
+	assert.Equal(t, "/oauth2/callback", events[0].Path)
+	assert.Equal(t, auditSignOut, events[1].Event)
+	assert.Equal(t, "michael.bland@gsa.gov", events[1].User)
+}
+
+func TestAuditAuthorizationDenied(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer provider.Close()
+
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	providerURL, _ := url.Parse(provider.URL)
+	opts.provider = NewTestProvider(providerURL, "someone.else@example.com")
+	sink := &memoryAuditSink{}
+	opts.auditLog = &auditLog{sink: sink, now: time.Now}
+	proxy := NewOAuthProxy(opts, func(email string) bool { return email == "michael.bland@gsa.gov" })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+
+	events := sink.Events()
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, auditAuthorizationDenied, events[0].Event)
+	assert.Equal(t, "someone.else@example.com", events[0].User)
+}
+
+func TestWebhookAuditSinkClose(t *testing.T) {
+	s := newWebhookAuditSink("http://127.0.0.1:1/events")
+	assert.Equal(t, nil, s.Close())
+	assert.NotEqual(t, nil, s.Emit([]byte("{}")))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/bitly/oauth2_proxy/logger"
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// maxAuthzDecisionSize limits how much of a webhook's response is read
+const maxAuthzDecisionSize = 64 << 10
+
+// authzWebhook asks an external service whether each authenticated request
+// may go through, after the proxy's own checks have allowed it
+type authzWebhook struct {
+	url      string
+	client   *http.Client
+	failOpen bool
+}
+
+// authzRequest is the body POSTed to the webhook
+type authzRequest struct {
+	User     string           `json:"user"`
+	Email    string           `json:"email,omitempty"`
+	Groups   []string         `json:"groups,omitempty"`
+	Provider string           `json:"provider,omitempty"`
+	Request  authzRequestInfo `json:"request"`
+}
+
+type authzRequestInfo struct {
+	Method    string `json:"method"`
+	Host      string `json:"host"`
+	Path      string `json:"path"`
+	Query     string `json:"query,omitempty"`
+	ClientIP  string `json:"client_ip,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// authzDecision is the webhook's answer. allow is required so that an empty
+// or unrelated response isn't taken as a denial.
+type authzDecision struct {
+	Allow  *bool  `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// decide POSTs r to the webhook and returns whether it allows the request,
+// and why
+func (w *authzWebhook) decide(r *authzRequest) (bool, string, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return false, "", err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxAuthzDecisionSize))
+		return false, "", fmt.Errorf("got %d", resp.StatusCode)
+	}
+	var d authzDecision
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxAuthzDecisionSize)).Decode(&d); err != nil {
+		return false, "", fmt.Errorf("invalid response: %s", err)
+	}
+	if d.Allow == nil {
+		return false, "", fmt.Errorf("invalid response: missing allow")
+	}
+	return *d.Allow, d.Reason, nil
+}
+
+// checkAuthzWebhook asks the authorization webhook, if there is one, whether
+// session may make req. It returns http.StatusAccepted when it may,
+// statusPolicyDenied when the webhook denies it, and
+// http.StatusInternalServerError when the webhook can't be asked and
+// authz-webhook-fail-open isn't set.
+func (p *OAuthProxy) checkAuthzWebhook(req *http.Request, session *providers.SessionState) int {
+	if p.authzWebhook == nil {
+		return http.StatusAccepted
+	}
+	authorized := p.authorizedRequest(req)
+	r := &authzRequest{
+		User:     session.User,
+		Email:    session.Email,
+		Groups:   session.Groups,
+		Provider: session.Provider,
+		Request: authzRequestInfo{
+			Method:    authorized.Method,
+			Host:      authorized.Host,
+			Path:      authorized.URL.Path,
+			Query:     authorized.URL.RawQuery,
+			RequestID: requestID(req),
+		},
+	}
+	if ip := clientIP(req, p.trustedProxies); ip != nil {
+		r.Request.ClientIP = ip.String()
+	}
+
+	allow, reason, err := p.authzWebhook.decide(r)
+	switch {
+	case err != nil:
+		authzWebhookRequestsTotal.WithLabelValues("error").Inc()
+		if p.authzWebhook.failOpen {
+			log.Printf("error asking authorization webhook about %s, allowing: %s", session, err)
+			return http.StatusAccepted
+		}
+		log.Printf("error asking authorization webhook about %s: %s", session, err)
+		return http.StatusInternalServerError
+	case !allow:
+		authzWebhookRequestsTotal.WithLabelValues("deny").Inc()
+		if reason == "" {
+			reason = "no reason given"
+		}
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Permission Denied: authorization webhook denied %s: %s", session, reason)
+		p.audit(req, auditAuthorizationDenied, session.Email, "authorization webhook denied %s: %s", session, reason)
+		return statusPolicyDenied
+	}
+	authzWebhookRequestsTotal.WithLabelValues("allow").Inc()
+	return http.StatusAccepted
+}
+
+func parseAuthzWebhook(o *Options, msgs []string) []string {
+	if o.AuthzWebhookURL == "" {
+		return msgs
+	}
+	u, err := url.Parse(o.AuthzWebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return append(msgs, fmt.Sprintf("authz-webhook-url must be an http:// or https:// URL: %q", o.AuthzWebhookURL))
+	}
+	if o.AuthzWebhookTimeout <= 0 {
+		return append(msgs, "authz-webhook-timeout must be positive")
+	}
+	o.authzWebhook = &authzWebhook{
+		url:      o.AuthzWebhookURL,
+		client:   &http.Client{Timeout: o.AuthzWebhookTimeout},
+		failOpen: o.AuthzWebhookFailOpen,
+	}
+	return msgs
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestAuthzWebhookOptions(t *testing.T) {
+	o := testOptions()
+	o.AuthzWebhookURL = "authz.example.com/check"
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`authz-webhook-url must be an http:// or https:// URL: "authz.example.com/check"`}), err.Error())
+
+	o = testOptions()
+	o.AuthzWebhookURL = "https://authz.example.com/check"
+	o.AuthzWebhookTimeout = 0
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{"authz-webhook-timeout must be positive"}), err.Error())
+
+	o = testOptions()
+	o.AuthzWebhookURL = "https://authz.example.com/check"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2*time.Second, o.authzWebhook.client.Timeout)
+	assert.Equal(t, false, o.authzWebhook.failOpen)
+}
+
+func TestAuthzWebhook(t *testing.T) {
+	var got authzRequest
+	response := `{"allow": true}`
+	status := http.StatusOK
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = authzRequest{}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	defer webhook.Close()
+
+	failOpen := false
+	test := func(path string, header ...string) int {
+		pc_test := NewProcessCookieTestWithDefaults()
+		pc_test.proxy.authzWebhook = &authzWebhook{url: webhook.URL, client: &http.Client{}, failOpen: failOpen}
+		pc_test.req, _ = http.NewRequest("GET", path, nil)
+		pc_test.req.Host = "app.example.com"
+		pc_test.req.RemoteAddr = "203.0.113.7:51234"
+		for i := 0; i < len(header); i += 2 {
+			pc_test.req.Header.Set(header[i], header[i+1])
+		}
+		pc_test.SaveSession(&providers.SessionState{
+			Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+			Groups: []string{"ops"}}, time.Now())
+		pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+		return pc_test.rw.Code
+	}
+
+	assert.Equal(t, http.StatusAccepted, test("/oauth2/auth", "X-Request-Id", "req-1"))
+	assert.Equal(t, authzRequest{
+		User:   "michael.bland",
+		Email:  "michael.bland@gsa.gov",
+		Groups: []string{"ops"},
+		Request: authzRequestInfo{
+			Method:    "GET",
+			Host:      "app.example.com",
+			Path:      "/oauth2/auth",
+			ClientIP:  "203.0.113.7",
+			RequestID: "req-1",
+		},
+	}, got)
+
+	// the auth endpoint asks about the original request
+	test("/oauth2/auth/reports/daily?format=csv")
+	assert.Equal(t, "/reports/daily", got.Request.Path)
+	assert.Equal(t, "format=csv", got.Request.Query)
+
+	response = `{"allow": false, "reason": "outside business hours"}`
+	assert.Equal(t, http.StatusForbidden, test("/oauth2/auth"))
+
+	for _, bad := range []struct {
+		status   int
+		response string
+	}{
+		{http.StatusServiceUnavailable, `{"allow": true}`},
+		{http.StatusOK, `allow`},
+		{http.StatusOK, `{}`},
+	} {
+		status, response = bad.status, bad.response
+		failOpen = false
+		assert.Equal(t, http.StatusInternalServerError, test("/oauth2/auth"))
+		failOpen = true
+		assert.Equal(t, http.StatusAccepted, test("/oauth2/auth"))
+	}
+}
+
+func TestAuthzWebhookTimeout(t *testing.T) {
+	done := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer webhook.Close()
+	defer close(done)
+
+	w := &authzWebhook{url: webhook.URL, client: &http.Client{Timeout: 50 * time.Millisecond}}
+	_, _, err := w.decide(&authzRequest{User: "michael.bland"})
+	assert.NotEqual(t, nil, err)
+}
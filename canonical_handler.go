@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CanonicalHandler redirects requests that don't arrive on the canonical
+// scheme and host before handing them off to the wrapped handler. Requests
+// for the Exempt paths, such as health checks that reach the proxy by its
+// address, are never redirected.
+type CanonicalHandler struct {
+	URL            *url.URL
+	TrustedProxies []*net.IPNet
+	Exempt         []string
+	Handler        http.Handler
+}
+
+func NewCanonicalHandler(u *url.URL, trustedProxies []*net.IPNet, exempt []string, h http.Handler) CanonicalHandler {
+	return CanonicalHandler{
+		URL:            u,
+		TrustedProxies: trustedProxies,
+		Exempt:         exempt,
+		Handler:        h,
+	}
+}
+
+// requestScheme returns the scheme the client used to reach us, honouring
+// X-Forwarded-Proto when TLS is terminated by one of the trusted proxies in
+// front of the proxy.
+func requestScheme(req *http.Request, trustedProxies []*net.IPNet) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		if ip := remoteIP(req); ip != nil && containsIP(trustedProxies, ip) {
+			return strings.ToLower(proto)
+		}
+	}
+	return "http"
+}
+
+// normalizeHost lowercases a host and strips the port if it is the default
+// for the given scheme.
+func normalizeHost(host, scheme string) string {
+	host = strings.ToLower(host)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+			return h
+		}
+	}
+	return host
+}
+
+func (h CanonicalHandler) isCanonical(req *http.Request) bool {
+	for _, path := range h.Exempt {
+		if req.URL.Path == path {
+			return true
+		}
+	}
+	scheme := requestScheme(req, h.TrustedProxies)
+	return scheme == h.URL.Scheme &&
+		normalizeHost(req.Host, scheme) == normalizeHost(h.URL.Host, h.URL.Scheme)
+}
+
+func (h CanonicalHandler) buildRedirectURL(requestURL url.URL) string {
+	u := *h.URL
+	u.Path = requestURL.Path
+	u.RawPath = requestURL.RawPath
+	u.RawQuery = requestURL.RawQuery
+	return u.String()
+}
+
+func (h CanonicalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.isCanonical(r) {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+	http.Redirect(w, r, h.buildRedirectURL(*r.URL), http.StatusMovedPermanently)
+}
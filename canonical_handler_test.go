@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func testCanonicalHandler() CanonicalHandler {
+	u, _ := url.Parse("https://www.example.com")
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	return NewCanonicalHandler(u, []*net.IPNet{trusted}, []string{"/ping"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("upstream"))
+	}))
+}
+
+func TestCanonicalRedirects(t *testing.T) {
+	tests := []struct {
+		url      string
+		tls      bool
+		proto    string
+		code     int
+		location string
+	}{
+		{"http://example.com/foo?a=1", false, "", 301, "https://www.example.com/foo?a=1"},
+		{"https://example.com/foo?a=1", true, "", 301, "https://www.example.com/foo?a=1"},
+		{"http://www.example.com/foo?a=1", false, "", 301, "https://www.example.com/foo?a=1"},
+		{"http://example.com/foo", false, "https", 301, "https://www.example.com/foo"},
+		{"http://WWW.Example.com:443/", false, "https", 200, ""},
+		{"http://www.example.com/foo", false, "https", 200, ""},
+		{"https://www.example.com/foo", true, "", 200, ""},
+		// health checks aren't redirected
+		{"http://10.1.2.3:4180/ping", false, "", 200, ""},
+	}
+
+	h := testCanonicalHandler()
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		if !tt.tls {
+			req.TLS = nil
+		} else {
+			req.TLS = &tls.ConnectionState{}
+		}
+		if tt.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		req.RemoteAddr = "10.0.0.2:4000"
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		assert.Equal(t, tt.code, rw.Code)
+		assert.Equal(t, tt.location, rw.Header().Get("Location"))
+	}
+
+	// X-Forwarded-Proto isn't trusted from other clients
+	req := httptest.NewRequest("GET", "http://www.example.com/foo", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.RemoteAddr = "203.0.113.7:4000"
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusMovedPermanently, rw.Code)
+	assert.Equal(t, "https://www.example.com/foo", rw.Header().Get("Location"))
+}
+
+func TestCanonicalRedirectPreservesEncodedPath(t *testing.T) {
+	h := testCanonicalHandler()
+	u, _ := url.Parse("http://example.com/a%2Fb/c?d=1")
+	assert.Equal(t, "https://www.example.com/a%2Fb/c?d=1", h.buildRedirectURL(*u))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"sync"
+)
+
+// certReloader serves the certificate in tls-cert and tls-key, reloading it
+// when either file changes so that rotated certificates, such as those
+// written by cert-manager, are used without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate from disk. The previous certificate is kept
+// if it can't be loaded, as happens while only one of the files has been
+// replaced.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the certificate whenever the certificate or key file
+// changes, until done is closed
+func (r *certReloader) Watch(done <-chan bool) {
+	action := func() {
+		if err := r.reload(); err != nil {
+			log.Printf("ERROR: reloading tls certificate (%s, %s) - %s", r.certFile, r.keyFile, err)
+			return
+		}
+		log.Printf("reloaded tls certificate %s", r.certFile)
+	}
+	WatchForUpdates(r.certFile, done, action)
+	if r.keyFile != r.certFile {
+		WatchForUpdates(r.keyFile, done, action)
+	}
+}
+
+// GetCertificate returns the current certificate, for use as
+// tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// serverCertificatePEM returns a self signed certificate for names and its
+// key, PEM encoded
+func serverCertificatePEM(t *testing.T, names []string, notAfter time.Time) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func servedName(t *testing.T, r *certReloader) string {
+	cert, err := r.GetCertificate(nil)
+	assert.Equal(t, nil, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Equal(t, nil, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert_reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+
+	certPEM, keyPEM := serverCertificatePEM(t, []string{"old.example.com"}, time.Now().Add(time.Hour))
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+	r, err := newCertReloader(certFile, keyFile)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "old.example.com", servedName(t, r))
+
+	// the old certificate is kept while the key doesn't match
+	certPEM, keyPEM = serverCertificatePEM(t, []string{"new.example.com"}, time.Now().Add(time.Hour))
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	assert.NotEqual(t, nil, r.reload())
+	assert.Equal(t, "old.example.com", servedName(t, r))
+
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+	assert.Equal(t, nil, r.reload())
+	assert.Equal(t, "new.example.com", servedName(t, r))
+
+	_, err = newCertReloader(filepath.Join(dir, "missing.crt"), keyFile)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert_reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "tls.pem")
+
+	certPEM, keyPEM := serverCertificatePEM(t, []string{"old.example.com"}, time.Now().Add(time.Hour))
+	ioutil.WriteFile(certFile, append(certPEM, keyPEM...), 0600)
+	r, err := newCertReloader(certFile, certFile)
+	assert.Equal(t, nil, err)
+	done := make(chan bool)
+	defer close(done)
+	r.Watch(done)
+
+	// replaced the way kubernetes updates mounted secrets
+	certPEM, keyPEM = serverCertificatePEM(t, []string{"new.example.com"}, time.Now().Add(time.Hour))
+	tmp := filepath.Join(dir, "tls.pem.tmp")
+	ioutil.WriteFile(tmp, append(certPEM, keyPEM...), 0600)
+	assert.Equal(t, nil, os.Rename(tmp, certFile))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for servedName(t, r) != "new.example.com" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "new.example.com", servedName(t, r))
+}
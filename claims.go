@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// ClaimHeaderOptions describes a [[claim_header]] table in the config file,
+// which passes a claim from the id token or userinfo to upstreams as a
+// header
+type ClaimHeaderOptions struct {
+	Header    string `toml:"header" yaml:"header"`
+	Claim     string `toml:"claim" yaml:"claim"`
+	Type      string `toml:"type" yaml:"type"`
+	Separator string `toml:"separator" yaml:"separator"`
+}
+
+// claimHeader sets header from claim, a claim name or a dotted path to a
+// claim nested in objects, converted to typ. Lists are converted element by
+// element and joined with separator.
+type claimHeader struct {
+	header    string
+	claim     string
+	typ       string
+	separator string
+}
+
+var claimTypes = []string{"string", "int", "bool", "json"}
+
+// loadClaimHeaders reads the [[claim_header]] tables from a config file
+func loadClaimHeaders(path string) ([]ClaimHeaderOptions, error) {
+	var cfg struct {
+		ClaimHeaders []ClaimHeaderOptions `toml:"claim_header"`
+	}
+	_, err := toml.DecodeFile(path, &cfg)
+	return cfg.ClaimHeaders, err
+}
+
+func parseClaimHeaders(o *Options, msgs []string) []string {
+	o.claimHeaders = nil
+	for i, c := range o.ClaimHeaders {
+		name := fmt.Sprintf("claim_header[%d]", i)
+		header := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(c.Header))
+		if header == "" || strings.ContainsAny(header, " \t:") {
+			msgs = append(msgs, fmt.Sprintf("%s invalid header: %q", name, c.Header))
+			continue
+		}
+		if c.Claim == "" {
+			msgs = append(msgs, fmt.Sprintf("%s missing setting: claim", name))
+			continue
+		}
+		ch := claimHeader{header: header, claim: c.Claim, typ: c.Type, separator: c.Separator}
+		if ch.typ == "" {
+			ch.typ = "string"
+		}
+		if !isClaimType(ch.typ) {
+			msgs = append(msgs, fmt.Sprintf("%s invalid type=%q expected one of %s",
+				name, c.Type, strings.Join(claimTypes, ", ")))
+			continue
+		}
+		if ch.separator == "" {
+			ch.separator = ","
+		}
+		o.claimHeaders = append(o.claimHeaders, ch)
+	}
+	return msgs
+}
+
+func isClaimType(typ string) bool {
+	for _, t := range claimTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupClaim finds a claim by its full name, which may itself contain dots
+// as namespaced claims like "https://example.com/roles" do, or else by
+// following a dotted path through nested objects
+func lookupClaim(claims map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := claims[name]; ok {
+		return v, true
+	}
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	nested, ok := claims[parts[0]].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return lookupClaim(nested, parts[1])
+}
+
+func decodeClaims(data []byte) (map[string]interface{}, error) {
+	var claims map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	err := d.Decode(&claims)
+	return claims, err
+}
+
+// idTokenClaims returns the claims of an id token that has already been
+// verified
+func idTokenClaims(idToken string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("malformed id token payload: %s", err)
+	}
+	return decodeClaims(payload)
+}
+
+// userinfoClaims returns the claims from the provider's userinfo endpoint,
+// its validate-url
+func userinfoClaims(provider providers.Provider, accessToken string) (map[string]interface{}, error) {
+	u := provider.Data().ValidateURL
+	if u == nil || u.String() == "" || accessToken == "" {
+		return nil, nil
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %d from %s", resp.StatusCode, u)
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+	return decodeClaims(body.Bytes())
+}
+
+// mapClaims stores the claims used by the claim headers in the session,
+// from idToken or, for those it lacks, from the provider's userinfo. A nil
+// provider skips userinfo. Claims that aren't found keep any value the
+// session already had.
+func (p *OAuthProxy) mapClaims(provider providers.Provider, s *providers.SessionState, idToken string) {
+	if len(p.claimHeaders) == 0 {
+		return
+	}
+	var sources []map[string]interface{}
+	if idToken != "" {
+		claims, err := idTokenClaims(idToken)
+		if err != nil {
+			log.Printf("error reading claims from id token for %s: %s", s, err)
+		}
+		sources = append(sources, claims)
+	}
+
+	found := make(map[string]string)
+	var missing bool
+	for _, ch := range p.claimHeaders {
+		if _, ok := found[ch.claim]; ok {
+			continue
+		}
+		if v, ok := findClaim(sources, ch.claim); ok {
+			found[ch.claim] = v
+		} else {
+			missing = true
+		}
+	}
+	if missing && provider != nil {
+		claims, err := userinfoClaims(provider, s.AccessToken)
+		if err != nil {
+			log.Printf("error reading claims from userinfo for %s: %s", s, err)
+		}
+		sources = append(sources, claims)
+		for _, ch := range p.claimHeaders {
+			if _, ok := found[ch.claim]; ok {
+				continue
+			}
+			if v, ok := findClaim(sources, ch.claim); ok {
+				found[ch.claim] = v
+			}
+		}
+	}
+
+	// the session's map may be shared with other requests through the
+	// session refresher, so it is replaced rather than updated
+	for k, v := range s.Claims {
+		if _, ok := found[k]; !ok {
+			found[k] = v
+		}
+	}
+	if len(found) != 0 {
+		s.Claims = found
+	}
+}
+
+// findClaim returns the JSON encoding of the first value of claim in sources
+func findClaim(sources []map[string]interface{}, claim string) (string, bool) {
+	for _, claims := range sources {
+		if v, ok := lookupClaim(claims, claim); ok && v != nil {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return "", false
+			}
+			return string(b), true
+		}
+	}
+	return "", false
+}
+
+// setClaimHeaders sets the claim headers from the session's claims. Headers
+// whose claim is missing or can't be converted to their type are left
+// unset.
+func setClaimHeaders(h http.Header, headers []claimHeader, s *providers.SessionState) {
+	for _, ch := range headers {
+		h.Del(ch.header)
+		raw, ok := s.Claims[ch.claim]
+		if !ok {
+			continue
+		}
+		value, err := ch.value(raw)
+		if err != nil {
+			log.Printf("error setting header %s for %s: %s", ch.header, s, err)
+			continue
+		}
+		if value != "" {
+			h.Set(ch.header, value)
+		}
+	}
+}
+
+// value converts the JSON value of the header's claim to its type
+func (ch claimHeader) value(raw string) (string, error) {
+	if ch.typ == "json" {
+		return raw, nil
+	}
+	d := json.NewDecoder(strings.NewReader(raw))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return "", err
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return convertClaim(v, ch.typ)
+	}
+	values := make([]string, len(list))
+	for i, e := range list {
+		s, err := convertClaim(e, ch.typ)
+		if err != nil {
+			return "", err
+		}
+		values[i] = s
+	}
+	return strings.Join(values, ch.separator), nil
+}
+
+// convertClaim converts a single claim value to typ: string, int or bool
+func convertClaim(v interface{}, typ string) (string, error) {
+	switch typ {
+	case "int":
+		switch v := v.(type) {
+		case json.Number:
+			if i, err := v.Int64(); err == nil {
+				return strconv.FormatInt(i, 10), nil
+			}
+			if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+				return strconv.FormatFloat(f, 'f', -1, 64), nil
+			}
+		case string:
+			if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				return strconv.FormatInt(i, 10), nil
+			}
+		}
+		return "", fmt.Errorf("%v is not an integer", v)
+	case "bool":
+		switch v := v.(type) {
+		case bool:
+			return strconv.FormatBool(v), nil
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				return strconv.FormatBool(b), nil
+			}
+		}
+		return "", fmt.Errorf("%v is not a boolean", v)
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("%v is not a string, number or boolean", v)
+}
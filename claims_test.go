@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestLoadClaimHeaders(t *testing.T) {
+	file, err := ioutil.TempFile("", "oauth2_proxy.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`
+upstreams = ["http://127.0.0.1:8080/"]
+
+[[claim_header]]
+header = "X-Employee-Id"
+claim = "employee_id"
+type = "int"
+
+[[claim_header]]
+header = "X-Roles"
+claim = "https://example.com/roles"
+separator = " "
+`)
+	file.Close()
+
+	headers, err := loadClaimHeaders(file.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []ClaimHeaderOptions{
+		{Header: "X-Employee-Id", Claim: "employee_id", Type: "int"},
+		{Header: "X-Roles", Claim: "https://example.com/roles", Separator: " "},
+	}, headers)
+}
+
+func TestParseClaimHeaders(t *testing.T) {
+	o := testOptions()
+	o.ClaimHeaders = []ClaimHeaderOptions{
+		{Header: "x-department", Claim: "department"},
+		{Header: "X-Bad Header", Claim: "department"},
+		{Header: "X-Employee-Id"},
+		{Header: "X-Employee-Id", Claim: "employee_id", Type: "float"},
+	}
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`claim_header[1] invalid header: "X-Bad Header"`,
+		"claim_header[2] missing setting: claim",
+		`claim_header[3] invalid type="float" expected one of string, int, bool, json`,
+	}), err.Error())
+	assert.Equal(t, []claimHeader{
+		{header: "X-Department", claim: "department", typ: "string", separator: ","},
+	}, o.claimHeaders)
+}
+
+func TestClaimHeaderValues(t *testing.T) {
+	testCases := []struct {
+		typ      string
+		raw      string
+		expected string
+		err      bool
+	}{
+		{"string", `"R&D"`, "R&D", false},
+		{"string", `12345678901234567890`, "12345678901234567890", false},
+		{"string", `true`, "true", false},
+		{"string", `["admin","dev"]`, "admin,dev", false},
+		{"string", `{"a":1}`, "", true},
+		{"int", `42`, "42", false},
+		{"int", `"42"`, "42", false},
+		{"int", `4.0e1`, "40", false},
+		{"int", `4.5`, "", true},
+		{"int", `[1,"2"]`, "1,2", false},
+		{"bool", `false`, "false", false},
+		{"bool", `"True"`, "true", false},
+		{"bool", `"yes"`, "", true},
+		{"json", `{"a":[1,2]}`, `{"a":[1,2]}`, false},
+	}
+	for _, tc := range testCases {
+		ch := claimHeader{header: "X-Claim", claim: "claim", typ: tc.typ, separator: ","}
+		value, err := ch.value(tc.raw)
+		assert.Equal(t, tc.expected, value)
+		assert.Equal(t, tc.err, err != nil)
+	}
+}
+
+func testIDToken(payload string) string {
+	return "eyJhbGciOiJSUzI1NiJ9." +
+		base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2lnbmF0dXJl"
+}
+
+func TestMapClaims(t *testing.T) {
+	var userinfoToken string
+	userinfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userinfoToken = r.Header.Get("Authorization")
+		w.Write([]byte(`{"department": "Engineering", "employee_id": 7}`))
+	}))
+	defer userinfo.Close()
+
+	opts := testOptions()
+	opts.ValidateURL = userinfo.URL
+	opts.ClaimHeaders = []ClaimHeaderOptions{
+		{Header: "X-Employee-Id", Claim: "employee_id", Type: "int"},
+		{Header: "X-Country", Claim: "address.country"},
+		{Header: "X-Roles", Claim: "https://example.com/roles"},
+		{Header: "X-Department", Claim: "department"},
+	}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	session := &providers.SessionState{
+		AccessToken: "access",
+		Claims:      map[string]string{"department": `"Sales"`, "cost_center": `"C1"`},
+	}
+	idToken := testIDToken(`{"employee_id": 12345678901,
+		"address": {"country": "NL"},
+		"https://example.com/roles": ["admin", "dev"]}`)
+	proxy.mapClaims(proxy.provider, session, idToken)
+	assert.Equal(t, "Bearer access", userinfoToken)
+	assert.Equal(t, map[string]string{
+		"employee_id":               "12345678901",
+		"address.country":           `"NL"`,
+		"https://example.com/roles": `["admin","dev"]`,
+		"department":                `"Engineering"`,
+		"cost_center":               `"C1"`,
+	}, session.Claims)
+
+	// without a provider, claims the token lacks keep their old value
+	session.Claims = map[string]string{"department": `"Sales"`}
+	proxy.mapClaims(nil, session, idToken)
+	assert.Equal(t, `"Sales"`, session.Claims["department"])
+	assert.Equal(t, "12345678901", session.Claims["employee_id"])
+}
+
+func TestClaimHeaderInjection(t *testing.T) {
+	var upstreamHeaders http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders = r.Header
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.SetXAuthRequest = true
+	opts.ClaimHeaders = []ClaimHeaderOptions{
+		{Header: "X-Employee-Id", Claim: "employee_id", Type: "int"},
+		{Header: "X-Roles", Claim: "roles", Separator: " "},
+		{Header: "X-Manager", Claim: "manager", Type: "bool"},
+		{Header: "X-Department", Claim: "department"},
+	}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	session := &providers.SessionState{Email: "user@example.com", Claims: map[string]string{
+		"employee_id": "42",
+		"roles":       `["admin","dev"]`,
+		"manager":     `"maybe"`,
+	}}
+	req, _ := http.NewRequest("GET", "/", nil)
+	rw := httptest.NewRecorder()
+	assert.Equal(t, nil, proxy.SaveSession(rw, req, session))
+	req.AddCookie(rw.Result().Cookies()[0])
+	req.Header.Set("X-Manager", "true")
+	req.Header.Set("X-Department", "spoofed")
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "42", upstreamHeaders.Get("X-Employee-Id"))
+	assert.Equal(t, "admin dev", upstreamHeaders.Get("X-Roles"))
+	assert.Equal(t, "", upstreamHeaders.Get("X-Manager"))
+	assert.Equal(t, "", upstreamHeaders.Get("X-Department"))
+	assert.Equal(t, "42", rw.Header().Get("X-Employee-Id"))
+}
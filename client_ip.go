@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseCIDRs parses a list of networks, accepting bare addresses as
+// single-host networks
+func parseCIDRs(values []string, name string, msgs []string) ([]*net.IPNet, []string) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				msgs = append(msgs, fmt.Sprintf("%s is not an address or CIDR range: %q", name, v))
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%s is not an address or CIDR range: %q", name, v))
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets, msgs
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrustedIP reports whether a request comes from one of the trusted-ip
+// networks, whose requests don't need to authenticate
+func (p *OAuthProxy) isTrustedIP(req *http.Request) bool {
+	if len(p.trustedIPs) == 0 {
+		return false
+	}
+	ip := clientIP(req, p.trustedProxies)
+	return ip != nil && containsIP(p.trustedIPs, ip)
+}
+
+// remoteIP returns the address of the peer that sent a request
+func remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP returns the address of the client that made a request. The
+// X-Forwarded-For header is only honoured when the request comes from one of
+// the trusted proxies, and is read from the right so that a client can't
+// choose its address by sending the header itself: the client is the last
+// address that isn't a trusted proxy.
+func clientIP(req *http.Request, trusted []*net.IPNet) net.IP {
+	ip := remoteIP(req)
+	if ip == nil || !containsIP(trusted, ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, h := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(trusted, hop) {
+			break
+		}
+	}
+	return ip
+}
@@ -1,14 +1,18 @@
 package cookie
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
@@ -82,6 +86,10 @@ func checkHmac(input, expected string) bool {
 // Cipher provides methods to encrypt and decrypt cookie values
 type Cipher struct {
 	cipher.Block
+	aead cipher.AEAD
+
+	// Compress gzips values passed to Seal when that makes them smaller
+	Compress bool
 }
 
 // NewCipher returns a new aes Cipher for encrypting cookie values
@@ -90,10 +98,84 @@ func NewCipher(secret []byte) (*Cipher, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Cipher{Block: c}, err
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{Block: c, aead: aead}, nil
+}
+
+// sealed values start with a flags byte, which can't be the first byte of
+// a plain text session
+const (
+	sealedFlag     byte = 0x01
+	compressedFlag byte = 0x02
+)
+
+// IsSealed reports whether v was produced by Seal
+func IsSealed(v string) bool {
+	return len(v) > 0 && v[0]&^compressedFlag == sealedFlag
+}
+
+// Seal encrypts and authenticates a value with AES-GCM. The result is
+// binary, and must be encoded before it is put in a cookie, as SignedValue
+// does.
+func (c *Cipher) Seal(value string) (string, error) {
+	flags := sealedFlag
+	plaintext := []byte(value)
+	if c.Compress {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(plaintext)
+		if err := w.Close(); err != nil {
+			return "", fmt.Errorf("failed to compress cookie value %s", err)
+		}
+		if buf.Len() < len(plaintext) {
+			flags |= compressedFlag
+			plaintext = buf.Bytes()
+		}
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to create nonce %s", err)
+	}
+	sealed := append([]byte{flags}, nonce...)
+	sealed = c.aead.Seal(sealed, nonce, plaintext, []byte{flags})
+	return string(sealed), nil
+}
+
+// Open decrypts a value produced by Seal, failing if it was sealed with a
+// different secret or has been tampered with
+func (c *Cipher) Open(value string) (string, error) {
+	if !IsSealed(value) {
+		return "", errors.New("cookie value is not sealed")
+	}
+	flags := value[0]
+	nonceSize := c.aead.NonceSize()
+	if len(value) < 1+nonceSize+c.aead.Overhead() {
+		return "", errors.New("sealed cookie value is too short")
+	}
+	nonce := []byte(value[1 : 1+nonceSize])
+	plaintext, err := c.aead.Open(nil, nonce, []byte(value[1+nonceSize:]), []byte{flags})
+	if err != nil {
+		return "", fmt.Errorf("failed to open cookie value %s", err)
+	}
+	if flags&compressedFlag != 0 {
+		r, err := gzip.NewReader(bytes.NewReader(plaintext))
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress cookie value %s", err)
+		}
+		plaintext, err = ioutil.ReadAll(r)
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress cookie value %s", err)
+		}
+	}
+	return string(plaintext), nil
 }
 
-// Encrypt a value for use in a cookie
+// Encrypt a value for use in a cookie with AES-CFB. Unlike Seal the value
+// isn't authenticated; it's kept to read sessions in the original format.
 func (c *Cipher) Encrypt(value string) (string, error) {
 	ciphertext := make([]byte, aes.BlockSize+len(value))
 	iv := ciphertext[:aes.BlockSize]
@@ -2,6 +2,7 @@ package cookie
 
 import (
 	"encoding/base64"
+	"strings"
 	"testing"
 
 	"github.com/bmizerany/assert"
@@ -40,3 +41,55 @@ func TestEncodeAndDecodeAccessTokenB64(t *testing.T) {
 	assert.NotEqual(t, token, encoded)
 	assert.Equal(t, token, decoded)
 }
+
+func TestSealAndOpen(t *testing.T) {
+	const value = "user@domain.com|my access token|1425917019|"
+	c, err := NewCipher([]byte("0123456789abcdefghijklmnopqrstuv"))
+	assert.Equal(t, nil, err)
+
+	sealed, err := c.Seal(value)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, IsSealed(sealed))
+	assert.Equal(t, false, IsSealed(value))
+
+	opened, err := c.Open(sealed)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, value, opened)
+
+	other, err := NewCipher([]byte("0000000000abcdefghijklmnopqrstuv"))
+	assert.Equal(t, nil, err)
+	_, err = other.Open(sealed)
+	assert.NotEqual(t, nil, err)
+
+	tampered := []byte(sealed)
+	tampered[len(tampered)-1] ^= 0xff
+	_, err = c.Open(string(tampered))
+	assert.NotEqual(t, nil, err)
+
+	// the flags byte is authenticated too
+	_, err = c.Open(string(sealed[0]|compressedFlag) + sealed[1:])
+	assert.NotEqual(t, nil, err)
+	_, err = c.Open(sealed[:10])
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSealCompressed(t *testing.T) {
+	c, err := NewCipher([]byte("0123456789abcdefghijklmnopqrstuv"))
+	assert.Equal(t, nil, err)
+	c.Compress = true
+
+	// short values are left uncompressed when gzip would make them larger
+	sealed, err := c.Seal("short")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, sealedFlag, sealed[0])
+
+	value := strings.Repeat("my access token", 100)
+	sealed, err = c.Seal(value)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, sealedFlag|compressedFlag, sealed[0])
+	assert.Equal(t, true, len(sealed) < len(value))
+
+	opened, err := c.Open(sealed)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, value, opened)
+}
@@ -0,0 +1,97 @@
+package cookie
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+)
+
+// Keyring caches the secrets fetched from a KeySource. The newest secret is
+// used to sign and encrypt cookies; up to retain previous secrets are kept so
+// that cookies issued before a rotation can still be decoded.
+type Keyring struct {
+	source   KeySource
+	retain   int
+	validate func([]byte) error
+
+	mu      sync.RWMutex
+	secrets [][]byte
+}
+
+// NewKeyring fetches the initial secret from source. validate, if not nil,
+// is used to reject unusable secrets before they are put into service.
+func NewKeyring(source KeySource, retain int, validate func([]byte) error) (*Keyring, error) {
+	k := &Keyring{
+		source:   source,
+		retain:   retain,
+		validate: validate,
+	}
+	if err := k.Refresh(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// NewStaticKeyring returns a keyring holding fixed secrets, the first of
+// which is the current secret. Refreshing it has no effect.
+func NewStaticKeyring(secrets ...[]byte) *Keyring {
+	return &Keyring{secrets: secrets}
+}
+
+// Refresh fetches the secret from the source and, if it changed, makes it
+// the current secret.
+func (k *Keyring) Refresh() error {
+	if k.source == nil {
+		return nil
+	}
+	secret, err := k.source.Key()
+	if err != nil {
+		return err
+	}
+	if k.validate != nil {
+		if err := k.validate(secret); err != nil {
+			return err
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.secrets) > 0 && bytes.Equal(k.secrets[0], secret) {
+		return nil
+	}
+	k.secrets = append([][]byte{secret}, k.secrets...)
+	if len(k.secrets) > k.retain+1 {
+		k.secrets = k.secrets[:k.retain+1]
+	}
+	return nil
+}
+
+// Secrets returns the current secret followed by the retained previous ones
+func (k *Keyring) Secrets() [][]byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	secrets := make([][]byte, len(k.secrets))
+	copy(secrets, k.secrets)
+	return secrets
+}
+
+// RefreshEvery periodically refreshes the keyring in the background until
+// done is closed. Failed refreshes are logged and the previously fetched
+// secrets stay in use.
+func (k *Keyring) RefreshEvery(interval time.Duration, done <-chan bool) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := k.Refresh(); err != nil {
+					log.Printf("error refreshing cookie secret: %s", err)
+				}
+			}
+		}
+	}()
+}
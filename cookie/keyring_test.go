@@ -0,0 +1,126 @@
+package cookie
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+type mockKeySource struct {
+	keys [][]byte
+	err  error
+}
+
+func (m *mockKeySource) Key() ([]byte, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.keys[0], nil
+}
+
+func TestKeyringRotation(t *testing.T) {
+	source := &mockKeySource{keys: [][]byte{[]byte("first")}}
+	k, err := NewKeyring(source, 1, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, [][]byte{[]byte("first")}, k.Secrets())
+
+	// an unchanged secret is not added twice
+	assert.Equal(t, nil, k.Refresh())
+	assert.Equal(t, [][]byte{[]byte("first")}, k.Secrets())
+
+	source.keys[0] = []byte("second")
+	assert.Equal(t, nil, k.Refresh())
+	assert.Equal(t, [][]byte{[]byte("second"), []byte("first")}, k.Secrets())
+
+	source.keys[0] = []byte("third")
+	assert.Equal(t, nil, k.Refresh())
+	assert.Equal(t, [][]byte{[]byte("third"), []byte("second")}, k.Secrets())
+}
+
+func TestKeyringKeepsSecretsOnFailedRefresh(t *testing.T) {
+	source := &mockKeySource{keys: [][]byte{[]byte("first")}}
+	k, err := NewKeyring(source, 1, nil)
+	assert.Equal(t, nil, err)
+
+	source.err = errors.New("unreachable")
+	assert.NotEqual(t, nil, k.Refresh())
+	assert.Equal(t, [][]byte{[]byte("first")}, k.Secrets())
+}
+
+func TestStaticKeyring(t *testing.T) {
+	k := NewStaticKeyring([]byte("current"), []byte("previous"))
+	assert.Equal(t, nil, k.Refresh())
+	assert.Equal(t, [][]byte{[]byte("current"), []byte("previous")}, k.Secrets())
+}
+
+func TestKeyringRejectsInvalidSecrets(t *testing.T) {
+	source := &mockKeySource{keys: [][]byte{[]byte("0123456789abcdef")}}
+	validate := func(b []byte) error {
+		_, err := NewCipher(b)
+		return err
+	}
+	k, err := NewKeyring(source, 1, validate)
+	assert.Equal(t, nil, err)
+
+	source.keys[0] = []byte("too short")
+	assert.NotEqual(t, nil, k.Refresh())
+	assert.Equal(t, [][]byte{[]byte("0123456789abcdef")}, k.Secrets())
+
+	_, err = NewKeyring(source, 1, validate)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestKMSKeySource(t *testing.T) {
+	kms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Ciphertext string `json:"ciphertext"`
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &req)
+		if r.Header.Get("Authorization") != "Bearer kms-token" || req.Ciphertext != "d3JhcHBlZA==" {
+			w.WriteHeader(403)
+			return
+		}
+		w.Write([]byte(`{"plaintext": "` + base64.StdEncoding.EncodeToString([]byte("unwrapped secret")) + `"}`))
+	}))
+	defer kms.Close()
+
+	f, _ := ioutil.TempFile("", "ciphertext")
+	defer os.Remove(f.Name())
+	f.WriteString("d3JhcHBlZA==\n")
+	f.Close()
+
+	source := &KMSKeySource{URL: kms.URL, Token: "kms-token", CiphertextFile: f.Name()}
+	key, err := source.Key()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "unwrapped secret", string(key))
+
+	source.Token = "wrong"
+	_, err = source.Key()
+	assert.NotEqual(t, nil, err)
+
+	kms.Close()
+	_, err = source.Key()
+	assert.NotEqual(t, nil, err)
+}
+
+func TestFileKeySource(t *testing.T) {
+	f, _ := ioutil.TempFile("", "secret")
+	defer os.Remove(f.Name())
+	f.WriteString("file secret\n")
+	f.Close()
+
+	key, err := FileKeySource(f.Name()).Key()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "file secret", string(key))
+
+	_, err = FileKeySource("/does/not/exist").Key()
+	assert.NotEqual(t, nil, err)
+}
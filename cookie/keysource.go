@@ -0,0 +1,107 @@
+package cookie
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// kmsClient is used by a KMSKeySource without its own client, so that a
+// key management service that doesn't answer can't hold up a refresh forever
+var kmsClient = &http.Client{Timeout: 10 * time.Second}
+
+// KeySource supplies the secret used to sign and encrypt cookies
+type KeySource interface {
+	Key() ([]byte, error)
+}
+
+// StaticKeySource is a secret given inline in the configuration
+type StaticKeySource []byte
+
+func (s StaticKeySource) Key() ([]byte, error) {
+	return []byte(s), nil
+}
+
+// FileKeySource reads the secret from a file every time it is fetched, so
+// a replaced file is picked up on the next refresh
+type FileKeySource string
+
+func (f FileKeySource) Key() ([]byte, error) {
+	b, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%s is empty", string(f))
+	}
+	return b, nil
+}
+
+// KMSKeySource unwraps an encrypted data key with a key management service.
+// The wrapped key is POSTed as {"ciphertext": "<base64>"} and the service is
+// expected to respond with {"plaintext": "<base64>"}. The ciphertext is read
+// from CiphertextFile on every fetch so that a re-wrapped or rotated data
+// key is picked up on refresh.
+type KMSKeySource struct {
+	URL            string
+	Token          string
+	CiphertextFile string
+	Client         *http.Client
+}
+
+func (k *KMSKeySource) Key() ([]byte, error) {
+	ciphertext, err := ioutil.ReadFile(k.CiphertextFile)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(struct {
+		Ciphertext string `json:"ciphertext"`
+	}{strings.TrimSpace(string(ciphertext))})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", k.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if k.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.Token)
+	}
+
+	client := k.Client
+	if client == nil {
+		client = kmsClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, k.URL, respBody)
+	}
+
+	var data struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := json.Unmarshal(respBody, &data); err != nil {
+		return nil, err
+	}
+	if data.Plaintext == "" {
+		return nil, errors.New("kms response is missing the plaintext key")
+	}
+	return base64.StdEncoding.DecodeString(data.Plaintext)
+}
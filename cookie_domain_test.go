@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestCookieDomainLongestMatch(t *testing.T) {
+	domains := []string{".example.com", ".apps.example.com", "example.io"}
+	assert.Equal(t, ".apps.example.com", cookieDomain("wiki.apps.example.com", domains))
+	assert.Equal(t, ".example.com", cookieDomain("www.example.com", domains))
+	assert.Equal(t, ".example.com", cookieDomain("example.com", domains))
+	assert.Equal(t, "example.io", cookieDomain("Docs.Example.IO", domains))
+	assert.Equal(t, "", cookieDomain("notexample.com", domains))
+	assert.Equal(t, "", cookieDomain("example.org", domains))
+}
+
+func TestMakeCookieForMultipleDomains(t *testing.T) {
+	o := testOptions()
+	o.CookieDomains = []string{".example.com", ".example.io"}
+	assert.Equal(t, nil, o.Validate())
+	proxy := NewOAuthProxy(o, func(string) bool { return true })
+
+	for host, domain := range map[string]string{
+		"app.example.com:8080": ".example.com",
+		"app.example.io":       ".example.io",
+		"app.example.org":      "app.example.org",
+	} {
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		c := proxy.MakeSessionCookie(req, "value", time.Hour, time.Now())
+		assert.Equal(t, domain, c.Domain)
+	}
+}
+
+func TestCookieSameSite(t *testing.T) {
+	o := testOptions()
+	o.CookieSameSite = "Strict"
+	assert.Equal(t, nil, o.Validate())
+	proxy := NewOAuthProxy(o, func(string) bool { return true })
+
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, http.SameSiteStrictMode, proxy.MakeSessionCookie(req, "v", time.Hour, time.Now()).SameSite)
+	// the CSRF cookie has to survive the cross site redirect from the provider
+	assert.Equal(t, http.SameSiteLaxMode, proxy.MakeCSRFCookie(req, "v", time.Hour, time.Now()).SameSite)
+}
+
+func TestCookiePartitioned(t *testing.T) {
+	o := testOptions()
+	o.CookieSameSite = "none"
+	o.CookiePartitioned = true
+	assert.Equal(t, nil, o.Validate())
+	proxy := NewOAuthProxy(o, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	proxy.SetSessionCookie(rw, httptest.NewRequest("GET", "/", nil), "value")
+	cookie := rw.Header().Get("Set-Cookie")
+	assert.Equal(t, true, strings.Contains(cookie, "; SameSite=None"))
+	assert.Equal(t, true, strings.HasSuffix(cookie, "; Secure; SameSite=None; Partitioned"))
+}
+
+func TestCookieSameSiteValidation(t *testing.T) {
+	o := testOptions()
+	o.CookieSameSite = "relaxed"
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`invalid cookie-samesite="relaxed" expected lax, strict or none`}), err.Error())
+
+	o = testOptions()
+	o.CookieSecure = false
+	o.CookieSameSite = "none"
+	o.CookiePartitioned = true
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"cookie-samesite=none requires cookie-secure",
+		"cookie-partitioned requires cookie-secure",
+	}), err.Error())
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// envPrefix is prepended to the upper cased config file name of an option
+// for its environment variable
+const envPrefix = "OAUTH2_PROXY_"
+
 type EnvOptions map[string]interface{}
 
-func (cfg EnvOptions) LoadEnvForStruct(options interface{}) {
+// LoadEnvForStruct sets options from the environment, returning an error
+// listing the variables that are set to values their options can't take
+func (cfg EnvOptions) LoadEnvForStruct(options interface{}) error {
+	var msgs []string
 	val := reflect.ValueOf(options).Elem()
 	typ := val.Type()
 	for i := 0; i < typ.NumField(); i++ {
@@ -16,6 +26,7 @@ func (cfg EnvOptions) LoadEnvForStruct(options interface{}) {
 		//    flag - the name of the command line flag
 		//    deprecated - (optional) the name of the deprecated command line flag
 		//    cfg - (optional, defaults to underscored flag) the name of the config file option
+		//    env - (optional, defaults to OAUTH2_PROXY_ and the upper cased cfg for flags) the environment variable
 		field := typ.Field(i)
 		flagName := field.Tag.Get("flag")
 		envName := field.Tag.Get("env")
@@ -23,13 +34,121 @@ func (cfg EnvOptions) LoadEnvForStruct(options interface{}) {
 		if cfgName == "" && flagName != "" {
 			cfgName = strings.Replace(flagName, "-", "_", -1)
 		}
+		if envName == "" && flagName != "" {
+			envName = envPrefix + strings.ToUpper(cfgName)
+		}
 		if envName == "" || cfgName == "" {
-			// resolvable fields must have the `env` and `cfg` struct tag
+			// resolvable fields must have the `env` and `cfg` struct tag,
+			// or a `flag` tag
 			continue
 		}
 		v := os.Getenv(envName)
-		if v != "" {
-			cfg[cfgName] = v
+		if v == "" {
+			continue
+		}
+		if _, err := coerceOption(v, field.Type); err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid %s: %s", envName, err))
+			continue
+		}
+		cfg[cfgName] = v
+	}
+	if len(msgs) != 0 {
+		return fmt.Errorf("Invalid environment:\n  %s", strings.Join(msgs, "\n  "))
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// coerceOption checks that a value from the environment or a config file
+// suits an option of type typ, returning it in a form options are resolved
+// from
+func coerceOption(v interface{}, typ reflect.Type) (interface{}, error) {
+	if typ == durationType {
+		if s, ok := v.(string); ok {
+			if _, err := time.ParseDuration(s); err == nil {
+				return s, nil
+			}
+		}
+		return nil, fmt.Errorf("expected a duration such as \"1h30m\", not %s", describeOption(v))
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		switch x := v.(type) {
+		case bool:
+			return x, nil
+		case string:
+			if b, err := strconv.ParseBool(x); err == nil {
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("expected true or false, not %s", describeOption(v))
+	case reflect.Int, reflect.Int64:
+		switch x := v.(type) {
+		case int:
+			return x, nil
+		case int64:
+			return int(x), nil
+		case string:
+			if n, err := strconv.Atoi(x); err == nil {
+				return n, nil
+			}
+		}
+		return nil, fmt.Errorf("expected a whole number, not %s", describeOption(v))
+	case reflect.Float64:
+		switch x := v.(type) {
+		case float64:
+			return x, nil
+		case int:
+			return float64(x), nil
+		case int64:
+			return float64(x), nil
+		case string:
+			if f, err := strconv.ParseFloat(x, 64); err == nil {
+				return f, nil
+			}
 		}
+		return nil, fmt.Errorf("expected a number, not %s", describeOption(v))
+	case reflect.String:
+		switch v.(type) {
+		case string, int, int64, float64:
+			return fmt.Sprint(v), nil
+		}
+		return nil, fmt.Errorf("expected a string, not %s", describeOption(v))
+	case reflect.Slice:
+		switch x := v.(type) {
+		case string:
+			return x, nil
+		case []interface{}:
+			values := make([]string, 0, len(x))
+			for _, e := range x {
+				switch e.(type) {
+				case string, int, int64, float64:
+					values = append(values, fmt.Sprint(e))
+				default:
+					return nil, fmt.Errorf("expected a list of strings, not a list containing %s", describeOption(e))
+				}
+			}
+			return values, nil
+		}
+		return nil, fmt.Errorf("expected a list of strings, not %s", describeOption(v))
+	}
+	return nil, fmt.Errorf("can't be set to %s", describeOption(v))
+}
+
+// describeOption describes a value for error messages
+func describeOption(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case bool, int, int64, float64:
+		return fmt.Sprint(v)
+	case []interface{}:
+		return "a list"
+	case map[interface{}]interface{}, map[string]interface{}:
+		return "a mapping"
+	case nil:
+		return "nothing"
 	}
+	return fmt.Sprintf("a %T", v)
 }
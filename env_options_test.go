@@ -24,3 +24,24 @@ func TestLoadEnvForStruct(t *testing.T) {
 	v := cfg["target_field"]
 	assert.Equal(t, v, "1234abcd")
 }
+
+func TestLoadEnvForOptions(t *testing.T) {
+	os.Setenv("OAUTH2_PROXY_UPSTREAMS", "http://127.0.0.1:8080/,http://127.0.0.1:8081/")
+	os.Setenv("OAUTH2_PROXY_PASS_ACCESS_TOKEN", "true")
+	defer os.Unsetenv("OAUTH2_PROXY_UPSTREAMS")
+	defer os.Unsetenv("OAUTH2_PROXY_PASS_ACCESS_TOKEN")
+
+	cfg := make(EnvOptions)
+	assert.Equal(t, nil, cfg.LoadEnvForStruct(NewOptions()))
+	assert.Equal(t, "http://127.0.0.1:8080/,http://127.0.0.1:8081/", cfg["upstreams"])
+	assert.Equal(t, "true", cfg["pass_access_token"])
+
+	os.Setenv("OAUTH2_PROXY_COOKIE_EXPIRE", "7d")
+	os.Setenv("OAUTH2_PROXY_USER_QUOTA", "lots")
+	defer os.Unsetenv("OAUTH2_PROXY_COOKIE_EXPIRE")
+	defer os.Unsetenv("OAUTH2_PROXY_USER_QUOTA")
+	err := make(EnvOptions).LoadEnvForStruct(NewOptions())
+	assert.Equal(t, "Invalid environment:\n"+
+		"  invalid OAUTH2_PROXY_USER_QUOTA: expected a whole number, not \"lots\"\n"+
+		"  invalid OAUTH2_PROXY_COOKIE_EXPIRE: expected a duration such as \"1h30m\", not \"7d\"", err.Error())
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// upstreamErrorCodes are the upstream responses replaced by an error page
+// with intercept-upstream-errors, including the proxy's own 502 when an
+// upstream can't be reached
+var upstreamErrorCodes = map[int]bool{
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// serveUpstream proxies req to its upstream. With intercept-upstream-errors,
+// gateway errors are replaced by an error page rather than passing on the
+// upstream's or the reverse proxy's own response.
+func (p *OAuthProxy) serveUpstream(rw http.ResponseWriter, req *http.Request) {
+	if !p.interceptErrors {
+		p.serveMux.ServeHTTP(rw, req)
+		return
+	}
+	w := &upstreamErrorWriter{ResponseWriter: rw, header: cloneHeader(rw.Header())}
+	p.serveMux.ServeHTTP(w, req)
+	if w.intercepted == 0 {
+		return
+	}
+
+	// drop the headers of the upstream's response, but keep its address
+	// for the request log
+	h := rw.Header()
+	upstream := h.Get("GAP-Upstream-Address")
+	for k := range h {
+		delete(h, k)
+	}
+	for k, v := range w.header {
+		h[k] = v
+	}
+	if upstream != "" {
+		h.Set("GAP-Upstream-Address", upstream)
+	}
+	p.ErrorPage(rw, req, w.intercepted, http.StatusText(w.intercepted),
+		"The application is unavailable, please try again later.")
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// upstreamErrorWriter holds back an upstream response with one of the
+// upstreamErrorCodes, discarding its body, so that an error page can be
+// served in its place
+type upstreamErrorWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	intercepted int
+	wroteHeader bool
+}
+
+func (w *upstreamErrorWriter) WriteHeader(code int) {
+	if !w.wroteHeader && upstreamErrorCodes[code] {
+		w.intercepted = code
+	}
+	w.wroteHeader = true
+	if w.intercepted == 0 {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *upstreamErrorWriter) Write(b []byte) (int, error) {
+	if w.intercepted != 0 {
+		return len(b), nil
+	}
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *upstreamErrorWriter) Flush() {
+	if w.intercepted != 0 {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *upstreamErrorWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("webserver doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
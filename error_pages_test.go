@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func newErrorPageTest(t *testing.T, opts *Options) *OAuthProxy {
+	assert.Equal(t, nil, opts.Validate())
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+func TestErrorPageRequestID(t *testing.T) {
+	proxy := newErrorPageTest(t, testOptions())
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "req-1")
+	proxy.ErrorPage(rw, req, http.StatusForbidden, "Permission Denied", "Invalid Account")
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, "req-1", rw.Header().Get("X-Request-Id"))
+	assert.Equal(t, true, strings.Contains(rw.Body.String(), "Request ID: req-1"))
+
+	rw = httptest.NewRecorder()
+	proxy.ErrorPage(rw, httptest.NewRequest("GET", "/", nil), http.StatusForbidden, "Permission Denied", "Invalid Account")
+	id := rw.Header().Get("X-Request-Id")
+	assert.Equal(t, true, regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(id))
+	assert.Equal(t, true, strings.Contains(rw.Body.String(), "Request ID: "+id))
+}
+
+func TestErrorPageJSON(t *testing.T) {
+	proxy := newErrorPageTest(t, testOptions())
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/items", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Request-Id", "req-1")
+	proxy.ErrorPage(rw, req, http.StatusForbidden, "Permission Denied", "Invalid Account")
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	var body map[string]string
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &body))
+	assert.Equal(t, map[string]string{
+		"error":      "permission_denied",
+		"message":    "Invalid Account",
+		"request_id": "req-1",
+	}, body)
+}
+
+func newFailingUpstream(code int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "app-1")
+		if r.URL.Path == "/missing" {
+			http.Error(w, "no such page", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "dial tcp 10.0.0.5:5432: connection refused", code)
+	}))
+}
+
+func TestInterceptUpstreamErrors(t *testing.T) {
+	upstream := newFailingUpstream(http.StatusServiceUnavailable)
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"/"}
+	opts.InterceptUpstreamErrors = true
+	proxy := newErrorPageTest(t, opts)
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, false, strings.Contains(rw.Body.String(), "connection refused"))
+	assert.Equal(t, true, strings.Contains(rw.Body.String(), "503 Service Unavailable"))
+	assert.Equal(t, "", rw.Header().Get("X-Backend"))
+	assert.NotEqual(t, "", rw.Header().Get("GAP-Upstream-Address"))
+
+	// other responses are passed on
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+	assert.Equal(t, "no such page\n", rw.Body.String())
+	assert.Equal(t, "app-1", rw.Header().Get("X-Backend"))
+}
+
+func TestInterceptUnreachableUpstream(t *testing.T) {
+	upstream := newFailingUpstream(http.StatusBadGateway)
+	upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"/"}
+	opts.InterceptUpstreamErrors = true
+	proxy := newErrorPageTest(t, opts)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	assert.Equal(t, true, strings.HasPrefix(rw.Body.String(), `{"error":"bad_gateway"`))
+}
+
+func TestUpstreamErrorsPassedOnByDefault(t *testing.T) {
+	upstream := newFailingUpstream(http.StatusServiceUnavailable)
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"/"}
+	proxy := newErrorPageTest(t, opts)
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, "dial tcp 10.0.0.5:5432: connection refused\n", rw.Body.String())
+}
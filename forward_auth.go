@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// forwardedRequest returns the original request that an external
+// authenticator is asking about, or nil if it can't be told.
+//
+// Envoy ext_authz appends the original path to the auth endpoint, ie:
+// /oauth2/auth/original/path. Traefik forwardAuth sends the original method,
+// host and URI in X-Forwarded-Method, X-Forwarded-Host and X-Forwarded-Uri,
+// and nginx can be configured to send X-Original-Method, X-Original-Host and
+// X-Original-URI. As clients could send those headers themselves, they are
+// only honoured from trusted proxies.
+func (p *OAuthProxy) forwardedRequest(req *http.Request) *http.Request {
+	method, host, uri := req.Method, req.Host, ""
+	trusted := false
+	if ip := remoteIP(req); ip != nil && containsIP(p.trustedProxies, ip) {
+		trusted = true
+		if h := firstHeader(req, "X-Forwarded-Host", "X-Original-Host"); h != "" {
+			// the first proxy's host, if several have added theirs
+			host = strings.TrimSpace(strings.Split(h, ",")[0])
+		}
+	}
+	if rest := strings.TrimPrefix(req.URL.Path, p.AuthOnlyPath); rest != req.URL.Path && rest != "" {
+		uri = rest
+		if req.URL.RawQuery != "" {
+			uri += "?" + req.URL.RawQuery
+		}
+	} else if trusted {
+		uri = firstHeader(req, "X-Forwarded-Uri", "X-Original-URI")
+		if m := firstHeader(req, "X-Forwarded-Method", "X-Original-Method"); m != "" {
+			method = strings.ToUpper(m)
+		}
+	}
+	if uri == "" {
+		return nil
+	}
+	// a path such as //admin/ would otherwise be parsed as host and path
+	if strings.HasPrefix(uri, "/") {
+		uri = "/" + strings.TrimLeft(uri, "/")
+	}
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil
+	}
+	u.Path, u.RawPath = cleanPath(u.Path), ""
+	return &http.Request{Method: method, URL: u, Header: req.Header, Host: host}
+}
+
+// authorizedRequest returns the request that authorization applies to: the
+// original request for the auth endpoint, when it can be told, and
+// otherwise req itself. Its path is cleaned, so that prefixes such as
+// /admin/ can't be dodged with //admin/ or /public/../admin/, which
+// upstreams resolve to the same path.
+func (p *OAuthProxy) authorizedRequest(req *http.Request) *http.Request {
+	if req.URL.Path == p.AuthOnlyPath || strings.HasPrefix(req.URL.Path, p.AuthOnlyPath+"/") {
+		if fwd := p.forwardedRequest(req); fwd != nil {
+			return fwd
+		}
+	}
+	return cleanRequest(req)
+}
+
+// cleanRequest returns req, or a copy of it when its path isn't clean with
+// the path cleaned
+func cleanRequest(req *http.Request) *http.Request {
+	clean := cleanPath(req.URL.Path)
+	if clean == req.URL.Path {
+		return req
+	}
+	r := *req
+	u := *req.URL
+	u.Path, u.RawPath = clean, ""
+	r.URL = &u
+	return &r
+}
+
+// cleanPath resolves . and .. elements and repeated slashes in an absolute
+// path, keeping a trailing slash
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+func firstHeader(req *http.Request, names ...string) string {
+	for _, name := range names {
+		if v := req.Header.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func newForwardAuthTestProxy(t *testing.T) *OAuthProxy {
+	opts := testOptions()
+	opts.Upstreams = nil
+	opts.AuthOnly = true
+	opts.SkipAuthRegex = []string{"^/public/"}
+	opts.SkipAuthRoutes = []string{"GET=^/healthz$"}
+	opts.TrustedProxies = []string{"10.0.0.0/8"}
+	assert.Equal(t, nil, opts.Validate())
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+func TestForwardAuthSkipsAuthForForwardedURI(t *testing.T) {
+	proxy := newForwardAuthTestProxy(t)
+
+	auth := func(remoteAddr string, headers map[string]string) int {
+		req, _ := http.NewRequest("GET", "/oauth2/auth", nil)
+		req.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// Traefik forwardAuth
+	assert.Equal(t, http.StatusAccepted, auth("10.0.0.2:4000", map[string]string{
+		"X-Forwarded-Method": "GET", "X-Forwarded-Uri": "/public/logo.png?v=2"}))
+	assert.Equal(t, http.StatusAccepted, auth("10.0.0.2:4000", map[string]string{
+		"X-Forwarded-Method": "GET", "X-Forwarded-Uri": "/healthz"}))
+	assert.Equal(t, http.StatusUnauthorized, auth("10.0.0.2:4000", map[string]string{
+		"X-Forwarded-Method": "POST", "X-Forwarded-Uri": "/healthz"}))
+	assert.Equal(t, http.StatusUnauthorized, auth("10.0.0.2:4000", map[string]string{
+		"X-Forwarded-Uri": "/private/"}))
+	// nginx auth_request
+	assert.Equal(t, http.StatusAccepted, auth("10.0.0.2:4000", map[string]string{
+		"X-Original-URI": "/public/logo.png"}))
+	// the headers aren't trusted from other clients
+	assert.Equal(t, http.StatusUnauthorized, auth("203.0.113.7:4000", map[string]string{
+		"X-Forwarded-Uri": "/public/logo.png"}))
+}
+
+func TestForwardAuthHostPolicy(t *testing.T) {
+	test := func(remoteAddr string, headers map[string]string) int {
+		pc_test := NewProcessCookieTestWithDefaults()
+		pc_test.proxy.policies = []*policy{
+			{name: "policy[0]", host: "admin.example.com", allowedGroups: []string{"ops"}},
+		}
+		_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+		pc_test.proxy.trustedProxies = []*net.IPNet{trusted}
+		pc_test.req, _ = http.NewRequest("GET", "/oauth2/auth", nil)
+		pc_test.req.Host = "auth.example.com"
+		pc_test.req.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			pc_test.req.Header.Set(k, v)
+		}
+		pc_test.SaveSession(&providers.SessionState{
+			Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+			Groups: []string{"devs"}}, time.Now())
+		pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+		return pc_test.rw.Code
+	}
+
+	// Traefik forwardAuth and nginx send the original host
+	assert.Equal(t, http.StatusForbidden, test("10.0.0.2:4000", map[string]string{
+		"X-Forwarded-Host": "admin.example.com", "X-Forwarded-Uri": "/users"}))
+	assert.Equal(t, http.StatusForbidden, test("10.0.0.2:4000", map[string]string{
+		"X-Original-Host": "admin.example.com:443", "X-Original-URI": "/users"}))
+	assert.Equal(t, http.StatusAccepted, test("10.0.0.2:4000", map[string]string{
+		"X-Forwarded-Host": "app.example.com", "X-Forwarded-Uri": "/users"}))
+	// the header isn't trusted from other clients
+	assert.Equal(t, http.StatusAccepted, test("203.0.113.7:4000", map[string]string{
+		"X-Forwarded-Host": "admin.example.com", "X-Forwarded-Uri": "/users"}))
+}
+
+func TestCleanPath(t *testing.T) {
+	for path, clean := range map[string]string{
+		"":                 "/",
+		"/":                "/",
+		"//":               "/",
+		"/admin/":          "/admin/",
+		"//admin//users":   "/admin/users",
+		"/./admin/./":      "/admin/",
+		"/public/../admin": "/admin",
+		"/../../admin/":    "/admin/",
+	} {
+		assert.Equal(t, clean, cleanPath(path))
+	}
+}
+
+func TestForwardAuthEnvoyPathPrefix(t *testing.T) {
+	proxy := newForwardAuthTestProxy(t)
+
+	auth := func(method, path string) int {
+		req, _ := http.NewRequest(method, path, nil)
+		req.RemoteAddr = "203.0.113.7:4000"
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusAccepted, auth("GET", "/oauth2/auth/public/logo.png"))
+	assert.Equal(t, http.StatusAccepted, auth("GET", "/oauth2/auth/healthz"))
+	assert.Equal(t, http.StatusUnauthorized, auth("DELETE", "/oauth2/auth/healthz"))
+	assert.Equal(t, http.StatusUnauthorized, auth("GET", "/oauth2/auth/private/"))
+}
+
+func TestForwardAuthIdentityHeaders(t *testing.T) {
+	opts := testOptions()
+	opts.Upstreams = nil
+	opts.AuthOnly = true
+	opts.SetXAuthRequest = true
+	opts.PassAccessToken = true
+	opts.CookieSecret = "0123456789abcdefabcd"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	req, _ := http.NewRequest("GET", "/oauth2/auth/private/", nil)
+	rw := httptest.NewRecorder()
+	session := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		ExpiresOn: time.Now().Add(time.Hour)}
+	assert.Equal(t, nil, proxy.SaveSession(rw, req, session))
+	req.AddCookie(rw.Result().Cookies()[0])
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, "michael.bland@gsa.gov", rw.Header().Get("X-Auth-Request-Email"))
+	assert.Equal(t, "my_access_token", rw.Header().Get("X-Auth-Request-Access-Token"))
+}
+
+func TestTrustedIPSkipsAuth(t *testing.T) {
+	opts := testOptions()
+	opts.TrustedIPs = []string{"172.16.0.0/12"}
+	opts.TrustedProxies = []string{"10.0.0.0/8"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	serve := func(path, remoteAddr, forwardedFor string) int {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusAccepted, serve("/oauth2/auth", "172.16.4.2:4000", ""))
+	assert.Equal(t, http.StatusUnauthorized, serve("/oauth2/auth", "203.0.113.7:4000", ""))
+	// through a trusted proxy
+	assert.Equal(t, http.StatusAccepted, serve("/oauth2/auth", "10.0.0.2:4000", "172.16.4.2"))
+	assert.Equal(t, http.StatusUnauthorized, serve("/oauth2/auth", "10.0.0.2:4000", "203.0.113.7"))
+	// clients can't claim a trusted address themselves
+	assert.Equal(t, http.StatusUnauthorized, serve("/oauth2/auth", "203.0.113.7:4000", "172.16.4.2"))
+
+	assert.Equal(t, http.StatusForbidden, serve("/", "203.0.113.7:4000", "172.16.4.2"))
+	assert.NotEqual(t, http.StatusForbidden, serve("/", "172.16.4.2:4000", ""))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// isGRPCContentType reports whether a Content-Type header is one of gRPC's
+// or gRPC-Web's: application/grpc, application/grpc+proto,
+// application/grpc-web-text and so on
+func isGRPCContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && strings.HasPrefix(mediaType, "application/grpc")
+}
+
+// isGRPCRequest reports whether req is a gRPC or gRPC-Web call. Clients
+// can't follow a redirect to sign in, so they are sent a 401 like other
+// API clients, which gRPC reports as UNAUTHENTICATED.
+func isGRPCRequest(req *http.Request) bool {
+	return isGRPCContentType(req.Header.Get("Content-Type"))
+}
+
+// h2cHandler accepts HTTP/2 without TLS, either with prior knowledge as
+// gRPC clients send it or by upgrading an HTTP/1.1 request, when enable-h2c
+// is set. Other requests are served as before.
+func (s *Server) h2cHandler(h http.Handler) http.Handler {
+	if !s.Opts.EnableH2C {
+		return h
+	}
+	return h2c.NewHandler(h, &http2.Server{IdleTimeout: s.Opts.IdleTimeout})
+}
+
+// h2cTarget returns the http URL that requests to an h2c upstream are made to
+func h2cTarget(u *url.URL) *url.URL {
+	target := *u
+	target.Scheme = "http"
+	return &target
+}
+
+// newH2CTransport returns a transport that makes HTTP/2 requests to an h2c
+// upstream over plain TCP, instead of negotiating it through TLS
+func newH2CTransport(timeouts upstreamTimeouts) http.RoundTripper {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if timeouts.dial != 0 {
+		dialer.Timeout = timeouts.dial
+	}
+	var transport http.RoundTripper = &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		},
+	}
+	if timeouts.responseHeader != 0 {
+		transport = &responseHeaderTimeoutTransport{transport, timeouts.responseHeader}
+	}
+	return transport
+}
+
+var errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// responseHeaderTimeoutTransport gives up on requests whose response headers
+// take longer than timeout, like http.Transport's ResponseHeaderTimeout.
+// Once the headers arrive the body may take as long as it needs.
+type responseHeaderTimeoutTransport struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+func (t *responseHeaderTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+	resp, err := t.transport.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, errResponseHeaderTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases a request's context once its response body has
+// been read
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newGRPCUpstream returns an h2c server that answers like a gRPC service,
+// with the protocol of the request as the body and the status in a trailer
+func newGRPCUpstream(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte(r.Proto))
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+}
+
+func newGRPCProxy(t *testing.T, opts *Options) *OAuthProxy {
+	opts.SkipAuthRegex = []string{"/"}
+	assert.Equal(t, nil, opts.Validate())
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+func grpcCall(proxy *OAuthProxy) *http.Response {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/helloworld.Greeter/SayHello", strings.NewReader(""))
+	req.Header.Set("Content-Type", "application/grpc")
+	proxy.ServeHTTP(rw, req)
+	return rw.Result()
+}
+
+func TestH2CUpstream(t *testing.T) {
+	upstream := newGRPCUpstream(0)
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{"h2c://" + upstream.Listener.Addr().String()}
+	resp := grpcCall(newGRPCProxy(t, opts))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "HTTP/2.0", string(body))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestH2CRoute(t *testing.T) {
+	upstream := newGRPCUpstream(0)
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = nil
+	opts.Routes = []RouteOptions{{
+		Path: "/helloworld.Greeter/", Upstream: "h2c://" + upstream.Listener.Addr().String()}}
+	resp := grpcCall(newGRPCProxy(t, opts))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "HTTP/2.0", string(body))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestH2CUpstreamResponseTimeout(t *testing.T) {
+	upstream := newGRPCUpstream(200 * time.Millisecond)
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{"h2c://" + upstream.Listener.Addr().String()}
+	opts.UpstreamResponseTimeout = 50 * time.Millisecond
+	resp := grpcCall(newGRPCProxy(t, opts))
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestGRPCRequestIsAPIRequest(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	resp := grpcCall(proxy)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func serveH2CProto(t *testing.T, enabled bool) (string, error) {
+	opts := NewOptions()
+	opts.EnableH2C = enabled
+	s := &Server{Opts: opts, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})}
+	ln, err := s.listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serveHTTP(ln)
+	defer s.Shutdown()
+
+	client := &http.Client{Transport: newH2CTransport(upstreamTimeouts{})}
+	resp, err := client.Get(fmt.Sprintf("http://%s/", ln.Addr()))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body), nil
+}
+
+func TestServeH2C(t *testing.T) {
+	proto, err := serveH2CProto(t, true)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "HTTP/2.0", proto)
+
+	_, err = serveH2CProto(t, false)
+	assert.NotEqual(t, nil, err)
+}
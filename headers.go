@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"text/template"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// identityHeaders are set from the session by the pass-* options, so a
+// client must never be able to send them itself
+var identityHeaders = []string{
+	"X-Forwarded-User",
+	"X-Forwarded-Email",
+	"X-Forwarded-Groups",
+	"X-Forwarded-Access-Token",
+}
+
+var headerFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// injectedHeader is a header whose value is rendered from the session
+type injectedHeader struct {
+	name  string
+	value *template.Template
+}
+
+// parseInjectedHeaders parses name=template values. The template is
+// executed with the session, so "X-Forwarded-Id-Token={{.IDToken}}" passes
+// the id token and a value without actions is a static header.
+func parseInjectedHeaders(values []string, option string, msgs []string) ([]injectedHeader, []string) {
+	var headers []injectedHeader
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		name := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 || name == "" || strings.ContainsAny(name, " \t:") {
+			msgs = append(msgs, fmt.Sprintf("%s must be of the form name=value: %q", option, v))
+			continue
+		}
+		t, err := template.New(name).Funcs(headerFuncs).Parse(parts[1])
+		if err == nil {
+			// catches references to fields the session doesn't have
+			err = t.Execute(ioutil.Discard, &providers.SessionState{})
+		}
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%s %s: %s", option, name, err))
+			continue
+		}
+		headers = append(headers, injectedHeader{name: name, value: t})
+	}
+	return headers, msgs
+}
+
+// setInjectedHeaders renders each header from the session into h. Headers
+// that render to an empty value are left unset.
+func setInjectedHeaders(h http.Header, headers []injectedHeader, session *providers.SessionState) error {
+	for _, ih := range headers {
+		var buf bytes.Buffer
+		if err := ih.value.Execute(&buf, session); err != nil {
+			return fmt.Errorf("error rendering header %s: %s", ih.name, err)
+		}
+		if buf.Len() != 0 {
+			h.Set(ih.name, buf.String())
+		} else {
+			h.Del(ih.name)
+		}
+	}
+	return nil
+}
+
+// stripRequestHeaders removes headers set by the proxy from a client request,
+// along with any headers configured with strip-request-header
+func (p *OAuthProxy) stripRequestHeaders(req *http.Request) {
+	for _, name := range identityHeaders {
+		req.Header.Del(name)
+	}
+	for _, ih := range p.injectRequestHeaders {
+		req.Header.Del(ih.name)
+	}
+	for _, ch := range p.claimHeaders {
+		req.Header.Del(ch.header)
+	}
+	if p.upstreamJWT != nil {
+		req.Header.Del(p.upstreamJWT.header)
+	}
+	for _, name := range p.stripHeaders {
+		req.Header.Del(name)
+	}
+}
@@ -7,10 +7,14 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 // lookup passwords in a htpasswd file
-// The entries must have been created with -s for SHA encryption
+// The entries must have been created with -B for bcrypt or -s for SHA
+// encryption
 
 type HtpasswdFile struct {
 	Users map[string]string
@@ -47,14 +51,18 @@ func (h *HtpasswdFile) Validate(user string, password string) bool {
 	if !exists {
 		return false
 	}
-	if realPassword[:5] == "{SHA}" {
+	switch {
+	case strings.HasPrefix(realPassword, "{SHA}"):
 		d := sha1.New()
 		d.Write([]byte(password))
 		if realPassword[5:] == base64.StdEncoding.EncodeToString(d.Sum(nil)) {
 			return true
 		}
-	} else {
-		log.Printf("Invalid htpasswd entry for %s. Must be a SHA entry.", user)
+	case strings.HasPrefix(realPassword, "$2a$"), strings.HasPrefix(realPassword, "$2b$"),
+		strings.HasPrefix(realPassword, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(realPassword), []byte(password)) == nil
+	default:
+		log.Printf("Invalid htpasswd entry for %s. Must be a bcrypt or SHA entry.", user)
 	}
 	return false
 }
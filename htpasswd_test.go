@@ -2,8 +2,12 @@ package main
 
 import (
 	"bytes"
-	"github.com/bmizerany/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/bmizerany/assert"
 )
 
 func TestHtpasswd(t *testing.T) {
@@ -14,3 +18,70 @@ func TestHtpasswd(t *testing.T) {
 	valid := h.Validate("testuser", "asdf")
 	assert.Equal(t, valid, true)
 }
+
+func TestHtpasswdBcrypt(t *testing.T) {
+	file := bytes.NewBuffer([]byte(
+		"monitor:$2y$05$0/Y.pmozlrsivoOvw6z4guaHRdMe9CyJUn4mV5FVFVKgZXenJTFLG\n" +
+			"deploy:$2a$05$0/Y.pmozlrsivoOvw6z4guaHRdMe9CyJUn4mV5FVFVKgZXenJTFLG\n" +
+			"legacy:plaintext\n"))
+	h, err := NewHtpasswd(file)
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, true, h.Validate("monitor", "monitor-secret"))
+	assert.Equal(t, true, h.Validate("deploy", "monitor-secret"))
+	assert.Equal(t, false, h.Validate("monitor", "wrong"))
+	assert.Equal(t, false, h.Validate("legacy", "plaintext"))
+	assert.Equal(t, false, h.Validate("nobody", "monitor-secret"))
+}
+
+func TestBasicAuthWithBcryptHtpasswd(t *testing.T) {
+	var upstreamUser string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamUser = r.Header.Get("X-Forwarded-User")
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return false })
+	proxy.HtpasswdFile, _ = NewHtpasswd(bytes.NewBufferString(
+		"monitor:$2y$05$0/Y.pmozlrsivoOvw6z4guaHRdMe9CyJUn4mV5FVFVKgZXenJTFLG\n"))
+
+	req, _ := http.NewRequest("GET", "/health", nil)
+	req.SetBasicAuth("monitor", "monitor-secret")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "monitor", upstreamUser)
+	assert.Equal(t, "monitor", rw.Header().Get("GAP-Auth"))
+
+	req, _ = http.NewRequest("GET", "/health", nil)
+	req.SetBasicAuth("monitor", "wrong")
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestCheckBasicAuthLeavesOutCredentials(t *testing.T) {
+	proxy := NewProcessCookieTestWithDefaults().proxy
+	proxy.HtpasswdFile, _ = NewHtpasswd(bytes.NewBufferString("monitor:plaintext\n"))
+	check := func(auth string) (bool, error) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", auth)
+		session, err := proxy.CheckBasicAuth(req)
+		return session != nil, err
+	}
+
+	// bearer tokens that weren't accepted aren't basic auth
+	ok, err := check("Bearer secret-token")
+	assert.Equal(t, false, ok)
+	assert.Equal(t, nil, err)
+
+	for _, auth := range []string{"Basic", "Basic secret-token", "Basic c2VjcmV0LXRva2Vu"} {
+		ok, err = check(auth)
+		assert.Equal(t, false, ok)
+		assert.NotEqual(t, nil, err)
+		assert.Equal(t, false, strings.Contains(err.Error(), "secret"))
+	}
+}
@@ -1,76 +1,279 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/pires/go-proxyproto"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
+// proxyProtocolHeaderTimeout limits how long a connection has to send its
+// PROXY protocol header when read-header-timeout is disabled
+const proxyProtocolHeaderTimeout = 10 * time.Second
+
 type Server struct {
 	Handler http.Handler
 	Opts    *Options
+
+	mu       sync.Mutex
+	servers  []*http.Server
+	stopping bool
+	stopped  chan bool
 }
 
 func (s *Server) ListenAndServe() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-signals
+		log.Printf("received %s, shutting down (waiting up to %s for requests to complete)", sig, s.Opts.GracefulShutdownTimeout)
+		if err := s.Shutdown(); err != nil {
+			log.Printf("ERROR: shutdown - %s", err)
+		}
+		close(stopped)
+	}()
+
 	if s.Opts.RedirectHttpToHttps {
 		go s.ServeHTTPSRedirector()
 	}
-	if s.Opts.TLSKeyFile != "" || s.Opts.TLSCertFile != "" || s.Opts.LetsEncryptEnabled {
+	if s.Opts.MetricsAddress != "" {
+		go s.ServeMetrics()
+	}
+	if s.Opts.AdminAddress != "" {
+		go s.ServeAdmin()
+	}
+	activated, err := activatedListeners()
+	if err != nil {
+		log.Fatalf("FATAL: socket activation - %s", err)
+	}
+	if len(activated) != 0 {
+		s.ServeActivated(activated)
+	} else if s.tlsEnabled() {
 		s.ServeHTTPS()
 	} else {
 		s.ServeHTTP()
 	}
+
+	if s.isStopping() {
+		<-stopped
+	}
 }
 
-func (s *Server) ServeHTTP() {
-	u, err := url.Parse(s.Opts.HttpAddress)
-	if err != nil {
-		log.Fatalf("FATAL: could not parse %#v: %v", s.Opts.HttpAddress, err)
+// serve accepts connections on ln until the server is shut down
+func (s *Server) serve(srv *http.Server, ln net.Listener) error {
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
 	}
+	s.servers = append(s.servers, srv)
+	s.mu.Unlock()
 
-	var networkType string
-	switch u.Scheme {
-	case "", "http":
-		networkType = "tcp"
-	default:
-		networkType = u.Scheme
+	err := srv.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
 	}
-	listenAddr := strings.TrimPrefix(u.String(), u.Scheme+"://")
+	return err
+}
 
-	listener, err := net.Listen(networkType, listenAddr)
-	if err != nil {
-		log.Fatalf("FATAL: listen (%s, %s) failed - %s", networkType, listenAddr, err)
+func (s *Server) isStopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopping
+}
+
+// done returns a channel that is closed when the server shuts down, which
+// stops the background work of its listeners
+func (s *Server) done() <-chan bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped == nil {
+		s.stopped = make(chan bool)
 	}
-	log.Printf("HTTP: listening on %s", listenAddr)
+	return s.stopped
+}
 
-	server := &http.Server{Handler: s.Handler}
-	err = server.Serve(listener)
-	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-		log.Printf("ERROR: http.Serve() - %s", err)
+// Shutdown closes all listeners and waits for in-flight requests to
+// complete, giving up after the configured graceful shutdown timeout.
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	if s.stopped != nil && !s.stopping {
+		close(s.stopped)
 	}
+	s.stopping = true
+	servers := s.servers
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Opts.GracefulShutdownTimeout)
+	defer cancel()
 
-	log.Printf("HTTP: closing %s", listener.Addr())
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			errs <- srv.Shutdown(ctx)
+		}(srv)
+	}
+	var err error
+	for range servers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *Server) tlsEnabled() bool {
+	return s.Opts.TLSKeyFile != "" || s.Opts.TLSCertFile != "" || s.Opts.LetsEncryptEnabled
+}
+
+// listenAddresses splits a comma separated list of addresses
+func listenAddresses(addrs string) []string {
+	var list []string
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			list = append(list, addr)
+		}
+	}
+	return list
+}
+
+// parseHTTPAddress returns the network and address to listen on for an
+// http-address, which may be a unix:// URL
+func parseHTTPAddress(addr string) (string, string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", err
+	}
+	networkType := u.Scheme
+	if networkType == "" || networkType == "http" {
+		networkType = "tcp"
+	}
+	return networkType, strings.TrimPrefix(u.String(), u.Scheme+"://"), nil
+}
+
+func (s *Server) ServeHTTP() {
+	var listeners []net.Listener
+	for _, addr := range listenAddresses(s.Opts.HttpAddress) {
+		networkType, listenAddr, err := parseHTTPAddress(addr)
+		if err != nil {
+			log.Fatalf("FATAL: could not parse %#v: %v", addr, err)
+		}
+		ln, err := s.listen(networkType, listenAddr)
+		if err != nil {
+			log.Fatalf("FATAL: listen (%s, %s) failed - %s", networkType, listenAddr, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	s.serveListeners("HTTP", listeners, s.serveHTTP)
 }
 
 func (s *Server) ServeHTTPS() {
-	addr := s.Opts.HttpsAddress
+	config := s.httpsConfig()
+	var listeners []net.Listener
+	for _, addr := range listenAddresses(s.Opts.HttpsAddress) {
+		ln, err := s.listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("FATAL: listen (%s) failed - %s", addr, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	s.serveListeners("HTTPS", listeners, func(ln net.Listener) error {
+		return s.serveTLS(ln, config)
+	})
+}
 
-	config := &tls.Config{
-		MinVersion: tls.VersionTLS12,
-		MaxVersion: tls.VersionTLS12,
+// ServeActivated serves the sockets passed in by socket activation in place
+// of http-address and https-address. Sockets named "http" or "https" are
+// served with that protocol; others with HTTPS when a certificate or Let's
+// Encrypt is configured and HTTP otherwise.
+func (s *Server) ServeActivated(activated []activatedListener) {
+	var config *tls.Config
+	var httpListeners, httpsListeners []net.Listener
+	for _, ln := range activated {
+		useTLS := s.tlsEnabled()
+		switch ln.name {
+		case "http":
+			useTLS = false
+		case "https":
+			useTLS = true
+		}
+		if !useTLS {
+			httpListeners = append(httpListeners, ln.Listener)
+			continue
+		}
+		if config == nil {
+			config = s.httpsConfig()
+		}
+		httpsListeners = append(httpsListeners, ln.Listener)
 	}
-	if config.NextProtos == nil {
-		config.NextProtos = []string{"http/1.1"}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.serveListeners("HTTP", httpListeners, s.serveHTTP)
+	}()
+	go func() {
+		defer wg.Done()
+		s.serveListeners("HTTPS", httpsListeners, func(ln net.Listener) error {
+			return s.serveTLS(ln, config)
+		})
+	}()
+	wg.Wait()
+}
+
+// serveListeners serves each listener from its own goroutine, returning
+// once they have all been closed
+func (s *Server) serveListeners(name string, listeners []net.Listener, serve func(net.Listener) error) {
+	var wg sync.WaitGroup
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			log.Printf("%s: listening on %s", name, ln.Addr())
+			err := serve(ln)
+			if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("ERROR: %s.Serve() - %s", strings.ToLower(name), err)
+			}
+			log.Printf("%s: closing %s", name, ln.Addr())
+		}(ln)
 	}
+	wg.Wait()
+}
+
+// serveHTTP accepts plain HTTP connections on ln until the server is shut
+// down
+func (s *Server) serveHTTP(ln net.Listener) error {
+	return s.serve(s.newServer(s.h2cHandler(s.Handler)), s.proxyProtocolListener(ln))
+}
 
-	if s.Opts.LetsEncryptEnabled {
+// httpsConfig returns the TLS configuration for HTTPS listeners, with the
+// certificate loaded or obtained from Let's Encrypt. A certificate loaded
+// from tls-cert and tls-key is reloaded when the files change.
+func (s *Server) httpsConfig() *tls.Config {
+	config := s.tlsConfig()
+
+	if s.Opts.LetsEncryptEnabled && s.Opts.LetsEncryptChallenge == "dns-01" {
+		manager := newDNSCertManager(s.Opts)
+		if err := manager.Start(s.done()); err != nil {
+			log.Fatalf("FATAL: obtaining certificate for %s failed - %s", strings.Join(s.Opts.LetsEncryptHosts, ","), err)
+		}
+		config.GetCertificate = manager.GetCertificate
+	} else if s.Opts.LetsEncryptEnabled {
 		manager := autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
 			Cache:      autocert.DirCache(s.Opts.LetsEncryptCacheDir),
@@ -80,36 +283,105 @@ func (s *Server) ServeHTTPS() {
 			manager.Email = s.Opts.LetsEncryptAdminEmail
 		}
 		config.GetCertificate = manager.GetCertificate
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
 	} else {
-		var err error
-		config.Certificates = make([]tls.Certificate, 1)
-		config.Certificates[0], err = tls.LoadX509KeyPair(s.Opts.TLSCertFile, s.Opts.TLSKeyFile)
+		reloader, err := newCertReloader(s.Opts.TLSCertFile, s.Opts.TLSKeyFile)
 		if err != nil {
 			log.Fatalf("FATAL: loading tls config (%s, %s) failed - %s", s.Opts.TLSCertFile, s.Opts.TLSKeyFile, err)
 		}
+		reloader.Watch(s.done())
+		config.GetCertificate = reloader.GetCertificate
 	}
+	return config
+}
 
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatalf("FATAL: listen (%s) failed - %s", addr, err)
+// tlsConfig returns the protocol settings for the HTTPS listener. h2 is
+// offered through ALPN unless HTTP/2 is disabled.
+func (s *Server) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:   s.Opts.tlsMinVersion,
+		MaxVersion:   s.Opts.tlsMaxVersion,
+		CipherSuites: s.Opts.tlsCipherSuites,
+		NextProtos:   []string{"h2", "http/1.1"},
 	}
-	log.Printf("HTTPS: listening on %s", ln.Addr())
-
-	tlsListener := tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
-	srv := &http.Server{Handler: s.Handler}
-	err = srv.Serve(tlsListener)
-
-	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-		log.Printf("ERROR: https.Serve() - %s", err)
+	if s.Opts.DisableHTTP2 {
+		config.NextProtos = []string{"http/1.1"}
 	}
+	return config
+}
 
-	log.Printf("HTTPS: closing %s", tlsListener.Addr())
+// serveTLS accepts TLS connections on ln until the server is shut down
+func (s *Server) serveTLS(ln net.Listener, config *tls.Config) error {
+	tlsListener := tls.NewListener(s.proxyProtocolListener(keepAlive(ln)), config)
+	srv := s.newServer(s.Handler)
+	if s.Opts.DisableHTTP2 {
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return s.serve(srv, tlsListener)
 }
 
 func (s *Server) ServeHTTPSRedirector() {
-	h := LoggingHandler(os.Stdout, NewRedirectHandler(*s.Opts), s.Opts.RequestLogging)
+	h := LoggingHandler(NewRedirectHandler(*s.Opts))
+	ln, err := s.listen("tcp", s.Opts.HttpsRedirectorAddress)
+	if err != nil {
+		log.Fatalf("FATAL: listen (%s) failed - %s", s.Opts.HttpsRedirectorAddress, err)
+	}
 	log.Printf("HTTPs redirector listening on: %s", s.Opts.HttpsRedirectorAddress)
-	log.Fatal(http.ListenAndServe(s.Opts.HttpsRedirectorAddress, h))
+	srv := s.newServer(h)
+	if err := s.serve(srv, s.proxyProtocolListener(keepAlive(ln))); err != nil {
+		log.Fatalf("FATAL: https redirector - %s", err)
+	}
+}
+
+// proxyProtocolListener reads the client address of each connection from
+// its PROXY protocol v1 or v2 header when enable-proxy-protocol is set. The
+// header is only believed from the trusted proxies; from anyone else it is
+// read and ignored, so that clients can't choose their own address.
+// Connections without a header keep their own address.
+func (s *Server) proxyProtocolListener(ln net.Listener) net.Listener {
+	if !s.Opts.EnableProxyProtocol {
+		return ln
+	}
+	timeout := s.Opts.ReadHeaderTimeout
+	if timeout <= 0 {
+		timeout = proxyProtocolHeaderTimeout
+	}
+	trusted := s.Opts.trustedProxies
+	return &proxyproto.Listener{
+		Listener: ln,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			if addr, ok := upstream.(*net.TCPAddr); ok && containsIP(trusted, addr.IP) {
+				return proxyproto.USE, nil
+			}
+			return proxyproto.IGNORE, nil
+		},
+		ReadHeaderTimeout: timeout,
+	}
+}
+
+// listen creates a listener with the configured socket options applied
+func (s *Server) listen(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: listenControl(s.Opts.ReusePort)}
+	ln, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.Opts.ListenBacklog > 0 {
+		if err := setListenBacklog(ln, s.Opts.ListenBacklog); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// keepAlive enables TCP keep-alives on connections accepted by ln, unless
+// it isn't a TCP listener
+func keepAlive(ln net.Listener) net.Listener {
+	if tcp, ok := ln.(*net.TCPListener); ok {
+		return tcpKeepAliveListener{tcp}
+	}
+	return ln
 }
 
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/pires/go-proxyproto"
+)
+
+func TestListenReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("reuse-port is only supported on linux")
+	}
+	opts := NewOptions()
+	opts.ReusePort = true
+	opts.ListenBacklog = 128
+	s := &Server{Opts: opts}
+
+	first, err := s.listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer first.Close()
+
+	second, err := s.listen("tcp", first.Addr().String())
+	assert.Equal(t, nil, err)
+	defer second.Close()
+	assert.Equal(t, first.Addr().String(), second.Addr().String())
+}
+
+func TestListenWithoutReusePort(t *testing.T) {
+	s := &Server{Opts: NewOptions()}
+
+	first, err := s.listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer first.Close()
+
+	_, err = s.listen("tcp", first.Addr().String())
+	assert.NotEqual(t, nil, err)
+}
+
+func TestGracefulShutdownDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	s := &Server{Handler: handler, Opts: NewOptions()}
+	ln, err := s.listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	addr := ln.Addr().String()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(&http.Server{Handler: handler}, ln)
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(b)
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown()
+	}()
+
+	// the listener is closed straight away...
+	assert.Equal(t, nil, <-served)
+	_, err = net.Dial("tcp", addr)
+	assert.NotEqual(t, nil, err)
+
+	// ...but the in-flight request is allowed to finish
+	close(release)
+	assert.Equal(t, "done", <-body)
+	assert.Equal(t, nil, <-shutdown)
+}
+
+func TestGracefulShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	opts := NewOptions()
+	opts.GracefulShutdownTimeout = 10 * time.Millisecond
+	s := &Server{Handler: handler, Opts: opts}
+	ln, err := s.listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+
+	go s.serve(&http.Server{Handler: handler}, ln)
+	go http.Get("http://" + ln.Addr().String() + "/")
+	<-started
+
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown())
+}
+
+func TestServeAfterShutdown(t *testing.T) {
+	s := &Server{Opts: NewOptions()}
+	assert.Equal(t, nil, s.Shutdown())
+
+	ln, err := s.listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, s.serve(&http.Server{}, ln))
+	_, err = net.Dial("tcp", ln.Addr().String())
+	assert.NotEqual(t, nil, err)
+}
+
+func testCertificate() tls.Certificate {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	return ts.TLS.Certificates[0]
+}
+
+func serveTLSProto(t *testing.T, opts *Options) string {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	s := &Server{Handler: handler, Opts: opts}
+	ln, err := s.listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	config := s.tlsConfig()
+	config.Certificates = []tls.Certificate{testCertificate()}
+	go s.serveTLS(ln, config)
+	defer s.Shutdown()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, resp.Proto, string(body))
+	return string(body)
+}
+
+func TestServeTLSNegotiatesHTTP2(t *testing.T) {
+	assert.Equal(t, "HTTP/2.0", serveTLSProto(t, NewOptions()))
+}
+
+func TestServeTLSDisableHTTP2(t *testing.T) {
+	opts := NewOptions()
+	opts.DisableHTTP2 = true
+	assert.Equal(t, "HTTP/1.1", serveTLSProto(t, opts))
+}
+
+// remoteAddrOverProxyProtocol sends a request preceded by header, which may
+// be empty, and returns the RemoteAddr seen by the handler. The request
+// comes from 127.0.0.1, which is only a trusted proxy if it is in trusted.
+func remoteAddrOverProxyProtocol(t *testing.T, enabled bool, trusted string, header []byte) string {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})
+	opts := NewOptions()
+	opts.EnableProxyProtocol = enabled
+	opts.trustedProxies, _ = parseCIDRs([]string{trusted}, "trusted-proxy", nil)
+	s := &Server{Handler: handler, Opts: opts}
+	ln, err := s.listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	go s.serve(&http.Server{Handler: handler}, s.proxyProtocolListener(ln))
+	defer s.Shutdown()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(header)
+	conn.Write([]byte("GET / HTTP/1.0\r\nHost: example.com\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	header := []byte("PROXY TCP4 203.0.113.7 127.0.0.1 51234 4180\r\n")
+	assert.Equal(t, "203.0.113.7:51234", remoteAddrOverProxyProtocol(t, true, "127.0.0.0/8", header))
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	var header bytes.Buffer
+	_, err := (&proxyproto.Header{
+		Version:           2,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: proxyproto.TCPv6,
+		SourceAddr:        &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234},
+		DestinationAddr:   &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4180},
+	}).WriteTo(&header)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[2001:db8::7]:51234", remoteAddrOverProxyProtocol(t, true, "127.0.0.0/8", header.Bytes()))
+}
+
+func TestProxyProtocolWithoutHeader(t *testing.T) {
+	addr := remoteAddrOverProxyProtocol(t, true, "127.0.0.0/8", nil)
+	assert.Equal(t, true, strings.HasPrefix(addr, "127.0.0.1:"))
+}
+
+func TestProxyProtocolFromUntrustedPeer(t *testing.T) {
+	// the header is ignored, and the request still served
+	header := []byte("PROXY TCP4 203.0.113.7 127.0.0.1 51234 4180\r\n")
+	addr := remoteAddrOverProxyProtocol(t, true, "10.0.0.0/8", header)
+	assert.Equal(t, true, strings.HasPrefix(addr, "127.0.0.1:"))
+}
+
+func TestProxyProtocolDisabled(t *testing.T) {
+	header := []byte("PROXY TCP4 203.0.113.7 127.0.0.1 51234 4180\r\n")
+	assert.NotEqual(t, "203.0.113.7:51234", remoteAddrOverProxyProtocol(t, false, "127.0.0.0/8", header))
+}
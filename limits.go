@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// upstreamTimeouts bound how long the proxy waits to connect to an upstream
+// and for its response headers once the request has been sent. Zero keeps
+// the http.DefaultTransport behaviour.
+type upstreamTimeouts struct {
+	dial           time.Duration
+	responseHeader time.Duration
+}
+
+func (t upstreamTimeouts) empty() bool {
+	return t.dial == 0 && t.responseHeader == 0
+}
+
+// apply sets the timeouts on a transport cloned from http.DefaultTransport.
+// The dialer keeps the default keep-alive so only the timeout changes.
+func (t upstreamTimeouts) apply(transport *http.Transport) {
+	if t.dial != 0 && transport.DialContext != nil {
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, t.dial)
+			defer cancel()
+			return dial(ctx, network, addr)
+		}
+	}
+	if t.responseHeader != 0 {
+		transport.ResponseHeaderTimeout = t.responseHeader
+	}
+}
+
+// parseServerLimits checks the listener timeouts, request size limits and
+// upstream timeouts
+func parseServerLimits(o *Options, msgs []string) []string {
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"read-timeout", o.ReadTimeout},
+		{"read-header-timeout", o.ReadHeaderTimeout},
+		{"write-timeout", o.WriteTimeout},
+		{"idle-timeout", o.IdleTimeout},
+		{"upstream-dial-timeout", o.UpstreamDialTimeout},
+		{"upstream-response-timeout", o.UpstreamResponseTimeout},
+	} {
+		if d.value < 0 {
+			msgs = append(msgs, fmt.Sprintf("%s must not be negative: %s", d.name, d.value))
+		}
+	}
+	if o.MaxHeaderBytes < 0 {
+		msgs = append(msgs, "max-header-bytes must not be negative")
+	}
+	if o.MaxRequestBodySize < 0 {
+		msgs = append(msgs, "max-request-body-size must not be negative")
+	}
+	o.upstreamTimeouts = upstreamTimeouts{
+		dial:           o.UpstreamDialTimeout,
+		responseHeader: o.UpstreamResponseTimeout,
+	}
+	return msgs
+}
+
+// newServer returns an http.Server for h with the configured timeouts and
+// header size limit
+func (s *Server) newServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadTimeout:       s.Opts.ReadTimeout,
+		ReadHeaderTimeout: s.Opts.ReadHeaderTimeout,
+		WriteTimeout:      s.Opts.WriteTimeout,
+		IdleTimeout:       s.Opts.IdleTimeout,
+		MaxHeaderBytes:    s.Opts.MaxHeaderBytes,
+	}
+}
+
+// MaxRequestBodyHandler limits request bodies to max bytes. Requests that
+// declare a larger Content-Length are refused with 413 Request Entity Too
+// Large before reaching h; other bodies fail to read past the limit.
+func MaxRequestBodyHandler(max int64, h http.Handler) http.Handler {
+	if max == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.ContentLength > max {
+			http.Error(rw, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = http.MaxBytesReader(rw, req.Body, max)
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestServerLimitsValidation(t *testing.T) {
+	o := testOptions()
+	o.ReadTimeout = -time.Second
+	o.MaxRequestBodySize = -1
+	o.UpstreamResponseTimeout = -time.Second
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"read-timeout must not be negative: -1s",
+		"upstream-response-timeout must not be negative: -1s",
+		"max-request-body-size must not be negative",
+	}), err.Error())
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	o := testOptions()
+	o.ReadTimeout = time.Minute
+	o.WriteTimeout = 2 * time.Minute
+	o.IdleTimeout = 3 * time.Minute
+	o.MaxHeaderBytes = 8192
+	assert.Equal(t, nil, o.Validate())
+
+	srv := (&Server{Opts: o}).newServer(http.NotFoundHandler())
+	assert.Equal(t, time.Minute, srv.ReadTimeout)
+	assert.Equal(t, 10*time.Second, srv.ReadHeaderTimeout)
+	assert.Equal(t, 2*time.Minute, srv.WriteTimeout)
+	assert.Equal(t, 3*time.Minute, srv.IdleTimeout)
+	assert.Equal(t, 8192, srv.MaxHeaderBytes)
+}
+
+func TestMaxRequestBodyHandler(t *testing.T) {
+	var readErr error
+	h := MaxRequestBodyHandler(8, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, readErr = ioutil.ReadAll(req.Body)
+	}))
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("POST", "/upload", strings.NewReader("12345678")))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, nil, readErr)
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("POST", "/upload", strings.NewReader("123456789")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+
+	// without a Content-Length the body is cut off at the limit
+	req := httptest.NewRequest("POST", "/upload", ioutil.NopCloser(bytes.NewBufferString("123456789")))
+	req.ContentLength = -1
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	assert.NotEqual(t, nil, readErr)
+}
+
+func TestUpstreamResponseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"/"}
+	opts.UpstreamResponseTimeout = 50 * time.Millisecond
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/slow", nil))
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	o := testOptions()
+	o.UpstreamDialTimeout = 5 * time.Second
+	o.UpstreamResponseTimeout = time.Minute
+	o.Upstreams = nil
+	o.Routes = []RouteOptions{
+		{Path: "/reports/", Upstream: "http://127.0.0.1:8080/", ResponseTimeout: "5m"},
+		{Path: "/", Upstream: "http://127.0.0.1:8081/"},
+	}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, upstreamTimeouts{5 * time.Second, 5 * time.Minute}, o.routes[0].timeouts)
+	assert.Equal(t, upstreamTimeouts{5 * time.Second, time.Minute}, o.routes[1].timeouts)
+
+	o.Routes = []RouteOptions{{Path: "/", Upstream: "http://127.0.0.1:8080/", DialTimeout: "soon"}}
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{`invalid route[0] dial_timeout="soon"`}), err.Error())
+}
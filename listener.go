@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenControl returns a net.ListenConfig Control function that applies
+// socket options to listeners before they are bound.
+func listenControl(reusePort bool) func(network, address string, c syscall.RawConn) error {
+	if !reusePort {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
+
+// setListenBacklog resizes the accept queue of a listening socket. Linux
+// allows listen(2) to be called again on a listening socket to adjust it.
+func setListenBacklog(ln net.Listener, backlog int) error {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		opErr = unix.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"log"
+	"net"
+	"syscall"
+)
+
+func listenControl(reusePort bool) func(network, address string, c syscall.RawConn) error {
+	if reusePort {
+		log.Printf("WARNING: reuse-port is not supported on this platform; ignoring")
+	}
+	return nil
+}
+
+func setListenBacklog(ln net.Listener, backlog int) error {
+	log.Printf("WARNING: listen-backlog is not supported on this platform; ignoring")
+	return nil
+}
@@ -0,0 +1,302 @@
+// Package logger writes the proxy's standard, auth and request logs. Each
+// stream can be sent to its own writer and formatted either with a text
+// template or as one JSON object per line.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// AuthStatus is the outcome recorded with an auth log entry
+type AuthStatus string
+
+const (
+	AuthSuccess AuthStatus = "AuthSuccess"
+	AuthFailure AuthStatus = "AuthFailure"
+	AuthError   AuthStatus = "AuthError"
+)
+
+const (
+	DefaultStandardFormat = "{{.Timestamp}} {{if .File}}{{.File}}: {{end}}{{.Message}}"
+	DefaultAuthFormat     = "{{.Client}} - {{.Username}} [{{.Timestamp}}] [{{.Status}}] {{.Message}}"
+	DefaultRequestFormat  = "{{.Client}} - {{.Username}} [{{.Timestamp}}] {{.Host}} {{.RequestMethod}} {{.Upstream}} {{printf \"%q\" .RequestURI}} {{.Protocol}} {{printf \"%q\" .UserAgent}} {{.StatusCode}} {{.ResponseSize}} {{printf \"%0.3f\" .RequestDuration}}"
+
+	standardTimeFormat = "2006/01/02 15:04:05"
+	requestTimeFormat  = "02/Jan/2006:15:04:05 -0700"
+)
+
+// Config describes the format and destination of each log stream. Empty
+// formats use the defaults and nil writers use stderr for the standard log
+// and stdout for the others.
+type Config struct {
+	JSON bool
+
+	StandardEnabled bool
+	StandardFormat  string
+	StandardOutput  io.Writer
+
+	AuthEnabled bool
+	AuthFormat  string
+	AuthOutput  io.Writer
+
+	RequestEnabled bool
+	RequestFormat  string
+	RequestOutput  io.Writer
+
+	// ExcludePaths are request paths that are left out of the request log
+	ExcludePaths []string
+}
+
+// StandardFields are available to the standard log template
+type StandardFields struct {
+	Timestamp string `json:"timestamp"`
+	File      string `json:"file,omitempty"`
+	Message   string `json:"message"`
+}
+
+// AuthFields are available to the auth log template
+type AuthFields struct {
+	Client        string     `json:"client"`
+	Host          string     `json:"host"`
+	Protocol      string     `json:"protocol"`
+	RequestMethod string     `json:"request_method"`
+	Timestamp     string     `json:"timestamp"`
+	Username      string     `json:"username"`
+	Status        AuthStatus `json:"status"`
+	Message       string     `json:"message"`
+	RequestID     string     `json:"request_id,omitempty"`
+}
+
+// RequestFields are available to the request log template
+type RequestFields struct {
+	Client          string  `json:"client"`
+	Host            string  `json:"host"`
+	Protocol        string  `json:"protocol"`
+	RequestDuration float64 `json:"request_duration"`
+	RequestMethod   string  `json:"request_method"`
+	RequestURI      string  `json:"request_uri"`
+	ResponseSize    int     `json:"response_size"`
+	StatusCode      int     `json:"status_code"`
+	Timestamp       string  `json:"timestamp"`
+	Upstream        string  `json:"upstream"`
+	UserAgent       string  `json:"user_agent"`
+	Username        string  `json:"username"`
+	RequestID       string  `json:"request_id,omitempty"`
+}
+
+type stream struct {
+	enabled  bool
+	writer   io.Writer
+	template *template.Template
+}
+
+// Logger writes entries to the configured streams. It is safe for
+// concurrent use.
+type Logger struct {
+	mu           sync.Mutex
+	json         bool
+	std          stream
+	auth         stream
+	req          stream
+	excludePaths map[string]bool
+	now          func() time.Time
+}
+
+// New creates a Logger, returning an error if a template can't be parsed
+func New(c Config) (*Logger, error) {
+	l := &Logger{
+		json:         c.JSON,
+		excludePaths: make(map[string]bool),
+		now:          time.Now,
+	}
+	var err error
+	if l.std, err = newStream("standard", c.StandardEnabled, c.StandardFormat,
+		DefaultStandardFormat, c.StandardOutput, os.Stderr); err != nil {
+		return nil, err
+	}
+	if l.auth, err = newStream("auth", c.AuthEnabled, c.AuthFormat,
+		DefaultAuthFormat, c.AuthOutput, os.Stdout); err != nil {
+		return nil, err
+	}
+	if l.req, err = newStream("request", c.RequestEnabled, c.RequestFormat,
+		DefaultRequestFormat, c.RequestOutput, os.Stdout); err != nil {
+		return nil, err
+	}
+	for _, path := range c.ExcludePaths {
+		l.excludePaths[path] = true
+	}
+	return l, nil
+}
+
+func newStream(name string, enabled bool, format, defaultFormat string, w, defaultWriter io.Writer) (stream, error) {
+	if format == "" {
+		format = defaultFormat
+	}
+	t, err := template.New(name).Parse(format)
+	if err != nil {
+		return stream{}, fmt.Errorf("error parsing %s logging format: %s", name, err)
+	}
+	if w == nil {
+		w = defaultWriter
+	}
+	return stream{enabled: enabled, writer: w, template: t}, nil
+}
+
+func (l *Logger) timestamp(t time.Time, format string) string {
+	if l.json {
+		return t.Format(time.RFC3339Nano)
+	}
+	return t.Format(format)
+}
+
+func (l *Logger) write(s stream, fields interface{}) {
+	var buf bytes.Buffer
+	if l.json {
+		json.NewEncoder(&buf).Encode(fields)
+	} else {
+		if err := s.template.Execute(&buf, fields); err != nil {
+			fmt.Fprintf(&buf, "error executing logging template: %s", err)
+		}
+		buf.WriteByte('\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s.writer.Write(buf.Bytes())
+}
+
+// Output writes a standard log entry. file is the source location of the
+// caller and may be empty.
+func (l *Logger) Output(file, message string) {
+	if !l.std.enabled {
+		return
+	}
+	l.write(l.std, StandardFields{
+		Timestamp: l.timestamp(l.now(), standardTimeFormat),
+		File:      file,
+		Message:   message,
+	})
+}
+
+// Write implements io.Writer so the Logger can be the output of the
+// standard library's log package. Entries are expected to be prefixed by
+// the short file name, as with log.Lshortfile.
+func (l *Logger) Write(b []byte) (int, error) {
+	message := strings.TrimSuffix(string(b), "\n")
+	var file string
+	if i := strings.Index(message, ": "); i > 0 && !strings.Contains(message[:i], " ") &&
+		strings.Contains(message[:i], ".go:") {
+		file, message = message[:i], message[i+2:]
+	}
+	l.Output(file, message)
+	return len(b), nil
+}
+
+// PrintAuthf writes an auth log entry for req
+func (l *Logger) PrintAuthf(username string, req *http.Request, status AuthStatus, format string, a ...interface{}) {
+	if !l.auth.enabled {
+		return
+	}
+	if username == "" {
+		username = "-"
+	}
+	l.write(l.auth, AuthFields{
+		Client:        clientIP(req),
+		Host:          req.Host,
+		Protocol:      req.Proto,
+		RequestMethod: req.Method,
+		Timestamp:     l.timestamp(l.now(), requestTimeFormat),
+		Username:      username,
+		Status:        status,
+		Message:       fmt.Sprintf(format, a...),
+		RequestID:     req.Header.Get("X-Request-Id"),
+	})
+}
+
+// PrintReq writes a request log entry. ts is the time the request started
+// and u its URL before any handler modified it.
+func (l *Logger) PrintReq(username, upstream string, req *http.Request, u url.URL, ts time.Time, status int, size int) {
+	if !l.req.enabled || l.excludePaths[u.Path] {
+		return
+	}
+	if username == "" {
+		username = "-"
+	}
+	if upstream == "" {
+		upstream = "-"
+	}
+	if u.User != nil && username == "-" {
+		if name := u.User.Username(); name != "" {
+			username = name
+		}
+	}
+	l.write(l.req, RequestFields{
+		Client:          clientIP(req),
+		Host:            req.Host,
+		Protocol:        req.Proto,
+		RequestDuration: float64(l.now().Sub(ts)) / float64(time.Second),
+		RequestMethod:   req.Method,
+		RequestURI:      u.RequestURI(),
+		ResponseSize:    size,
+		StatusCode:      status,
+		Timestamp:       l.timestamp(ts, requestTimeFormat),
+		Upstream:        upstream,
+		UserAgent:       req.UserAgent(),
+		Username:        username,
+		RequestID:       req.Header.Get("X-Request-Id"),
+	})
+}
+
+func clientIP(req *http.Request) string {
+	client := req.Header.Get("X-Real-IP")
+	if client == "" {
+		client = req.RemoteAddr
+	}
+	if c, _, err := net.SplitHostPort(client); err == nil {
+		client = c
+	}
+	return client
+}
+
+var (
+	stdMu sync.RWMutex
+	std   *Logger
+)
+
+func init() {
+	std, _ = New(Config{StandardEnabled: true, AuthEnabled: true, RequestEnabled: true})
+}
+
+// SetDefault replaces the logger used by the package level functions
+func SetDefault(l *Logger) {
+	stdMu.Lock()
+	defer stdMu.Unlock()
+	std = l
+}
+
+// Default returns the logger used by the package level functions
+func Default() *Logger {
+	stdMu.RLock()
+	defer stdMu.RUnlock()
+	return std
+}
+
+// PrintAuthf writes an auth log entry with the default logger
+func PrintAuthf(username string, req *http.Request, status AuthStatus, format string, a ...interface{}) {
+	Default().PrintAuthf(username, req, status, format, a...)
+}
+
+// PrintReq writes a request log entry with the default logger
+func PrintReq(username, upstream string, req *http.Request, u url.URL, ts time.Time, status int, size int) {
+	Default().PrintReq(username, upstream, req, u, ts, status, size)
+}
@@ -0,0 +1,132 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+var testTime = time.Date(2015, time.March, 19, 17, 20, 19, 0, time.FixedZone("EDT", -4*60*60))
+
+func testLogger(t *testing.T, c Config) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	c.StandardOutput, c.AuthOutput, c.RequestOutput = &buf, &buf, &buf
+	l, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return testTime }
+	return l, &buf
+}
+
+func testRequest() *http.Request {
+	req, _ := http.NewRequest("GET", "http://example.com/foo/bar?baz=1", nil)
+	req.RemoteAddr = "127.0.0.1:41234"
+	req.Header.Set("User-Agent", "curl/7.43.0")
+	return req
+}
+
+func TestRequestLogDefaultFormat(t *testing.T) {
+	l, buf := testLogger(t, Config{RequestEnabled: true})
+	req := testRequest()
+	l.PrintReq("michael.bland@gsa.gov", "127.0.0.1:8080", req, *req.URL,
+		testTime.Add(-1500*time.Millisecond), 200, 42)
+	assert.Equal(t, "127.0.0.1 - michael.bland@gsa.gov [19/Mar/2015:17:20:17 -0400] "+
+		"example.com GET 127.0.0.1:8080 \"/foo/bar?baz=1\" HTTP/1.1 \"curl/7.43.0\" 200 42 1.500\n",
+		buf.String())
+}
+
+func TestRequestLogCustomFormat(t *testing.T) {
+	l, buf := testLogger(t, Config{
+		RequestEnabled: true,
+		RequestFormat:  "{{.RequestMethod}} {{.RequestURI}} {{.StatusCode}} {{.Username}} {{.Upstream}}",
+	})
+	req := testRequest()
+	l.PrintReq("", "", req, *req.URL, testTime, 404, 0)
+	assert.Equal(t, "GET /foo/bar?baz=1 404 - -\n", buf.String())
+}
+
+func TestRequestLogExcludePaths(t *testing.T) {
+	l, buf := testLogger(t, Config{RequestEnabled: true, ExcludePaths: []string{"/ping"}})
+	req, _ := http.NewRequest("GET", "http://example.com/ping", nil)
+	l.PrintReq("", "", req, *req.URL, testTime, 200, 2)
+	assert.Equal(t, "", buf.String())
+
+	req = testRequest()
+	l.PrintReq("", "", req, *req.URL, testTime, 200, 2)
+	assert.NotEqual(t, "", buf.String())
+}
+
+func TestRequestLogJSON(t *testing.T) {
+	l, buf := testLogger(t, Config{JSON: true, RequestEnabled: true})
+	req := testRequest()
+	req.Header.Set("X-Real-IP", "10.0.0.1")
+	req.Header.Set("X-Request-Id", "req-1")
+	l.PrintReq("michael.bland@gsa.gov", "127.0.0.1:8080", req, *req.URL, testTime, 200, 42)
+
+	var fields RequestFields
+	assert.Equal(t, nil, json.Unmarshal(buf.Bytes(), &fields))
+	assert.Equal(t, RequestFields{
+		Client:        "10.0.0.1",
+		Host:          "example.com",
+		Protocol:      "HTTP/1.1",
+		RequestMethod: "GET",
+		RequestURI:    "/foo/bar?baz=1",
+		ResponseSize:  42,
+		StatusCode:    200,
+		Timestamp:     "2015-03-19T17:20:19-04:00",
+		Upstream:      "127.0.0.1:8080",
+		UserAgent:     "curl/7.43.0",
+		Username:      "michael.bland@gsa.gov",
+		RequestID:     "req-1",
+	}, fields)
+}
+
+func TestAuthLog(t *testing.T) {
+	l, buf := testLogger(t, Config{AuthEnabled: true})
+	l.PrintAuthf("michael.bland@gsa.gov", testRequest(), AuthFailure, "Permission Denied: %q", "x")
+	assert.Equal(t, "127.0.0.1 - michael.bland@gsa.gov [19/Mar/2015:17:20:19 -0400] "+
+		"[AuthFailure] Permission Denied: \"x\"\n", buf.String())
+}
+
+func TestDisabledStreams(t *testing.T) {
+	l, buf := testLogger(t, Config{})
+	req := testRequest()
+	l.PrintAuthf("", req, AuthSuccess, "authenticated")
+	l.PrintReq("", "", req, *req.URL, testTime, 200, 0)
+	l.Output("", "hello")
+	assert.Equal(t, "", buf.String())
+}
+
+func TestStandardLogWriter(t *testing.T) {
+	l, buf := testLogger(t, Config{StandardEnabled: true})
+	std := log.New(l, "", log.Lshortfile)
+	std.Printf("hello world")
+	assert.Equal(t, true, strings.HasPrefix(buf.String(), "2015/03/19 17:20:19 logger_test.go:"))
+	assert.Equal(t, true, strings.HasSuffix(buf.String(), ": hello world\n"))
+
+	buf.Reset()
+	l.Write([]byte("no file: here\n"))
+	assert.Equal(t, "2015/03/19 17:20:19 no file: here\n", buf.String())
+}
+
+func TestStandardLogJSON(t *testing.T) {
+	l, buf := testLogger(t, Config{JSON: true, StandardEnabled: true})
+	log.New(l, "", log.Lshortfile).Printf("hello world")
+
+	var fields StandardFields
+	assert.Equal(t, nil, json.Unmarshal(buf.Bytes(), &fields))
+	assert.Equal(t, "hello world", fields.Message)
+	assert.Equal(t, "2015-03-19T17:20:19-04:00", fields.Timestamp)
+}
+
+func TestInvalidFormat(t *testing.T) {
+	_, err := New(Config{AuthFormat: "{{.Username"})
+	assert.NotEqual(t, nil, err)
+}
@@ -6,12 +6,11 @@ package main
 import (
 	"bufio"
 	"errors"
-	"fmt"
-	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"time"
+
+	"github.com/bitly/oauth2_proxy/logger"
 )
 
 // responseLogger is wrapper of http.ResponseWriter that keeps track of its HTTP status
@@ -38,6 +37,14 @@ func (l *responseLogger) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return hijacker.Hijack()
 }
 
+// Flush sends buffered data to the client, so that streamed responses
+// aren't held up by the log wrapper
+func (l *responseLogger) Flush() {
+	if flusher, ok := l.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func (l *responseLogger) ExtractGAPMetadata() {
 	upstream := l.w.Header().Get("GAP-Upstream-Address")
 	if upstream != "" {
@@ -76,69 +83,20 @@ func (l *responseLogger) Size() int {
 	return l.size
 }
 
-// loggingHandler is the http.Handler implementation for LoggingHandlerTo and its friends
+// loggingHandler is the http.Handler implementation for LoggingHandler
 type loggingHandler struct {
-	writer  io.Writer
 	handler http.Handler
-	enabled bool
 }
 
-func LoggingHandler(out io.Writer, h http.Handler, v bool) http.Handler {
-	return loggingHandler{out, h, v}
+// LoggingHandler writes a request log entry for each request served by h
+func LoggingHandler(h http.Handler) http.Handler {
+	return loggingHandler{h}
 }
 
 func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	t := time.Now()
 	url := *req.URL
-	logger := &responseLogger{w: w}
-	h.handler.ServeHTTP(logger, req)
-	if !h.enabled {
-		return
-	}
-	logLine := buildLogLine(logger.authInfo, logger.upstream, req, url, t, logger.Status(), logger.Size())
-	h.writer.Write(logLine)
-}
-
-// Log entry for req similar to Apache Common Log Format.
-// ts is the timestamp with which the entry should be logged.
-// status, size are used to provide the response HTTP status and size.
-func buildLogLine(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int) []byte {
-	if username == "" {
-		username = "-"
-	}
-	if upstream == "" {
-		upstream = "-"
-	}
-	if url.User != nil && username == "-" {
-		if name := url.User.Username(); name != "" {
-			username = name
-		}
-	}
-
-	client := req.Header.Get("X-Real-IP")
-	if client == "" {
-		client = req.RemoteAddr
-	}
-
-	if c, _, err := net.SplitHostPort(client); err == nil {
-		client = c
-	}
-
-	duration := float64(time.Now().Sub(ts)) / float64(time.Second)
-
-	logLine := fmt.Sprintf("%s - %s [%s] %s %s %s %q %s %q %d %d %0.3f\n",
-		client,
-		username,
-		ts.Format("02/Jan/2006:15:04:05 -0700"),
-		req.Host,
-		req.Method,
-		upstream,
-		url.RequestURI(),
-		req.Proto,
-		req.UserAgent(),
-		status,
-		size,
-		duration,
-	)
-	return []byte(logLine)
+	rl := &responseLogger{w: w}
+	h.handler.ServeHTTP(rl, req)
+	logger.PrintReq(rl.authInfo, rl.upstream, req, url, t, rl.Status(), rl.Size())
 }
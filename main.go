@@ -4,12 +4,15 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/bitly/oauth2_proxy/logger"
 	"github.com/mreiferson/go-options"
 )
 
@@ -19,74 +22,225 @@ func main() {
 
 	emailDomains := StringArray{}
 	upstreams := StringArray{}
+	cookieSecrets := StringArray{}
+	cookieDomains := StringArray{}
+	httpsRedirectorSkip := StringArray{}
 	skipAuthRegex := StringArray{}
+	skipAuthRoutes := StringArray{}
+	apiRoutes := StringArray{}
+	extraJwtIssuers := StringArray{}
+	injectRequestHeaders := StringArray{}
+	injectResponseHeaders := StringArray{}
+	stripRequestHeaders := StringArray{}
+	signatureHeaders := StringArray{}
 	googleGroups := StringArray{}
+	gitlabGroups := StringArray{}
+	gitlabProjects := StringArray{}
+	keycloakRoles := StringArray{}
+	allowedGroups := StringArray{}
 	letsEncryptHosts := StringArray{}
+	excludeLoggingPaths := StringArray{}
+	tlsCipherSuites := StringArray{}
+	trustedProxies := StringArray{}
+	trustedIPs := StringArray{}
+	streamContentTypes := StringArray{}
+	sessionMemcachedServers := StringArray{}
+	groupQuotas := StringArray{}
+	maintenancePaths := StringArray{}
+	maintenanceAllowedGroups := StringArray{}
 
-	config := flagSet.String("config", "", "path to config file")
+	config := flagSet.String("config", "", "path to config file, in YAML if it ends in .yaml or .yml, otherwise TOML")
 	showVersion := flagSet.Bool("version", false, "print version string")
 
-	flagSet.String("http-address", "127.0.0.1:4180", "[http://]<addr>:<port> or unix://<path> to listen on for HTTP clients")
-	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients")
-	flagSet.String("https-redirector-address", ":80", "<addr>:<port> to listen on for HTTPS clients")
+	flagSet.String("http-address", "127.0.0.1:4180", "[http://]<addr>:<port> or unix://<path> to listen on for HTTP clients; comma separated to listen on several")
+	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients; comma separated to listen on several")
+	flagSet.String("https-redirector-address", ":80", "<addr>:<port> to listen on for HTTPS clients; comma separated to listen on several")
 	flagSet.Bool("redirect-http-to-https", false, "Listens on the port specified in https-redirector-address and rewrites to the host and protocol of redirect-url.")
+	flagSet.Int("https-redirector-status", 308, "HTTP status used by the https redirector; 307 and 308 preserve the request method and body")
+	flagSet.Var(&httpsRedirectorSkip, "https-redirector-skip", "host, /path or host/path the https redirector answers with 200 OK instead of redirecting (may be given multiple times)")
 	flagSet.String("tls-cert", "", "path to certificate file")
 	flagSet.String("tls-key", "", "path to private key file")
+	flagSet.String("tls-min-version", "1.2", "minimum TLS version accepted by the HTTPS listener (1.0, 1.1, 1.2 or 1.3)")
+	flagSet.String("tls-max-version", "", "maximum TLS version accepted by the HTTPS listener; defaults to the highest supported")
+	flagSet.Var(&tlsCipherSuites, "tls-cipher-suite", "restrict TLS 1.2 and earlier connections to this cipher suite, ie: TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (may be given multiple times)")
+	flagSet.Bool("disable-http2", false, "don't offer HTTP/2 on the HTTPS listener")
+	flagSet.Int("listen-backlog", 0, "size of the accept queue for HTTP/HTTPS listeners; 0 uses the system default (linux only)")
+	flagSet.Duration("graceful-shutdown-timeout", 10*time.Second, "how long to wait for in-flight requests to complete on SIGTERM/SIGINT before exiting")
+	flagSet.Bool("reuse-port", false, "set SO_REUSEPORT on HTTP/HTTPS listeners so multiple processes can share a port (linux only)")
+	flagSet.Bool("enable-proxy-protocol", false, "read the client address from a PROXY protocol v1 or v2 header sent by a trusted-proxy on the HTTP and HTTPS listeners")
+	flagSet.Bool("enable-h2c", false, "accept HTTP/2 without TLS (h2c) on the HTTP listener, such as from gRPC clients or a load balancer")
 
 	flagSet.Bool("letsencrypt-enabled", false, "use Let's Encrypt ACME certificates")
 	flagSet.String("letsencrypt-admin-email", "", "Admin contact email; sent to Let's Encrypt during registration during registration")
 	flagSet.Var(&letsEncryptHosts, "letsencrypt-host", "Obtain TLS certificates for this domain with Let's Encrypt (may be given multiple times)")
 	flagSet.String("letsencrypt-cache-dir", "./", "Let's Encrypt certificate cache directory")
+	flagSet.String("letsencrypt-challenge", "tls-alpn-01", "ACME challenge used to obtain Let's Encrypt certificates: tls-alpn-01 or dns-01 (required for wildcard hosts)")
+	flagSet.String("letsencrypt-dns-provider", "", "DNS provider that publishes dns-01 challenge records: cloudflare or exec")
+	flagSet.String("letsencrypt-dns-exec", "", "command run with present|cleanup, the record name and value to publish dns-01 challenge records for the exec DNS provider")
+	flagSet.String("letsencrypt-dns-api-token", "", "API token of the DNS provider")
+	flagSet.Duration("letsencrypt-dns-delay", 10*time.Second, "time to wait for dns-01 challenge records to propagate before they are checked")
 
 	flagSet.String("redirect-url", "", "the OAuth Redirect URL. ie: \"https://internalapp.yourcompany.com/oauth2/callback\"")
+	flagSet.String("canonical-url", "", "redirect requests for any other scheme or host to this URL before authenticating, except /ping and /ready; X-Forwarded-Proto is only honoured from trusted-proxy addresses. ie: \"https://www.yourcompany.com\"")
 	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User and X-Auth-Request-Email response headers (useful in Nginx auth_request mode)")
-	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint or file:// paths for static files. Routing is based on the path")
+	flagSet.Bool("auth-only", false, "only authenticate requests for an external proxy via the /oauth2/auth endpoint (nginx auth_request, Traefik forwardAuth, Envoy ext_authz); no upstream is required")
+	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint, h2c:// urls of HTTP/2 servers without TLS, unix:// socket paths, file:// paths for static files, or srv:// and k8s:// upstreams discovered from DNS SRV records or Kubernetes endpoints. Routing is based on the path")
 	flagSet.Bool("pass-basic-auth", true, "pass HTTP Basic Auth, X-Forwarded-User and X-Forwarded-Email information to upstream")
 	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User and X-Forwarded-Email information to upstream")
 	flagSet.String("basic-auth-password", "", "the password to set when passing the HTTP Basic Auth header")
 	flagSet.Bool("pass-access-token", false, "pass OAuth access_token to upstream via X-Forwarded-Access-Token header")
+	flagSet.Bool("pass-authorization-header", false, "pass the OIDC id_token, or the access token if there is none, to upstream as an \"Authorization: Bearer\" header")
+	flagSet.Duration("hsts-max-age", time.Duration(0), "send Strict-Transport-Security with this max-age on HTTPS responses; disabled if 0")
+	flagSet.Bool("hsts-include-subdomains", false, "add includeSubDomains to the Strict-Transport-Security header")
+	flagSet.String("frame-options", "", "send X-Frame-Options with this value, DENY or SAMEORIGIN, on responses that don't set it; disabled if empty")
+	flagSet.Bool("content-type-nosniff", false, "send \"X-Content-Type-Options: nosniff\" on responses that don't set it")
+	flagSet.String("sign-in-content-security-policy", "", "Content-Security-Policy header for the sign in page; disabled if empty")
+	flagSet.Bool("strip-authorization-header", false, "remove the Authorization header sent by the client from authenticated requests before they are proxied")
 	flagSet.Bool("pass-host-header", true, "pass the request Host Header to upstream")
+	flagSet.Bool("pass-websockets", true, "proxy WebSocket upgrade requests to http and https upstreams")
+	flagSet.Bool("intercept-upstream-errors", false, "serve the error page in place of 502, 503 and 504 responses from upstreams")
+	flagSet.Duration("flush-interval", time.Duration(0), "flush upstream responses to the client at this interval; 0 to only flush streamed responses")
+	flagSet.Var(&streamContentTypes, "stream-content-type", "flush each write of upstream responses with this content type, ie: application/x-ndjson or text/* (may be given multiple times)")
+	flagSet.Duration("read-timeout", time.Duration(0), "maximum duration for reading an entire request, including the body; 0 for no limit")
+	flagSet.Duration("read-header-timeout", 10*time.Second, "maximum duration for reading request headers; 0 for no limit")
+	flagSet.Duration("write-timeout", time.Duration(0), "maximum duration before timing out writes of a response, including proxied responses; 0 for no limit")
+	flagSet.Duration("idle-timeout", time.Duration(0), "maximum duration to wait for the next request on a keep-alive connection; 0 to use read-timeout")
+	flagSet.Int("max-header-bytes", 0, "maximum size in bytes of request headers; 0 for the 1MB default")
+	flagSet.Int64("max-request-body-size", 0, "maximum size in bytes of request bodies; 0 for no limit")
+	flagSet.Duration("upstream-dial-timeout", time.Duration(0), "maximum duration to wait for a connection to an upstream; 0 for the 30s default")
+	flagSet.Duration("upstream-response-timeout", time.Duration(0), "maximum duration to wait for an upstream's response headers after sending the request; 0 for no limit")
+	flagSet.String("upstream-health-check-path", "", "path requested on each http, https or unix socket upstream to check its health, such as /healthz; upstreams failing the check are skipped while others are available")
+	flagSet.Duration("upstream-health-check-interval", 10*time.Second, "how often upstreams are health checked, which is also the timeout of each check")
+	flagSet.Duration("upstream-discovery-interval", 30*time.Second, "how often the SRV records of srv:// upstreams are looked up, and how long to wait before retrying a failed watch of a k8s:// upstream")
+	flagSet.String("kubernetes-api-url", "", "the Kubernetes API server to discover k8s:// upstreams from, such as http://127.0.0.1:8001 for kubectl proxy; defaults to the cluster the proxy is running in, as its service account")
 	flagSet.Var(&skipAuthRegex, "skip-auth-regex", "bypass authentication for requests path's that match (may be given multiple times)")
+	flagSet.Var(&skipAuthRoutes, "skip-auth-route", "bypass authentication for requests that match the method & path. Format: method=path_regex OR path_regex alone for all methods (may be given multiple times)")
+	flagSet.Var(&apiRoutes, "api-route", "respond with 401 Unauthorized rather than redirecting to sign in for requests whose path matches (may be given multiple times)")
 	flagSet.Bool("skip-provider-button", false, "will skip sign-in-page to directly reach the next step: oauth/start")
 	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests")
+	flagSet.Bool("skip-jwt-bearer-tokens", false, "will skip requests that have verified JWT bearer tokens (the oidc provider's and any extra-jwt-issuer)")
+	flagSet.Var(&extraJwtIssuers, "extra-jwt-issuer", "trust bearer tokens from this issuer, as issuer=audience or issuer=audience=jwks_url (may be given multiple times)")
+	flagSet.Var(&injectRequestHeaders, "inject-request-header", "set a header on authenticated requests to the upstream, as name=value where value is a template executed with the session, ie: X-Forwarded-Id-Token={{.IDToken}} (may be given multiple times)")
+	flagSet.Var(&injectResponseHeaders, "inject-response-header", "set a header on responses to authenticated requests, as name=value where value is a template executed with the session (may be given multiple times)")
+	flagSet.Var(&stripRequestHeaders, "strip-request-header", "remove this header from client requests before they are proxied (may be given multiple times)")
 	flagSet.Bool("ssl-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS")
+	flagSet.String("upstream-tls-cert", "", "path to a client certificate presented to https upstreams")
+	flagSet.String("upstream-tls-key", "", "path to the private key of upstream-tls-cert")
+	flagSet.String("upstream-ca-file", "", "path to a PEM bundle of CAs used to verify https upstreams instead of the system roots")
 
+	flagSet.Var(&allowedGroups, "allowed-group", "restrict logins to members of this group as reported by the provider (may be given multiple times)")
 	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain (may be given multiple times). Use * to authenticate any email")
 	flagSet.String("azure-tenant", "common", "go to a tenant-specific or common (tenant-independent) endpoint.")
+	flagSet.Bool("azure-v2", false, "use the Azure AD v2.0 endpoints and Microsoft Graph")
+	flagSet.Bool("azure-graph-groups", false, "look up Azure AD groups with Microsoft Graph for users in too many groups to be listed in the id_token")
 	flagSet.String("github-org", "", "restrict logins to members of this organisation")
 	flagSet.String("github-team", "", "restrict logins to members of this team")
+	flagSet.String("bitbucket-workspace", "", "restrict logins to members of this Bitbucket workspace")
+	flagSet.String("bitbucket-repository", "", "restrict logins to users with access to any of these repositories in bitbucket-workspace, separated by a comma")
+	flagSet.String("login-gov-private-key-file", "", "path to the PEM encoded RSA private key registered with login.gov, used instead of a client secret")
+	flagSet.String("login-gov-acr-values", "", "identity assurance level to request from login.gov (default \"http://idmanagement.gov/ns/assurance/ial/1\")")
+	flagSet.String("gitlab-url", "", "base URL of a self-hosted GitLab instance (default https://gitlab.com)")
+	flagSet.Var(&gitlabGroups, "gitlab-group", "restrict logins to members of this GitLab group, as path[=access_level] (may be given multiple times)")
+	flagSet.Var(&gitlabProjects, "gitlab-project", "restrict logins to members of this GitLab project, as group/project[=access_level] (may be given multiple times)")
 	flagSet.Var(&googleGroups, "google-group", "restrict logins to members of this google group (may be given multiple times).")
 	flagSet.String("google-admin-email", "", "the google admin to impersonate for api calls")
 	flagSet.String("google-service-account-json", "", "the path to the service account json credentials")
+	flagSet.String("keycloak-url", "", "base URL of the Keycloak server, including /auth for versions that serve it there (ie: https://keycloak.example.com)")
+	flagSet.String("keycloak-realm", "", "Keycloak realm to sign users in with")
+	flagSet.Var(&keycloakRoles, "keycloak-role", "restrict logins to users with this Keycloak realm role, or client role as client:role (may be given multiple times)")
 	flagSet.String("client-id", "", "the OAuth Client ID: ie: \"123456.apps.googleusercontent.com\"")
 	flagSet.String("client-secret", "", "the OAuth Client Secret")
 	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
-	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption")
+	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -B\" for bcrypt or \"htpasswd -s\" for SHA encryption")
 	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file is provided")
 	flagSet.String("custom-templates-dir", "", "path to custom html templates")
 	flagSet.String("footer", "", "custom footer string. Use \"-\" to disable default footer.")
+	flagSet.String("app-name", "", "name of the application, shown on the sign in page")
+	flagSet.String("logo-url", "", "URL of a logo to show on the sign in and error pages")
+	flagSet.String("provider-button-text", "", "text of the sign in button (default \"Sign in with a <provider> Account\")")
 	flagSet.String("proxy-prefix", "/oauth2", "the url root path that this proxy should be nested under (e.g. /<oauth2>/sign_in)")
 
 	flagSet.String("cookie-name", "_oauth2_proxy", "the name of the cookie that the oauth_proxy creates")
-	flagSet.String("cookie-secret", "", "the seed string for secure cookies (optionally base64 encoded)")
-	flagSet.String("cookie-domain", "", "an optional cookie domain to force cookies to (ie: .yourcompany.com)*")
+	flagSet.Var(&cookieSecrets, "cookie-secret", "the seed string for secure cookies (optionally base64 encoded). May be given multiple times to rotate secrets: the first signs new cookies and the others are still accepted")
+	flagSet.String("cookie-secret-file", "", "read the cookie secret from this file instead of cookie-secret")
+	flagSet.String("cookie-secret-kms-url", "", "unwrap the cookie secret by POSTing the ciphertext in cookie-secret-kms-ciphertext-file to this KMS endpoint")
+	flagSet.String("cookie-secret-kms-token", "", "bearer token used to authenticate to cookie-secret-kms-url")
+	flagSet.String("cookie-secret-kms-ciphertext-file", "", "path to the base64 encoded, KMS wrapped cookie secret")
+	flagSet.Duration("cookie-secret-refresh", time.Duration(0), "re-read the cookie secret from its file or KMS after this duration; 0 to disable")
+	flagSet.Var(&cookieDomains, "cookie-domain", "an optional cookie domain to force cookies to (ie: .yourcompany.com). May be given multiple times; the longest domain matching the request host is used")
+	flagSet.String("cookie-samesite", "", "set SameSite on cookies to lax, strict or none; unset if empty")
+	flagSet.Bool("cookie-partitioned", false, "mark cookies Partitioned so browsers that block third party cookies still send them to embedded apps; requires cookie-secure")
 	flagSet.Duration("cookie-expire", time.Duration(168)*time.Hour, "expire timeframe for cookie")
 	flagSet.Duration("cookie-refresh", time.Duration(0), "refresh the cookie after this duration; 0 to disable")
 	flagSet.Bool("cookie-secure", true, "set secure (HTTPS) cookie flag")
 	flagSet.Bool("cookie-httponly", true, "set HttpOnly cookie flag")
+	flagSet.Bool("cookie-compress", false, "gzip session cookies before encrypting them, for sessions with large tokens")
+	flagSet.Var(&sessionMemcachedServers, "session-memcached-server", "keep sessions in this memcached server, as host:port or a unix socket path, with only a ticket for them in the cookie (may be given multiple times)")
+	flagSet.Int("session-limit", 0, "sign out a user's least recently used sessions beyond this many; 0 for no limit. Requires session-memcached-server")
+	flagSet.Bool("session-management", false, "let users list and sign out their sessions at /oauth2/sessions. Requires session-memcached-server")
+	flagSet.Bool("bearer-sessions", false, "issue session tokens from /oauth2/token in exchange for a provider code, accepted as \"Authorization: Bearer\" headers in place of the session cookie. Requires session-memcached-server")
 
-	flagSet.Bool("request-logging", true, "Log requests to stdout")
+	flagSet.String("logging-format", "text", "format of log entries: text (using the logging format templates) or json")
+	flagSet.Int("logging-max-size", 100, "maximum size in megabytes of a log file before it is rotated")
+	flagSet.Int("logging-max-age", 7, "maximum number of days to retain rotated log files")
+	flagSet.Int("logging-max-backups", 0, "maximum number of rotated log files to retain; 0 retains all within logging-max-age")
+	flagSet.Bool("logging-compress", false, "gzip rotated log files")
+	flagSet.Bool("standard-logging", true, "log standard runtime information")
+	flagSet.String("standard-logging-format", logger.DefaultStandardFormat, "template for standard log lines")
+	flagSet.String("standard-logging-file", "", "write standard log lines to this file instead of stderr")
+	flagSet.Bool("auth-logging", true, "log authentication attempts")
+	flagSet.String("auth-logging-format", logger.DefaultAuthFormat, "template for authentication log lines")
+	flagSet.String("auth-logging-file", "", "write authentication log lines to this file instead of stdout")
+	flagSet.Bool("request-logging", true, "log HTTP requests")
+	flagSet.String("request-logging-format", logger.DefaultRequestFormat, "template for HTTP request log lines")
+	flagSet.String("request-logging-file", "", "write HTTP request log lines to this file instead of stdout")
+	flagSet.Var(&excludeLoggingPaths, "exclude-logging-path", "don't log requests to this path (may be given multiple times)")
+	flagSet.Bool("silence-ping-logging", false, "don't log requests to the ping endpoint")
+	flagSet.String("audit-log", "", "write authentication audit events as JSON to this file, syslog:// URL or http(s):// webhook URL; disabled if empty")
+	flagSet.String("metrics-address", "", "<addr>:<port> to serve Prometheus metrics on at /metrics; disabled if empty")
+	flagSet.String("tracing-endpoint", "", "OTLP/HTTP collector URL to export OpenTelemetry traces to, ie: \"http://localhost:4318\"; disabled if empty")
+	flagSet.Float64("tracing-sample-rate", 1, "fraction of new traces to sample, between 0 and 1")
+	flagSet.String("admin-address", "", "<addr>:<port> to serve the session administration API on; disabled if empty")
+	flagSet.String("admin-token", "", "bearer token required by the session administration API")
+	flagSet.Int("rate-limit", 0, "maximum sign in and callback requests per client IP in each rate-limit-window; 0 to disable")
+	flagSet.Duration("rate-limit-window", time.Minute, "window that rate-limit requests are counted in")
+	flagSet.String("rate-limit-redis-url", "", "count rate-limited requests in this Redis server (ie: redis://127.0.0.1:6379/0) to share limits between instances; counted in memory if empty")
+	flagSet.Int("user-quota", 0, "maximum requests each authenticated user can make a minute; 0 for no quota")
+	flagSet.Bool("response-cache", false, "cache GET responses from upstreams as their Cache-Control headers allow")
+	flagSet.Int("response-cache-size", 64, "megabytes of responses to cache in memory")
+	flagSet.String("response-cache-redis-url", "", "cache responses in this Redis server (ie: redis://127.0.0.1:6379/0) to share them between instances; cached in memory if empty")
+	flagSet.String("maintenance-file", "", "serve the maintenance page while this file exists, showing its contents as the message")
+	flagSet.Var(&maintenancePaths, "maintenance-path", "path prefix, optionally preceded by a host, served the maintenance page while in maintenance; all paths if none (may be given multiple times)")
+	flagSet.Var(&maintenanceAllowedGroups, "maintenance-allowed-group", "let members of this group through to upstreams while in maintenance (may be given multiple times)")
+	flagSet.String("authz-webhook-url", "", "POST each authenticated request's user and metadata to this URL and let it allow or deny the request; disabled if empty")
+	flagSet.Duration("authz-webhook-timeout", 2*time.Second, "timeout for authz-webhook-url requests")
+	flagSet.Bool("authz-webhook-fail-open", false, "allow requests when authz-webhook-url can't be reached or gives an invalid answer, instead of failing them")
+	flagSet.Var(&groupQuotas, "group-quota", "maximum requests a minute for members of a group (ie: \"contractors=60\"); overrides user-quota, 0 for no quota (may be given multiple times)")
+	flagSet.Var(&trustedIPs, "trusted-ip", "address or CIDR range of clients that are allowed without authenticating (may be given multiple times)")
+	flagSet.Var(&trustedProxies, "trusted-proxy", "address or CIDR range of a proxy trusted to set X-Forwarded-For and X-Request-Id (may be given multiple times)")
 
 	flagSet.String("provider", "google", "OAuth provider")
+	flagSet.String("oidc-issuer-url", "", "OpenID Connect issuer URL used for discovery (ie: https://accounts.example.com)")
+	flagSet.String("oidc-email-claim", "email", "id_token claim containing the user's email address")
+	flagSet.String("oidc-groups-claim", "groups", "id_token claim containing the user's groups")
 	flagSet.String("login-url", "", "Authentication endpoint")
 	flagSet.String("redeem-url", "", "Token redemption endpoint")
 	flagSet.String("profile-url", "", "Profile access endpoint")
 	flagSet.String("resource", "", "The resource that is protected (Azure AD only)")
 	flagSet.String("validate-url", "", "Access token validation endpoint")
+	flagSet.String("logout-url", "", "Provider end session endpoint for provider-logout")
+	flagSet.Bool("provider-logout", false, "on sign out, also sign out of the provider by redirecting to its logout endpoint")
 	flagSet.String("scope", "", "OAuth scope specification")
 	flagSet.String("approval-prompt", "force", "OAuth approval_prompt")
+	flagSet.Bool("pkce", false, "send a PKCE S256 code challenge when signing in and its code verifier when redeeming the code")
 
 	flagSet.String("signature-key", "", "GAP-Signature request signature key (algorithm:secretkey)")
+	flagSet.Var(&signatureHeaders, "signature-header", "sign this request header in GAP-Signature instead of the default headers (may be given multiple times)")
+	flagSet.String("upstream-jwt-key-file", "", "path to a PEM encoded RSA or ECDSA private key to sign a JWT carrying the user's identity to upstreams with")
+	flagSet.String("upstream-jwt-header", "GAP-Identity", "request header to send the upstream JWT in")
+	flagSet.String("upstream-jwt-issuer", "oauth2_proxy", "issuer (iss) of the upstream JWT")
+	flagSet.String("upstream-jwt-audience", "", "audience (aud) of the upstream JWT; defaults to the request's host")
+	flagSet.Duration("upstream-jwt-expiry", time.Minute, "how long the upstream JWT is valid for")
 
 	flagSet.Parse(os.Args[1:])
 
@@ -95,25 +249,156 @@ func main() {
 		return
 	}
 
+	opts, err := loadOptions(flagSet, *config)
+	if err != nil {
+		log.Printf("%s", err)
+		os.Exit(1)
+	}
+	// logging is configured once; a reload keeps the original streams
+	logger.SetDefault(opts.logger)
+	log.SetFlags(log.Lshortfile)
+	log.SetOutput(opts.logger)
+	done := make(chan bool)
+	proxy, err := newProxyHandler(opts, done)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err)
+	}
+	var current <-chan bool = done
+	handler := NewReloadHandler(proxy, done, func(done <-chan bool) (http.Handler, error) {
+		opts, err := loadOptions(flagSet, *config)
+		if err != nil {
+			return nil, err
+		}
+		h, err := newProxyHandler(opts, done)
+		if err != nil {
+			return nil, err
+		}
+		// pools, log files and the like that only the old configuration
+		// used are closed once it has been replaced
+		retired := resources.retire(opts.usedResources())
+		go func(old <-chan bool) {
+			<-old
+			closeResources(retired)
+		}(current)
+		current = done
+		return h, nil
+	})
+	handler.ReloadOnSignal(syscall.SIGHUP)
+	RevokeSessionsOnSignal(registeredSessions, revokeSessionsSignals...)
+
+	s := &Server{
+		Handler: handler,
+		Opts:    opts,
+	}
+	s.ListenAndServe()
+	handler.Close()
+	tracersRunning.Wait()
+}
+
+// loadOptions resolves and validates Options from the config file,
+// environment and command line flags
+func loadOptions(flagSet *flag.FlagSet, config string) (*Options, error) {
 	opts := NewOptions()
 
 	cfg := make(EnvOptions)
-	if *config != "" {
-		_, err := toml.DecodeFile(*config, &cfg)
+	if config == "" {
+		config = os.Getenv(envPrefix + "CONFIG")
+	}
+	if isYAMLConfig(config) {
+		var err error
+		cfg, err = loadYAMLConfig(config, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config file %s - %s", config, err)
+		}
+	} else if config != "" {
+		_, err := toml.DecodeFile(config, &cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config file %s - %s", config, err)
+		}
+		opts.Routes, err = loadRoutes(config)
 		if err != nil {
-			log.Fatalf("ERROR: failed to load config file %s - %s", *config, err)
+			return nil, fmt.Errorf("failed to load routes from config file %s - %s", config, err)
 		}
+		opts.Policies, err = loadPolicies(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load policies from config file %s - %s", config, err)
+		}
+		opts.Providers, err = loadProviders(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load providers from config file %s - %s", config, err)
+		}
+		opts.Applications, err = loadApplications(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load applications from config file %s - %s", config, err)
+		}
+		opts.ClaimHeaders, err = loadClaimHeaders(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load claim headers from config file %s - %s", config, err)
+		}
+	}
+	if err := cfg.LoadEnvForStruct(opts); err != nil {
+		return nil, err
 	}
-	cfg.LoadEnvForStruct(opts)
 	options.Resolve(opts, flagSet, cfg)
 
-	err := opts.Validate()
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// newProxyHandler builds the handler for opts, dispatching requests for
+// the hosts of each application to its own proxy. Background tasks it
+// starts are stopped when done is closed.
+func newProxyHandler(opts *Options, done <-chan bool) (http.Handler, error) {
+	// the session registry is shared by every application, which have the
+	// same cookie-expire and session store as the top level
+	registeredSessions.SetTTL(opts.CookieExpire)
+	registeredSessions.SetStore(opts.sessionStore)
+
+	handler, err := newApplicationHandler(opts, done)
 	if err != nil {
-		log.Printf("%s", err)
-		os.Exit(1)
+		return nil, err
 	}
-	validator := NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
+	if len(opts.applications) != 0 {
+		vhosts := &virtualHostHandler{hosts: make(map[string]http.Handler), fallback: handler}
+		for _, app := range opts.applications {
+			h, err := newApplicationHandler(app.opts, done)
+			if err != nil {
+				return nil, err
+			}
+			for _, host := range app.hosts {
+				log.Printf("serving host %q with client ID %s", host, app.opts.ClientID)
+				vhosts.hosts[host] = h
+			}
+		}
+		handler = vhosts
+	}
+	if opts.MetricsAddress != "" {
+		handler = MetricsHandler(handler)
+	}
+	handler = LoggingHandler(RequestIDHandler(handler, opts.trustedProxies))
+	if opts.TracingEndpoint != "" {
+		tp, err := newTracerProvider(opts.TracingEndpoint, opts.TracingSampleRate)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("exporting traces to %s", opts.TracingEndpoint)
+		shutdownTracerOnDone(tp, done)
+		handler = TracingHandler(tp, handler)
+	}
+	return handler, nil
+}
+
+// newApplicationHandler builds the proxy for a single set of options
+func newApplicationHandler(opts *Options, done <-chan bool) (http.Handler, error) {
+	var err error
+	if opts.cookieKeyring != nil && opts.CookieSecretRefresh != time.Duration(0) {
+		opts.cookieKeyring.RefreshEvery(opts.CookieSecretRefresh, done)
+	}
+	validator := newValidatorImpl(opts.EmailDomains, opts.AuthenticatedEmailsFile, done, func() {})
 	oauthproxy := NewOAuthProxy(opts, validator)
+	oauthproxy.CheckUpstreams(done)
 
 	if len(opts.EmailDomains) != 0 && opts.AuthenticatedEmailsFile == "" {
 		if len(opts.EmailDomains) > 1 {
@@ -128,13 +413,15 @@ func main() {
 		oauthproxy.HtpasswdFile, err = NewHtpasswdFromFile(opts.HtpasswdFile)
 		oauthproxy.DisplayHtpasswdForm = opts.DisplayHtpasswdForm
 		if err != nil {
-			log.Fatalf("FATAL: unable to open %s %s", opts.HtpasswdFile, err)
+			return nil, fmt.Errorf("unable to open %s %s", opts.HtpasswdFile, err)
 		}
 	}
 
-	s := &Server{
-		Handler: LoggingHandler(os.Stdout, oauthproxy, opts.RequestLogging),
-		Opts:    opts,
+	var handler http.Handler = MaxRequestBodyHandler(opts.MaxRequestBodySize, oauthproxy)
+	if opts.canonicalURL != nil {
+		log.Printf("redirecting requests to canonical url %s", opts.canonicalURL)
+		handler = NewCanonicalHandler(opts.canonicalURL, opts.trustedProxies,
+			[]string{oauthproxy.PingPath, oauthproxy.ReadyPath}, handler)
 	}
-	s.ListenAndServe()
+	return SecurityHeadersHandler(opts.securityHeaders, opts.trustedProxies, handler), nil
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// statusMaintenance is returned by Authenticate when the request is for a
+// path under maintenance and the user isn't allowed through. Like
+// statusPolicyDenied it is never sent to clients.
+const statusMaintenance = -http.StatusServiceUnavailable
+
+// maintenanceFileInterval is how often maintenance-file is checked for
+const maintenanceFileInterval = time.Second
+
+const defaultMaintenanceMessage = "This service is down for maintenance, please try again later."
+
+// maintenanceSwitch outlives configuration reloads so that maintenance
+// turned on through the admin API stays on
+var maintenanceSwitch = &maintenanceState{}
+
+// maintenanceState is maintenance mode as turned on or off through the
+// admin API, with the message to show while it is on
+type maintenanceState struct {
+	mu      sync.RWMutex
+	on      bool
+	message string
+}
+
+func (s *maintenanceState) Set(on bool, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.on, s.message = on, message
+}
+
+func (s *maintenanceState) Get() (bool, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.on, s.message
+}
+
+// maintenanceMode serves a maintenance page in place of the upstreams for
+// its paths, or every path when it has none, while it is switched on
+// through the admin API or its file exists. Members of its allowed groups
+// are let through.
+type maintenanceMode struct {
+	state         *maintenanceState
+	file          string
+	paths         []string
+	allowedGroups []string
+
+	mu          sync.Mutex
+	checked     time.Time
+	fileExists  bool
+	fileMessage string
+	now         func() time.Time
+}
+
+// active reports whether maintenance mode is on, and the message to show
+func (m *maintenanceMode) active() (bool, string) {
+	if on, message := m.state.Get(); on {
+		return true, message
+	}
+	if m.file == "" {
+		return false, ""
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now := m.now(); now.Sub(m.checked) >= maintenanceFileInterval {
+		b, err := ioutil.ReadFile(m.file)
+		m.checked, m.fileExists, m.fileMessage = now, err == nil, strings.TrimSpace(string(b))
+	}
+	return m.fileExists, m.fileMessage
+}
+
+// covers reports whether req is for one of the paths under maintenance,
+// which are path prefixes optionally preceded by a host
+func (m *maintenanceMode) covers(req *http.Request) bool {
+	if len(m.paths) == 0 {
+		return true
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, p := range m.paths {
+		if strings.HasPrefix(p, "/") {
+			if strings.HasPrefix(req.URL.Path, p) {
+				return true
+			}
+		} else if strings.HasPrefix(host+req.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocks reports whether req is kept from its upstream by maintenance. s is
+// nil for requests that aren't authenticated.
+func (m *maintenanceMode) blocks(req *http.Request, s *providers.SessionState) bool {
+	if m == nil || !m.covers(req) {
+		return false
+	}
+	if on, _ := m.active(); !on {
+		return false
+	}
+	if s != nil {
+		for _, g := range s.Groups {
+			for _, allowed := range m.allowedGroups {
+				if g == allowed {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// MaintenancePage responds to a request kept from its upstream by
+// maintenance with the maintenance.html template
+func (p *OAuthProxy) MaintenancePage(rw http.ResponseWriter, req *http.Request) {
+	_, message := p.maintenance.active()
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	if p.isAPIRequest(req) {
+		p.ErrorPage(rw, req, http.StatusServiceUnavailable, "Service Unavailable", message)
+		return
+	}
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	t := struct {
+		pageBranding
+		Message string
+	}{
+		pageBranding: p.branding(),
+		Message:      message,
+	}
+	p.templates.ExecuteTemplate(rw, "maintenance.html", t)
+}
+
+func parseMaintenance(o *Options, msgs []string) []string {
+	for _, p := range o.MaintenancePaths {
+		if p == "" || strings.Contains(p, "://") {
+			msgs = append(msgs, fmt.Sprintf(
+				"maintenance-path must be a path prefix such as /admin/, optionally preceded by a host: %q", p))
+		}
+	}
+	o.maintenance = &maintenanceMode{
+		state:         maintenanceSwitch,
+		file:          o.MaintenanceFile,
+		paths:         o.MaintenancePaths,
+		allowedGroups: o.MaintenanceAllowedGroups,
+		now:           time.Now,
+	}
+	return msgs
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestMaintenanceOptions(t *testing.T) {
+	o := testOptions()
+	o.MaintenancePaths = []string{"/admin/", "wiki.example.com/", "", "http://wiki.example.com/"}
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`maintenance-path must be a path prefix such as /admin/, optionally preceded by a host: ""`,
+		`maintenance-path must be a path prefix such as /admin/, optionally preceded by a host: "http://wiki.example.com/"`,
+	}), err.Error())
+}
+
+func TestMaintenanceCovers(t *testing.T) {
+	m := &maintenanceMode{paths: []string{"/reports/", "wiki.example.com/"}}
+	covers := func(host, path string) bool {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Host = host
+		return m.covers(req)
+	}
+	assert.Equal(t, true, covers("app.example.com", "/reports/daily"))
+	assert.Equal(t, true, covers("wiki.example.com:8443", "/"))
+	assert.Equal(t, false, covers("app.example.com", "/"))
+	assert.Equal(t, false, covers("app.example.com", "/reportsx"))
+
+	m.paths = nil
+	assert.Equal(t, true, covers("app.example.com", "/"))
+}
+
+func TestMaintenanceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "maintenance")
+
+	now := time.Date(2015, time.March, 19, 17, 20, 15, 0, time.UTC)
+	m := &maintenanceMode{state: &maintenanceState{}, file: file, now: func() time.Time { return now }}
+	on, _ := m.active()
+	assert.Equal(t, false, on)
+
+	ioutil.WriteFile(file, []byte("Back at 18:00 UTC\n"), 0644)
+	// the file is only checked for once a second
+	on, _ = m.active()
+	assert.Equal(t, false, on)
+	now = now.Add(time.Second)
+	on, message := m.active()
+	assert.Equal(t, true, on)
+	assert.Equal(t, "Back at 18:00 UTC", message)
+
+	// the admin API takes precedence
+	m.state.Set(true, "Upgrading the database")
+	_, message = m.active()
+	assert.Equal(t, "Upgrading the database", message)
+}
+
+func TestAuthenticateUnderMaintenance(t *testing.T) {
+	state := &maintenanceState{}
+	test := func(path string, groups []string, header ...string) *httptest.ResponseRecorder {
+		pc_test := NewProcessCookieTestWithDefaults()
+		pc_test.proxy.maintenance = &maintenanceMode{
+			state:         state,
+			paths:         []string{"/reports/"},
+			allowedGroups: []string{"ops"},
+			now:           time.Now,
+		}
+		pc_test.req, _ = http.NewRequest("GET", path, nil)
+		for i := 0; i < len(header); i += 2 {
+			pc_test.req.Header.Set(header[i], header[i+1])
+		}
+		pc_test.SaveSession(&providers.SessionState{
+			Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+			Groups: groups}, time.Now())
+		pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+		return pc_test.rw
+	}
+
+	assert.Equal(t, http.StatusAccepted, test("/oauth2/auth/reports/", nil).Code)
+
+	state.Set(true, "")
+	assert.Equal(t, http.StatusServiceUnavailable, test("/oauth2/auth/reports/", nil).Code)
+	assert.Equal(t, http.StatusServiceUnavailable, test("/oauth2/auth//dashboard/../reports/", nil).Code)
+	assert.Equal(t, http.StatusAccepted, test("/oauth2/auth/reports/", []string{"devs", "ops"}).Code)
+	assert.Equal(t, http.StatusAccepted, test("/oauth2/auth/dashboard/", nil).Code)
+
+	rw := test("/reports/daily", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, true, strings.Contains(rw.Body.String(), defaultMaintenanceMessage))
+
+	state.Set(true, "Back at 18:00 UTC")
+	rw = test("/reports/daily", nil, "Accept", "application/json")
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, true, strings.Contains(rw.Body.String(), `"message":"Back at 18:00 UTC"`))
+}
+
+func TestMaintenanceSkipsAuthenticatedRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"^/public/"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	proxy.maintenance.state = &maintenanceState{}
+
+	get := func() int {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/public/status", nil))
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusOK, get())
+	proxy.maintenance.state.Set(true, "")
+	assert.Equal(t, http.StatusServiceUnavailable, get())
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	state := &maintenanceState{}
+	h := AdminHandler(newSessionRegistry(), state, "s3cr3t")
+	do := func(method, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/maintenance", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cr3t")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, `{"enabled":false}`+"\n", do("GET", "").Body.String())
+	assert.Equal(t, http.StatusNoContent, do("PUT", `{"message": "Back at 18:00 UTC"}`).Code)
+	on, message := state.Get()
+	assert.Equal(t, true, on)
+	assert.Equal(t, "Back at 18:00 UTC", message)
+	assert.Equal(t, `{"enabled":true,"message":"Back at 18:00 UTC"}`+"\n", do("GET", "").Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, do("PUT", "back soon").Code)
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "").Code)
+	on, _ = state.Get()
+	assert.Equal(t, false, on)
+	assert.Equal(t, http.StatusMethodNotAllowed, do("POST", "").Code)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// sessions that made a request within this window are counted as active
+const activeSessionWindow = 5 * time.Minute
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oauth2_proxy",
+		Name:      "requests_total",
+		Help:      "Total number of requests by method and response code.",
+	}, []string{"method", "code"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "oauth2_proxy",
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of requests proxied to each upstream.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"upstream"})
+
+	authenticationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oauth2_proxy",
+		Name:      "authentications_total",
+		Help:      "Total number of sign in attempts by method and result.",
+	}, []string{"method", "result"})
+
+	providerRefreshErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oauth2_proxy",
+		Name:      "provider_refresh_errors_total",
+		Help:      "Total number of errors refreshing sessions with the provider.",
+	}, []string{"provider"})
+
+	rateLimitedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oauth2_proxy",
+		Name:      "rate_limited_requests_total",
+		Help:      "Total number of requests rejected by the rate limit by path.",
+	}, []string{"path"})
+
+	quotaExceededTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "oauth2_proxy",
+		Name:      "quota_exceeded_requests_total",
+		Help:      "Total number of requests rejected because the user was over their quota.",
+	})
+
+	responseCacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oauth2_proxy",
+		Name:      "response_cache_requests_total",
+		Help:      "Total number of cacheable requests by whether they were served from the response cache.",
+	}, []string{"result"})
+
+	authzWebhookRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oauth2_proxy",
+		Name:      "authz_webhook_requests_total",
+		Help:      "Total number of authorization webhook requests by decision.",
+	}, []string{"result"})
+
+	upstreamHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oauth2_proxy",
+		Name:      "upstream_healthy",
+		Help:      "Whether each health checked upstream passed its last check.",
+	}, []string{"upstream"})
+
+	activeSessions = newSessionTracker(activeSessionWindow)
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal)
+	prometheus.MustRegister(upstreamDuration)
+	prometheus.MustRegister(authenticationsTotal)
+	prometheus.MustRegister(providerRefreshErrorsTotal)
+	prometheus.MustRegister(rateLimitedTotal)
+	prometheus.MustRegister(quotaExceededTotal)
+	prometheus.MustRegister(responseCacheRequestsTotal)
+	prometheus.MustRegister(authzWebhookRequestsTotal)
+	prometheus.MustRegister(upstreamHealthy)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "oauth2_proxy",
+		Name:      "active_sessions",
+		Help:      "Number of distinct users with an authenticated request in the last 5 minutes.",
+	}, func() float64 { return float64(activeSessions.Count()) }))
+}
+
+func recordAuthentication(method string, ok bool) {
+	result := "failure"
+	if ok {
+		result = "success"
+	}
+	authenticationsTotal.WithLabelValues(method, result).Inc()
+}
+
+// sessionTracker remembers when each user was last seen so that the number
+// of active sessions can be reported without a server side session store
+type sessionTracker struct {
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[string]time.Time
+}
+
+func newSessionTracker(window time.Duration) *sessionTracker {
+	return &sessionTracker{window: window, seen: make(map[string]time.Time)}
+}
+
+func (t *sessionTracker) Seen(user string) {
+	t.mu.Lock()
+	t.seen[user] = time.Now()
+	t.mu.Unlock()
+}
+
+// Count prunes users not seen within the window and returns the remainder
+func (t *sessionTracker) Count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := time.Now().Add(-t.window)
+	for user, ts := range t.seen {
+		if ts.Before(cutoff) {
+			delete(t.seen, user)
+		}
+	}
+	return len(t.seen)
+}
+
+// statusRecorder captures the response code for the requests_total metric
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("webserver doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type metricsHandler struct {
+	handler http.Handler
+}
+
+// MetricsHandler counts the requests served by h
+func MetricsHandler(h http.Handler) http.Handler {
+	return metricsHandler{h}
+}
+
+func (h metricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	recorder := &statusRecorder{ResponseWriter: w}
+	h.handler.ServeHTTP(recorder, req)
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	requestsTotal.WithLabelValues(methodLabel(req.Method), strconv.Itoa(status)).Inc()
+}
+
+// methodLabel returns the method label for requests made with method.
+// Clients can send any method, so methods other than the standard ones are
+// counted together as "other" to keep the number of series bounded.
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "CONNECT", "OPTIONS", "TRACE":
+		return method
+	}
+	return "other"
+}
+
+func (s *Server) ServeMetrics() {
+	ln, err := s.listen("tcp", s.Opts.MetricsAddress)
+	if err != nil {
+		log.Fatalf("FATAL: listen (%s) failed - %s", s.Opts.MetricsAddress, err)
+	}
+	log.Printf("metrics: listening on %s", ln.Addr())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Handler: mux}
+	if err := s.serve(srv, ln); err != nil {
+		log.Printf("ERROR: metrics.Serve() - %s", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsHandlerCountsRequests(t *testing.T) {
+	h := MetricsHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	ok := requestsTotal.WithLabelValues("GET", "200")
+	notFound := requestsTotal.WithLabelValues("GET", "404")
+	okBefore := testutil.ToFloat64(ok)
+	notFoundBefore := testutil.ToFloat64(notFound)
+
+	for _, path := range []string{"/", "/foo", "/missing"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		h.ServeHTTP(rw, req)
+	}
+
+	assert.Equal(t, okBefore+2, testutil.ToFloat64(ok))
+	assert.Equal(t, notFoundBefore+1, testutil.ToFloat64(notFound))
+}
+
+func TestMetricsHandlerDefaultStatus(t *testing.T) {
+	h := MetricsHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	counter := requestsTotal.WithLabelValues("HEAD", "200")
+	before := testutil.ToFloat64(counter)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("HEAD", "/", nil)
+	h.ServeHTTP(rw, req)
+
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+}
+
+func TestMetricsHandlerOtherMethods(t *testing.T) {
+	h := MetricsHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	counter := requestsTotal.WithLabelValues("other", "200")
+	before := testutil.ToFloat64(counter)
+
+	for _, method := range []string{"PROPFIND", "get", "XYZZY"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/", nil)
+		h.ServeHTTP(rw, req)
+	}
+
+	assert.Equal(t, before+3, testutil.ToFloat64(counter))
+	assert.Equal(t, "DELETE", methodLabel("DELETE"))
+}
+
+func TestRecordAuthentication(t *testing.T) {
+	success := authenticationsTotal.WithLabelValues("htpasswd", "success")
+	failure := authenticationsTotal.WithLabelValues("htpasswd", "failure")
+	successBefore := testutil.ToFloat64(success)
+	failureBefore := testutil.ToFloat64(failure)
+
+	recordAuthentication("htpasswd", true)
+	recordAuthentication("htpasswd", false)
+	recordAuthentication("htpasswd", false)
+
+	assert.Equal(t, successBefore+1, testutil.ToFloat64(success))
+	assert.Equal(t, failureBefore+2, testutil.ToFloat64(failure))
+}
+
+func TestSessionTracker(t *testing.T) {
+	tracker := newSessionTracker(time.Minute)
+	tracker.Seen("alice@example.com")
+	tracker.Seen("bob@example.com")
+	tracker.Seen("alice@example.com")
+	assert.Equal(t, 2, tracker.Count())
+
+	tracker.seen["bob@example.com"] = time.Now().Add(-2 * time.Minute)
+	assert.Equal(t, 1, tracker.Count())
+}
+
+func TestUpstreamDurationObserved(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer backend.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, backend.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.SkipAuthRegex = append(opts.SkipAuthRegex, "^/")
+	opts.Validate()
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "upstream", rw.Body.String())
+
+	u, _ := url.Parse(backend.URL)
+	assert.Equal(t, uint64(1), upstreamSampleCount(t, u.Host))
+}
+
+func upstreamSampleCount(t *testing.T, upstream string) uint64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "oauth2_proxy_upstream_request_duration_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "upstream" && label.GetValue() == upstream {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	b64 "encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -12,11 +16,14 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/18F/hmacauth"
 	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/logger"
 	"github.com/bitly/oauth2_proxy/providers"
+	oidc "github.com/coreos/go-oidc"
 )
 
 const SignatureHeader = "GAP-Signature"
@@ -38,61 +45,128 @@ type OAuthProxy struct {
 	CookieSeed     string
 	CookieName     string
 	CSRFCookieName string
-	CookieDomain   string
+	CookieDomains  []string
 	CookieSecure   bool
 	CookieHttpOnly bool
 	CookieExpire   time.Duration
 	CookieRefresh  time.Duration
+	CookieSameSite http.SameSite
 	Validator      func(string) bool
 
+	cookiePartitioned bool
+
 	RobotsPath        string
 	PingPath          string
+	ReadyPath         string
 	SignInPath        string
 	SignOutPath       string
 	OAuthStartPath    string
 	OAuthCallbackPath string
 	AuthOnlyPath      string
-
-	redirectURL         *url.URL // the url to receive requests at
-	provider            providers.Provider
-	ProxyPrefix         string
-	SignInMessage       string
-	HtpasswdFile        *HtpasswdFile
-	DisplayHtpasswdForm bool
-	serveMux            http.Handler
-	SetXAuthRequest     bool
-	PassBasicAuth       bool
-	SkipProviderButton  bool
-	PassUserHeaders     bool
-	BasicAuthPassword   string
-	PassAccessToken     bool
-	CookieCipher        *cookie.Cipher
-	skipAuthRegex       []string
-	skipAuthPreflight   bool
-	compiledRegex       []*regexp.Regexp
-	templates           *template.Template
-	Footer              string
+	SessionsPath      string
+	JWKSPath          string
+	TokenPath         string
+
+	redirectURL           *url.URL // the url to receive requests at
+	provider              providers.Provider
+	signInProviders       []*signInProvider
+	ProxyPrefix           string
+	SignInMessage         string
+	HtpasswdFile          *HtpasswdFile
+	DisplayHtpasswdForm   bool
+	serveMux              http.Handler
+	upstreamPools         []*upstreamPool
+	SetXAuthRequest       bool
+	PassBasicAuth         bool
+	SkipProviderButton    bool
+	PassUserHeaders       bool
+	BasicAuthPassword     string
+	PassAccessToken       bool
+	CookieCipher          *cookie.Cipher
+	CookieKeyring         *cookie.Keyring
+	cookieCiphers         cookieCiphers
+	AllowedGroups         []string
+	providerLogout        bool
+	passAuthorization     bool
+	stripAuthorization    bool
+	pkce                  bool
+	skipAuthRegex         []string
+	skipAuthPreflight     bool
+	interceptErrors       bool
+	claimHeaders          []claimHeader
+	upstreamJWT           *upstreamJWTSigner
+	compiledRegex         []*regexp.Regexp
+	skipAuthRoutes        []skipAuthRoute
+	apiRoutes             []*regexp.Regexp
+	jwtVerifiers          []*oidc.IDTokenVerifier
+	jwtEmailClaim         string
+	jwtGroupsClaim        string
+	refresher             *sessionRefresher
+	sessions              *sessionRegistry
+	rateLimiter           *rateLimiter
+	sessionStore          SessionStore
+	sessionLimit          int
+	sessionManagement     bool
+	bearerSessions        bool
+	quota                 *quota
+	maintenance           *maintenanceMode
+	authzWebhook          *authzWebhook
+	auditLog              *auditLog
+	injectRequestHeaders  []injectedHeader
+	injectResponseHeaders []injectedHeader
+	stripHeaders          []string
+	trustedProxies        []*net.IPNet
+	trustedIPs            []*net.IPNet
+	policies              []*policy
+	templates             *template.Template
+	Footer                string
+	AppName               string
+	LogoURL               string
+	ProviderButtonText    string
+	StaticPath            string
+	staticHandler         http.Handler
+	signInCSP             string
 }
 
 type UpstreamProxy struct {
-	upstream url.URL
-	handler  http.Handler
-	auth     hmacauth.HmacAuth
+	upstream   url.URL
+	handler    http.Handler
+	auth       hmacauth.HmacAuth
+	websockets bool
+	tlsConfig  *tls.Config
 }
 
 func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("GAP-Upstream-Address", u.upstream.Host)
+	defer func(start time.Time) {
+		upstreamDuration.WithLabelValues(u.metricsLabel()).Observe(time.Since(start).Seconds())
+	}(time.Now())
+	r, span := startUpstreamSpan(r, u.metricsLabel())
+	defer span.End()
 	if u.auth != nil {
 		r.Header.Set("GAP-Auth", w.Header().Get("GAP-Auth"))
 		u.auth.SignRequest(r)
 	}
 	if isWebsocketRequest(r) {
+		if !u.websockets {
+			http.Error(w, "websocket proxying disabled", http.StatusBadRequest)
+			return
+		}
 		u.handleWebsocket(w, r)
 	} else {
 		u.handler.ServeHTTP(w, r)
 	}
 }
 
+// metricsLabel identifies the upstream in metrics; file and unix socket
+// upstreams have no host
+func (u *UpstreamProxy) metricsLabel() string {
+	if u.upstream.Host != "" {
+		return u.upstream.Host
+	}
+	return u.upstream.String()
+}
+
 func NewReverseProxy(target *url.URL) (proxy *httputil.ReverseProxy) {
 	return httputil.NewSingleHostReverseProxy(target)
 }
@@ -115,51 +189,127 @@ func setProxyDirector(proxy *httputil.ReverseProxy) {
 		req.URL.RawQuery = ""
 	}
 }
-func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
-	return http.StripPrefix(path, http.FileServer(http.Dir(filesystemPath)))
+
+// newUpstreamProxy returns the proxy to an http, https, h2c or unix socket
+// upstream
+func newUpstreamProxy(opts *Options, u url.URL, tlsConfig *tls.Config, timeouts upstreamTimeouts,
+	flushInterval time.Duration, auth hmacauth.HmacAuth) (*UpstreamProxy, *httputil.ReverseProxy) {
+	target, transport := &u, newUpstreamTransport(tlsConfig, timeouts)
+	switch u.Scheme {
+	case "unix":
+		target, transport = unixSocketTarget(), newUnixSocketTransport(u.Path, timeouts)
+	case "h2c":
+		target, transport = h2cTarget(&u), newH2CTransport(timeouts)
+	}
+	proxy := NewReverseProxy(target)
+	proxy.Transport = transport
+	proxy.FlushInterval = flushInterval
+	if !opts.PassHostHeader {
+		setProxyUpstreamHostHeader(proxy, target)
+	} else {
+		setProxyDirector(proxy)
+	}
+	return &UpstreamProxy{u, streamResponses(proxy, opts.streamContentTypes), auth, opts.PassWebsockets, tlsConfig}, proxy
 }
 
 func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 	serveMux := http.NewServeMux()
+	var upstream http.Handler = serveMux
+	if opts.responseCache != nil {
+		upstream = opts.responseCache.handler(serveMux)
+	}
+	var upstreamPools []*upstreamPool
 	var auth hmacauth.HmacAuth
 	if sigData := opts.signatureData; sigData != nil {
 		auth = hmacauth.NewHmacAuth(sigData.hash, []byte(sigData.key),
-			SignatureHeader, SignatureHeaders)
+			SignatureHeader, sigData.headers)
 	}
 	for _, u := range opts.proxyURLs {
-		path := u.Path
+		path := upstreamPattern(u)
 		switch u.Scheme {
-		case "http", "https":
+		case "http", "https", "h2c":
 			u.Path = ""
 			log.Printf("mapping path %q => upstream %q", path, u)
-			proxy := NewReverseProxy(u)
-			if !opts.PassHostHeader {
-				setProxyUpstreamHostHeader(proxy, u)
-			} else {
-				setProxyDirector(proxy)
+			up, proxy := newUpstreamProxy(opts, *u, opts.upstreamTLSConfig, opts.upstreamTimeouts, opts.FlushInterval, auth)
+			pool := newUpstreamPool([]*UpstreamProxy{up}, []*httputil.ReverseProxy{proxy}, false, opts.upstreamHealthCheck)
+			upstreamPools = append(upstreamPools, pool)
+			serveMux.Handle(path, pool)
+		case "unix":
+			log.Printf("mapping path %q => unix socket %q", path, u.Path)
+			up, proxy := newUpstreamProxy(opts, *u, nil, opts.upstreamTimeouts, opts.FlushInterval, auth)
+			pool := newUpstreamPool([]*UpstreamProxy{up}, []*httputil.ReverseProxy{proxy}, false, opts.upstreamHealthCheck)
+			upstreamPools = append(upstreamPools, pool)
+			serveMux.Handle(path, pool)
+		case "srv", "srv+http", "srv+https", "srv+h2c", "k8s", "k8s+http", "k8s+https", "k8s+h2c":
+			d, err := newUpstreamDiscovery(opts, u)
+			if err != nil {
+				panic(fmt.Sprintf("invalid upstream %q %s", u, err))
 			}
-			serveMux.Handle(path,
-				&UpstreamProxy{*u, proxy, auth})
-		case "file":
-			if u.Fragment != "" {
-				path = u.Fragment
+			log.Printf("mapping path %q => discovered upstream %q", path, u)
+			d.build = func(target url.URL) (*UpstreamProxy, *httputil.ReverseProxy) {
+				return newUpstreamProxy(opts, target, opts.upstreamTLSConfig, opts.upstreamTimeouts, opts.FlushInterval, auth)
 			}
+			pool := newDiscoveredUpstreamPool(d, false, opts.upstreamHealthCheck)
+			upstreamPools = append(upstreamPools, pool)
+			serveMux.Handle(path, pool)
+		case "file":
 			log.Printf("mapping path %q => file system %q", path, u.Path)
 			proxy := NewFileServer(path, u.Path)
-			serveMux.Handle(path, &UpstreamProxy{*u, proxy, nil})
+			serveMux.Handle(path, &UpstreamProxy{*u, proxy, nil, false, nil})
 		default:
 			panic(fmt.Sprintf("unknown upstream protocol %s", u.Scheme))
 		}
 	}
+	for _, r := range opts.routes {
+		tlsConfig, timeouts, flushInterval := r.tlsConfig, r.timeouts, r.flushInterval
+		if flushInterval == 0 {
+			flushInterval = opts.FlushInterval
+		}
+		build := func(target url.URL) (*UpstreamProxy, *httputil.ReverseProxy) {
+			return newUpstreamProxy(opts, target, tlsConfig, timeouts, flushInterval, auth)
+		}
+		var pool *upstreamPool
+		if r.discovery != nil {
+			log.Printf("mapping route %q => discovered upstream %q", r.pattern, r.discovery.source)
+			d := *r.discovery
+			d.build = build
+			pool = newDiscoveredUpstreamPool(&d, r.failover, r.healthCheck)
+		} else {
+			var upstreams []*UpstreamProxy
+			var proxies []*httputil.ReverseProxy
+			for _, u := range r.upstreams {
+				log.Printf("mapping route %q => upstream %q", r.pattern, u)
+				up, proxy := build(*u)
+				upstreams = append(upstreams, up)
+				proxies = append(proxies, proxy)
+			}
+			pool = newUpstreamPool(upstreams, proxies, r.failover, r.healthCheck)
+		}
+		upstreamPools = append(upstreamPools, pool)
+		serveMux.Handle(r.pattern, &routeHandler{r, pool})
+	}
 	for _, u := range opts.CompiledRegex {
 		log.Printf("compiled skip-auth-regex => %q", u)
 	}
+	for _, r := range opts.skipAuthRoutes {
+		method := r.method
+		if method == "" {
+			method = "*"
+		}
+		log.Printf("compiled skip-auth-route => %s %q", method, r.regex)
+	}
+
+	var staticHandler http.Handler
+	if dir := staticDir(opts.CustomTemplatesDir); dir != "" {
+		log.Printf("serving static files from %q at %s/static/", dir, opts.ProxyPrefix)
+		staticHandler = NewFileServer(opts.ProxyPrefix+"/static", dir)
+	}
 
 	redirectURL := opts.redirectURL
 	redirectURL.Path = fmt.Sprintf("%s/callback", opts.ProxyPrefix)
 
 	log.Printf("OAuthProxy configured for %s Client ID: %s", opts.provider.Data().ProviderName, opts.ClientID)
-	domain := opts.CookieDomain
+	domain := strings.Join(opts.CookieDomains, ",")
 	if domain == "" {
 		domain = "<default>"
 	}
@@ -168,52 +318,104 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		refresh = fmt.Sprintf("after %s", opts.CookieRefresh)
 	}
 
-	log.Printf("Cookie settings: name:%s secure(https):%v httponly:%v expiry:%s domain:%s refresh:%s", opts.CookieName, opts.CookieSecure, opts.CookieHttpOnly, opts.CookieExpire, domain, refresh)
+	sameSite := opts.CookieSameSite
+	if sameSite == "" {
+		sameSite = "<default>"
+	}
+
+	log.Printf("Cookie settings: name:%s secure(https):%v httponly:%v expiry:%s domain:%s samesite:%s refresh:%s", opts.CookieName, opts.CookieSecure, opts.CookieHttpOnly, opts.CookieExpire, domain, sameSite, refresh)
 
 	var cipher *cookie.Cipher
-	if opts.PassAccessToken || (opts.CookieRefresh != time.Duration(0)) {
+	if opts.PassAccessToken || opts.PassAuthorizationHeader || (opts.CookieRefresh != time.Duration(0)) {
 		var err error
 		cipher, err = cookie.NewCipher(secretBytes(opts.CookieSecret))
 		if err != nil {
 			log.Fatal("cookie-secret error: ", err)
 		}
+		cipher.Compress = opts.CookieCompress
 	}
 
 	return &OAuthProxy{
 		CookieName:     opts.CookieName,
 		CSRFCookieName: fmt.Sprintf("%v_%v", opts.CookieName, "csrf"),
 		CookieSeed:     opts.CookieSecret,
-		CookieDomain:   opts.CookieDomain,
+		CookieDomains:  opts.CookieDomains,
 		CookieSecure:   opts.CookieSecure,
 		CookieHttpOnly: opts.CookieHttpOnly,
 		CookieExpire:   opts.CookieExpire,
 		CookieRefresh:  opts.CookieRefresh,
+		CookieSameSite: opts.cookieSameSite,
 		Validator:      validator,
 
+		cookiePartitioned: opts.CookiePartitioned,
+
 		RobotsPath:        "/robots.txt",
 		PingPath:          "/ping",
+		ReadyPath:         "/ready",
 		SignInPath:        fmt.Sprintf("%s/sign_in", opts.ProxyPrefix),
 		SignOutPath:       fmt.Sprintf("%s/sign_out", opts.ProxyPrefix),
 		OAuthStartPath:    fmt.Sprintf("%s/start", opts.ProxyPrefix),
 		OAuthCallbackPath: fmt.Sprintf("%s/callback", opts.ProxyPrefix),
 		AuthOnlyPath:      fmt.Sprintf("%s/auth", opts.ProxyPrefix),
-
-		ProxyPrefix:        opts.ProxyPrefix,
-		provider:           opts.provider,
-		serveMux:           serveMux,
-		redirectURL:        redirectURL,
-		skipAuthRegex:      opts.SkipAuthRegex,
-		skipAuthPreflight:  opts.SkipAuthPreflight,
-		compiledRegex:      opts.CompiledRegex,
-		SetXAuthRequest:    opts.SetXAuthRequest,
-		PassBasicAuth:      opts.PassBasicAuth,
-		PassUserHeaders:    opts.PassUserHeaders,
-		BasicAuthPassword:  opts.BasicAuthPassword,
-		PassAccessToken:    opts.PassAccessToken,
-		SkipProviderButton: opts.SkipProviderButton,
-		CookieCipher:       cipher,
-		templates:          loadTemplates(opts.CustomTemplatesDir),
-		Footer:             opts.Footer,
+		SessionsPath:      fmt.Sprintf("%s/sessions", opts.ProxyPrefix),
+		JWKSPath:          fmt.Sprintf("%s/jwks.json", opts.ProxyPrefix),
+		TokenPath:         fmt.Sprintf("%s/token", opts.ProxyPrefix),
+		StaticPath:        fmt.Sprintf("%s/static/", opts.ProxyPrefix),
+
+		ProxyPrefix:           opts.ProxyPrefix,
+		provider:              opts.provider,
+		signInProviders:       opts.signInProviders,
+		serveMux:              upstream,
+		upstreamPools:         upstreamPools,
+		redirectURL:           redirectURL,
+		skipAuthRegex:         opts.SkipAuthRegex,
+		skipAuthPreflight:     opts.SkipAuthPreflight,
+		interceptErrors:       opts.InterceptUpstreamErrors,
+		claimHeaders:          opts.claimHeaders,
+		upstreamJWT:           opts.upstreamJWT,
+		compiledRegex:         opts.CompiledRegex,
+		skipAuthRoutes:        opts.skipAuthRoutes,
+		apiRoutes:             opts.apiRoutes,
+		jwtVerifiers:          opts.jwtVerifiers,
+		jwtEmailClaim:         opts.OIDCEmailClaim,
+		jwtGroupsClaim:        opts.OIDCGroupsClaim,
+		refresher:             newSessionRefresher(),
+		sessions:              registeredSessions,
+		rateLimiter:           opts.rateLimiter,
+		sessionStore:          opts.sessionStore,
+		sessionLimit:          opts.SessionLimit,
+		sessionManagement:     opts.SessionManagement,
+		bearerSessions:        opts.BearerSessions,
+		quota:                 opts.quota,
+		maintenance:           opts.maintenance,
+		authzWebhook:          opts.authzWebhook,
+		auditLog:              opts.auditLog,
+		injectRequestHeaders:  opts.injectRequestHeaders,
+		injectResponseHeaders: opts.injectResponseHeaders,
+		stripHeaders:          opts.StripRequestHeaders,
+		trustedProxies:        opts.trustedProxies,
+		trustedIPs:            opts.trustedIPs,
+		policies:              opts.policies,
+		SetXAuthRequest:       opts.SetXAuthRequest,
+		PassBasicAuth:         opts.PassBasicAuth,
+		PassUserHeaders:       opts.PassUserHeaders,
+		BasicAuthPassword:     opts.BasicAuthPassword,
+		PassAccessToken:       opts.PassAccessToken,
+		SkipProviderButton:    opts.SkipProviderButton,
+		CookieCipher:          cipher,
+		CookieKeyring:         opts.cookieKeyring,
+		AllowedGroups:         opts.allowedGroups(),
+		providerLogout:        opts.ProviderLogout,
+		passAuthorization:     opts.PassAuthorizationHeader,
+		stripAuthorization:    opts.StripAuthorizationHeader,
+		pkce:                  opts.PKCE,
+		templates:             loadTemplates(opts.CustomTemplatesDir),
+		Footer:                opts.Footer,
+		AppName:               opts.AppName,
+		LogoURL:               opts.LogoURL,
+		ProviderButtonText:    opts.ProviderButtonText,
+		signInCSP:             opts.SignInContentSecurityPolicy,
+		staticHandler:         staticHandler,
 	}
 }
 
@@ -239,25 +441,90 @@ func (p *OAuthProxy) displayCustomLoginForm() bool {
 	return p.HtpasswdFile != nil && p.DisplayHtpasswdForm
 }
 
-func (p *OAuthProxy) redeemCode(host, code string) (s *providers.SessionState, err error) {
+func (p *OAuthProxy) redeemCode(provider providers.Provider, redirectURI, code, codeVerifier string) (s *providers.SessionState, err error) {
 	if code == "" {
 		return nil, errors.New("missing code")
 	}
-	redirectURI := p.GetRedirectURI(host)
-	s, err = p.provider.Redeem(redirectURI, code)
+	s, err = provider.Redeem(redirectURI, code, codeVerifier)
 	if err != nil {
 		return
 	}
 
 	if s.Email == "" {
-		s.Email, err = p.provider.GetEmailAddress(s)
+		s.Email, err = provider.GetEmailAddress(s)
 	}
 	return
 }
 
+type cookieSecret struct {
+	seed   string
+	cipher *cookie.Cipher
+}
+
+// cookieCiphers holds the secrets built from the keyring's secrets the last
+// time they changed, so that ciphers aren't created on every request
+type cookieCiphers struct {
+	mu      sync.Mutex
+	keys    [][]byte
+	secrets []cookieSecret
+}
+
+// cookieSecrets returns the secrets session cookies may be signed with. The
+// first is used for new cookies; the rest are previous secrets still accepted
+// after a rotation.
+func (p *OAuthProxy) cookieSecrets() []cookieSecret {
+	if p.CookieKeyring == nil {
+		return []cookieSecret{{p.CookieSeed, p.CookieCipher}}
+	}
+	keys := p.CookieKeyring.Secrets()
+	c := &p.cookieCiphers
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !sameSecrets(c.keys, keys) {
+		c.keys, c.secrets = keys, p.buildCookieSecrets(keys)
+	}
+	return c.secrets
+}
+
+func sameSecrets(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildCookieSecrets creates the signing seeds and ciphers for the keyring's
+// secrets, skipping any that can't be used
+func (p *OAuthProxy) buildCookieSecrets(keys [][]byte) []cookieSecret {
+	var secrets []cookieSecret
+	for _, s := range keys {
+		secret := cookieSecret{seed: string(s)}
+		// a cipher is only in use when sessions carry tokens
+		if p.CookieCipher != nil {
+			c, err := cookie.NewCipher(secretBytes(string(s)))
+			if err != nil {
+				log.Printf("skipping unusable cookie secret: %s", err)
+				continue
+			}
+			c.Compress = p.CookieCipher.Compress
+			secret.cipher = c
+		}
+		secrets = append(secrets, secret)
+	}
+	if len(secrets) == 0 {
+		return []cookieSecret{{p.CookieSeed, p.CookieCipher}}
+	}
+	return secrets
+}
+
 func (p *OAuthProxy) MakeSessionCookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
 	if value != "" {
-		value = cookie.SignedValue(p.CookieSeed, p.CookieName, value, now)
+		value = cookie.SignedValue(p.cookieSecrets()[0].seed, p.CookieName, value, now)
 		if len(value) > 4096 {
 			// Cookies cannot be larger than 4kb
 			log.Printf("WARNING - Cookie Size: %d bytes", len(value))
@@ -266,20 +533,29 @@ func (p *OAuthProxy) MakeSessionCookie(req *http.Request, value string, expirati
 	return p.makeCookie(req, p.CookieName, value, expiration, now)
 }
 
+// MakeCSRFCookie makes the cookie that carries the CSRF nonce through the
+// provider's redirects. A strict SameSite setting is relaxed to lax for it,
+// as the browser wouldn't send it back on the redirect from the provider.
 func (p *OAuthProxy) MakeCSRFCookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
-	return p.makeCookie(req, p.CSRFCookieName, value, expiration, now)
+	c := p.makeCookie(req, p.CSRFCookieName, value, expiration, now)
+	if c.SameSite == http.SameSiteStrictMode {
+		c.SameSite = http.SameSiteLaxMode
+	}
+	return c
 }
 
 func (p *OAuthProxy) makeCookie(req *http.Request, name string, value string, expiration time.Duration, now time.Time) *http.Cookie {
-	domain := req.Host
-	if h, _, err := net.SplitHostPort(domain); err == nil {
-		domain = h
-	}
-	if p.CookieDomain != "" {
-		if !strings.HasSuffix(domain, p.CookieDomain) {
-			log.Printf("Warning: request host is %q but using configured cookie domain of %q", domain, p.CookieDomain)
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	domain := host
+	if len(p.CookieDomains) != 0 {
+		domain = cookieDomain(host, p.CookieDomains)
+		if domain == "" {
+			log.Printf("Warning: request host is %q but it isn't in any configured cookie domain %q", host, p.CookieDomains)
+			domain = host
 		}
-		domain = p.CookieDomain
 	}
 
 	return &http.Cookie{
@@ -289,24 +565,60 @@ func (p *OAuthProxy) makeCookie(req *http.Request, name string, value string, ex
 		Domain:   domain,
 		HttpOnly: p.CookieHttpOnly,
 		Secure:   p.CookieSecure,
+		SameSite: p.CookieSameSite,
 		Expires:  now.Add(expiration),
 	}
 }
 
+// cookieDomain returns the longest of domains that host is in, or "" if
+// it's in none of them
+func cookieDomain(host string, domains []string) string {
+	host = strings.ToLower(host)
+	var match string
+	for _, d := range domains {
+		bare := strings.ToLower(strings.TrimPrefix(d, "."))
+		if (host == bare || strings.HasSuffix(host, "."+bare)) && len(d) > len(match) {
+			match = d
+		}
+	}
+	return match
+}
+
+// setCookie sets c on the response like http.SetCookie, adding the
+// Partitioned attribute, which net/http has no field for, when
+// cookie-partitioned is set
+func (p *OAuthProxy) setCookie(rw http.ResponseWriter, c *http.Cookie) {
+	v := c.String()
+	if v == "" {
+		return
+	}
+	if p.cookiePartitioned {
+		v += "; Partitioned"
+	}
+	rw.Header().Add("Set-Cookie", v)
+}
+
 func (p *OAuthProxy) ClearCSRFCookie(rw http.ResponseWriter, req *http.Request) {
-	http.SetCookie(rw, p.MakeCSRFCookie(req, "", time.Hour*-1, time.Now()))
+	p.setCookie(rw, p.MakeCSRFCookie(req, "", time.Hour*-1, time.Now()))
 }
 
 func (p *OAuthProxy) SetCSRFCookie(rw http.ResponseWriter, req *http.Request, val string) {
-	http.SetCookie(rw, p.MakeCSRFCookie(req, val, p.CookieExpire, time.Now()))
+	p.setCookie(rw, p.MakeCSRFCookie(req, val, p.CookieExpire, time.Now()))
 }
 
 func (p *OAuthProxy) ClearSessionCookie(rw http.ResponseWriter, req *http.Request) {
-	http.SetCookie(rw, p.MakeSessionCookie(req, "", time.Hour*-1, time.Now()))
+	if p.sessionStore != nil {
+		if ticket := p.sessionTicket(req); ticket != "" {
+			if err := p.sessionStore.Clear(ticket); err != nil {
+				log.Printf("error removing session from session store: %s", err)
+			}
+		}
+	}
+	p.setCookie(rw, p.MakeSessionCookie(req, "", time.Hour*-1, time.Now()))
 }
 
 func (p *OAuthProxy) SetSessionCookie(rw http.ResponseWriter, req *http.Request, val string) {
-	http.SetCookie(rw, p.MakeSessionCookie(req, val, p.CookieExpire, time.Now()))
+	p.setCookie(rw, p.MakeSessionCookie(req, val, p.CookieExpire, time.Now()))
 }
 
 func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionState, time.Duration, error) {
@@ -316,25 +628,81 @@ func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionSt
 		// always http.ErrNoCookie
 		return nil, age, fmt.Errorf("Cookie %q not present", p.CookieName)
 	}
-	val, timestamp, ok := cookie.Validate(c, p.CookieSeed, p.CookieExpire)
+	var val, ticket string
+	var timestamp time.Time
+	var ok bool
+	var cipher *cookie.Cipher
+	for _, secret := range p.cookieSecrets() {
+		val, timestamp, ok = cookie.Validate(c, secret.seed, p.CookieExpire)
+		if ok {
+			cipher = secret.cipher
+			break
+		}
+	}
 	if !ok {
 		return nil, age, errors.New("Cookie Signature not valid")
 	}
 
-	session, err := p.provider.SessionFromCookie(val, p.CookieCipher)
+	if strings.HasPrefix(val, sessionTicketPrefix) {
+		if p.sessionStore == nil {
+			return nil, age, errors.New("session cookie has a ticket but there is no session store")
+		}
+		ticket = strings.TrimPrefix(val, sessionTicketPrefix)
+		val, err = p.sessionStore.Load(ticket)
+		if err != nil {
+			return nil, age, err
+		}
+	}
+
+	session, err := p.provider.SessionFromCookie(val, cipher)
 	if err != nil {
 		return nil, age, err
 	}
+	if p.sessions.IsRevoked(session, timestamp) {
+		return nil, age, errSessionRevoked
+	}
+	if p.tracksDevices() && ticketDevice(ticket) != "" {
+		if err := p.checkDevice(session, ticketDevice(ticket)); err != nil {
+			return nil, age, err
+		}
+	}
 
 	age = time.Now().Truncate(time.Second).Sub(timestamp)
 	return session, age, nil
 }
 
 func (p *OAuthProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *providers.SessionState) error {
-	value, err := p.provider.CookieForSession(s, p.CookieCipher)
+	value, err := p.provider.CookieForSession(s, p.cookieSecrets()[0].cipher)
 	if err != nil {
 		return err
 	}
+	if p.sessionStore != nil {
+		// a new ticket each time, so that a ticket from before signing in
+		// can't be used to reach the session. The previous ticket is
+		// cleared so that its session doesn't linger in the store.
+		previous := p.sessionTicket(req)
+		ticket, err := newSessionTicket()
+		if p.tracksDevices() {
+			ticket, err = newDeviceTicket(ticketDevice(previous))
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.sessionStore.Save(ticket, value, p.CookieExpire); err != nil {
+			return err
+		}
+		if p.tracksDevices() {
+			if err := p.saveDevice(req, s, ticketDevice(ticket), ticket); err != nil {
+				return err
+			}
+		}
+		if previous != "" {
+			if err := p.sessionStore.Clear(previous); err != nil && err != errSessionNotFound {
+				log.Printf("error removing previous session from session store: %s", err)
+			}
+		}
+		value = sessionTicketPrefix + ticket
+	}
 	p.SetSessionCookie(rw, req, value)
 	return nil
 }
@@ -349,23 +717,68 @@ func (p *OAuthProxy) PingPage(rw http.ResponseWriter) {
 	fmt.Fprintf(rw, "OK")
 }
 
-func (p *OAuthProxy) ErrorPage(rw http.ResponseWriter, code int, title string, message string) {
-	log.Printf("ErrorPage %d %s %s", code, title, message)
+// ReadyPage reports that the proxy has loaded its configuration and is
+// serving requests, for use as a load balancer readiness check
+func (p *OAuthProxy) ReadyPage(rw http.ResponseWriter) {
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, "OK")
+}
+
+func (p *OAuthProxy) branding() pageBranding {
+	return pageBranding{
+		AppName:     p.AppName,
+		LogoURL:     p.LogoURL,
+		Footer:      template.HTML(p.Footer),
+		Version:     VERSION,
+		ProxyPrefix: p.ProxyPrefix,
+		StaticPath:  strings.TrimSuffix(p.StaticPath, "/"),
+	}
+}
+
+// ErrorPage responds with an error page, or a JSON error for API clients.
+// Both include the request ID, which is logged with the error so that a
+// user's report can be matched to it.
+func (p *OAuthProxy) ErrorPage(rw http.ResponseWriter, req *http.Request, code int, title string, message string) {
+	id := requestID(req)
+	log.Printf("ErrorPage %d %s %s request_id=%s", code, title, message, id)
+	if id != "" {
+		rw.Header().Set("X-Request-Id", id)
+	}
+	if p.isAPIRequest(req) {
+		body := struct {
+			Error     string `json:"error"`
+			Message   string `json:"message"`
+			RequestID string `json:"request_id,omitempty"`
+		}{
+			Error:     strings.ToLower(strings.Replace(title, " ", "_", -1)),
+			Message:   message,
+			RequestID: id,
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(code)
+		json.NewEncoder(rw).Encode(body)
+		return
+	}
 	rw.WriteHeader(code)
 	t := struct {
-		Title       string
-		Message     string
-		ProxyPrefix string
+		pageBranding
+		Title     string
+		Message   string
+		RequestID string
 	}{
-		Title:       fmt.Sprintf("%d %s", code, title),
-		Message:     message,
-		ProxyPrefix: p.ProxyPrefix,
+		pageBranding: p.branding(),
+		Title:        fmt.Sprintf("%d %s", code, title),
+		Message:      message,
+		RequestID:    id,
 	}
 	p.templates.ExecuteTemplate(rw, "error.html", t)
 }
 
 func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code int) {
 	p.ClearSessionCookie(rw, req)
+	if p.signInCSP != "" {
+		rw.Header().Set("Content-Security-Policy", p.signInCSP)
+	}
 	rw.WriteHeader(code)
 
 	redirect_url := req.URL.RequestURI()
@@ -376,22 +789,27 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		redirect_url = "/"
 	}
 
+	var choices []providerChoice
+	for _, sp := range p.signInProviders {
+		choices = append(choices, providerChoice{ID: sp.id, Name: sp.name})
+	}
+
 	t := struct {
-		ProviderName  string
-		SignInMessage string
-		CustomLogin   bool
-		Redirect      string
-		Version       string
-		ProxyPrefix   string
-		Footer        template.HTML
+		pageBranding
+		ProviderName       string
+		ProviderButtonText string
+		Providers          []providerChoice
+		SignInMessage      string
+		CustomLogin        bool
+		Redirect           string
 	}{
-		ProviderName:  p.provider.Data().ProviderName,
-		SignInMessage: p.SignInMessage,
-		CustomLogin:   p.displayCustomLoginForm(),
-		Redirect:      redirect_url,
-		Version:       VERSION,
-		ProxyPrefix:   p.ProxyPrefix,
-		Footer:        template.HTML(p.Footer),
+		pageBranding:       p.branding(),
+		ProviderName:       p.provider.Data().ProviderName,
+		ProviderButtonText: p.ProviderButtonText,
+		Providers:          choices,
+		SignInMessage:      p.SignInMessage,
+		CustomLogin:        p.displayCustomLoginForm(),
+		Redirect:           redirect_url,
 	}
 	p.templates.ExecuteTemplate(rw, "sign_in.html", t)
 }
@@ -407,9 +825,14 @@ func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (st
 	}
 	// check auth
 	if p.HtpasswdFile.Validate(user, passwd) {
-		log.Printf("authenticated %q via HtpasswdFile", user)
+		logger.PrintAuthf(user, req, logger.AuthSuccess, "authenticated via HtpasswdFile")
+		p.audit(req, auditLoginSuccess, user, "authenticated via HtpasswdFile")
+		recordAuthentication("htpasswd", true)
 		return user, true
 	}
+	logger.PrintAuthf(user, req, logger.AuthFailure, "invalid authentication via HtpasswdFile")
+	p.audit(req, auditLoginFailure, user, "invalid authentication via HtpasswdFile")
+	recordAuthentication("htpasswd", false)
 	return "", false
 }
 
@@ -429,7 +852,16 @@ func (p *OAuthProxy) GetRedirect(req *http.Request) (redirect string, err error)
 
 func (p *OAuthProxy) IsWhitelistedRequest(req *http.Request) (ok bool) {
 	isPreflightRequestAllowed := p.skipAuthPreflight && req.Method == "OPTIONS"
-	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path)
+	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path) || p.isSkipAuthRoute(req)
+}
+
+func (p *OAuthProxy) isSkipAuthRoute(req *http.Request) bool {
+	for _, r := range p.skipAuthRoutes {
+		if r.matches(req) {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *OAuthProxy) IsWhitelistedPath(path string) (ok bool) {
@@ -451,23 +883,45 @@ func getRemoteAddr(req *http.Request) (s string) {
 }
 
 func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p.stripRequestHeaders(req)
 	switch path := req.URL.Path; {
 	case path == p.RobotsPath:
 		p.RobotsTxt(rw)
 	case path == p.PingPath:
 		p.PingPage(rw)
-	case p.IsWhitelistedRequest(req):
-		p.serveMux.ServeHTTP(rw, req)
+	case path == p.ReadyPath:
+		p.ReadyPage(rw)
+	case p.staticHandler != nil && strings.HasPrefix(path, p.StaticPath):
+		p.staticHandler.ServeHTTP(rw, req)
+	case p.upstreamJWT != nil && path == p.JWKSPath:
+		p.JWKS(rw)
+	case p.IsWhitelistedRequest(cleanRequest(req)):
+		p.traceAuthentication(req, "skipped")
+		if p.maintenance.blocks(cleanRequest(req), nil) {
+			p.MaintenancePage(rw, req)
+		} else {
+			p.serveUpstream(rw, req)
+		}
 	case path == p.SignInPath:
-		p.SignIn(rw, req)
+		if p.allowRequest(rw, req) {
+			p.SignIn(rw, req)
+		}
 	case path == p.SignOutPath:
 		p.SignOut(rw, req)
 	case path == p.OAuthStartPath:
 		p.OAuthStart(rw, req)
 	case path == p.OAuthCallbackPath:
-		p.OAuthCallback(rw, req)
-	case path == p.AuthOnlyPath:
+		if p.allowRequest(rw, req) {
+			p.OAuthCallback(rw, req)
+		}
+	case path == p.AuthOnlyPath || strings.HasPrefix(path, p.AuthOnlyPath+"/"):
 		p.AuthenticateOnly(rw, req)
+	case path == p.SessionsPath:
+		p.Sessions(rw, req)
+	case path == p.TokenPath:
+		if p.allowRequest(rw, req) {
+			p.Token(rw, req)
+		}
 	default:
 		p.Proxy(rw, req)
 	}
@@ -476,7 +930,7 @@ func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 	redirect, err := p.GetRedirect(req)
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
 
@@ -490,25 +944,83 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// SignOut clears the session and redirects to rd. With provider-logout the
+// user is first sent to the provider to end their session there too, which
+// returns them to rd afterwards.
 func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
+	redirect, err := p.GetRedirect(req)
+	if err != nil {
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
+		return
+	}
+	session, _, _ := p.LoadCookiedSession(req)
+	provider := p.provider
+	if session != nil {
+		if sp := p.signInProvider(session.Provider); sp != nil {
+			provider = sp.provider
+		}
+		p.auditFor(req, provider, auditSignOut, session.Email, "signed out %s", session)
+		if device := ticketDevice(p.sessionTicket(req)); p.tracksDevices() && device != "" {
+			p.forgetDevice(session, device)
+		}
+	}
 	p.ClearSessionCookie(rw, req)
-	http.Redirect(rw, req, "/", 302)
+	if p.providerLogout {
+		if logoutURL := provider.GetLogoutURL(session, p.postLogoutRedirectURI(req.Host, redirect)); logoutURL != "" {
+			redirect = logoutURL
+		}
+	}
+	http.Redirect(rw, req, redirect, 302)
+}
+
+// postLogoutRedirectURI returns the absolute URL of a path on the proxy, for
+// the provider to return users to after signing out
+func (p *OAuthProxy) postLogoutRedirectURI(host, path string) string {
+	base, err := url.Parse(p.GetRedirectURI(host))
+	if err != nil {
+		return ""
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return ""
+	}
+	return base.ResolveReference(ref).String()
 }
 
 func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
-	nonce, err := cookie.Nonce()
+	redirect, err := p.GetRedirect(req)
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
-	p.SetCSRFCookie(rw, req, nonce)
-	redirect, err := p.GetRedirect(req)
+	// only the start endpoint chooses a provider; requests for other paths
+	// sent to sign in by skip-provider-button use the default
+	var providerID string
+	if req.URL.Path == p.OAuthStartPath {
+		providerID = req.Form.Get("provider")
+	}
+	sp := p.signInProvider(providerID)
+	if sp == nil {
+		p.ErrorPage(rw, req, 400, "Bad Request", "Unknown provider")
+		return
+	}
+	nonce, err := cookie.Nonce()
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
+	var verifier, challenge string
+	if p.pkce {
+		verifier, err = newCodeVerifier()
+		if err != nil {
+			p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
+			return
+		}
+		challenge = codeChallenge(verifier)
+	}
+	p.SetCSRFCookie(rw, req, csrfCookieValue(nonce, verifier, sp.id))
 	redirectURI := p.GetRedirectURI(req.Host)
-	http.Redirect(rw, req, p.provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect)), 302)
+	http.Redirect(rw, req, sp.provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect), challenge), 302)
 }
 
 func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
@@ -517,106 +1029,196 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 	// finish the oauth cycle
 	err := req.ParseForm()
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
 	errorString := req.Form.Get("error")
 	if errorString != "" {
-		p.ErrorPage(rw, 403, "Permission Denied", errorString)
-		return
-	}
-
-	session, err := p.redeemCode(req.Host, req.Form.Get("code"))
-	if err != nil {
-		log.Printf("%s error redeeming code %s", remoteAddr, err)
-		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+		p.ErrorPage(rw, req, 403, "Permission Denied", errorString)
 		return
 	}
 
+	// the CSRF cookie is checked before redeeming the code, as it holds the
+	// PKCE code verifier
 	s := strings.SplitN(req.Form.Get("state"), ":", 2)
 	if len(s) != 2 {
-		p.ErrorPage(rw, 500, "Internal Error", "Invalid State")
+		p.ErrorPage(rw, req, 500, "Internal Error", "Invalid State")
 		return
 	}
-	nonce := s[0]
 	redirect := s[1]
 	c, err := req.Cookie(p.CSRFCookieName)
 	if err != nil {
-		p.ErrorPage(rw, 403, "Permission Denied", err.Error())
+		p.ErrorPage(rw, req, 403, "Permission Denied", err.Error())
 		return
 	}
 	p.ClearCSRFCookie(rw, req)
-	if c.Value != nonce {
-		log.Printf("%s csrf token mismatch, potential attack", remoteAddr)
-		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
+	nonce, verifier, providerID := parseCSRFCookieValue(c.Value)
+	if nonce != s[0] {
+		logger.PrintAuthf("", req, logger.AuthFailure, "csrf token mismatch, potential attack")
+		p.audit(req, auditLoginFailure, "", "csrf token mismatch, potential attack")
+		p.ErrorPage(rw, req, 403, "Permission Denied", "csrf failed")
+		return
+	}
+	sp := p.signInProvider(providerID)
+	if sp == nil {
+		logger.PrintAuthf("", req, logger.AuthFailure, "unknown provider %q", providerID)
+		p.audit(req, auditLoginFailure, "", "unknown provider %q", providerID)
+		p.ErrorPage(rw, req, 403, "Permission Denied", "Unknown provider")
+		return
+	}
+
+	session, err := p.redeemCode(sp.provider, p.GetRedirectURI(req.Host), req.Form.Get("code"), verifier)
+	if err != nil {
+		logger.PrintAuthf("", req, logger.AuthError, "error redeeming code %s", err)
+		p.auditFor(req, sp.provider, auditLoginFailure, "", "error redeeming code %s", err)
+		recordAuthentication("oauth", false)
+		p.ErrorPage(rw, req, 500, "Internal Error", "Internal Error")
 		return
 	}
+	if err := sp.provider.EnrichSession(session); err != nil {
+		logger.PrintAuthf(session.Email, req, logger.AuthError, "error enriching session %s", err)
+		p.auditFor(req, sp.provider, auditLoginFailure, session.Email, "error enriching session %s", err)
+		recordAuthentication("oauth", false)
+		p.ErrorPage(rw, req, 500, "Internal Error", "Internal Error")
+		return
+	}
+	session.Provider = sp.id
+	p.mapClaims(sp.provider, session, session.IDToken)
 
 	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
 		redirect = "/"
 	}
 
 	// set cookie, or deny
-	if p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) {
-		log.Printf("%s authentication complete %s", remoteAddr, session)
+	if sp.validator(session.Email) && sp.provider.ValidateGroup(session.Email) && p.hasAllowedGroup(session) {
+		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "authentication complete %s", session)
+		p.auditFor(req, sp.provider, auditLoginSuccess, session.Email, "authentication complete %s", session)
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
-			p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+			p.ErrorPage(rw, req, 500, "Internal Error", "Internal Error")
 			return
 		}
+		recordAuthentication("oauth", true)
 		http.Redirect(rw, req, redirect, 302)
 	} else {
-		log.Printf("%s Permission Denied: %q is unauthorized", remoteAddr, session.Email)
-		p.ErrorPage(rw, 403, "Permission Denied", "Invalid Account")
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Permission Denied: %q is unauthorized", session.Email)
+		p.auditFor(req, sp.provider, auditAuthorizationDenied, session.Email, "%q is unauthorized", session.Email)
+		recordAuthentication("oauth", false)
+		p.ErrorPage(rw, req, 403, "Permission Denied", "Invalid Account")
 	}
 }
 
 func (p *OAuthProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request) {
+	if fwd := p.forwardedRequest(req); p.isTrustedIP(req) || (fwd != nil && p.IsWhitelistedRequest(fwd)) {
+		p.traceAuthentication(req, "skipped")
+		rw.WriteHeader(http.StatusAccepted)
+		return
+	}
 	status := p.Authenticate(rw, req)
+	p.traceAuthentication(req, authOutcome(status))
 	if status == http.StatusAccepted {
 		rw.WriteHeader(http.StatusAccepted)
+	} else if status == statusPolicyDenied {
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+	} else if status == statusQuotaExceeded {
+		http.Error(rw, "too many requests", http.StatusTooManyRequests)
+	} else if status == statusMaintenance {
+		http.Error(rw, "service unavailable", http.StatusServiceUnavailable)
+	} else if status == http.StatusInternalServerError {
+		http.Error(rw, "internal error", http.StatusInternalServerError)
 	} else {
 		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
 	}
 }
 
 func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
+	if p.isTrustedIP(req) {
+		p.traceAuthentication(req, "skipped")
+		if p.maintenance.blocks(cleanRequest(req), nil) {
+			p.MaintenancePage(rw, req)
+			return
+		}
+		p.serveUpstream(rw, req)
+		return
+	}
 	status := p.Authenticate(rw, req)
+	p.traceAuthentication(req, authOutcome(status))
 	if status == http.StatusInternalServerError {
-		p.ErrorPage(rw, http.StatusInternalServerError,
+		p.ErrorPage(rw, req, http.StatusInternalServerError,
 			"Internal Error", "Internal Error")
+	} else if status == statusPolicyDenied {
+		p.ErrorPage(rw, req, http.StatusForbidden,
+			"Permission Denied", "You are not allowed to access this page")
+	} else if status == statusQuotaExceeded {
+		p.QuotaExceeded(rw, req)
+	} else if status == statusMaintenance {
+		p.MaintenancePage(rw, req)
 	} else if status == http.StatusForbidden {
-		if p.SkipProviderButton {
+		if p.isAPIRequest(req) {
+			p.Unauthorized(rw, req)
+		} else if p.SkipProviderButton {
 			p.OAuthStart(rw, req)
 		} else {
 			p.SignInPage(rw, req, http.StatusForbidden)
 		}
 	} else {
-		p.serveMux.ServeHTTP(rw, req)
+		p.serveUpstream(rw, req)
 	}
 }
 
 func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int {
 	var saveSession, clearSession, revalidated bool
 	remoteAddr := getRemoteAddr(req)
-
-	session, sessionAge, err := p.LoadCookiedSession(req)
-	if err != nil {
-		log.Printf("%s %s", remoteAddr, err)
+	policy := p.policyFor(req)
+
+	var session *providers.SessionState
+	var sessionAge time.Duration
+	var err error
+	// a session token is sent in place of the session cookie
+	sessionToken := p.sessionToken(req)
+	if policy.accepts(authMethodCookie) {
+		if sessionToken != "" {
+			session, sessionAge, err = p.LoadTokenSession(sessionToken)
+		} else {
+			session, sessionAge, err = p.LoadCookiedSession(req)
+		}
+		if err != nil {
+			log.Printf("%s %s", remoteAddr, err)
+			clearSession = err == errSessionRevoked || err == errSessionSignedOut
+		}
+	}
+	// sessions are refreshed and validated by the provider they came from
+	var sp *signInProvider
+	if session != nil {
+		if sp = p.signInProvider(session.Provider); sp == nil {
+			log.Printf("%s removing session. unknown provider %s", remoteAddr, session)
+			session = nil
+			clearSession = true
+		}
 	}
 	if session != nil && sessionAge > p.CookieRefresh && p.CookieRefresh != time.Duration(0) {
 		log.Printf("%s refreshing %s old session cookie for %s (refresh after %s)", remoteAddr, sessionAge, session, p.CookieRefresh)
 		saveSession = true
 	}
 
-	if ok, err := p.provider.RefreshSessionIfNeeded(session); err != nil {
-		log.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
-		clearSession = true
-		session = nil
-	} else if ok {
-		saveSession = true
-		revalidated = true
+	if session != nil && p.needsRefresh(session, sessionAge) {
+		// a refresh may replace the whole session, dropping what the proxy
+		// itself stored in it
+		provider, claims := session.Provider, session.Claims
+		if ok, err := p.refresher.Refresh(session, sp.provider.RefreshSession); err != nil {
+			log.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
+			p.auditFor(req, sp.provider, auditSessionRefreshFailure, session.Email, "error refreshing access token %s", err)
+			providerRefreshErrorsTotal.WithLabelValues(sp.provider.Data().ProviderName).Inc()
+			clearSession = true
+			session = nil
+		} else if ok {
+			session.Provider, session.Claims = provider, claims
+			p.mapClaims(sp.provider, session, session.IDToken)
+			p.auditFor(req, sp.provider, auditSessionRefresh, session.Email, "refreshed access token %s", session)
+			saveSession = true
+			revalidated = true
+		}
 	}
 
 	if session != nil && session.IsExpired() {
@@ -627,7 +1229,7 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	}
 
 	if saveSession && !revalidated && session != nil && session.AccessToken != "" {
-		if !p.provider.ValidateSessionState(session) {
+		if !sp.provider.ValidateSessionState(session) {
 			log.Printf("%s removing session. error validating %s", remoteAddr, session)
 			saveSession = false
 			session = nil
@@ -635,26 +1237,61 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		}
 	}
 
-	if session != nil && session.Email != "" && !p.Validator(session.Email) {
-		log.Printf("%s Permission Denied: removing session %s", remoteAddr, session)
+	if session != nil && session.Email != "" && !sp.validator(session.Email) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Permission Denied: removing session %s", session)
+		p.audit(req, auditAuthorizationDenied, session.Email, "removing session %s", session)
+		session = nil
+		saveSession = false
+		clearSession = true
+	}
+
+	if session != nil && !p.hasAllowedGroup(session) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Permission Denied: not in an allowed group, removing session %s", session)
+		p.audit(req, auditAuthorizationDenied, session.Email, "not in an allowed group, removing session %s", session)
 		session = nil
 		saveSession = false
 		clearSession = true
 	}
 
 	if saveSession && session != nil {
-		err := p.SaveSession(rw, req, session)
+		if sessionToken != "" {
+			err = p.refreshTokenSession(sessionToken, session)
+		} else {
+			err = p.SaveSession(rw, req, session)
+		}
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
 			return http.StatusInternalServerError
 		}
 	}
 
-	if clearSession {
+	if session != nil {
+		issuedAt := time.Now().Truncate(time.Second).Add(-sessionAge)
+		if saveSession {
+			issuedAt = time.Now()
+		}
+		p.sessions.Seen(session, issuedAt)
+	}
+
+	if clearSession && sessionToken != "" {
+		p.clearTokenSession(sessionToken)
+	} else if clearSession {
 		p.ClearSessionCookie(rw, req)
 	}
 
-	if session == nil {
+	if session == nil && len(p.jwtVerifiers) != 0 && policy.accepts(authMethodJWT) {
+		session, err = p.GetJwtSession(req)
+		if err != nil {
+			log.Printf("%s %s", remoteAddr, err)
+		}
+		if session != nil && (!p.Validator(session.Email) || !p.hasAllowedGroup(session)) {
+			logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Permission Denied: bearer token for %s is unauthorized", session)
+			p.audit(req, auditAuthorizationDenied, session.Email, "bearer token for %s is unauthorized", session)
+			session = nil
+		}
+	}
+
+	if session == nil && policy.accepts(authMethodBasic) {
 		session, err = p.CheckBasicAuth(req)
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
@@ -664,8 +1301,26 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	if session == nil {
 		return http.StatusForbidden
 	}
+	if !policy.allows(session) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Permission Denied: %s does not allow %s", policy.name, session)
+		p.audit(req, auditAuthorizationDenied, session.Email, "%s does not allow %s", policy.name, session)
+		return statusPolicyDenied
+	}
+	if status := p.checkAuthzWebhook(req, session); status != http.StatusAccepted {
+		return status
+	}
+	if p.maintenance.blocks(p.authorizedRequest(req), session) {
+		return statusMaintenance
+	}
+	if !p.checkQuota(rw, req, session) {
+		return statusQuotaExceeded
+	}
 
-	// At this point, the user is authenticated. proxy normally
+	// At this point, the user is authenticated. proxy normally. Session
+	// tokens are never passed on.
+	if p.stripAuthorization || sessionToken != "" {
+		req.Header.Del("Authorization")
+	}
 	if p.PassBasicAuth {
 		req.SetBasicAuth(session.User, p.BasicAuthPassword)
 		req.Header["X-Forwarded-User"] = []string{session.User}
@@ -678,24 +1333,123 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		if session.Email != "" {
 			req.Header["X-Forwarded-Email"] = []string{session.Email}
 		}
+		if len(session.Groups) != 0 {
+			req.Header["X-Forwarded-Groups"] = []string{strings.Join(session.Groups, ",")}
+		}
 	}
 	if p.SetXAuthRequest {
 		rw.Header().Set("X-Auth-Request-User", session.User)
 		if session.Email != "" {
 			rw.Header().Set("X-Auth-Request-Email", session.Email)
 		}
+		if len(session.Groups) != 0 {
+			rw.Header().Set("X-Auth-Request-Groups", strings.Join(session.Groups, ","))
+		}
+		if p.PassAccessToken && session.AccessToken != "" {
+			rw.Header().Set("X-Auth-Request-Access-Token", session.AccessToken)
+		}
 	}
 	if p.PassAccessToken && session.AccessToken != "" {
 		req.Header["X-Forwarded-Access-Token"] = []string{session.AccessToken}
 	}
+	if token := bearerToken(session); p.passAuthorization && token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+		if p.SetXAuthRequest {
+			rw.Header().Set("Authorization", "Bearer "+token)
+		}
+	}
+	setClaimHeaders(req.Header, p.claimHeaders, session)
+	if p.SetXAuthRequest {
+		setClaimHeaders(rw.Header(), p.claimHeaders, session)
+	}
+	if p.upstreamJWT != nil {
+		token, err := p.upstreamJWT.Token(session, req.Host)
+		if err != nil {
+			log.Printf("%s error signing upstream jwt: %s", remoteAddr, err)
+			return http.StatusInternalServerError
+		}
+		req.Header.Set(p.upstreamJWT.header, token)
+		if p.SetXAuthRequest {
+			rw.Header().Set(p.upstreamJWT.header, token)
+		}
+	}
+	if err := setInjectedHeaders(req.Header, p.injectRequestHeaders, session); err != nil {
+		log.Printf("%s %s", remoteAddr, err)
+		return http.StatusInternalServerError
+	}
+	if err := setInjectedHeaders(rw.Header(), p.injectResponseHeaders, session); err != nil {
+		log.Printf("%s %s", remoteAddr, err)
+		return http.StatusInternalServerError
+	}
 	if session.Email == "" {
 		rw.Header().Set("GAP-Auth", session.User)
+		activeSessions.Seen(session.User)
 	} else {
 		rw.Header().Set("GAP-Auth", session.Email)
+		activeSessions.Seen(session.Email)
 	}
 	return http.StatusAccepted
 }
 
+// bearerToken returns the token passed to upstreams with
+// pass-authorization-header: the id token, or the access token for
+// providers that don't issue one
+func bearerToken(session *providers.SessionState) string {
+	if session.IDToken != "" {
+		return session.IDToken
+	}
+	return session.AccessToken
+}
+
+// hasAllowedGroup reports whether the session is a member of one of the
+// allowed groups. Every session is allowed when no groups are configured.
+func (p *OAuthProxy) hasAllowedGroup(session *providers.SessionState) bool {
+	if len(p.AllowedGroups) == 0 {
+		return true
+	}
+	for _, group := range session.Groups {
+		for _, allowed := range p.AllowedGroups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetJwtSession returns a session for a request whose Authorization header
+// carries a bearer token signed by one of the trusted issuers. The session
+// is never saved to a cookie; the token is checked on every request.
+func (p *OAuthProxy) GetJwtSession(req *http.Request) (*providers.SessionState, error) {
+	auth := req.Header.Get("Authorization")
+	s := strings.SplitN(auth, " ", 2)
+	if len(s) != 2 || s[0] != "Bearer" {
+		return nil, nil
+	}
+	rawToken := strings.TrimSpace(s[1])
+	ctx := context.Background()
+	for _, verifier := range p.jwtVerifiers {
+		idToken, err := verifier.Verify(ctx, rawToken)
+		if err != nil {
+			continue
+		}
+		session, err := providers.NewSessionFromIDToken(idToken, p.jwtEmailClaim, p.jwtGroupsClaim)
+		if err != nil {
+			recordAuthentication("jwt_bearer", false)
+			return nil, err
+		}
+		session.User = strings.Split(session.Email, "@")[0]
+		session.AccessToken = rawToken
+		p.mapClaims(nil, session, rawToken)
+		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "authenticated via jwt bearer token from %s", idToken.Issuer)
+		p.audit(req, auditLoginSuccess, session.Email, "authenticated via jwt bearer token from %s", idToken.Issuer)
+		recordAuthentication("jwt_bearer", true)
+		return session, nil
+	}
+	recordAuthentication("jwt_bearer", false)
+	return nil, errors.New("unable to verify jwt bearer token")
+}
+
 func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*providers.SessionState, error) {
 	if p.HtpasswdFile == nil {
 		return nil, nil
@@ -704,21 +1458,31 @@ func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*providers.SessionState,
 	if auth == "" {
 		return nil, nil
 	}
+	// other schemes, such as bearer tokens that weren't accepted, aren't
+	// basic auth. Credentials are left out of errors, as they are logged.
 	s := strings.SplitN(auth, " ", 2)
-	if len(s) != 2 || s[0] != "Basic" {
-		return nil, fmt.Errorf("invalid Authorization header %s", req.Header.Get("Authorization"))
+	if !strings.EqualFold(s[0], "Basic") {
+		return nil, nil
+	}
+	if len(s) != 2 {
+		return nil, errors.New("invalid basic auth Authorization header")
 	}
 	b, err := b64.StdEncoding.DecodeString(s[1])
 	if err != nil {
-		return nil, err
+		return nil, errors.New("invalid basic auth Authorization header: credentials aren't base64 encoded")
 	}
 	pair := strings.SplitN(string(b), ":", 2)
 	if len(pair) != 2 {
-		return nil, fmt.Errorf("invalid format %s", b)
+		return nil, errors.New("invalid basic auth Authorization header: credentials aren't user:password")
 	}
 	if p.HtpasswdFile.Validate(pair[0], pair[1]) {
-		log.Printf("authenticated %q via basic auth", pair[0])
+		logger.PrintAuthf(pair[0], req, logger.AuthSuccess, "authenticated via basic auth")
+		p.audit(req, auditLoginSuccess, pair[0], "authenticated via basic auth")
+		recordAuthentication("basic_auth", true)
 		return &providers.SessionState{User: pair[0]}, nil
 	}
+	logger.PrintAuthf(pair[0], req, logger.AuthFailure, "invalid authentication via basic auth")
+	p.audit(req, auditLoginFailure, pair[0], "invalid authentication via basic auth")
+	recordAuthentication("basic_auth", false)
 	return nil, fmt.Errorf("%s not in HtpasswdFile", pair[0])
 }
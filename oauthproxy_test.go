@@ -2,8 +2,12 @@ package main
 
 import (
 	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/base64"
+	"encoding/json"
 	"github.com/18F/hmacauth"
+	"github.com/bitly/oauth2_proxy/cookie"
 	"github.com/bitly/oauth2_proxy/providers"
 	"github.com/bmizerany/assert"
 	"io"
@@ -17,6 +21,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
 )
 
 func init() {
@@ -556,6 +562,74 @@ func TestProcessCookieFailIfRefreshSetAndCookieExpired(t *testing.T) {
 	}
 }
 
+type rotatingKeySource struct {
+	key string
+}
+
+func (r *rotatingKeySource) Key() ([]byte, error) {
+	return []byte(r.key), nil
+}
+
+func TestLoadCookiedSessionAfterSecretRotation(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	source := &rotatingKeySource{"0123456789abcde!"}
+	keyring, err := cookie.NewKeyring(source, 1, nil)
+	assert.Equal(t, nil, err)
+	pc_test.proxy.CookieKeyring = keyring
+
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	rw := httptest.NewRecorder()
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(rw, pc_test.req, startSession))
+	pc_test.req.AddCookie(rw.Result().Cookies()[0])
+
+	// cookies issued with the previous secret are still accepted
+	source.key = "fedcba987654321!"
+	assert.Equal(t, nil, keyring.Refresh())
+	// the ciphers are only built again when the keyring's secrets change
+	secrets := pc_test.proxy.cookieSecrets()
+	assert.Equal(t, 2, len(secrets))
+	assert.Equal(t, true, secrets[0].cipher == pc_test.proxy.cookieSecrets()[0].cipher)
+	session, _, err := pc_test.LoadCookiedSession()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, startSession.Email, session.Email)
+	assert.Equal(t, startSession.AccessToken, session.AccessToken)
+
+	// until the secret is rotated out of the keyring
+	source.key = "abcdef012345678!"
+	assert.Equal(t, nil, keyring.Refresh())
+	session, _, err = pc_test.LoadCookiedSession()
+	assert.NotEqual(t, nil, err)
+	if session != nil {
+		t.Errorf("expected nil session %#v", session)
+	}
+}
+
+func TestLoadCookiedSessionWithPreviousCookieSecret(t *testing.T) {
+	newProxy := func(secrets ...string) *OAuthProxy {
+		opts := NewOptions()
+		opts.ClientID = "bazquux"
+		opts.ClientSecret = "xyzzyplugh"
+		opts.CookieSecrets = secrets
+		opts.EmailDomains = []string{"*"}
+		opts.PassAccessToken = true
+		opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+		assert.Equal(t, nil, opts.Validate())
+		return NewOAuthProxy(opts, func(email string) bool { return true })
+	}
+
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	assert.Equal(t, nil, newProxy("fedcba987654321!").SaveSession(rw, req, startSession))
+	req.AddCookie(rw.Result().Cookies()[0])
+
+	proxy := newProxy("0123456789abcde!", "fedcba987654321!")
+	session, _, err := proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, startSession.Email, session.Email)
+	assert.Equal(t, startSession.AccessToken, session.AccessToken)
+}
+
 func NewAuthOnlyEndpointTest() *ProcessCookieTest {
 	pc_test := NewProcessCookieTestWithDefaults()
 	pc_test.req, _ = http.NewRequest("GET",
@@ -641,6 +715,35 @@ func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
 	assert.Equal(t, "oauth_user@example.com", pc_test.rw.HeaderMap["X-Auth-Request-Email"][0])
 }
 
+func TestAuthOnlyEndpointAllowedGroups(t *testing.T) {
+	test := func(groups []string) *ProcessCookieTest {
+		pc_test := NewProcessCookieTestWithDefaults()
+		pc_test.validate_user = true
+		pc_test.proxy.SetXAuthRequest = true
+		pc_test.proxy.AllowedGroups = []string{"admins", "ops"}
+		pc_test.req, _ = http.NewRequest("GET",
+			pc_test.opts.ProxyPrefix+"/auth", nil)
+
+		startSession := &providers.SessionState{
+			Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+			Groups: groups}
+		pc_test.SaveSession(startSession, time.Now())
+		pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+		return pc_test
+	}
+
+	allowed := test([]string{"devs", "ops"})
+	assert.Equal(t, http.StatusAccepted, allowed.rw.Code)
+	assert.Equal(t, "devs,ops", allowed.rw.HeaderMap.Get("X-Auth-Request-Groups"))
+	assert.Equal(t, "devs,ops", allowed.req.Header.Get("X-Forwarded-Groups"))
+
+	denied := test([]string{"devs"})
+	assert.Equal(t, http.StatusUnauthorized, denied.rw.Code)
+
+	noGroups := test(nil)
+	assert.Equal(t, http.StatusUnauthorized, noGroups.rw.Code)
+}
+
 func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
@@ -668,6 +771,54 @@ func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	assert.Equal(t, "response", rw.Body.String())
 }
 
+func TestAuthSkippedForSkipAuthRoutes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("response"))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.SkipAuthRoutes = []string{"GET=^/healthz$", "^/public/"}
+	opts.Validate()
+
+	upstream_url, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstream_url, "")
+
+	proxy := NewOAuthProxy(opts, func(string) bool { return false })
+	serve := func(method, path string) int {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, 200, serve("GET", "/healthz"))
+	assert.Equal(t, 403, serve("POST", "/healthz"))
+	assert.Equal(t, 403, serve("GET", "/healthz/details"))
+	assert.Equal(t, 200, serve("POST", "/public/form"))
+	assert.Equal(t, 403, serve("GET", "/private"))
+}
+
+func TestReadyEndpoint(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.Validate()
+
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ready", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "OK", rw.Body.String())
+}
+
 type SignatureAuthenticator struct {
 	auth hmacauth.HmacAuth
 }
@@ -735,7 +886,8 @@ func (st *SignatureTest) Close() {
 
 // fakeNetConn simulates an http.Request.Body buffer that will be consumed
 // when it is read by the hmacauth.HmacAuth if not handled properly. See:
-//   https://github.com/18F/hmacauth/pull/4
+//
+//	https://github.com/18F/hmacauth/pull/4
 type fakeNetConn struct {
 	reqBody string
 }
@@ -803,3 +955,142 @@ func TestRequestSignaturePostRequest(t *testing.T) {
 	assert.Equal(t, 200, st.rw.Code)
 	assert.Equal(t, st.rw.Body.String(), "signatures match")
 }
+
+type jwtBearerTest struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	proxy *OAuthProxy
+}
+
+func newJwtBearerTest(t *testing.T) *jwtBearerTest {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jt := &jwtBearerTest{key: key}
+	jt.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	}))
+
+	opts := testOptions()
+	opts.CookieSecret = "xyzzyplugh!"
+	opts.SkipJwtBearerTokens = true
+	opts.ExtraJwtIssuers = []string{"https://issuer.example.com=api=" + jt.URL}
+	opts.AllowedGroups = []string{"services"}
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	jt.proxy = NewOAuthProxy(opts, func(email string) bool {
+		return strings.HasSuffix(email, "@example.com")
+	})
+	return jt
+}
+
+func (jt *jwtBearerTest) token(t *testing.T, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jt.key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(claims)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func (jt *jwtBearerTest) auth(authorization string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/auth", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	jt.proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+func jwtClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    "https://issuer.example.com",
+		"aud":    "api",
+		"sub":    "build-service",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"email":  "build@example.com",
+		"groups": []string{"services"},
+	}
+}
+
+func TestJwtBearerTokenAccepted(t *testing.T) {
+	jt := newJwtBearerTest(t)
+	defer jt.Close()
+
+	rw := jt.auth("Bearer " + jt.token(t, jwtClaims()))
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, "build@example.com", rw.HeaderMap.Get("GAP-Auth"))
+	assert.Equal(t, "", rw.HeaderMap.Get("Set-Cookie"))
+}
+
+func TestJwtBearerTokenRejected(t *testing.T) {
+	jt := newJwtBearerTest(t)
+	defer jt.Close()
+
+	assert.Equal(t, http.StatusUnauthorized, jt.auth("").Code)
+	assert.Equal(t, http.StatusUnauthorized, jt.auth("Bearer not-a-jwt").Code)
+
+	for name, mutate := range map[string]func(map[string]interface{}){
+		"wrong issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"wrong audience": func(c map[string]interface{}) { c["aud"] = "someone-else" },
+		"expired":        func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no email":       func(c map[string]interface{}) { delete(c, "email") },
+		"bad domain":     func(c map[string]interface{}) { c["email"] = "build@example.org" },
+		"wrong group":    func(c map[string]interface{}) { c["groups"] = []string{"devs"} },
+	} {
+		claims := jwtClaims()
+		mutate(claims)
+		rw := jt.auth("Bearer " + jt.token(t, claims))
+		if rw.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, rw.Code)
+		}
+	}
+
+	// signed with a key the issuer doesn't publish
+	jt.key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, http.StatusUnauthorized,
+		jt.auth("Bearer "+jt.token(t, jwtClaims())).Code)
+}
+
+func TestSignOut(t *testing.T) {
+	signOut := func(providerLogout bool) *httptest.ResponseRecorder {
+		pc_test := NewProcessCookieTestWithDefaults()
+		provider := NewTestProvider(&url.URL{Host: "idp.example.com"}, "")
+		provider.LogoutURL, _ = url.Parse("https://idp.example.com/logout")
+		pc_test.proxy.provider = provider
+		pc_test.proxy.providerLogout = providerLogout
+		pc_test.req, _ = http.NewRequest("GET",
+			"http://proxy.example.com/oauth2/sign_out?rd=/dashboard", nil)
+		pc_test.SaveSession(&providers.SessionState{
+			Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+			IDToken: "my_id_token"}, time.Now())
+		pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+		return pc_test.rw
+	}
+
+	rw := signOut(false)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/dashboard", rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "", rw.Result().Cookies()[0].Value)
+
+	rw = signOut(true)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "https://idp.example.com/logout?client_id=&id_token_hint=my_id_token"+
+		"&post_logout_redirect_uri=https%3A%2F%2Fproxy.example.com%2Fdashboard",
+		rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "", rw.Result().Cookies()[0].Value)
+}
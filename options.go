@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"crypto"
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"os"
 	"regexp"
@@ -13,59 +18,186 @@ import (
 	"time"
 
 	"github.com/18F/hmacauth"
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/logger"
 	"github.com/bitly/oauth2_proxy/providers"
+	oidc "github.com/coreos/go-oidc"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 // Configuration Options that can be set by Command Line Flag, or Config File
 type Options struct {
-	ProxyPrefix            string `flag:"proxy-prefix" cfg:"proxy-prefix"`
-	HttpAddress            string `flag:"http-address" cfg:"http_address"`
-	HttpsAddress           string `flag:"https-address" cfg:"https_address"`
-	HttpsRedirectorAddress string `flag:"https-redirector-address"`
-	RedirectHttpToHttps    bool   `flag:"redirect-http-to-https"`
-	RedirectURL            string `flag:"redirect-url" cfg:"redirect_url"`
-	ClientID               string `flag:"client-id" cfg:"client_id" env:"OAUTH2_PROXY_CLIENT_ID"`
-	ClientSecret           string `flag:"client-secret" cfg:"client_secret" env:"OAUTH2_PROXY_CLIENT_SECRET"`
-	TLSCertFile            string `flag:"tls-cert" cfg:"tls_cert_file"`
-	TLSKeyFile             string `flag:"tls-key" cfg:"tls_key_file"`
+	ProxyPrefix            string   `flag:"proxy-prefix" cfg:"proxy-prefix"`
+	HttpAddress            string   `flag:"http-address" cfg:"http_address"`
+	HttpsAddress           string   `flag:"https-address" cfg:"https_address"`
+	HttpsRedirectorAddress string   `flag:"https-redirector-address"`
+	RedirectHttpToHttps    bool     `flag:"redirect-http-to-https"`
+	HttpsRedirectorStatus  int      `flag:"https-redirector-status" cfg:"https_redirector_status"`
+	HttpsRedirectorSkip    []string `flag:"https-redirector-skip" cfg:"https_redirector_skip"`
+	RedirectURL            string   `flag:"redirect-url" cfg:"redirect_url"`
+	CanonicalURL           string   `flag:"canonical-url" cfg:"canonical_url"`
+	ClientID               string   `flag:"client-id" cfg:"client_id" env:"OAUTH2_PROXY_CLIENT_ID"`
+	ClientSecret           string   `flag:"client-secret" cfg:"client_secret" env:"OAUTH2_PROXY_CLIENT_SECRET"`
+	TLSCertFile            string   `flag:"tls-cert" cfg:"tls_cert_file"`
+	TLSKeyFile             string   `flag:"tls-key" cfg:"tls_key_file"`
+	TLSMinVersion          string   `flag:"tls-min-version" cfg:"tls_min_version"`
+	TLSMaxVersion          string   `flag:"tls-max-version" cfg:"tls_max_version"`
+	TLSCipherSuites        []string `flag:"tls-cipher-suite" cfg:"tls_cipher_suites"`
+	DisableHTTP2           bool     `flag:"disable-http2" cfg:"disable_http2"`
+	ListenBacklog          int      `flag:"listen-backlog" cfg:"listen_backlog"`
+	ReusePort              bool     `flag:"reuse-port" cfg:"reuse_port"`
+	EnableProxyProtocol    bool     `flag:"enable-proxy-protocol" cfg:"enable_proxy_protocol"`
+	EnableH2C              bool     `flag:"enable-h2c" cfg:"enable_h2c"`
+
+	GracefulShutdownTimeout time.Duration `flag:"graceful-shutdown-timeout" cfg:"graceful_shutdown_timeout"`
+	MetricsAddress          string        `flag:"metrics-address" cfg:"metrics_address"`
+	AdminAddress            string        `flag:"admin-address" cfg:"admin_address"`
+	AdminToken              string        `flag:"admin-token" cfg:"admin_token" env:"OAUTH2_PROXY_ADMIN_TOKEN"`
+	TracingEndpoint         string        `flag:"tracing-endpoint" cfg:"tracing_endpoint"`
+	TracingSampleRate       float64       `flag:"tracing-sample-rate" cfg:"tracing_sample_rate"`
+
+	RateLimit         int           `flag:"rate-limit" cfg:"rate_limit"`
+	RateLimitWindow   time.Duration `flag:"rate-limit-window" cfg:"rate_limit_window"`
+	RateLimitRedisURL string        `flag:"rate-limit-redis-url" cfg:"rate_limit_redis_url" env:"OAUTH2_PROXY_RATE_LIMIT_REDIS_URL"`
+	TrustedProxies    []string      `flag:"trusted-proxy" cfg:"trusted_proxies"`
+	TrustedIPs        []string      `flag:"trusted-ip" cfg:"trusted_ips"`
+
+	UserQuota   int      `flag:"user-quota" cfg:"user_quota"`
+	GroupQuotas []string `flag:"group-quota" cfg:"group_quotas"`
+
+	ResponseCache         bool   `flag:"response-cache" cfg:"response_cache"`
+	ResponseCacheSize     int    `flag:"response-cache-size" cfg:"response_cache_size"`
+	ResponseCacheRedisURL string `flag:"response-cache-redis-url" cfg:"response_cache_redis_url"`
+
+	MaintenanceFile          string   `flag:"maintenance-file" cfg:"maintenance_file"`
+	MaintenancePaths         []string `flag:"maintenance-path" cfg:"maintenance_paths"`
+	MaintenanceAllowedGroups []string `flag:"maintenance-allowed-group" cfg:"maintenance_allowed_groups"`
+
+	AuthzWebhookURL      string        `flag:"authz-webhook-url" cfg:"authz_webhook_url"`
+	AuthzWebhookTimeout  time.Duration `flag:"authz-webhook-timeout" cfg:"authz_webhook_timeout"`
+	AuthzWebhookFailOpen bool          `flag:"authz-webhook-fail-open" cfg:"authz_webhook_fail_open"`
 
 	LetsEncryptEnabled    bool     `flag:"letsencrypt-enabled" cfg:"letsencrypt_enabled"`
 	LetsEncryptHosts      []string `flag:"letsencrypt-host" cfg:"letsencrypt_hosts"`
 	LetsEncryptCacheDir   string   `flag:"letsencrypt-cache-dir" cfg:"letsencrypt_cache_dir"`
 	LetsEncryptAdminEmail string   `flag:"letsencrypt-admin-email" cfg:"letsencrypt_admin_email"`
 
+	LetsEncryptChallenge   string        `flag:"letsencrypt-challenge" cfg:"letsencrypt_challenge"`
+	LetsEncryptDNSProvider string        `flag:"letsencrypt-dns-provider" cfg:"letsencrypt_dns_provider"`
+	LetsEncryptDNSExec     string        `flag:"letsencrypt-dns-exec" cfg:"letsencrypt_dns_exec"`
+	LetsEncryptDNSAPIToken string        `flag:"letsencrypt-dns-api-token" cfg:"letsencrypt_dns_api_token" env:"OAUTH2_PROXY_LETSENCRYPT_DNS_API_TOKEN"`
+	LetsEncryptDNSDelay    time.Duration `flag:"letsencrypt-dns-delay" cfg:"letsencrypt_dns_delay"`
+
+	AllowedGroups            []string `flag:"allowed-group" cfg:"allowed_groups"`
 	AuthenticatedEmailsFile  string   `flag:"authenticated-emails-file" cfg:"authenticated_emails_file"`
 	AzureTenant              string   `flag:"azure-tenant" cfg:"azure_tenant"`
+	AzureV2                  bool     `flag:"azure-v2" cfg:"azure_v2"`
+	AzureGraphGroups         bool     `flag:"azure-graph-groups" cfg:"azure_graph_groups"`
+	BitbucketWorkspace       string   `flag:"bitbucket-workspace" cfg:"bitbucket_workspace"`
+	BitbucketRepository      string   `flag:"bitbucket-repository" cfg:"bitbucket_repository"`
 	EmailDomains             []string `flag:"email-domain" cfg:"email_domains"`
 	GitHubOrg                string   `flag:"github-org" cfg:"github_org"`
 	GitHubTeam               string   `flag:"github-team" cfg:"github_team"`
+	GitLabURL                string   `flag:"gitlab-url" cfg:"gitlab_url"`
+	LoginGovPrivateKeyFile   string   `flag:"login-gov-private-key-file" cfg:"login_gov_private_key_file"`
+	LoginGovACRValues        string   `flag:"login-gov-acr-values" cfg:"login_gov_acr_values"`
+	GitLabGroups             []string `flag:"gitlab-group" cfg:"gitlab_groups"`
+	GitLabProjects           []string `flag:"gitlab-project" cfg:"gitlab_projects"`
 	GoogleGroups             []string `flag:"google-group" cfg:"google_group"`
 	GoogleAdminEmail         string   `flag:"google-admin-email" cfg:"google_admin_email"`
 	GoogleServiceAccountJSON string   `flag:"google-service-account-json" cfg:"google_service_account_json"`
+	KeycloakURL              string   `flag:"keycloak-url" cfg:"keycloak_url"`
+	KeycloakRealm            string   `flag:"keycloak-realm" cfg:"keycloak_realm"`
+	KeycloakRoles            []string `flag:"keycloak-role" cfg:"keycloak_roles"`
 	HtpasswdFile             string   `flag:"htpasswd-file" cfg:"htpasswd_file"`
 	DisplayHtpasswdForm      bool     `flag:"display-htpasswd-form" cfg:"display_htpasswd_form"`
 	CustomTemplatesDir       string   `flag:"custom-templates-dir" cfg:"custom_templates_dir"`
 	Footer                   string   `flag:"footer" cfg:"footer"`
+	AppName                  string   `flag:"app-name" cfg:"app_name"`
+	LogoURL                  string   `flag:"logo-url" cfg:"logo_url"`
+	ProviderButtonText       string   `flag:"provider-button-text" cfg:"provider_button_text"`
 
 	CookieName     string        `flag:"cookie-name" cfg:"cookie_name" env:"OAUTH2_PROXY_COOKIE_NAME"`
-	CookieSecret   string        `flag:"cookie-secret" cfg:"cookie_secret" env:"OAUTH2_PROXY_COOKIE_SECRET"`
-	CookieDomain   string        `flag:"cookie-domain" cfg:"cookie_domain" env:"OAUTH2_PROXY_COOKIE_DOMAIN"`
+	CookieSecrets  []string      `flag:"cookie-secret" cfg:"cookie_secret" env:"OAUTH2_PROXY_COOKIE_SECRET"`
+	CookieDomains  []string      `flag:"cookie-domain" cfg:"cookie_domain" env:"OAUTH2_PROXY_COOKIE_DOMAIN"`
 	CookieExpire   time.Duration `flag:"cookie-expire" cfg:"cookie_expire" env:"OAUTH2_PROXY_COOKIE_EXPIRE"`
 	CookieRefresh  time.Duration `flag:"cookie-refresh" cfg:"cookie_refresh" env:"OAUTH2_PROXY_COOKIE_REFRESH"`
 	CookieSecure   bool          `flag:"cookie-secure" cfg:"cookie_secure"`
 	CookieHttpOnly bool          `flag:"cookie-httponly" cfg:"cookie_httponly"`
+	CookieCompress bool          `flag:"cookie-compress" cfg:"cookie_compress"`
+
+	CookieSameSite    string `flag:"cookie-samesite" cfg:"cookie_samesite"`
+	CookiePartitioned bool   `flag:"cookie-partitioned" cfg:"cookie_partitioned"`
+
+	SessionMemcachedServers []string `flag:"session-memcached-server" cfg:"session_memcached_servers"`
 
+	SessionLimit      int  `flag:"session-limit" cfg:"session_limit"`
+	SessionManagement bool `flag:"session-management" cfg:"session_management"`
+	BearerSessions    bool `flag:"bearer-sessions" cfg:"bearer_sessions"`
+
+	// CookieSecret signs and encrypts new cookies. It defaults to the first
+	// cookie-secret; the others are only used to read existing cookies.
+	CookieSecret string
+
+	CookieSecretFile              string        `flag:"cookie-secret-file" cfg:"cookie_secret_file"`
+	CookieSecretKMSURL            string        `flag:"cookie-secret-kms-url" cfg:"cookie_secret_kms_url"`
+	CookieSecretKMSToken          string        `flag:"cookie-secret-kms-token" cfg:"cookie_secret_kms_token" env:"OAUTH2_PROXY_COOKIE_SECRET_KMS_TOKEN"`
+	CookieSecretKMSCiphertextFile string        `flag:"cookie-secret-kms-ciphertext-file" cfg:"cookie_secret_kms_ciphertext_file"`
+	CookieSecretRefresh           time.Duration `flag:"cookie-secret-refresh" cfg:"cookie_secret_refresh"`
+
+	AuthOnly              bool     `flag:"auth-only" cfg:"auth_only"`
 	Upstreams             []string `flag:"upstream" cfg:"upstreams"`
 	SkipAuthRegex         []string `flag:"skip-auth-regex" cfg:"skip_auth_regex"`
+	SkipAuthRoutes        []string `flag:"skip-auth-route" cfg:"skip_auth_routes"`
+	APIRoutes             []string `flag:"api-route" cfg:"api_routes"`
 	PassBasicAuth         bool     `flag:"pass-basic-auth" cfg:"pass_basic_auth"`
 	BasicAuthPassword     string   `flag:"basic-auth-password" cfg:"basic_auth_password"`
 	PassAccessToken       bool     `flag:"pass-access-token" cfg:"pass_access_token"`
 	PassHostHeader        bool     `flag:"pass-host-header" cfg:"pass_host_header"`
+	PassWebsockets        bool     `flag:"pass-websockets" cfg:"pass_websockets"`
 	SkipProviderButton    bool     `flag:"skip-provider-button" cfg:"skip_provider_button"`
 	PassUserHeaders       bool     `flag:"pass-user-headers" cfg:"pass_user_headers"`
 	SSLInsecureSkipVerify bool     `flag:"ssl-insecure-skip-verify" cfg:"ssl_insecure_skip_verify"`
+	UpstreamTLSCert       string   `flag:"upstream-tls-cert" cfg:"upstream_tls_cert"`
+	UpstreamTLSKey        string   `flag:"upstream-tls-key" cfg:"upstream_tls_key"`
+	UpstreamCAFile        string   `flag:"upstream-ca-file" cfg:"upstream_ca_file"`
 	SetXAuthRequest       bool     `flag:"set-xauthrequest" cfg:"set_xauthrequest"`
 	SkipAuthPreflight     bool     `flag:"skip-auth-preflight" cfg:"skip_auth_preflight"`
+	SkipJwtBearerTokens   bool     `flag:"skip-jwt-bearer-tokens" cfg:"skip_jwt_bearer_tokens"`
+	ExtraJwtIssuers       []string `flag:"extra-jwt-issuer" cfg:"extra_jwt_issuers"`
+
+	FlushInterval      time.Duration `flag:"flush-interval" cfg:"flush_interval"`
+	StreamContentTypes []string      `flag:"stream-content-type" cfg:"stream_content_types"`
+
+	InterceptUpstreamErrors bool `flag:"intercept-upstream-errors" cfg:"intercept_upstream_errors"`
+
+	ReadTimeout             time.Duration `flag:"read-timeout" cfg:"read_timeout"`
+	ReadHeaderTimeout       time.Duration `flag:"read-header-timeout" cfg:"read_header_timeout"`
+	WriteTimeout            time.Duration `flag:"write-timeout" cfg:"write_timeout"`
+	IdleTimeout             time.Duration `flag:"idle-timeout" cfg:"idle_timeout"`
+	MaxHeaderBytes          int           `flag:"max-header-bytes" cfg:"max_header_bytes"`
+	MaxRequestBodySize      int64         `flag:"max-request-body-size" cfg:"max_request_body_size"`
+	UpstreamDialTimeout     time.Duration `flag:"upstream-dial-timeout" cfg:"upstream_dial_timeout"`
+	UpstreamResponseTimeout time.Duration `flag:"upstream-response-timeout" cfg:"upstream_response_timeout"`
+
+	UpstreamHealthCheckPath     string        `flag:"upstream-health-check-path" cfg:"upstream_health_check_path"`
+	UpstreamHealthCheckInterval time.Duration `flag:"upstream-health-check-interval" cfg:"upstream_health_check_interval"`
+
+	UpstreamDiscoveryInterval time.Duration `flag:"upstream-discovery-interval" cfg:"upstream_discovery_interval"`
+	KubernetesAPIURL          string        `flag:"kubernetes-api-url" cfg:"kubernetes_api_url"`
+
+	PassAuthorizationHeader  bool `flag:"pass-authorization-header" cfg:"pass_authorization_header"`
+	StripAuthorizationHeader bool `flag:"strip-authorization-header" cfg:"strip_authorization_header"`
+
+	HSTSMaxAge                  time.Duration `flag:"hsts-max-age" cfg:"hsts_max_age"`
+	HSTSIncludeSubdomains       bool          `flag:"hsts-include-subdomains" cfg:"hsts_include_subdomains"`
+	FrameOptions                string        `flag:"frame-options" cfg:"frame_options"`
+	ContentTypeNosniff          bool          `flag:"content-type-nosniff" cfg:"content_type_nosniff"`
+	SignInContentSecurityPolicy string        `flag:"sign-in-content-security-policy" cfg:"sign_in_content_security_policy"`
+
+	InjectRequestHeaders  []string `flag:"inject-request-header" cfg:"inject_request_headers"`
+	InjectResponseHeaders []string `flag:"inject-response-header" cfg:"inject_response_headers"`
+	StripRequestHeaders   []string `flag:"strip-request-header" cfg:"strip_request_headers"`
 
 	// These options allow for other providers besides Google, with
 	// potential overrides.
@@ -75,46 +207,146 @@ type Options struct {
 	ProfileURL        string `flag:"profile-url" cfg:"profile_url"`
 	ProtectedResource string `flag:"resource" cfg:"resource"`
 	ValidateURL       string `flag:"validate-url" cfg:"validate_url"`
+	LogoutURL         string `flag:"logout-url" cfg:"logout_url"`
+	ProviderLogout    bool   `flag:"provider-logout" cfg:"provider_logout"`
 	Scope             string `flag:"scope" cfg:"scope"`
 	ApprovalPrompt    string `flag:"approval-prompt" cfg:"approval_prompt"`
+	PKCE              bool   `flag:"pkce" cfg:"pkce"`
+	OIDCIssuerURL     string `flag:"oidc-issuer-url" cfg:"oidc_issuer_url"`
+	OIDCEmailClaim    string `flag:"oidc-email-claim" cfg:"oidc_email_claim"`
+	OIDCGroupsClaim   string `flag:"oidc-groups-claim" cfg:"oidc_groups_claim"`
+
+	LoggingFormat         string   `flag:"logging-format" cfg:"logging_format"`
+	LoggingMaxSize        int      `flag:"logging-max-size" cfg:"logging_max_size"`
+	LoggingMaxAge         int      `flag:"logging-max-age" cfg:"logging_max_age"`
+	LoggingMaxBackups     int      `flag:"logging-max-backups" cfg:"logging_max_backups"`
+	LoggingCompress       bool     `flag:"logging-compress" cfg:"logging_compress"`
+	StandardLogging       bool     `flag:"standard-logging" cfg:"standard_logging"`
+	StandardLoggingFormat string   `flag:"standard-logging-format" cfg:"standard_logging_format"`
+	StandardLoggingFile   string   `flag:"standard-logging-file" cfg:"standard_logging_file"`
+	AuthLogging           bool     `flag:"auth-logging" cfg:"auth_logging"`
+	AuthLoggingFormat     string   `flag:"auth-logging-format" cfg:"auth_logging_format"`
+	AuthLoggingFile       string   `flag:"auth-logging-file" cfg:"auth_logging_file"`
+	RequestLogging        bool     `flag:"request-logging" cfg:"request_logging"`
+	RequestLoggingFormat  string   `flag:"request-logging-format" cfg:"request_logging_format"`
+	RequestLoggingFile    string   `flag:"request-logging-file" cfg:"request_logging_file"`
+	ExcludeLoggingPaths   []string `flag:"exclude-logging-path" cfg:"exclude_logging_paths"`
+	SilencePingLogging    bool     `flag:"silence-ping-logging" cfg:"silence_ping_logging"`
+	AuditLog              string   `flag:"audit-log" cfg:"audit_log"`
+
+	SignatureKey     string   `flag:"signature-key" cfg:"signature_key" env:"OAUTH2_PROXY_SIGNATURE_KEY"`
+	SignatureHeaders []string `flag:"signature-header" cfg:"signature_headers"`
 
-	RequestLogging bool `flag:"request-logging" cfg:"request_logging"`
+	UpstreamJWTKeyFile  string        `flag:"upstream-jwt-key-file" cfg:"upstream_jwt_key_file"`
+	UpstreamJWTHeader   string        `flag:"upstream-jwt-header" cfg:"upstream_jwt_header"`
+	UpstreamJWTIssuer   string        `flag:"upstream-jwt-issuer" cfg:"upstream_jwt_issuer"`
+	UpstreamJWTAudience string        `flag:"upstream-jwt-audience" cfg:"upstream_jwt_audience"`
+	UpstreamJWTExpiry   time.Duration `flag:"upstream-jwt-expiry" cfg:"upstream_jwt_expiry"`
 
-	SignatureKey string `flag:"signature-key" cfg:"signature_key" env:"OAUTH2_PROXY_SIGNATURE_KEY"`
+	// Routes are loaded from [[route]] tables in the config file
+	Routes []RouteOptions
+	// Policies are loaded from [[policy]] tables in the config file
+	Policies []PolicyOptions
+	// Providers are loaded from [[provider]] tables in the config file
+	Providers []ProviderOptions
+	// Applications are loaded from [[application]] tables in the config file
+	Applications []ApplicationOptions
+	// ClaimHeaders are loaded from [[claim_header]] tables in the config file
+	ClaimHeaders []ClaimHeaderOptions
 
 	// internal values that are set after config validation
-	redirectURL   *url.URL
-	proxyURLs     []*url.URL
-	CompiledRegex []*regexp.Regexp
-	provider      providers.Provider
-	signatureData *SignatureData
+	redirectURL           *url.URL
+	canonicalURL          *url.URL
+	redirectorSkips       []redirectorSkip
+	proxyURLs             []*url.URL
+	CompiledRegex         []*regexp.Regexp
+	skipAuthRoutes        []skipAuthRoute
+	apiRoutes             []*regexp.Regexp
+	streamContentTypes    []string
+	jwtVerifiers          []*oidc.IDTokenVerifier
+	provider              providers.Provider
+	signatureData         *SignatureData
+	routes                []*route
+	signInProviders       []*signInProvider
+	cookieSameSite        http.SameSite
+	policies              []*policy
+	applications          []*application
+	upstreamTLSConfig     *tls.Config
+	upstreamTimeouts      upstreamTimeouts
+	upstreamHealthCheck   healthCheck
+	kubernetesAPI         *kubernetesAPI
+	quota                 *quota
+	responseCache         *responseCache
+	maintenance           *maintenanceMode
+	authzWebhook          *authzWebhook
+	dnsProvider           dnsProvider
+	injectRequestHeaders  []injectedHeader
+	claimHeaders          []claimHeader
+	upstreamJWT           *upstreamJWTSigner
+	injectResponseHeaders []injectedHeader
+	trustedProxies        []*net.IPNet
+	trustedIPs            []*net.IPNet
+	rateLimiter           *rateLimiter
+	sessionStore          SessionStore
+	resourceKeys          []string
+	cookieKeyring         *cookie.Keyring
+	tlsMinVersion         uint16
+	tlsMaxVersion         uint16
+	tlsCipherSuites       []uint16
+	logger                *logger.Logger
+	auditLog              *auditLog
+	securityHeaders       securityHeaders
 }
 
 type SignatureData struct {
-	hash crypto.Hash
-	key  string
+	hash    crypto.Hash
+	key     string
+	headers []string
 }
 
 func NewOptions() *Options {
 	return &Options{
-		ProxyPrefix:         "/oauth2",
-		HttpAddress:         "127.0.0.1:4180",
-		HttpsAddress:        ":443",
-		DisplayHtpasswdForm: true,
-		CookieName:          "_oauth2_proxy",
-		CookieSecure:        true,
-		CookieHttpOnly:      true,
-		CookieExpire:        time.Duration(168) * time.Hour,
-		CookieRefresh:       time.Duration(0),
-		SetXAuthRequest:     false,
-		SkipAuthPreflight:   false,
-		PassBasicAuth:       true,
-		PassUserHeaders:     true,
-		PassAccessToken:     false,
-		PassHostHeader:      true,
-		ApprovalPrompt:      "force",
-		RequestLogging:      true,
-		LetsEncryptCacheDir: "./",
+		ProxyPrefix:                 "/oauth2",
+		HttpAddress:                 "127.0.0.1:4180",
+		HttpsAddress:                ":443",
+		TLSMinVersion:               "1.2",
+		HttpsRedirectorStatus:       http.StatusPermanentRedirect,
+		GracefulShutdownTimeout:     10 * time.Second,
+		ReadHeaderTimeout:           10 * time.Second,
+		UpstreamHealthCheckInterval: 10 * time.Second,
+		UpstreamDiscoveryInterval:   30 * time.Second,
+		RateLimitWindow:             time.Minute,
+		ResponseCacheSize:           64,
+		AuthzWebhookTimeout:         2 * time.Second,
+		TracingSampleRate:           1,
+		DisplayHtpasswdForm:         true,
+		CookieName:                  "_oauth2_proxy",
+		CookieSecure:                true,
+		CookieHttpOnly:              true,
+		CookieExpire:                time.Duration(168) * time.Hour,
+		CookieRefresh:               time.Duration(0),
+		SetXAuthRequest:             false,
+		SkipAuthPreflight:           false,
+		PassBasicAuth:               true,
+		PassUserHeaders:             true,
+		PassAccessToken:             false,
+		PassHostHeader:              true,
+		PassWebsockets:              true,
+		ApprovalPrompt:              "force",
+		OIDCEmailClaim:              "email",
+		OIDCGroupsClaim:             "groups",
+		LoggingFormat:               "text",
+		LoggingMaxSize:              100,
+		LoggingMaxAge:               7,
+		StandardLogging:             true,
+		AuthLogging:                 true,
+		RequestLogging:              true,
+		LetsEncryptCacheDir:         "./",
+		LetsEncryptChallenge:        "tls-alpn-01",
+		LetsEncryptDNSDelay:         10 * time.Second,
+		UpstreamJWTHeader:           "GAP-Identity",
+		UpstreamJWTIssuer:           "oauth2_proxy",
+		UpstreamJWTExpiry:           time.Minute,
 	}
 }
 
@@ -127,9 +359,27 @@ func parseURL(to_parse string, urltype string, msgs []string) (*url.URL, []strin
 	return parsed, msgs
 }
 
+// the number of previous cookie secrets that remain valid for reading
+// cookies after the secret is rotated
+const cookieSecretRetain = 2
+
 func (o *Options) Validate() error {
+	if msgs := o.validate(); len(msgs) != 0 {
+		return fmt.Errorf("Invalid configuration:\n  %s",
+			strings.Join(msgs, "\n  "))
+	}
+	return nil
+}
+
+func (o *Options) validate() []string {
+	o.resourceKeys = nil
+	base := *o
 	msgs := make([]string, 0)
-	if len(o.Upstreams) < 1 {
+	if o.CookieSecret == "" && len(o.CookieSecrets) != 0 {
+		o.CookieSecret = o.CookieSecrets[0]
+	}
+	msgs = parseCookieSecretSource(o, msgs)
+	if !o.AuthOnly && len(o.Upstreams) < 1 && len(o.Routes) < 1 && len(o.Applications) < 1 {
 		msgs = append(msgs, "missing setting: upstream")
 	}
 	if o.CookieSecret == "" {
@@ -138,13 +388,40 @@ func (o *Options) Validate() error {
 	if o.ClientID == "" {
 		msgs = append(msgs, "missing setting: client-id")
 	}
-	if o.ClientSecret == "" {
+	if o.ClientSecret == "" && o.Provider != "login.gov" {
 		msgs = append(msgs, "missing setting: client-secret")
 	}
 	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomains) == 0 && o.HtpasswdFile == "" {
 		msgs = append(msgs, "missing setting for email validation: email-domain or authenticated-emails-file required.\n      use email-domain=* to authorize all email addresses")
 	}
 
+	switch o.HttpsRedirectorStatus {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		msgs = append(msgs, fmt.Sprintf(
+			"https-redirector-status must be one of 301, 302, 307 or 308, got %d",
+			o.HttpsRedirectorStatus))
+	}
+
+	msgs = parseRedirectorSkips(o, msgs)
+
+	if o.GracefulShutdownTimeout < 0 {
+		msgs = append(msgs, "graceful-shutdown-timeout must not be negative")
+	}
+
+	if o.ListenBacklog < 0 {
+		msgs = append(msgs, "listen-backlog must not be negative")
+	}
+
+	if o.AdminAddress != "" && o.AdminToken == "" {
+		msgs = append(msgs, "missing setting: admin-token")
+	}
+
+	msgs = parseTLSOptions(o, msgs)
+	msgs = parseLoggingOptions(o, msgs)
+	msgs = parseAuditLog(o, msgs)
+
 	if o.LetsEncryptEnabled && (o.TLSCertFile != "" || o.TLSKeyFile != "") {
 		msgs = append(msgs, "cannot enable letsencrypt AND specify a TLS keypair")
 	}
@@ -160,21 +437,41 @@ func (o *Options) Validate() error {
 	if o.LetsEncryptEnabled && len(o.LetsEncryptHosts) == 0 {
 		msgs = append(msgs, "must provide at least one letsencrypt-host if letsencrypt is enabled")
 	}
+	msgs = parseLetsEncryptChallenge(o, msgs)
 
 	o.redirectURL, msgs = parseURL(o.RedirectURL, "redirect", msgs)
+	msgs = parseCanonicalURL(o, msgs)
 
+	msgs = parseUpstreamDiscovery(o, msgs)
+	o.proxyURLs = nil
 	for _, u := range o.Upstreams {
 		upstreamURL, err := url.Parse(u)
 		if err != nil {
 			msgs = append(msgs, fmt.Sprintf(
 				"error parsing upstream=%q %s",
-				upstreamURL, err))
+				u, err))
+			continue
 		}
-		if upstreamURL.Path == "" {
-			upstreamURL.Path = "/"
+		if upstreamURL.Scheme == "unix" {
+			msgs = parseUnixSocketURL(upstreamURL, "upstream", msgs)
+		} else if upstreamURL.Scheme == "file" {
+			msgs = parseFileURL(upstreamURL, "upstream", msgs)
+		} else {
+			if isDiscoveryScheme(upstreamURL.Scheme) {
+				msgs = parseDiscoveryURL(o, upstreamURL, "upstream", msgs)
+			}
+			if upstreamURL.Path == "" {
+				upstreamURL.Path = "/"
+			}
 		}
 		o.proxyURLs = append(o.proxyURLs, upstreamURL)
 	}
+	msgs = parseServerLimits(o, msgs)
+	msgs = parseUpstreamHealthCheck(o, msgs)
+	msgs = parseUpstreamTLS(o, msgs)
+	msgs = parseRoutes(o, msgs)
+	msgs = checkServePatterns(o, msgs)
+	msgs = parseStreamContentTypes(o, msgs)
 
 	for _, u := range o.SkipAuthRegex {
 		CompiledRegex, err := regexp.Compile(u)
@@ -184,30 +481,45 @@ func (o *Options) Validate() error {
 		}
 		o.CompiledRegex = append(o.CompiledRegex, CompiledRegex)
 	}
+	msgs = parseSkipAuthRoutes(o, msgs)
+	msgs = parseAPIRoutes(o, msgs)
+	msgs = parsePolicies(o, msgs)
 	msgs = parseProviderInfo(o, msgs)
+	msgs = parseSignInProviders(o, base, msgs)
+	msgs = parseJwtIssuers(o, msgs)
+	msgs = parseClaimHeaders(o, msgs)
 
-	if o.PassAccessToken || (o.CookieRefresh != time.Duration(0)) {
-		valid_cookie_secret_size := false
-		for _, i := range []int{16, 24, 32} {
-			if len(secretBytes(o.CookieSecret)) == i {
-				valid_cookie_secret_size = true
+	if o.PassAccessToken || o.PassAuthorizationHeader || (o.CookieRefresh != time.Duration(0)) {
+		secrets := []string{o.CookieSecret}
+		if o.cookieKeyring != nil {
+			secrets = nil
+			for _, secret := range o.cookieKeyring.Secrets() {
+				secrets = append(secrets, string(secret))
 			}
 		}
-		var decoded bool
-		if string(secretBytes(o.CookieSecret)) != o.CookieSecret {
-			decoded = true
-		}
-		if valid_cookie_secret_size == false {
-			var suffix string
-			if decoded {
-				suffix = fmt.Sprintf(" note: cookie secret was base64 decoded from %q", o.CookieSecret)
+		for _, secret := range secrets {
+			valid_cookie_secret_size := false
+			for _, i := range []int{16, 24, 32} {
+				if len(secretBytes(secret)) == i {
+					valid_cookie_secret_size = true
+				}
+			}
+			var decoded bool
+			if string(secretBytes(secret)) != secret {
+				decoded = true
+			}
+			if valid_cookie_secret_size == false {
+				var suffix string
+				if decoded {
+					suffix = fmt.Sprintf(" note: cookie secret was base64 decoded from %q", secret)
+				}
+				msgs = append(msgs, fmt.Sprintf(
+					"cookie_secret must be 16, 24, or 32 bytes "+
+						"to create an AES cipher when "+
+						"pass_access_token == true or "+
+						"cookie_refresh != 0, but is %d bytes.%s",
+					len(secretBytes(secret)), suffix))
 			}
-			msgs = append(msgs, fmt.Sprintf(
-				"cookie_secret must be 16, 24, or 32 bytes "+
-					"to create an AES cipher when "+
-					"pass_access_token == true or "+
-					"cookie_refresh != 0, but is %d bytes.%s",
-				len(secretBytes(o.CookieSecret)), suffix))
 		}
 	}
 
@@ -220,7 +532,7 @@ func (o *Options) Validate() error {
 	}
 
 	if len(o.GoogleGroups) > 0 || o.GoogleAdminEmail != "" || o.GoogleServiceAccountJSON != "" {
-		if len(o.GoogleGroups) < 1 {
+		if len(o.GoogleGroups) < 1 && len(o.AllowedGroups) < 1 {
 			msgs = append(msgs, "missing setting: google-group")
 		}
 		if o.GoogleAdminEmail == "" {
@@ -232,7 +544,23 @@ func (o *Options) Validate() error {
 	}
 
 	msgs = parseSignatureKey(o, msgs)
+	msgs = parseUpstreamJWT(o, msgs)
 	msgs = validateCookieName(o, msgs)
+	msgs = parseCookieSameSite(o, msgs)
+	msgs = parseRateLimit(o, msgs)
+	if o.EnableProxyProtocol && len(o.TrustedProxies) == 0 {
+		msgs = append(msgs, "enable-proxy-protocol requires trusted-proxy")
+	}
+	o.trustedIPs, msgs = parseCIDRs(o.TrustedIPs, "trusted-ip", msgs)
+	msgs = parseSessionStore(o, msgs)
+	msgs = parseQuotas(o, msgs)
+	msgs = parseResponseCache(o, msgs)
+	msgs = parseMaintenance(o, msgs)
+	msgs = parseAuthzWebhook(o, msgs)
+	msgs = parseSecurityHeaders(o, msgs)
+	msgs = parseTracing(o, msgs)
+	o.injectRequestHeaders, msgs = parseInjectedHeaders(o.InjectRequestHeaders, "inject-request-header", msgs)
+	o.injectResponseHeaders, msgs = parseInjectedHeaders(o.InjectResponseHeaders, "inject-response-header", msgs)
 
 	if o.SSLInsecureSkipVerify {
 		insecureTransport := &http.Transport{
@@ -241,11 +569,76 @@ func (o *Options) Validate() error {
 		http.DefaultClient = &http.Client{Transport: insecureTransport}
 	}
 
-	if len(msgs) != 0 {
-		return fmt.Errorf("Invalid configuration:\n  %s",
-			strings.Join(msgs, "\n  "))
+	return parseApplications(o, base, msgs)
+}
+
+func parseRateLimit(o *Options, msgs []string) []string {
+	o.trustedProxies, msgs = parseCIDRs(o.TrustedProxies, "trusted-proxy", msgs)
+	o.rateLimiter = nil
+	if o.RateLimit <= 0 {
+		if o.RateLimitRedisURL != "" {
+			msgs = append(msgs, "rate-limit-redis-url requires rate-limit")
+		}
+		return msgs
 	}
-	return nil
+	if o.RateLimitWindow <= 0 {
+		return append(msgs, "rate-limit-window must be positive")
+	}
+
+	var store RateLimitStore = newMemoryRateLimitStore()
+	if o.RateLimitRedisURL != "" {
+		u, err := url.Parse(o.RateLimitRedisURL)
+		if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") {
+			return append(msgs, fmt.Sprintf(
+				"rate-limit-redis-url must be a redis:// or rediss:// URL: %q", o.RateLimitRedisURL))
+		}
+		store = &redisRateLimitStore{pool: sharedRedisPool(o, o.RateLimitRedisURL)}
+	}
+	o.rateLimiter = newRateLimiter(store, o.RateLimit, o.RateLimitWindow, o.trustedProxies)
+	return msgs
+}
+
+func parseSessionStore(o *Options, msgs []string) []string {
+	o.sessionStore = nil
+	if o.SessionLimit < 0 {
+		msgs = append(msgs, "session-limit must not be negative")
+	}
+	if len(o.SessionMemcachedServers) == 0 {
+		if o.SessionLimit > 0 {
+			msgs = append(msgs, "session-limit requires session-memcached-server")
+		}
+		if o.SessionManagement {
+			msgs = append(msgs, "session-management requires session-memcached-server")
+		}
+		if o.BearerSessions {
+			msgs = append(msgs, "bearer-sessions requires session-memcached-server")
+		}
+		return msgs
+	}
+	key := "memcached " + strings.Join(o.SessionMemcachedServers, " ")
+	store, err := o.shared(key, func() (interface{}, error) {
+		return newMemcachedSessionStore(o.SessionMemcachedServers)
+	})
+	if err != nil {
+		return append(msgs, fmt.Sprintf("session-memcached-server: %s", err))
+	}
+	o.sessionStore = store.(*memcachedSessionStore)
+	return msgs
+}
+
+func parseTracing(o *Options, msgs []string) []string {
+	if o.TracingEndpoint != "" {
+		u, err := url.Parse(o.TracingEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			msgs = append(msgs, fmt.Sprintf(
+				"tracing-endpoint must be an http or https URL: %q", o.TracingEndpoint))
+		}
+	}
+	if o.TracingSampleRate < 0 || o.TracingSampleRate > 1 {
+		msgs = append(msgs, fmt.Sprintf(
+			"tracing-sample-rate must be between 0 and 1: %v", o.TracingSampleRate))
+	}
+	return msgs
 }
 
 func parseProviderInfo(o *Options, msgs []string) []string {
@@ -260,28 +653,526 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 	p.ProfileURL, msgs = parseURL(o.ProfileURL, "profile", msgs)
 	p.ValidateURL, msgs = parseURL(o.ValidateURL, "validate", msgs)
 	p.ProtectedResource, msgs = parseURL(o.ProtectedResource, "resource", msgs)
+	p.LogoutURL, msgs = parseURL(o.LogoutURL, "logout", msgs)
 
 	o.provider = providers.New(o.Provider, p)
 	switch p := o.provider.(type) {
 	case *providers.AzureProvider:
-		p.Configure(o.AzureTenant)
+		p.Configure(o.AzureTenant, o.AzureV2)
+		p.GraphGroups = o.AzureGraphGroups
 	case *providers.GitHubProvider:
 		p.SetOrgTeam(o.GitHubOrg, o.GitHubTeam)
+		if len(o.AllowedGroups) > 0 {
+			p.RequireOrgScope()
+		}
+	case *providers.GitLabProvider:
+		msgs = parseGitLabOptions(o, p, msgs)
+	case *providers.BitbucketProvider:
+		if o.BitbucketRepository != "" && o.BitbucketWorkspace == "" {
+			msgs = append(msgs, "bitbucket-repository requires bitbucket-workspace")
+		}
+		p.SetWorkspaceRepositories(o.BitbucketWorkspace, o.BitbucketRepository)
+	case *providers.LoginGovProvider:
+		if o.LoginGovACRValues != "" {
+			p.ACRValues = o.LoginGovACRValues
+		}
+		if o.LoginGovPrivateKeyFile == "" {
+			msgs = append(msgs, "missing setting: login-gov-private-key-file")
+		} else if data, err := ioutil.ReadFile(o.LoginGovPrivateKeyFile); err != nil {
+			msgs = append(msgs, fmt.Sprintf("could not read login-gov-private-key-file: %s", err))
+		} else if p.PrivateKey, err = providers.ParseLoginGovPrivateKey(data); err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid login-gov-private-key-file=%q %s", o.LoginGovPrivateKeyFile, err))
+		}
+	case *providers.KeycloakProvider:
+		msgs = parseKeycloakOptions(o, p, msgs)
+	case *providers.OIDCProvider:
+		p.EmailClaim = o.OIDCEmailClaim
+		p.GroupsClaim = o.OIDCGroupsClaim
+		if o.OIDCIssuerURL == "" {
+			msgs = append(msgs, "missing setting: oidc-issuer-url")
+		} else if err := p.Configure(o.OIDCIssuerURL); err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"error discovering oidc-issuer-url=%q %s", o.OIDCIssuerURL, err))
+		}
 	case *providers.GoogleProvider:
 		if o.GoogleServiceAccountJSON != "" {
 			file, err := os.Open(o.GoogleServiceAccountJSON)
 			if err != nil {
 				msgs = append(msgs, "invalid Google credentials file: "+o.GoogleServiceAccountJSON)
-			} else {
+			} else if len(o.GoogleGroups) > 0 {
 				p.SetGroupRestriction(o.GoogleGroups, o.GoogleAdminEmail, file)
+			} else {
+				p.SetAdminService(o.GoogleAdminEmail, file)
+			}
+		}
+	}
+	if _, ok := o.provider.(*providers.KeycloakProvider); !ok && len(o.KeycloakRoles) != 0 {
+		msgs = append(msgs, "keycloak-role requires provider=keycloak")
+	}
+	if o.ProviderLogout && (p.LogoutURL == nil || p.LogoutURL.String() == "") {
+		msgs = append(msgs, fmt.Sprintf(
+			"provider-logout requires logout-url, the %s provider has no logout endpoint", p.ProviderName))
+	}
+	return msgs
+}
+
+func parseKeycloakOptions(o *Options, p *providers.KeycloakProvider, msgs []string) []string {
+	p.EmailClaim = o.OIDCEmailClaim
+	p.GroupsClaim = o.OIDCGroupsClaim
+	if o.KeycloakURL == "" {
+		msgs = append(msgs, "missing setting: keycloak-url")
+	}
+	if o.KeycloakRealm == "" {
+		msgs = append(msgs, "missing setting: keycloak-realm")
+	}
+	if o.KeycloakURL == "" || o.KeycloakRealm == "" {
+		return msgs
+	}
+	issuerURL := providers.KeycloakIssuerURL(o.KeycloakURL, o.KeycloakRealm)
+	if err := p.Configure(issuerURL); err != nil {
+		msgs = append(msgs, fmt.Sprintf(
+			"error discovering keycloak realm %q at %q %s", o.KeycloakRealm, issuerURL, err))
+	}
+	return msgs
+}
+
+// allowedGroups returns the groups that may sign in: allowed-group along
+// with the group of each keycloak-role
+func (o *Options) allowedGroups() []string {
+	groups := append([]string(nil), o.AllowedGroups...)
+	for _, role := range o.KeycloakRoles {
+		groups = append(groups, providers.KeycloakRoleGroup(role))
+	}
+	return groups
+}
+
+func parseGitLabOptions(o *Options, p *providers.GitLabProvider, msgs []string) []string {
+	if o.GitLabURL != "" {
+		u, err := url.Parse(o.GitLabURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			msgs = append(msgs, fmt.Sprintf(
+				"gitlab-url must be an http or https URL: %q", o.GitLabURL))
+		} else {
+			p.SetGitLabURL(u)
+		}
+	}
+	parse := func(name string, values []string) []providers.GitLabMembership {
+		var memberships []providers.GitLabMembership
+		for _, v := range values {
+			m, err := providers.ParseGitLabMembership(v)
+			if err != nil {
+				msgs = append(msgs, fmt.Sprintf("invalid %s=%q %s", name, v, err))
+				continue
+			}
+			memberships = append(memberships, m)
+		}
+		return memberships
+	}
+	p.SetMemberships(parse("gitlab-group", o.GitLabGroups),
+		parse("gitlab-project", o.GitLabProjects))
+	return msgs
+}
+
+func parseCookieSecretSource(o *Options, msgs []string) []string {
+	var source cookie.KeySource
+	switch {
+	case o.CookieSecretFile != "" && o.CookieSecretKMSURL != "":
+		return append(msgs, "cannot set both cookie-secret-file and cookie-secret-kms-url")
+	case o.CookieSecretFile != "":
+		source = cookie.FileKeySource(o.CookieSecretFile)
+	case o.CookieSecretKMSURL != "":
+		if o.CookieSecretKMSCiphertextFile == "" {
+			return append(msgs, "missing setting: cookie-secret-kms-ciphertext-file")
+		}
+		source = &cookie.KMSKeySource{
+			URL:            o.CookieSecretKMSURL,
+			Token:          o.CookieSecretKMSToken,
+			CiphertextFile: o.CookieSecretKMSCiphertextFile,
+		}
+	default:
+		return parseCookieSecrets(o, msgs)
+	}
+	if o.CookieSecret != "" && o.cookieKeyring == nil {
+		return append(msgs, "cannot set cookie-secret together with cookie-secret-file or cookie-secret-kms-url")
+	}
+
+	needsCipher := o.PassAccessToken || o.PassAuthorizationHeader || o.CookieRefresh != time.Duration(0)
+	keyring, err := cookie.NewKeyring(source, cookieSecretRetain, func(secret []byte) error {
+		if !needsCipher {
+			return nil
+		}
+		_, err := cookie.NewCipher(secretBytes(string(secret)))
+		return err
+	})
+	if err != nil {
+		return append(msgs, fmt.Sprintf("unable to load cookie secret: %s", err))
+	}
+	o.cookieKeyring = keyring
+	o.CookieSecret = string(keyring.Secrets()[0])
+	return msgs
+}
+
+// parseCookieSecrets keeps the cookie-secret values other than the current
+// secret in a keyring, so that cookies issued with them are still accepted
+func parseCookieSecrets(o *Options, msgs []string) []string {
+	secrets := [][]byte{[]byte(o.CookieSecret)}
+	for _, secret := range o.CookieSecrets {
+		if secret != "" && secret != o.CookieSecret {
+			secrets = append(secrets, []byte(secret))
+		}
+	}
+	if len(secrets) > 1 {
+		o.cookieKeyring = cookie.NewStaticKeyring(secrets...)
+	}
+	return msgs
+}
+
+// skipAuthRoute bypasses authentication for requests whose path matches
+// regex and, if method is set, whose method matches too
+type skipAuthRoute struct {
+	method string
+	regex  *regexp.Regexp
+}
+
+func (r skipAuthRoute) matches(req *http.Request) bool {
+	return (r.method == "" || r.method == req.Method) && r.regex.MatchString(req.URL.Path)
+}
+
+func isHTTPMethod(s string) bool {
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// parseSkipAuthRoutes parses routes of the form METHOD=regex, or a bare
+// regex matching any method
+func parseSkipAuthRoutes(o *Options, msgs []string) []string {
+	o.skipAuthRoutes = nil
+	for _, r := range o.SkipAuthRoutes {
+		var route skipAuthRoute
+		pattern := r
+		if i := strings.Index(r, "="); i > 0 && isHTTPMethod(r[:i]) {
+			route.method = r[:i]
+			pattern = r[i+1:]
+		}
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"error compiling skip-auth-route=%q %s", r, err))
+			continue
+		}
+		route.regex = regex
+		o.skipAuthRoutes = append(o.skipAuthRoutes, route)
+	}
+	return msgs
+}
+
+// parseJwtIssuers sets up verification of bearer tokens when
+// skip-jwt-bearer-tokens is enabled. Tokens from the oidc provider are
+// always trusted; extra issuers are given as issuer=audience, with an
+// optional =jwks_url for issuers that don't support discovery.
+func parseJwtIssuers(o *Options, msgs []string) []string {
+	o.jwtVerifiers = nil
+	if !o.SkipJwtBearerTokens {
+		return msgs
+	}
+	switch p := o.provider.(type) {
+	case *providers.OIDCProvider:
+		if p.Verifier != nil {
+			o.jwtVerifiers = append(o.jwtVerifiers, p.Verifier)
+		}
+	case *providers.KeycloakProvider:
+		if p.Verifier != nil {
+			o.jwtVerifiers = append(o.jwtVerifiers, p.Verifier)
+		}
+	}
+	ctx := context.Background()
+	for _, issuer := range o.ExtraJwtIssuers {
+		parts := strings.SplitN(issuer, "=", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid extra-jwt-issuer=%q expected issuer=audience", issuer))
+			continue
+		}
+		config := &oidc.Config{ClientID: parts[1]}
+		if len(parts) == 3 {
+			keySet := oidc.NewRemoteKeySet(ctx, parts[2])
+			o.jwtVerifiers = append(o.jwtVerifiers,
+				oidc.NewVerifier(parts[0], keySet, config))
+			continue
+		}
+		provider, err := oidc.NewProvider(ctx, parts[0])
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"error discovering extra-jwt-issuer=%q %s", issuer, err))
+			continue
+		}
+		o.jwtVerifiers = append(o.jwtVerifiers, provider.Verifier(config))
+	}
+	if o.Provider != "oidc" && o.Provider != "keycloak" && len(o.ExtraJwtIssuers) == 0 {
+		msgs = append(msgs, "skip-jwt-bearer-tokens requires "+
+			"provider=oidc, provider=keycloak or at least one extra-jwt-issuer")
+	}
+	return msgs
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSOptions resolves the tls version and cipher suite names. An empty
+// max version allows the highest version supported.
+func parseTLSOptions(o *Options, msgs []string) []string {
+	o.tlsMinVersion, o.tlsMaxVersion, o.tlsCipherSuites = 0, 0, nil
+	if o.TLSMinVersion != "" {
+		v, ok := tlsVersions[o.TLSMinVersion]
+		if !ok {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid tls-min-version=%q expected one of 1.0, 1.1, 1.2, 1.3", o.TLSMinVersion))
+		}
+		o.tlsMinVersion = v
+	}
+	if o.TLSMaxVersion != "" {
+		v, ok := tlsVersions[o.TLSMaxVersion]
+		if !ok {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid tls-max-version=%q expected one of 1.0, 1.1, 1.2, 1.3", o.TLSMaxVersion))
+		}
+		o.tlsMaxVersion = v
+	}
+	if o.tlsMinVersion != 0 && o.tlsMaxVersion != 0 && o.tlsMinVersion > o.tlsMaxVersion {
+		msgs = append(msgs, "tls-min-version must not be greater than tls-max-version")
+	}
+
+	suites := make(map[string]uint16)
+	for _, c := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[c.Name] = c.ID
+	}
+	for _, name := range o.TLSCipherSuites {
+		id, ok := suites[name]
+		if !ok {
+			msgs = append(msgs, fmt.Sprintf("unknown tls-cipher-suite=%q", name))
+			continue
+		}
+		o.tlsCipherSuites = append(o.tlsCipherSuites, id)
+	}
+	if len(o.tlsCipherSuites) != 0 && !o.DisableHTTP2 && !hasHTTP2CipherSuite(o.tlsCipherSuites) {
+		msgs = append(msgs, "tls-cipher-suite must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 "+
+			"or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 unless disable-http2 is set")
+	}
+	return msgs
+}
+
+// parseLetsEncryptChallenge checks the challenge used to obtain Let's
+// Encrypt certificates and sets up the DNS provider for dns-01, which is
+// required for wildcard hosts
+func parseLetsEncryptChallenge(o *Options, msgs []string) []string {
+	o.dnsProvider = nil
+	if !o.LetsEncryptEnabled {
+		return msgs
+	}
+	switch o.LetsEncryptChallenge {
+	case "tls-alpn-01":
+		for _, h := range o.LetsEncryptHosts {
+			if strings.HasPrefix(h, "*.") {
+				msgs = append(msgs, fmt.Sprintf(
+					"letsencrypt-host %q requires letsencrypt-challenge=dns-01", h))
+			}
+		}
+	case "dns-01":
+		newProvider, ok := dnsProviders[o.LetsEncryptDNSProvider]
+		if !ok {
+			return append(msgs, fmt.Sprintf(
+				"invalid letsencrypt-dns-provider=%q expected one of %s",
+				o.LetsEncryptDNSProvider, dnsProviderNames()))
+		}
+		provider, err := newProvider(o)
+		if err != nil {
+			return append(msgs, fmt.Sprintf("letsencrypt-dns-provider %s %s", o.LetsEncryptDNSProvider, err))
+		}
+		o.dnsProvider = provider
+	default:
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid letsencrypt-challenge=%q expected one of tls-alpn-01, dns-01", o.LetsEncryptChallenge))
+	}
+	return msgs
+}
+
+// matchLetsEncryptHost reports whether host is covered by a letsencrypt-host,
+// which may be a wildcard such as "*.example.com"
+func matchLetsEncryptHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		i := strings.Index(host, ".")
+		return i > 0 && strings.EqualFold(pattern[1:], host[i:])
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+// hasHTTP2CipherSuite reports whether suites include one of the cipher
+// suites that HTTP/2 requires of TLS 1.2 connections
+func hasHTTP2CipherSuite(suites []uint16) bool {
+	for _, id := range suites {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 ||
+			id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLoggingOptions builds the logger. Streams that name the same file
+// share a writer so that rotation happens once.
+func parseLoggingOptions(o *Options, msgs []string) []string {
+	if o.LoggingFormat != "text" && o.LoggingFormat != "json" {
+		return append(msgs, fmt.Sprintf(
+			"invalid logging-format=%q expected text or json", o.LoggingFormat))
+	}
+	output := func(filename string) io.Writer {
+		if filename == "" {
+			return nil
+		}
+		return logFile(o, filename)
+	}
+
+	excludePaths := o.ExcludeLoggingPaths
+	if o.SilencePingLogging {
+		excludePaths = append(excludePaths, "/ping")
+	}
+	var err error
+	o.logger, err = logger.New(logger.Config{
+		JSON:            o.LoggingFormat == "json",
+		StandardEnabled: o.StandardLogging,
+		StandardFormat:  o.StandardLoggingFormat,
+		StandardOutput:  output(o.StandardLoggingFile),
+		AuthEnabled:     o.AuthLogging,
+		AuthFormat:      o.AuthLoggingFormat,
+		AuthOutput:      output(o.AuthLoggingFile),
+		RequestEnabled:  o.RequestLogging,
+		RequestFormat:   o.RequestLoggingFormat,
+		RequestOutput:   output(o.RequestLoggingFile),
+		ExcludePaths:    excludePaths,
+	})
+	if err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	return msgs
+}
+
+// logFile returns the rotating writer for a log file. Logs that name the
+// same file share a writer, also across reloads, so that rotation happens
+// once.
+func logFile(o *Options, filename string) io.Writer {
+	key := fmt.Sprintf("log-file %s %d %d %d %t", filename,
+		o.LoggingMaxSize, o.LoggingMaxAge, o.LoggingMaxBackups, o.LoggingCompress)
+	w, _ := o.shared(key, func() (interface{}, error) {
+		return &lumberjack.Logger{
+			Filename:   filename,
+			MaxSize:    o.LoggingMaxSize,
+			MaxAge:     o.LoggingMaxAge,
+			MaxBackups: o.LoggingMaxBackups,
+			Compress:   o.LoggingCompress,
+			LocalTime:  true,
+		}, nil
+	})
+	return w.(io.Writer)
+}
+
+// parseAuditLog sets up the audit log. Audit files rotate with the same
+// settings as the other logs.
+func parseAuditLog(o *Options, msgs []string) []string {
+	o.auditLog = nil
+	if o.AuditLog == "" {
+		return msgs
+	}
+	file := func(filename string) io.Writer {
+		return logFile(o, filename)
+	}
+	a, err := newAuditLog(o.AuditLog, file)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("audit-log: %s", err))
+	}
+	// syslog and webhook sinks hold a connection or a delivery goroutine
+	if _, ok := a.sink.(io.Closer); ok {
+		sink, _ := o.shared("audit-log "+o.AuditLog, func() (interface{}, error) {
+			return a.sink, nil
+		})
+		a.sink = sink.(auditSink)
+	}
+	o.auditLog = a
+	return msgs
+}
+
+func parseCanonicalURL(o *Options, msgs []string) []string {
+	if o.CanonicalURL == "" {
+		return msgs
+	}
+	u, err := url.Parse(o.CanonicalURL)
+	if err != nil {
+		return append(msgs, fmt.Sprintf(
+			"error parsing canonical-url=%q %s", o.CanonicalURL, err))
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return append(msgs, fmt.Sprintf(
+			"canonical-url must be an absolute http or https URL: %q", o.CanonicalURL))
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return append(msgs, fmt.Sprintf(
+			"canonical-url must not contain a path, query or fragment: %q", o.CanonicalURL))
+	}
+	u.Path = ""
+
+	host := u.Hostname()
+	if o.LetsEncryptEnabled {
+		var found bool
+		for _, h := range o.LetsEncryptHosts {
+			if matchLetsEncryptHost(h, host) {
+				found = true
 			}
 		}
+		if !found {
+			msgs = append(msgs, fmt.Sprintf(
+				"canonical-url host %q is not a letsencrypt-host", host))
+		}
+	}
+	if len(o.CookieDomains) != 0 && cookieDomain(host, o.CookieDomains) == "" {
+		msgs = append(msgs, fmt.Sprintf(
+			"canonical-url host %q is outside of cookie-domain %q", host, strings.Join(o.CookieDomains, ",")))
+	}
+	if o.RedirectHttpToHttps && u.Scheme != "https" {
+		// the https redirector and the canonical redirect would bounce
+		// clients between schemes forever
+		msgs = append(msgs, "canonical-url must use https when redirect-http-to-https is enabled")
+	}
+	o.canonicalURL = u
+	return msgs
+}
+
+func parseRedirectorSkips(o *Options, msgs []string) []string {
+	o.redirectorSkips = nil
+	for _, pattern := range o.HttpsRedirectorSkip {
+		skip, err := newRedirectorSkip(pattern)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid https-redirector-skip=%q %s", pattern, err))
+			continue
+		}
+		o.redirectorSkips = append(o.redirectorSkips, skip)
 	}
 	return msgs
 }
 
 func parseSignatureKey(o *Options, msgs []string) []string {
 	if o.SignatureKey == "" {
+		if len(o.SignatureHeaders) != 0 {
+			msgs = append(msgs, "signature-header requires signature-key")
+		}
 		return msgs
 	}
 
@@ -296,11 +1187,38 @@ func parseSignatureKey(o *Options, msgs []string) []string {
 		return append(msgs, "unsupported signature hash algorithm: "+
 			o.SignatureKey)
 	} else {
-		o.signatureData = &SignatureData{hash, secretKey}
+		o.signatureData = &SignatureData{hash, secretKey, SignatureHeaders}
+	}
+	if len(o.SignatureHeaders) != 0 && o.signatureData != nil {
+		o.signatureData.headers = nil
+		for _, h := range o.SignatureHeaders {
+			o.signatureData.headers = append(o.signatureData.headers, textproto.CanonicalMIMEHeaderKey(h))
+		}
 	}
 	return msgs
 }
 
+func parseUpstreamJWT(o *Options, msgs []string) []string {
+	o.upstreamJWT = nil
+	if o.UpstreamJWTKeyFile == "" {
+		return msgs
+	}
+	if o.UpstreamJWTExpiry <= 0 {
+		return append(msgs, "upstream-jwt-expiry must be positive")
+	}
+	name := textproto.CanonicalMIMEHeaderKey(o.UpstreamJWTHeader)
+	if name == "" || strings.ContainsAny(name, " \t:") {
+		return append(msgs, fmt.Sprintf("invalid upstream-jwt-header=%q", o.UpstreamJWTHeader))
+	}
+	o.UpstreamJWTHeader = name
+	signer, err := newUpstreamJWTSigner(o)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid upstream-jwt-key-file=%q %s", o.UpstreamJWTKeyFile, err))
+	}
+	o.upstreamJWT = signer
+	return msgs
+}
+
 func validateCookieName(o *Options, msgs []string) []string {
 	cookie := &http.Cookie{Name: o.CookieName}
 	if cookie.String() == "" {
@@ -309,6 +1227,31 @@ func validateCookieName(o *Options, msgs []string) []string {
 	return msgs
 }
 
+// parseCookieSameSite checks cookie-samesite and cookie-partitioned. Browsers
+// ignore SameSite=None and Partitioned cookies that aren't Secure.
+func parseCookieSameSite(o *Options, msgs []string) []string {
+	switch strings.ToLower(o.CookieSameSite) {
+	case "":
+		o.cookieSameSite = http.SameSiteDefaultMode
+	case "lax":
+		o.cookieSameSite = http.SameSiteLaxMode
+	case "strict":
+		o.cookieSameSite = http.SameSiteStrictMode
+	case "none":
+		o.cookieSameSite = http.SameSiteNoneMode
+		if !o.CookieSecure {
+			msgs = append(msgs, "cookie-samesite=none requires cookie-secure")
+		}
+	default:
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid cookie-samesite=%q expected lax, strict or none", o.CookieSameSite))
+	}
+	if o.CookiePartitioned && !o.CookieSecure {
+		msgs = append(msgs, "cookie-partitioned requires cookie-secure")
+	}
+	return msgs
+}
+
 func addPadding(secret string) string {
 	padding := len(secret) % 4
 	switch padding {
@@ -2,12 +2,20 @@ package main
 
 import (
 	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/bitly/oauth2_proxy/providers"
 	"github.com/bmizerany/assert"
 )
 
@@ -54,6 +62,17 @@ func TestGoogleGroupOptions(t *testing.T) {
 	assert.Equal(t, expected, err.Error())
 }
 
+func TestOIDCOptionsRequireIssuer(t *testing.T) {
+	o := testOptions()
+	o.Provider = "oidc"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"missing setting: oidc-issuer-url"})
+	assert.Equal(t, expected, err.Error())
+}
+
 func TestLetsEncryptOptions(t *testing.T) {
 	o := testOptions()
 	o.LetsEncryptEnabled = true
@@ -103,10 +122,10 @@ func TestRedirectURL(t *testing.T) {
 
 func TestProxyURLs(t *testing.T) {
 	o := testOptions()
-	o.Upstreams = append(o.Upstreams, "http://127.0.0.1:8081")
+	o.Upstreams = []string{"http://127.0.0.1:8080/api/", "http://127.0.0.1:8081"}
 	assert.Equal(t, nil, o.Validate())
 	expected := []*url.URL{
-		&url.URL{Scheme: "http", Host: "127.0.0.1:8080", Path: "/"},
+		&url.URL{Scheme: "http", Host: "127.0.0.1:8080", Path: "/api/"},
 		// note the '/' was added
 		&url.URL{Scheme: "http", Host: "127.0.0.1:8081", Path: "/"},
 	}
@@ -186,6 +205,29 @@ func TestCookieRefreshMustBeLessThanCookieExpire(t *testing.T) {
 	assert.Equal(t, nil, o.Validate())
 }
 
+func TestMultipleCookieSecrets(t *testing.T) {
+	o := testOptions()
+	o.CookieSecret = ""
+	o.CookieSecrets = []string{"16 bytes AES-128", "24 byte secret AES-192--"}
+	o.PassAccessToken = true
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "16 bytes AES-128", o.CookieSecret)
+	assert.Equal(t, [][]byte{[]byte("16 bytes AES-128"), []byte("24 byte secret AES-192--")},
+		o.cookieKeyring.Secrets())
+
+	// previous secrets must be usable too
+	o = testOptions()
+	o.CookieSecret = ""
+	o.CookieSecrets = []string{"16 bytes AES-128", "previous secret"}
+	o.PassAccessToken = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"cookie_secret must be 16, 24, or 32 bytes to create an AES cipher " +
+			"when pass_access_token == true or cookie_refresh != 0, but is 15 bytes."}),
+		err.Error())
+}
+
 func TestBase64CookieSecret(t *testing.T) {
 	o := testOptions()
 	assert.Equal(t, nil, o.Validate())
@@ -248,3 +290,320 @@ func TestValidateCookieBadName(t *testing.T) {
 	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
 		fmt.Sprintf("  invalid cookie name: %q", o.CookieName))
 }
+
+func TestCanonicalURL(t *testing.T) {
+	o := testOptions()
+	o.CanonicalURL = "https://www.example.com/"
+	assert.Equal(t, nil, o.Validate())
+	expected := &url.URL{Scheme: "https", Host: "www.example.com"}
+	assert.Equal(t, expected, o.canonicalURL)
+}
+
+func TestCanonicalURLWithPath(t *testing.T) {
+	o := testOptions()
+	o.CanonicalURL = "https://www.example.com/app"
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  canonical-url must not contain a path, query or fragment: \"https://www.example.com/app\"")
+}
+
+func TestCanonicalURLOutsideWhitelist(t *testing.T) {
+	o := testOptions()
+	o.CanonicalURL = "http://www.example.com"
+	o.CookieDomains = []string{".example.org"}
+	o.RedirectHttpToHttps = true
+	err := o.Validate()
+	assert.Equal(t, err.Error(), errorMsg([]string{
+		"canonical-url host \"www.example.com\" is outside of cookie-domain \".example.org\"",
+		"canonical-url must use https when redirect-http-to-https is enabled",
+	}))
+}
+
+func TestHttpsRedirectorStatus(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, 308, o.HttpsRedirectorStatus)
+	o.HttpsRedirectorStatus = 303
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  https-redirector-status must be one of 301, 302, 307 or 308, got 303")
+}
+
+func TestCookieSecretKMSUnreachable(t *testing.T) {
+	o := testOptions()
+	o.CookieSecret = ""
+	o.CookieSecretKMSURL = "http://127.0.0.1:1/decrypt"
+	o.CookieSecretKMSCiphertextFile = "options_test.go"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(), "unable to load cookie secret"))
+}
+
+func TestCookieSecretSourceConflict(t *testing.T) {
+	o := testOptions()
+	o.CookieSecretFile = "options_test.go"
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  cannot set cookie-secret together with cookie-secret-file or cookie-secret-kms-url")
+}
+
+func TestSkipAuthRoutes(t *testing.T) {
+	o := testOptions()
+	o.SkipAuthRoutes = []string{"GET=^/healthz$", "^/static/", "^/search\\?q=.*"}
+	assert.Equal(t, nil, o.Validate())
+
+	assert.Equal(t, 3, len(o.skipAuthRoutes))
+	assert.Equal(t, "GET", o.skipAuthRoutes[0].method)
+	assert.Equal(t, "^/healthz$", o.skipAuthRoutes[0].regex.String())
+	assert.Equal(t, "", o.skipAuthRoutes[1].method)
+	assert.Equal(t, "^/static/", o.skipAuthRoutes[1].regex.String())
+	// an "=" that doesn't follow a method is part of the regex
+	assert.Equal(t, "", o.skipAuthRoutes[2].method)
+	assert.Equal(t, "^/search\\?q=.*", o.skipAuthRoutes[2].regex.String())
+}
+
+func TestInvalidSkipAuthRoute(t *testing.T) {
+	o := testOptions()
+	o.SkipAuthRoutes = []string{"GET=("}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"error compiling skip-auth-route=\"GET=(\" error parsing regexp: missing closing ): `(`"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestJwtBearerTokensRequireIssuer(t *testing.T) {
+	o := testOptions()
+	o.SkipJwtBearerTokens = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"skip-jwt-bearer-tokens requires provider=oidc, provider=keycloak or at least one extra-jwt-issuer"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestInvalidExtraJwtIssuer(t *testing.T) {
+	o := testOptions()
+	o.SkipJwtBearerTokens = true
+	o.ExtraJwtIssuers = []string{"https://issuer.example.com"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"invalid extra-jwt-issuer=\"https://issuer.example.com\" expected issuer=audience"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestExtraJwtIssuerWithJwksURL(t *testing.T) {
+	o := testOptions()
+	o.SkipJwtBearerTokens = true
+	o.ExtraJwtIssuers = []string{"https://issuer.example.com=api=https://issuer.example.com/keys"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 1, len(o.jwtVerifiers))
+}
+
+func TestTLSOptions(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, uint16(tls.VersionTLS12), o.tlsMinVersion)
+	assert.Equal(t, uint16(0), o.tlsMaxVersion)
+
+	o.TLSMinVersion = "1.3"
+	o.TLSMaxVersion = "1.3"
+	o.TLSCipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, uint16(tls.VersionTLS13), o.tlsMinVersion)
+	assert.Equal(t, uint16(tls.VersionTLS13), o.tlsMaxVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, o.tlsCipherSuites)
+}
+
+func TestInvalidTLSOptions(t *testing.T) {
+	o := testOptions()
+	o.TLSMinVersion = "1.3"
+	o.TLSMaxVersion = "1.2"
+	o.TLSCipherSuites = []string{"TLS_NOT_A_CIPHER", "TLS_RSA_WITH_AES_256_GCM_SHA384"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"tls-min-version must not be greater than tls-max-version",
+		"unknown tls-cipher-suite=\"TLS_NOT_A_CIPHER\"",
+		"tls-cipher-suite must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 " +
+			"or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 unless disable-http2 is set",
+	})
+	assert.Equal(t, expected, err.Error())
+
+	o.TLSMinVersion = "1.4"
+	o.TLSMaxVersion = ""
+	o.TLSCipherSuites = []string{"TLS_RSA_WITH_AES_256_GCM_SHA384"}
+	o.DisableHTTP2 = true
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"invalid tls-min-version=\"1.4\" expected one of 1.0, 1.1, 1.2, 1.3"}), err.Error())
+}
+
+func TestInvalidLoggingOptions(t *testing.T) {
+	o := testOptions()
+	o.LoggingFormat = "xml"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"invalid logging-format=\"xml\" expected text or json"}), err.Error())
+
+	o.LoggingFormat = "text"
+	o.RequestLoggingFormat = "{{.Client"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.HasPrefix(err.Error(),
+		errorMsg([]string{"error parsing request logging format: "})))
+}
+
+func TestGitLabOptions(t *testing.T) {
+	o := testOptions()
+	o.Provider = "gitlab"
+	o.GitLabURL = "https://gitlab.example.com"
+	o.GitLabGroups = []string{"infra"}
+	o.GitLabProjects = []string{"apps/billing=developer"}
+	assert.Equal(t, nil, o.Validate())
+
+	p := o.provider.(*providers.GitLabProvider)
+	assert.Equal(t, "https://gitlab.example.com/oauth/authorize", p.Data().LoginURL.String())
+	assert.Equal(t, "https://gitlab.example.com/api/v4/user", p.Data().ValidateURL.String())
+	assert.Equal(t, []providers.GitLabMembership{{Path: "infra", MinAccessLevel: 10}}, p.Groups)
+	assert.Equal(t, []providers.GitLabMembership{{Path: "apps/billing", MinAccessLevel: 30}}, p.Projects)
+}
+
+func TestInvalidGitLabOptions(t *testing.T) {
+	o := testOptions()
+	o.Provider = "gitlab"
+	o.GitLabURL = "gitlab.example.com"
+	o.GitLabGroups = []string{"infra=admin"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"gitlab-url must be an http or https URL: \"gitlab.example.com\"",
+		"invalid gitlab-group=\"infra=admin\" unknown access level \"admin\"",
+	}), err.Error())
+}
+
+func TestBitbucketOptions(t *testing.T) {
+	o := testOptions()
+	o.Provider = "bitbucket"
+	o.BitbucketRepository = "infra, deploy"
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{"bitbucket-repository requires bitbucket-workspace"}), err.Error())
+
+	o.BitbucketWorkspace = "acme"
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.BitbucketProvider)
+	assert.Equal(t, "acme", p.Workspace)
+	assert.Equal(t, []string{"infra", "deploy"}, p.Repositories)
+	assert.Equal(t, "account email repository", p.Data().Scope)
+}
+
+func TestLoginGovOptions(t *testing.T) {
+	o := testOptions()
+	o.Provider = "login.gov"
+	o.ClientSecret = ""
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"missing setting: login-gov-private-key-file"}), err.Error())
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	f, _ := ioutil.TempFile("", "login-gov-key")
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	f.Close()
+	o.LoginGovPrivateKeyFile = f.Name()
+	o.LoginGovACRValues = "http://idmanagement.gov/ns/assurance/ial/2"
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.LoginGovProvider)
+	assert.Equal(t, key.N, p.PrivateKey.N)
+	assert.Equal(t, "http://idmanagement.gov/ns/assurance/ial/2", p.ACRValues)
+}
+
+func TestKeycloakOptions(t *testing.T) {
+	o := testOptions()
+	o.KeycloakRoles = []string{"admin"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"keycloak-role requires provider=keycloak"}), err.Error())
+
+	o.Provider = "keycloak"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"missing setting: keycloak-url",
+		"missing setting: keycloak-realm"}), err.Error())
+
+	o.AllowedGroups = []string{"ops"}
+	o.KeycloakRoles = []string{"admin", "wiki:editor"}
+	assert.Equal(t, []string{"ops", "role:admin", "role:wiki:editor"}, o.allowedGroups())
+	assert.Equal(t, []string{"ops"}, o.AllowedGroups)
+}
+
+func TestRateLimitOptions(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, (*rateLimiter)(nil), o.rateLimiter)
+
+	o.RateLimit = 10
+	o.RateLimitRedisURL = "redis://127.0.0.1:6379/0"
+	o.TrustedProxies = []string{"10.0.0.0/8"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, int64(10), o.rateLimiter.limit)
+	assert.Equal(t, time.Minute, o.rateLimiter.window)
+	assert.Equal(t, 1, len(o.rateLimiter.trusted))
+	_, ok := o.rateLimiter.store.(*redisRateLimitStore)
+	assert.Equal(t, true, ok)
+}
+
+func TestInvalidRateLimitOptions(t *testing.T) {
+	o := testOptions()
+	o.RateLimit = 10
+	o.RateLimitWindow = 0
+	o.TrustedProxies = []string{"10.0.0.0/33"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"trusted-proxy is not an address or CIDR range: \"10.0.0.0/33\"",
+		"rate-limit-window must be positive",
+	}), err.Error())
+
+	o = testOptions()
+	o.RateLimit = 10
+	o.RateLimitRedisURL = "127.0.0.1:6379"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"rate-limit-redis-url must be a redis:// or rediss:// URL: \"127.0.0.1:6379\""}), err.Error())
+}
+
+func TestProviderLogoutRequiresLogoutURL(t *testing.T) {
+	o := testOptions()
+	o.ProviderLogout = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"provider-logout requires logout-url, the Google provider has no logout endpoint"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.ProviderLogout = true
+	o.LogoutURL = "https://accounts.example.com/logout"
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestProxyProtocolRequiresTrustedProxy(t *testing.T) {
+	o := testOptions()
+	o.EnableProxyProtocol = true
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{"enable-proxy-protocol requires trusted-proxy"}), err.Error())
+
+	o.TrustedProxies = []string{"10.0.0.0/8"}
+	assert.Equal(t, nil, o.Validate())
+}
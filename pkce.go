@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// newCodeVerifier returns a random PKCE code verifier (RFC 7636), 43
+// characters of base64url as recommended
+func newCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// codeChallenge returns the S256 code challenge for a code verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// csrfCookieValue joins the CSRF nonce with the PKCE code verifier and the
+// id of the provider signed in with, if any, that the callback needs from
+// the CSRF cookie
+func csrfCookieValue(nonce, verifier, provider string) string {
+	v := nonce
+	if verifier != "" || provider != "" {
+		v += ":" + verifier
+	}
+	if provider != "" {
+		v += ":" + provider
+	}
+	return v
+}
+
+// parseCSRFCookieValue splits a value from csrfCookieValue
+func parseCSRFCookieValue(v string) (nonce, verifier, provider string) {
+	parts := strings.SplitN(v, ":", 3)
+	nonce = parts[0]
+	if len(parts) > 1 {
+		verifier = parts[1]
+	}
+	if len(parts) > 2 {
+		provider = parts[2]
+	}
+	return
+}
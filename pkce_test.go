@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestCodeChallenge(t *testing.T) {
+	// RFC 7636 Appendix B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		codeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+
+	verifier, err := newCodeVerifier()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 43, len(verifier))
+}
+
+func TestCSRFCookieValue(t *testing.T) {
+	nonce, verifier, provider := parseCSRFCookieValue(csrfCookieValue("abc123", "verifier-_x", ""))
+	assert.Equal(t, "abc123", nonce)
+	assert.Equal(t, "verifier-_x", verifier)
+	assert.Equal(t, "", provider)
+
+	nonce, verifier, provider = parseCSRFCookieValue(csrfCookieValue("abc123", "", ""))
+	assert.Equal(t, "abc123", nonce)
+	assert.Equal(t, "", verifier)
+	assert.Equal(t, "", provider)
+
+	nonce, verifier, provider = parseCSRFCookieValue(csrfCookieValue("abc123", "", "github"))
+	assert.Equal(t, "abc123", nonce)
+	assert.Equal(t, "", verifier)
+	assert.Equal(t, "github", provider)
+}
+
+func TestPKCELoginFlow(t *testing.T) {
+	var redeemedVerifier string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		redeemedVerifier = r.Form.Get("code_verifier")
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer provider.Close()
+
+	opts := testOptions()
+	opts.PKCE = true
+	assert.Equal(t, nil, opts.Validate())
+	providerURL, _ := url.Parse(provider.URL)
+	opts.provider = NewTestProvider(providerURL, "michael.bland@gsa.gov")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?rd=/dashboard", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	login, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "S256", login.Query().Get("code_challenge_method"))
+	csrf := rw.Result().Cookies()[0]
+	nonce, verifier, _ := parseCSRFCookieValue(csrf.Value)
+	assert.Equal(t, codeChallenge(verifier), login.Query().Get("code_challenge"))
+	assert.Equal(t, nonce+":/dashboard", login.Query().Get("state"))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+
+		url.QueryEscape(login.Query().Get("state")), nil)
+	req.AddCookie(csrf)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/dashboard", rw.HeaderMap.Get("Location"))
+	assert.Equal(t, verifier, redeemedVerifier)
+}
+
+func TestCallbackChecksCSRFBeforeRedeeming(t *testing.T) {
+	redeemed := false
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redeemed = true
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer provider.Close()
+
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	providerURL, _ := url.Parse(provider.URL)
+	opts.provider = NewTestProvider(providerURL, "michael.bland@gsa.gov")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "other:verifier", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, false, redeemed)
+}
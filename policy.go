@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// the ways a request can be authenticated, for a policy's auth_methods
+const (
+	authMethodCookie = "cookie"
+	authMethodJWT    = "jwt"
+	authMethodBasic  = "basic"
+)
+
+// statusPolicyDenied is returned by Authenticate when the user is
+// authenticated but the policy for the request doesn't allow them, as
+// opposed to http.StatusForbidden when they need to sign in. It is never
+// sent to clients.
+const statusPolicyDenied = -http.StatusForbidden
+
+// PolicyOptions describes the conditions a request must meet, from a
+// [[policy]] table in the config file. Each policy applies to requests for
+// its host and path prefix, and optionally only to some methods.
+type PolicyOptions struct {
+	Host          string   `toml:"host" yaml:"host"`
+	Path          string   `toml:"path" yaml:"path"`
+	Methods       []string `toml:"methods" yaml:"methods"`
+	AllowedGroups []string `toml:"allowed_groups" yaml:"allowed_groups"`
+	AllowedEmails []string `toml:"allowed_emails" yaml:"allowed_emails"`
+	AuthMethods   []string `toml:"auth_methods" yaml:"auth_methods"`
+}
+
+type policy struct {
+	name          string
+	host          string
+	path          string
+	methods       []string
+	allowedGroups []string
+	allowedEmails []string
+	authMethods   []string
+}
+
+// loadPolicies reads the [[policy]] tables from a config file
+func loadPolicies(path string) ([]PolicyOptions, error) {
+	var cfg struct {
+		Policies []PolicyOptions `toml:"policy"`
+	}
+	_, err := toml.DecodeFile(path, &cfg)
+	return cfg.Policies, err
+}
+
+func parsePolicies(o *Options, msgs []string) []string {
+	o.policies = nil
+	for i, p := range o.Policies {
+		name := fmt.Sprintf("policy[%d]", i)
+		path := p.Path
+		if path == "" {
+			path = "/"
+		}
+		if !strings.HasPrefix(path, "/") {
+			msgs = append(msgs, fmt.Sprintf(
+				"%s path must begin with /: %q", name, p.Path))
+			continue
+		}
+		if strings.ContainsAny(p.Host, "/:") {
+			msgs = append(msgs, fmt.Sprintf(
+				"%s host must be a bare hostname: %q", name, p.Host))
+			continue
+		}
+		pol := &policy{
+			name:          name,
+			host:          strings.ToLower(p.Host),
+			path:          path,
+			allowedGroups: p.AllowedGroups,
+		}
+		for _, m := range p.Methods {
+			pol.methods = append(pol.methods, strings.ToUpper(m))
+		}
+		for _, e := range p.AllowedEmails {
+			pol.allowedEmails = append(pol.allowedEmails, strings.ToLower(e))
+		}
+		valid := true
+		for _, m := range p.AuthMethods {
+			switch m {
+			case authMethodCookie, authMethodJWT, authMethodBasic:
+				pol.authMethods = append(pol.authMethods, m)
+			default:
+				msgs = append(msgs, fmt.Sprintf(
+					"%s auth_methods must be %s, %s or %s: %q",
+					name, authMethodCookie, authMethodJWT, authMethodBasic, m))
+				valid = false
+			}
+		}
+		if valid {
+			o.policies = append(o.policies, pol)
+		}
+	}
+	return msgs
+}
+
+func (pol *policy) matches(req *http.Request) bool {
+	if pol.host != "" {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+		if strings.ToLower(host) != pol.host {
+			return false
+		}
+	}
+	if !pathHasPrefix(req.URL.Path, pol.path) {
+		return false
+	}
+	if len(pol.methods) == 0 {
+		return true
+	}
+	for _, m := range pol.methods {
+		if m == req.Method {
+			return true
+		}
+	}
+	return false
+}
+
+// pathHasPrefix reports whether p is prefix or below it. A prefix that
+// doesn't end in / only matches whole path segments, so /admin matches
+// /admin and /admin/users but not /administrator.
+func pathHasPrefix(p, prefix string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(p, prefix)
+	}
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// accepts reports whether requests may be authenticated with method. A nil
+// policy, for requests that no policy applies to, accepts every method.
+func (pol *policy) accepts(method string) bool {
+	if pol == nil || len(pol.authMethods) == 0 {
+		return true
+	}
+	for _, m := range pol.authMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the session meets the policy's conditions, which
+// are in addition to email-domain, allowed-group and the other global
+// restrictions
+func (pol *policy) allows(session *providers.SessionState) bool {
+	if pol == nil {
+		return true
+	}
+	if len(pol.allowedEmails) != 0 {
+		found := false
+		for _, e := range pol.allowedEmails {
+			if e == strings.ToLower(session.Email) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(pol.allowedGroups) != 0 {
+		for _, allowed := range pol.allowedGroups {
+			for _, g := range session.Groups {
+				if g == allowed {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// policyFor returns the first policy that applies to a request, or nil.
+// Requests to the auth only endpoint are matched on the original request
+// when the proxy in front says what it was.
+func (p *OAuthProxy) policyFor(req *http.Request) *policy {
+	if len(p.policies) == 0 {
+		return nil
+	}
+	req = p.authorizedRequest(req)
+	for _, pol := range p.policies {
+		if pol.matches(req) {
+			return pol
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestLoadPolicies(t *testing.T) {
+	file, err := ioutil.TempFile("", "oauth2_proxy.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`
+upstreams = ["http://127.0.0.1:8080/"]
+
+[[policy]]
+path = "/admin/"
+allowed_groups = ["ops"]
+
+[[policy]]
+host = "api.example.com"
+path = "/api/"
+methods = ["POST"]
+auth_methods = ["jwt"]
+`)
+	file.Close()
+
+	policies, err := loadPolicies(file.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []PolicyOptions{
+		{Path: "/admin/", AllowedGroups: []string{"ops"}},
+		{Host: "api.example.com", Path: "/api/", Methods: []string{"POST"}, AuthMethods: []string{"jwt"}},
+	}, policies)
+}
+
+func TestInvalidPolicies(t *testing.T) {
+	o := testOptions()
+	o.Policies = []PolicyOptions{
+		{Path: "admin"},
+		{Host: "example.com:443"},
+		{Path: "/api/", AuthMethods: []string{"jwt", "oauth"}},
+		{Path: "/"},
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"policy[0] path must begin with /: \"admin\"",
+		"policy[1] host must be a bare hostname: \"example.com:443\"",
+		"policy[2] auth_methods must be cookie, jwt or basic: \"oauth\"",
+	}), err.Error())
+	assert.Equal(t, 1, len(o.policies))
+}
+
+func TestPolicyMatches(t *testing.T) {
+	o := testOptions()
+	o.Policies = []PolicyOptions{
+		{Host: "API.example.com", Path: "/api/", Methods: []string{"post"}},
+	}
+	assert.Equal(t, nil, o.Validate())
+	pol := o.policies[0]
+
+	matches := func(method, rawurl string) bool {
+		req, _ := http.NewRequest(method, rawurl, nil)
+		return pol.matches(req)
+	}
+	assert.Equal(t, true, matches("POST", "http://api.example.com/api/builds"))
+	assert.Equal(t, true, matches("POST", "http://api.example.com:8080/api/builds"))
+	assert.Equal(t, false, matches("GET", "http://api.example.com/api/builds"))
+	assert.Equal(t, false, matches("POST", "http://www.example.com/api/builds"))
+	assert.Equal(t, false, matches("POST", "http://api.example.com/admin/"))
+
+	// paths without a trailing slash only match whole segments
+	pol.path = "/admin"
+	assert.Equal(t, true, matches("POST", "http://api.example.com/admin"))
+	assert.Equal(t, true, matches("POST", "http://api.example.com/admin/users"))
+	assert.Equal(t, false, matches("POST", "http://api.example.com/administrator"))
+	assert.Equal(t, false, matches("POST", "http://api.example.com/admin-public"))
+}
+
+func TestPolicyAllows(t *testing.T) {
+	pol := &policy{allowedGroups: []string{"ops", "admins"}}
+	assert.Equal(t, true, pol.allows(&providers.SessionState{Groups: []string{"devs", "ops"}}))
+	assert.Equal(t, false, pol.allows(&providers.SessionState{Groups: []string{"devs"}}))
+
+	pol = &policy{allowedEmails: []string{"michael.bland@gsa.gov"}}
+	assert.Equal(t, true, pol.allows(&providers.SessionState{Email: "Michael.Bland@gsa.gov"}))
+	assert.Equal(t, false, pol.allows(&providers.SessionState{Email: "someone@gsa.gov"}))
+
+	pol = nil
+	assert.Equal(t, true, pol.allows(&providers.SessionState{}))
+	assert.Equal(t, true, pol.accepts(authMethodCookie))
+}
+
+func TestAuthenticateWithPolicies(t *testing.T) {
+	test := func(path string, groups []string) *ProcessCookieTest {
+		pc_test := NewProcessCookieTestWithDefaults()
+		pc_test.proxy.policies = []*policy{
+			{name: "policy[0]", path: "/admin/", allowedGroups: []string{"ops"}},
+			{name: "policy[1]", path: "/api/", authMethods: []string{authMethodJWT}},
+		}
+		pc_test.req, _ = http.NewRequest("GET", path, nil)
+		pc_test.SaveSession(&providers.SessionState{
+			Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+			Groups: groups}, time.Now())
+		pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+		return pc_test
+	}
+
+	assert.Equal(t, http.StatusAccepted, test("/oauth2/auth/admin/users", []string{"ops"}).rw.Code)
+	assert.Equal(t, http.StatusAccepted, test("/oauth2/auth/", []string{"devs"}).rw.Code)
+
+	// signed in users without the group are denied rather than signed out
+	denied := test("/oauth2/auth/admin/users", []string{"devs"})
+	assert.Equal(t, http.StatusForbidden, denied.rw.Code)
+	assert.Equal(t, "", denied.rw.HeaderMap.Get("Set-Cookie"))
+	denied = test("/admin/users", []string{"devs"})
+	assert.Equal(t, http.StatusForbidden, denied.rw.Code)
+	assert.Equal(t, true, strings.Contains(denied.rw.Body.String(), "Permission Denied"))
+
+	// the session cookie isn't accepted where only bearer tokens are
+	assert.Equal(t, http.StatusUnauthorized, test("/oauth2/auth/api/builds", []string{"ops"}).rw.Code)
+
+	// policies apply to paths that upstreams resolve to theirs
+	for _, path := range []string{
+		"/oauth2/auth//admin/users",
+		"/oauth2/auth/./admin/users",
+		"/oauth2/auth/public/../admin/users",
+		"/oauth2/auth/admin//users",
+	} {
+		assert.Equal(t, http.StatusForbidden, test(path, []string{"devs"}).rw.Code)
+	}
+}
+
+func TestPolicyForForwardedURI(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.policies = []*policy{{name: "policy[0]", path: "/admin/"}}
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	pc_test.proxy.trustedProxies = []*net.IPNet{trusted}
+	policyFor := func(uri string) *policy {
+		req, _ := http.NewRequest("GET", "/oauth2/auth", nil)
+		req.RemoteAddr = "10.0.0.2:4000"
+		req.Header.Set("X-Forwarded-Uri", uri)
+		return pc_test.proxy.policyFor(req)
+	}
+
+	for _, uri := range []string{"/admin/x", "//admin/x", "/./admin/x", "/public/../admin/x", "/admin/"} {
+		assert.Equal(t, pc_test.proxy.policies[0], policyFor(uri))
+	}
+	assert.Equal(t, (*policy)(nil), policyFor("/admin/../public/x"))
+}
@@ -1,22 +1,37 @@
 package providers
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/bitly/go-simplejson"
 	"github.com/bitly/oauth2_proxy/api"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 )
 
 type AzureProvider struct {
 	*ProviderData
 	Tenant string
+	// GraphGroups enables looking up a user's groups with Microsoft Graph
+	// when they are in too many for Azure AD to list them in the id_token
+	GraphGroups bool
+
+	// which settings were defaulted for the v1 endpoints, and so should be
+	// changed when Configure selects v2
+	defaultProfileURL bool
+	defaultResource   bool
+	defaultScope      bool
 }
 
 func NewAzureProvider(p *ProviderData) *AzureProvider {
 	p.ProviderName = "Azure"
+	a := &AzureProvider{ProviderData: p}
 
 	if p.ProfileURL == nil || p.ProfileURL.String() == "" {
 		p.ProfileURL = &url.URL{
@@ -25,39 +40,227 @@ func NewAzureProvider(p *ProviderData) *AzureProvider {
 			Path:     "/me",
 			RawQuery: "api-version=1.6",
 		}
+		a.defaultProfileURL = true
 	}
 	if p.ProtectedResource == nil || p.ProtectedResource.String() == "" {
 		p.ProtectedResource = &url.URL{
 			Scheme: "https",
 			Host:   "graph.windows.net",
 		}
+		a.defaultResource = true
 	}
 	if p.Scope == "" {
 		p.Scope = "openid"
+		a.defaultScope = true
 	}
 
-	return &AzureProvider{ProviderData: p}
+	return a
 }
 
-func (p *AzureProvider) Configure(tenant string) {
+// Configure sets the endpoints for a tenant, which may be "common" or empty
+// for the tenant-independent endpoints. With v2 the v2.0 endpoints are used,
+// which take scopes rather than a resource and read the profile from
+// Microsoft Graph.
+func (p *AzureProvider) Configure(tenant string, v2 bool) {
 	p.Tenant = tenant
 	if tenant == "" {
 		p.Tenant = "common"
 	}
+	path := "/" + p.Tenant + "/oauth2"
+	if v2 {
+		path += "/v2.0"
+	}
 
 	if p.LoginURL == nil || p.LoginURL.String() == "" {
 		p.LoginURL = &url.URL{
 			Scheme: "https",
 			Host:   "login.microsoftonline.com",
-			Path:   "/" + p.Tenant + "/oauth2/authorize"}
+			Path:   path + "/authorize"}
 	}
 	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
 		p.RedeemURL = &url.URL{
 			Scheme: "https",
 			Host:   "login.microsoftonline.com",
-			Path:   "/" + p.Tenant + "/oauth2/token",
+			Path:   path + "/token",
+		}
+	}
+	if p.LogoutURL == nil || p.LogoutURL.String() == "" {
+		p.LogoutURL = &url.URL{
+			Scheme: "https",
+			Host:   "login.microsoftonline.com",
+			Path:   path + "/logout",
+		}
+	}
+	if !v2 {
+		return
+	}
+	if p.defaultProfileURL {
+		p.ProfileURL = &url.URL{
+			Scheme: "https",
+			Host:   "graph.microsoft.com",
+			Path:   "/v1.0/me",
 		}
 	}
+	if p.defaultResource {
+		// the v2.0 endpoints reject the resource parameter
+		p.ProtectedResource = &url.URL{}
+	}
+	if p.defaultScope {
+		p.Scope = "openid email profile User.Read"
+	}
+}
+
+// Redeem exchanges the code for tokens, keeping the id_token so that
+// EnrichSession can read the user's groups from it
+func (p *AzureProvider) Redeem(redirectURL, code, codeVerifier string) (s *SessionState, err error) {
+	if code == "" {
+		err = errors.New("missing code")
+		return
+	}
+
+	params := url.Values{}
+	params.Add("redirect_uri", redirectURL)
+	params.Add("client_id", p.ClientID)
+	params.Add("client_secret", p.ClientSecret)
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
+	if p.ProtectedResource != nil && p.ProtectedResource.String() != "" {
+		params.Add("resource", p.ProtectedResource.String())
+	}
+
+	var req *http.Request
+	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	var body []byte
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+		return
+	}
+
+	// the v1 endpoints encode expires_in as a string, v2 as a number
+	var jsonResponse struct {
+		AccessToken  string      `json:"access_token"`
+		RefreshToken string      `json:"refresh_token"`
+		ExpiresIn    json.Number `json:"expires_in"`
+		IdToken      string      `json:"id_token"`
+	}
+	err = json.Unmarshal(body, &jsonResponse)
+	if err != nil {
+		return
+	}
+	if jsonResponse.AccessToken == "" {
+		err = fmt.Errorf("no access token found %s", body)
+		return
+	}
+	s = &SessionState{
+		AccessToken:  jsonResponse.AccessToken,
+		IDToken:      jsonResponse.IdToken,
+		RefreshToken: jsonResponse.RefreshToken,
+	}
+	if expiresIn, _ := jsonResponse.ExpiresIn.Int64(); expiresIn > 0 {
+		s.ExpiresOn = time.Now().Add(time.Duration(expiresIn) * time.Second).Truncate(time.Second)
+	}
+	return
+}
+
+// azureGroupClaims are the claims describing group membership. When a user
+// is in more groups than fit in a token, Azure AD omits the groups claim and
+// instead points to the Graph API with _claim_names, or sets hasgroups in
+// tokens returned from the authorize endpoint.
+type azureGroupClaims struct {
+	Groups     []string          `json:"groups"`
+	ClaimNames map[string]string `json:"_claim_names"`
+	HasGroups  bool              `json:"hasgroups"`
+}
+
+func (c *azureGroupClaims) overage() bool {
+	_, ok := c.ClaimNames["groups"]
+	return ok || c.HasGroups
+}
+
+// the id_token is received directly from the token endpoint over TLS, so as
+// with Google its payload is read without verifying the signature
+func groupClaimsFromIDToken(idToken string) (*azureGroupClaims, error) {
+	jwt := strings.Split(idToken, ".")
+	if len(jwt) != 3 {
+		return nil, errors.New("malformed id_token")
+	}
+	b, err := jwtDecodeSegment(jwt[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims azureGroupClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// EnrichSession adds the object IDs of the user's groups from the id_token's
+// groups claim, which the application must be configured to emit. Users in
+// too many groups are looked up with Microsoft Graph when GraphGroups is
+// set.
+func (p *AzureProvider) EnrichSession(s *SessionState) error {
+	if s.IDToken == "" {
+		return nil
+	}
+	claims, err := groupClaimsFromIDToken(s.IDToken)
+	if err != nil {
+		return err
+	}
+	if !claims.overage() {
+		s.Groups = claims.Groups
+		return nil
+	}
+	if !p.GraphGroups {
+		log.Printf("%s is in too many groups to be listed in the id_token, set azure-graph-groups to look them up", s.Email)
+		return nil
+	}
+	groups, err := p.getMemberGroups(s.AccessToken)
+	if err != nil {
+		return err
+	}
+	s.Groups = groups
+	return nil
+}
+
+// getMemberGroups lists the IDs of every group the user is a member of,
+// including through nested groups, from the profile endpoint's Graph API
+func (p *AzureProvider) getMemberGroups(accessToken string) ([]string, error) {
+	endpoint := *p.ProfileURL
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/getMemberGroups"
+	req, err := http.NewRequest("POST", endpoint.String(),
+		strings.NewReader(`{"securityEnabledOnly":false}`))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = getAzureHeader(accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	var groups struct {
+		Value []string `json:"value"`
+	}
+	if err := api.RequestJson(req, &groups); err != nil {
+		return nil, err
+	}
+	return groups.Value, nil
 }
 
 func getAzureHeader(access_token string) http.Header {
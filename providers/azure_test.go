@@ -1,11 +1,13 @@
 package providers
 
 import (
+	"encoding/base64"
 	"github.com/bmizerany/assert"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func testAzureProvider(hostname string) *AzureProvider {
@@ -31,7 +33,7 @@ func testAzureProvider(hostname string) *AzureProvider {
 func TestAzureProviderDefaults(t *testing.T) {
 	p := testAzureProvider("")
 	assert.NotEqual(t, nil, p)
-	p.Configure("")
+	p.Configure("", false)
 	assert.Equal(t, "Azure", p.Data().ProviderName)
 	assert.Equal(t, "common", p.Tenant)
 	assert.Equal(t, "https://login.microsoftonline.com/common/oauth2/authorize",
@@ -87,7 +89,7 @@ func TestAzureProviderOverrides(t *testing.T) {
 
 func TestAzureSetTenant(t *testing.T) {
 	p := testAzureProvider("")
-	p.Configure("example")
+	p.Configure("example", false)
 	assert.Equal(t, "Azure", p.Data().ProviderName)
 	assert.Equal(t, "example", p.Tenant)
 	assert.Equal(t, "https://login.microsoftonline.com/example/oauth2/authorize",
@@ -198,3 +200,111 @@ func TestAzureProviderGetEmailAddressIncorrectOtherMails(t *testing.T) {
 	assert.Equal(t, "type assertion to string failed", err.Error())
 	assert.Equal(t, "", email)
 }
+
+func TestAzureProviderV2Defaults(t *testing.T) {
+	p := testAzureProvider("")
+	p.Configure("example", true)
+	assert.Equal(t, "https://login.microsoftonline.com/example/oauth2/v2.0/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://login.microsoftonline.com/example/oauth2/v2.0/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://login.microsoftonline.com/example/oauth2/v2.0/logout",
+		p.Data().LogoutURL.String())
+	assert.Equal(t, "https://graph.microsoft.com/v1.0/me",
+		p.Data().ProfileURL.String())
+	assert.Equal(t, "", p.Data().ProtectedResource.String())
+	assert.Equal(t, "openid email profile User.Read", p.Data().Scope)
+}
+
+func TestAzureProviderV2KeepsOverrides(t *testing.T) {
+	p := NewAzureProvider(
+		&ProviderData{
+			ProfileURL: &url.URL{
+				Scheme: "https",
+				Host:   "example.com",
+				Path:   "/oauth/profile"},
+			ProtectedResource: &url.URL{
+				Scheme: "https",
+				Host:   "example.com"},
+			Scope: "profile"})
+	p.Configure("", true)
+	assert.Equal(t, "https://example.com/oauth/profile",
+		p.Data().ProfileURL.String())
+	assert.Equal(t, "https://example.com",
+		p.Data().ProtectedResource.String())
+	assert.Equal(t, "profile", p.Data().Scope)
+}
+
+func testAzureIDToken(claims string) string {
+	return "header." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".signature"
+}
+
+func TestAzureProviderRedeem(t *testing.T) {
+	idToken := testAzureIDToken(`{"groups": ["group1"]}`)
+	b := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			if r.Form.Get("code") != "code1234" {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write([]byte(`{"access_token": "a1234", "refresh_token": "r1234", ` +
+				`"expires_in": "3599", "id_token": "` + idToken + `"}`))
+		}))
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testAzureProvider(bURL.Host)
+	p.Configure("", false)
+	s, err := p.Redeem("http://redirect/", "code1234", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a1234", s.AccessToken)
+	assert.Equal(t, "r1234", s.RefreshToken)
+	assert.Equal(t, idToken, s.IDToken)
+	assert.Equal(t, true, s.ExpiresOn.After(time.Now()))
+}
+
+func TestAzureProviderEnrichSession(t *testing.T) {
+	p := testAzureProvider("")
+	s := &SessionState{IDToken: testAzureIDToken(`{"groups": ["group1", "group2"]}`)}
+	assert.Equal(t, nil, p.EnrichSession(s))
+	assert.Equal(t, []string{"group1", "group2"}, s.Groups)
+
+	// without an id_token there is nothing to read groups from
+	s = &SessionState{AccessToken: "imaginary_access_token"}
+	assert.Equal(t, nil, p.EnrichSession(s))
+	assert.Equal(t, 0, len(s.Groups))
+}
+
+func TestAzureProviderEnrichSessionGroupOverage(t *testing.T) {
+	b := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" || r.URL.Path != "/me/getMemberGroups" ||
+				r.URL.RawQuery != "api-version=1.6" {
+				w.WriteHeader(404)
+			} else if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(403)
+			} else {
+				w.Write([]byte(`{"value": ["group1", "group2", "group3"]}`))
+			}
+		}))
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testAzureProvider(bURL.Host)
+	idToken := testAzureIDToken(`{"_claim_names": {"groups": "src1"}, ` +
+		`"_claim_sources": {"src1": {"endpoint": "https://graph.windows.net/..."}}}`)
+
+	s := &SessionState{AccessToken: "imaginary_access_token", IDToken: idToken}
+	assert.Equal(t, nil, p.EnrichSession(s))
+	assert.Equal(t, 0, len(s.Groups))
+
+	p.GraphGroups = true
+	assert.Equal(t, nil, p.EnrichSession(s))
+	assert.Equal(t, []string{"group1", "group2", "group3"}, s.Groups)
+
+	s = &SessionState{AccessToken: "imaginary_access_token",
+		IDToken: testAzureIDToken(`{"hasgroups": true}`)}
+	assert.Equal(t, nil, p.EnrichSession(s))
+	assert.Equal(t, 3, len(s.Groups))
+}
@@ -0,0 +1,220 @@
+package providers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// BitbucketProvider signs in with Bitbucket Cloud. Logins can be restricted
+// to members of a workspace, and further to users with access to any of a
+// comma separated list of the workspace's repositories, the way the GitHub
+// provider restricts them to an org and its teams.
+type BitbucketProvider struct {
+	*ProviderData
+	Workspace    string
+	Repositories []string
+}
+
+func NewBitbucketProvider(p *ProviderData) *BitbucketProvider {
+	p.ProviderName = "Bitbucket"
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		p.LoginURL = &url.URL{
+			Scheme: "https",
+			Host:   "bitbucket.org",
+			Path:   "/site/oauth2/authorize",
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		p.RedeemURL = &url.URL{
+			Scheme: "https",
+			Host:   "bitbucket.org",
+			Path:   "/site/oauth2/access_token",
+		}
+	}
+	// the API base URL is taken from ValidateURL, less its /user path
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		p.ValidateURL = &url.URL{
+			Scheme: "https",
+			Host:   "api.bitbucket.org",
+			Path:   "/2.0/user",
+		}
+	}
+	if p.Scope == "" {
+		p.Scope = "account email"
+	}
+	return &BitbucketProvider{ProviderData: p}
+}
+
+// SetWorkspaceRepositories restricts logins to members of workspace, and
+// when repositories isn't empty, to those with access to any of them.
+// Repositories are given by their slug, comma separated.
+func (p *BitbucketProvider) SetWorkspaceRepositories(workspace, repositories string) {
+	p.Workspace = workspace
+	p.Repositories = nil
+	for _, r := range strings.Split(repositories, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			p.Repositories = append(p.Repositories, r)
+		}
+	}
+	if len(p.Repositories) != 0 && !strings.Contains(p.Scope, "repository") {
+		p.Scope += " repository"
+	}
+}
+
+func getBitbucketHeader(accessToken string) http.Header {
+	header := make(http.Header)
+	header.Set("Accept", "application/json")
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	return header
+}
+
+// getJSON fetches an API path relative to the validate URL's /user endpoint
+func (p *BitbucketProvider) getJSON(apiPath string, params url.Values, accessToken string, v interface{}) error {
+	endpoint := &url.URL{
+		Scheme:   p.ValidateURL.Scheme,
+		Host:     p.ValidateURL.Host,
+		Path:     strings.TrimSuffix(p.ValidateURL.Path, "/user") + apiPath,
+		RawQuery: params.Encode(),
+	}
+	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header = getBitbucketHeader(accessToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	return nil
+}
+
+// workspaces returns the slugs of the workspaces the user is a member of,
+// only looking for slug when it is set
+func (p *BitbucketProvider) workspaces(slug, accessToken string) ([]string, error) {
+	// https://developer.atlassian.com/cloud/bitbucket/rest/api-group-workspaces/
+	var page struct {
+		Values []struct {
+			Workspace struct {
+				Slug string `json:"slug"`
+			} `json:"workspace"`
+		} `json:"values"`
+	}
+	params := url.Values{"pagelen": {"100"}}
+	if slug != "" {
+		params.Set("q", fmt.Sprintf("workspace.slug=%q", slug))
+	}
+	if err := p.getJSON("/user/permissions/workspaces", params, accessToken, &page); err != nil {
+		return nil, err
+	}
+	var slugs []string
+	for _, v := range page.Values {
+		slugs = append(slugs, v.Workspace.Slug)
+	}
+	return slugs, nil
+}
+
+func (p *BitbucketProvider) hasWorkspace(accessToken string) (bool, error) {
+	slugs, err := p.workspaces(p.Workspace, accessToken)
+	if err != nil {
+		return false, err
+	}
+	for _, slug := range slugs {
+		if slug == p.Workspace {
+			log.Printf("Found Bitbucket Workspace: %q", slug)
+			return true, nil
+		}
+	}
+	log.Printf("Missing Workspace:%q", p.Workspace)
+	return false, nil
+}
+
+func (p *BitbucketProvider) hasRepository(accessToken string) (bool, error) {
+	// https://developer.atlassian.com/cloud/bitbucket/rest/api-group-repositories/
+	var names []string
+	for _, r := range p.Repositories {
+		names = append(names, fmt.Sprintf("repository.full_name=%q", p.Workspace+"/"+r))
+	}
+	var page struct {
+		Values []struct {
+			Permission string `json:"permission"`
+			Repository struct {
+				FullName string `json:"full_name"`
+			} `json:"repository"`
+		} `json:"values"`
+	}
+	params := url.Values{"q": {strings.Join(names, " OR ")}, "pagelen": {"100"}}
+	if err := p.getJSON("/user/permissions/repositories", params, accessToken, &page); err != nil {
+		return false, err
+	}
+	for _, v := range page.Values {
+		for _, r := range p.Repositories {
+			if strings.EqualFold(v.Repository.FullName, p.Workspace+"/"+r) {
+				log.Printf("Found Bitbucket Repository:%q Permission:%q", v.Repository.FullName, v.Permission)
+				return true, nil
+			}
+		}
+	}
+	log.Printf("Missing Repository:%q from Workspace:%q", strings.Join(p.Repositories, ","), p.Workspace)
+	return false, nil
+}
+
+func (p *BitbucketProvider) GetEmailAddress(s *SessionState) (string, error) {
+	// if we require a workspace or repository, check that first
+	if p.Workspace != "" {
+		check := p.hasWorkspace
+		if len(p.Repositories) != 0 {
+			check = p.hasRepository
+		}
+		if ok, err := check(s.AccessToken); err != nil || !ok {
+			return "", err
+		}
+	}
+
+	var emails struct {
+		Values []struct {
+			Email       string `json:"email"`
+			IsPrimary   bool   `json:"is_primary"`
+			IsConfirmed bool   `json:"is_confirmed"`
+		} `json:"values"`
+	}
+	if err := p.getJSON("/user/emails", url.Values{}, s.AccessToken, &emails); err != nil {
+		return "", err
+	}
+	for _, email := range emails.Values {
+		if email.IsPrimary && email.IsConfirmed {
+			return email.Email, nil
+		}
+	}
+	return "", nil
+}
+
+// EnrichSession adds the workspaces the user is a member of to the session
+// as groups
+func (p *BitbucketProvider) EnrichSession(s *SessionState) error {
+	groups, err := p.workspaces("", s.AccessToken)
+	if err != nil {
+		return err
+	}
+	s.Groups = groups
+	return nil
+}
+
+func (p *BitbucketProvider) ValidateSessionState(s *SessionState) bool {
+	return validateToken(p, s.AccessToken, getBitbucketHeader(s.AccessToken))
+}
@@ -0,0 +1,138 @@
+package providers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func testBitbucketProvider(hostname string) *BitbucketProvider {
+	p := NewBitbucketProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+// testBitbucketBackend serves payloads keyed by path and query
+func testBitbucketBackend(payloads map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(401)
+				return
+			}
+			payload, ok := payloads[r.URL.RequestURI()]
+			if !ok {
+				payload = `{"values": []}`
+			}
+			w.Write([]byte(payload))
+		}))
+}
+
+func TestBitbucketProviderDefaults(t *testing.T) {
+	p := testBitbucketProvider("")
+	assert.Equal(t, "Bitbucket", p.Data().ProviderName)
+	assert.Equal(t, "https://bitbucket.org/site/oauth2/authorize", p.Data().LoginURL.String())
+	assert.Equal(t, "https://bitbucket.org/site/oauth2/access_token", p.Data().RedeemURL.String())
+	assert.Equal(t, "https://api.bitbucket.org/2.0/user", p.Data().ValidateURL.String())
+	assert.Equal(t, "account email", p.Data().Scope)
+
+	p.SetWorkspaceRepositories("acme", "")
+	assert.Equal(t, "account email", p.Data().Scope)
+	p.SetWorkspaceRepositories("acme", "infra,deploy")
+	assert.Equal(t, []string{"infra", "deploy"}, p.Repositories)
+	assert.Equal(t, "account email repository", p.Data().Scope)
+}
+
+const bitbucketEmails = `{"values": [
+	{"email": "old@example.com", "is_primary": false, "is_confirmed": true},
+	{"email": "michael.bland@gsa.gov", "is_primary": true, "is_confirmed": true}
+]}`
+
+func TestBitbucketProviderGetEmailAddress(t *testing.T) {
+	b := testBitbucketBackend(map[string]string{"/2.0/user/emails": bitbucketEmails})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host)
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+}
+
+func TestBitbucketProviderWorkspace(t *testing.T) {
+	b := testBitbucketBackend(map[string]string{
+		"/2.0/user/emails": bitbucketEmails,
+		"/2.0/user/permissions/workspaces?pagelen=100&q=workspace.slug%3D%22acme%22": `{"values": [
+			{"permission": "member", "workspace": {"slug": "acme"}}
+		]}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host)
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	p.SetWorkspaceRepositories("acme", "")
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	p.SetWorkspaceRepositories("other", "")
+	email, err = p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestBitbucketProviderRepository(t *testing.T) {
+	b := testBitbucketBackend(map[string]string{
+		"/2.0/user/emails": bitbucketEmails,
+		"/2.0/user/permissions/repositories?pagelen=100&q=repository.full_name%3D%22acme%2Finfra%22+OR+repository.full_name%3D%22acme%2Fdeploy%22": `{"values": [
+			{"permission": "write", "repository": {"full_name": "acme/deploy"}}
+		]}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host)
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	p.SetWorkspaceRepositories("acme", "infra,deploy")
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	p.SetWorkspaceRepositories("acme", "infra")
+	email, err = p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestBitbucketProviderEnrichSession(t *testing.T) {
+	b := testBitbucketBackend(map[string]string{
+		"/2.0/user/permissions/workspaces?pagelen=100": `{"values": [
+			{"permission": "owner", "workspace": {"slug": "acme"}},
+			{"permission": "member", "workspace": {"slug": "18f"}}
+		]}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host)
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	assert.Equal(t, nil, p.EnrichSession(session))
+	assert.Equal(t, []string{"acme", "18f"}, session.Groups)
+}
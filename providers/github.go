@@ -50,6 +50,14 @@ func (p *GitHubProvider) SetOrgTeam(org, team string) {
 	p.Org = org
 	p.Team = team
 	if org != "" || team != "" {
+		p.RequireOrgScope()
+	}
+}
+
+// RequireOrgScope requests the read:org scope needed to list the user's
+// organizations and teams
+func (p *GitHubProvider) RequireOrgScope() {
+	if !strings.Contains(p.Scope, "read:org") {
 		p.Scope += " read:org"
 	}
 }
@@ -237,3 +245,70 @@ func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
 
 	return "", nil
 }
+
+func (p *GitHubProvider) getJSON(apiPath, accessToken string, v interface{}) error {
+	params := url.Values{
+		"access_token": {accessToken},
+		"per_page":     {"100"},
+	}
+	endpoint := &url.URL{
+		Scheme:   p.ValidateURL.Scheme,
+		Host:     p.ValidateURL.Host,
+		Path:     path.Join(p.ValidateURL.Path, apiPath),
+		RawQuery: params.Encode(),
+	}
+	req, _ := http.NewRequest("GET", endpoint.String(), nil)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf(
+			"got %d from %q %s", resp.StatusCode, stripToken(endpoint.String()), body)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	return nil
+}
+
+// EnrichSession adds the user's organizations and teams to the session as
+// groups named "org" and "org:team", where team is the team's slug. Teams
+// can only be listed with the read:org scope, so without it the session is
+// left unchanged.
+func (p *GitHubProvider) EnrichSession(s *SessionState) error {
+	if !strings.Contains(p.Scope, "read:org") {
+		return nil
+	}
+	var orgs []struct {
+		Login string `json:"login"`
+	}
+	if err := p.getJSON("/user/orgs", s.AccessToken, &orgs); err != nil {
+		return err
+	}
+	var teams []struct {
+		Slug string `json:"slug"`
+		Org  struct {
+			Login string `json:"login"`
+		} `json:"organization"`
+	}
+	if err := p.getJSON("/user/teams", s.AccessToken, &teams); err != nil {
+		return err
+	}
+
+	var groups []string
+	for _, org := range orgs {
+		groups = append(groups, org.Login)
+	}
+	for _, team := range teams {
+		groups = append(groups, team.Org.Login+":"+team.Slug)
+	}
+	s.Groups = groups
+	return nil
+}
@@ -0,0 +1,75 @@
+package providers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func testGitHubProvider(hostname string) *GitHubProvider {
+	p := NewGitHubProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+func testGitHubBackend(payloads map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			payload, ok := payloads[r.URL.Path]
+			if !ok || r.URL.Query().Get("access_token") != "imaginary_access_token" {
+				w.WriteHeader(404)
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(payload))
+		}))
+}
+
+func TestGitHubProviderEnrichSession(t *testing.T) {
+	b := testGitHubBackend(map[string]string{
+		"/user/orgs":  `[{"login":"bitly"},{"login":"18F"}]`,
+		"/user/teams": `[{"slug":"ops","organization":{"login":"bitly"}}]`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	p.RequireOrgScope()
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	err := p.EnrichSession(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"bitly", "18F", "bitly:ops"}, session.Groups)
+}
+
+func TestGitHubProviderEnrichSessionWithoutOrgScope(t *testing.T) {
+	p := testGitHubProvider("")
+	assert.Equal(t, "user:email", p.Data().Scope)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	err := p.EnrichSession(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string(nil), session.Groups)
+}
+
+func TestGitHubProviderRequireOrgScope(t *testing.T) {
+	p := testGitHubProvider("")
+	p.SetOrgTeam("bitly", "")
+	p.RequireOrgScope()
+	assert.Equal(t, "user:email read:org", p.Data().Scope)
+}
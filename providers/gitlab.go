@@ -1,39 +1,82 @@
 package providers
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-
-	"github.com/bitly/oauth2_proxy/api"
+	"strconv"
+	"strings"
 )
 
+// GitLab member access levels, see
+// https://docs.gitlab.com/ee/api/members.html
+var gitLabAccessLevels = map[string]int{
+	"guest":      10,
+	"reporter":   20,
+	"developer":  30,
+	"maintainer": 40,
+	"owner":      50,
+}
+
+// GitLabMembership is a group or project, by its full path, that users
+// must be a member of with at least MinAccessLevel
+type GitLabMembership struct {
+	Path           string
+	MinAccessLevel int
+}
+
+// ParseGitLabMembership parses "path" or "path=level", where level is an
+// access level name such as developer or its numeric value. The minimum
+// level defaults to guest, ie: any member.
+func ParseGitLabMembership(s string) (GitLabMembership, error) {
+	m := GitLabMembership{Path: s, MinAccessLevel: gitLabAccessLevels["guest"]}
+	if i := strings.LastIndex(s, "="); i != -1 {
+		m.Path = s[:i]
+		level := strings.ToLower(s[i+1:])
+		if n, ok := gitLabAccessLevels[level]; ok {
+			m.MinAccessLevel = n
+		} else if n, err := strconv.Atoi(level); err == nil && n > 0 {
+			m.MinAccessLevel = n
+		} else {
+			return m, fmt.Errorf("unknown access level %q", s[i+1:])
+		}
+	}
+	m.Path = strings.Trim(m.Path, "/")
+	if m.Path == "" {
+		return m, fmt.Errorf("missing path in %q", s)
+	}
+	return m, nil
+}
+
 type GitLabProvider struct {
 	*ProviderData
+	Groups   []GitLabMembership
+	Projects []GitLabMembership
+}
+
+var gitLabDefaultURL = &url.URL{Scheme: "https", Host: "gitlab.com"}
+
+func gitLabEndpoint(base *url.URL, path string) *url.URL {
+	return &url.URL{
+		Scheme: base.Scheme,
+		Host:   base.Host,
+		Path:   strings.TrimSuffix(base.Path, "/") + path,
+	}
 }
 
 func NewGitLabProvider(p *ProviderData) *GitLabProvider {
 	p.ProviderName = "GitLab"
 	if p.LoginURL == nil || p.LoginURL.String() == "" {
-		p.LoginURL = &url.URL{
-			Scheme: "https",
-			Host:   "gitlab.com",
-			Path:   "/oauth/authorize",
-		}
+		p.LoginURL = gitLabEndpoint(gitLabDefaultURL, "/oauth/authorize")
 	}
 	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
-		p.RedeemURL = &url.URL{
-			Scheme: "https",
-			Host:   "gitlab.com",
-			Path:   "/oauth/token",
-		}
+		p.RedeemURL = gitLabEndpoint(gitLabDefaultURL, "/oauth/token")
 	}
 	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
-		p.ValidateURL = &url.URL{
-			Scheme: "https",
-			Host:   "gitlab.com",
-			Path:   "/api/v3/user",
-		}
+		p.ValidateURL = gitLabEndpoint(gitLabDefaultURL, "/api/v4/user")
 	}
 	if p.Scope == "" {
 		p.Scope = "api"
@@ -41,18 +84,131 @@ func NewGitLabProvider(p *ProviderData) *GitLabProvider {
 	return &GitLabProvider{ProviderData: p}
 }
 
-func (p *GitLabProvider) GetEmailAddress(s *SessionState) (string, error) {
+// SetGitLabURL points the provider at a self-hosted GitLab instance.
+// Endpoints that were configured explicitly are left unchanged.
+func (p *GitLabProvider) SetGitLabURL(base *url.URL) {
+	for _, e := range []struct {
+		u    **url.URL
+		path string
+	}{
+		{&p.LoginURL, "/oauth/authorize"},
+		{&p.RedeemURL, "/oauth/token"},
+		{&p.ValidateURL, "/api/v4/user"},
+	} {
+		if (*e.u).String() == gitLabEndpoint(gitLabDefaultURL, e.path).String() {
+			*e.u = gitLabEndpoint(base, e.path)
+		}
+	}
+}
+
+// SetMemberships restricts logins to members of at least one of the given
+// groups or projects
+func (p *GitLabProvider) SetMemberships(groups, projects []GitLabMembership) {
+	p.Groups = groups
+	p.Projects = projects
+}
 
-	req, err := http.NewRequest("GET",
-		p.ValidateURL.String()+"?access_token="+s.AccessToken, nil)
+type gitLabNotFoundError struct {
+	endpoint string
+}
+
+func (e gitLabNotFoundError) Error() string {
+	return fmt.Sprintf("got 404 from %q", e.endpoint)
+}
+
+// getJSON fetches an API path relative to the validate URL's /user
+// endpoint. Paths may contain escaped segments such as group%2Fproject.
+func (p *GitLabProvider) getJSON(apiPath, accessToken string, v interface{}) error {
+	base := strings.TrimSuffix(p.ValidateURL.EscapedPath(), "/user")
+	endpoint := &url.URL{Scheme: p.ValidateURL.Scheme, Host: p.ValidateURL.Host}
+	endpoint.Path, _ = url.PathUnescape(base + apiPath)
+	endpoint.RawPath = base + apiPath
+
+	req, err := http.NewRequest("GET", endpoint.String(), nil)
 	if err != nil {
-		log.Printf("failed building request %s", err)
-		return "", err
+		return err
 	}
-	json, err := api.Request(req)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Printf("failed making request %s", err)
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case 200:
+	case 404:
+		return gitLabNotFoundError{endpoint.String()}
+	default:
+		return fmt.Errorf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	return nil
+}
+
+// accessLevel returns the user's access level in a group or project,
+// including membership inherited from parent groups, or 0 if the user is
+// not a member
+func (p *GitLabProvider) accessLevel(kind, path string, userID int, accessToken string) (int, error) {
+	var member struct {
+		AccessLevel int `json:"access_level"`
+	}
+	apiPath := fmt.Sprintf("/%s/%s/members/all/%d", kind, url.PathEscape(path), userID)
+	err := p.getJSON(apiPath, accessToken, &member)
+	if _, ok := err.(gitLabNotFoundError); ok {
+		return 0, nil
+	}
+	return member.AccessLevel, err
+}
+
+func (p *GitLabProvider) hasMembership(userID int, accessToken string) (bool, error) {
+	for _, kind := range []struct {
+		name        string
+		memberships []GitLabMembership
+	}{
+		{"groups", p.Groups},
+		{"projects", p.Projects},
+	} {
+		for _, m := range kind.memberships {
+			level, err := p.accessLevel(kind.name, m.Path, userID, accessToken)
+			if err != nil {
+				return false, err
+			}
+			if level >= m.MinAccessLevel {
+				log.Printf("found gitlab %s membership %s with access level %d", kind.name, m.Path, level)
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (p *GitLabProvider) GetEmailAddress(s *SessionState) (string, error) {
+	var user struct {
+		ID    int    `json:"id"`
+		Email string `json:"email"`
+	}
+	if err := p.getJSON("/user", s.AccessToken, &user); err != nil {
 		return "", err
 	}
-	return json.Get("email").String()
+	if user.Email == "" {
+		return "", fmt.Errorf("no email address for gitlab user %d", user.ID)
+	}
+
+	if len(p.Groups) != 0 || len(p.Projects) != 0 {
+		ok, err := p.hasMembership(user.ID, s.AccessToken)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			log.Printf("%s is not a member of an allowed gitlab group or project", user.Email)
+			return "", nil
+		}
+	}
+	return user.Email, nil
 }
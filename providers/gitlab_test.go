@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -28,18 +29,30 @@ func testGitLabProvider(hostname string) *GitLabProvider {
 }
 
 func testGitLabBackend(payload string) *httptest.Server {
-	path := "/api/v3/user"
-	query := "access_token=imaginary_access_token"
+	return testGitLabBackendWithMembers(payload, nil)
+}
 
+// testGitLabBackendWithMembers serves the user payload along with the
+// access levels of user 42 in the groups and projects in members, keyed by
+// escaped API path
+func testGitLabBackendWithMembers(payload string, members map[string]int) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			url := r.URL
-			if url.Path != path || url.RawQuery != query {
-				w.WriteHeader(404)
-			} else {
-				w.WriteHeader(200)
+			if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(401)
+				return
+			}
+			if r.URL.EscapedPath() == "/api/v4/user" {
 				w.Write([]byte(payload))
+				return
 			}
+			level, ok := members[r.URL.EscapedPath()]
+			if !ok {
+				w.WriteHeader(404)
+				w.Write([]byte(`{"message":"404 Not found"}`))
+				return
+			}
+			fmt.Fprintf(w, `{"id": 42, "access_level": %d}`, level)
 		}))
 }
 
@@ -51,7 +64,7 @@ func TestGitLabProviderDefaults(t *testing.T) {
 		p.Data().LoginURL.String())
 	assert.Equal(t, "https://gitlab.com/oauth/token",
 		p.Data().RedeemURL.String())
-	assert.Equal(t, "https://gitlab.com/api/v3/user",
+	assert.Equal(t, "https://gitlab.com/api/v4/user",
 		p.Data().ValidateURL.String())
 	assert.Equal(t, "api", p.Data().Scope)
 }
@@ -70,7 +83,7 @@ func TestGitLabProviderOverrides(t *testing.T) {
 			ValidateURL: &url.URL{
 				Scheme: "https",
 				Host:   "example.com",
-				Path:   "/api/v3/user"},
+				Path:   "/api/v4/user"},
 			Scope: "profile"})
 	assert.NotEqual(t, nil, p)
 	assert.Equal(t, "GitLab", p.Data().ProviderName)
@@ -78,7 +91,7 @@ func TestGitLabProviderOverrides(t *testing.T) {
 		p.Data().LoginURL.String())
 	assert.Equal(t, "https://example.com/oauth/token",
 		p.Data().RedeemURL.String())
-	assert.Equal(t, "https://example.com/api/v3/user",
+	assert.Equal(t, "https://example.com/api/v4/user",
 		p.Data().ValidateURL.String())
 	assert.Equal(t, "profile", p.Data().Scope)
 }
@@ -126,3 +139,76 @@ func TestGitLabProviderGetEmailAddressEmailNotPresentInPayload(t *testing.T) {
 	assert.NotEqual(t, nil, err)
 	assert.Equal(t, "", email)
 }
+
+func TestGitLabProviderSetGitLabURL(t *testing.T) {
+	p := NewGitLabProvider(&ProviderData{
+		RedeemURL: &url.URL{Scheme: "https", Host: "token.example.com", Path: "/token"},
+	})
+	base, _ := url.Parse("https://git.example.com/gitlab/")
+	p.SetGitLabURL(base)
+	assert.Equal(t, "https://git.example.com/gitlab/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://token.example.com/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://git.example.com/gitlab/api/v4/user",
+		p.Data().ValidateURL.String())
+}
+
+func TestParseGitLabMembership(t *testing.T) {
+	m, err := ParseGitLabMembership("group/subgroup")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, GitLabMembership{Path: "group/subgroup", MinAccessLevel: 10}, m)
+
+	m, err = ParseGitLabMembership("group/project=Developer")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, GitLabMembership{Path: "group/project", MinAccessLevel: 30}, m)
+
+	m, err = ParseGitLabMembership("group/project=40")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 40, m.MinAccessLevel)
+
+	_, err = ParseGitLabMembership("group=admin")
+	assert.NotEqual(t, nil, err)
+	_, err = ParseGitLabMembership("=developer")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestGitLabProviderMemberships(t *testing.T) {
+	b := testGitLabBackendWithMembers(
+		`{"id": 42, "email": "michael.bland@gsa.gov"}`,
+		map[string]int{
+			"/api/v4/groups/ops/members/all/42":                      10,
+			"/api/v4/projects/infra%2Fdeploy/members/all/42":         30,
+			"/api/v4/projects/infra%2Fsecrets/members/all/42":        20,
+			"/api/v4/groups/infra%2Fplatform/members/all/42":         40,
+			"/api/v4/projects/infra%2Fplatform%2Fk8s/members/all/42": 50,
+		})
+	defer b.Close()
+	b_url, _ := url.Parse(b.URL)
+
+	email := func(groups, projects []string) string {
+		p := testGitLabProvider(b_url.Host)
+		var gs, ps []GitLabMembership
+		for _, g := range groups {
+			m, _ := ParseGitLabMembership(g)
+			gs = append(gs, m)
+		}
+		for _, pr := range projects {
+			m, _ := ParseGitLabMembership(pr)
+			ps = append(ps, m)
+		}
+		p.SetMemberships(gs, ps)
+		email, err := p.GetEmailAddress(&SessionState{AccessToken: "imaginary_access_token"})
+		assert.Equal(t, nil, err)
+		return email
+	}
+
+	assert.Equal(t, "michael.bland@gsa.gov", email([]string{"ops"}, nil))
+	assert.Equal(t, "", email([]string{"ops=reporter"}, nil))
+	assert.Equal(t, "", email([]string{"security"}, nil))
+	assert.Equal(t, "michael.bland@gsa.gov", email([]string{"infra/platform=maintainer"}, nil))
+	assert.Equal(t, "michael.bland@gsa.gov", email(nil, []string{"infra/deploy=developer"}))
+	assert.Equal(t, "", email(nil, []string{"infra/secrets=developer"}))
+	assert.Equal(t, "michael.bland@gsa.gov",
+		email([]string{"security"}, []string{"infra/platform/k8s=owner"}))
+}
@@ -26,6 +26,8 @@ type GoogleProvider struct {
 	// GroupValidator is a function that determines if the passed email is in
 	// the configured Google group.
 	GroupValidator func(string) bool
+
+	adminService *admin.Service
 }
 
 func NewGoogleProvider(p *ProviderData) *GoogleProvider {
@@ -97,7 +99,7 @@ func jwtDecodeSegment(seg string) ([]byte, error) {
 	return base64.URLEncoding.DecodeString(seg)
 }
 
-func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err error) {
+func (p *GoogleProvider) Redeem(redirectURL, code, codeVerifier string) (s *SessionState, err error) {
 	if code == "" {
 		err = errors.New("missing code")
 		return
@@ -109,6 +111,9 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 	params.Add("client_secret", p.ClientSecret)
 	params.Add("code", code)
 	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
 	var req *http.Request
 	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
 	if err != nil {
@@ -149,6 +154,7 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 	}
 	s = &SessionState{
 		AccessToken:  jsonResponse.AccessToken,
+		IDToken:      jsonResponse.IdToken,
 		ExpiresOn:    time.Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second).Truncate(time.Second),
 		RefreshToken: jsonResponse.RefreshToken,
 		Email:        email,
@@ -161,12 +167,19 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 // checked. CredentialsFile is the path to a json file containing a Google service
 // account credentials.
 func (p *GoogleProvider) SetGroupRestriction(groups []string, adminEmail string, credentialsReader io.Reader) {
-	adminService := getAdminService(adminEmail, credentialsReader)
+	p.SetAdminService(adminEmail, credentialsReader)
+	adminService := p.adminService
 	p.GroupValidator = func(email string) bool {
 		return userInGroup(adminService, groups, email)
 	}
 }
 
+// SetAdminService configures the Admin SDK client used by EnrichSession to
+// look up the groups a user belongs to, without restricting sign in.
+func (p *GoogleProvider) SetAdminService(adminEmail string, credentialsReader io.Reader) {
+	p.adminService = getAdminService(adminEmail, credentialsReader)
+}
+
 func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Service {
 	data, err := ioutil.ReadAll(credentialsReader)
 	if err != nil {
@@ -250,18 +263,55 @@ func fetchGroupMembers(service *admin.Service, group string) ([]*admin.Member, e
 	return members, nil
 }
 
+func fetchUserGroups(service *admin.Service, email string) ([]string, error) {
+	var groups []string
+	pageToken := ""
+	for {
+		req := service.Groups.List().UserKey(email)
+		if pageToken != "" {
+			req.PageToken(pageToken)
+		}
+		r, err := req.Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range r.Groups {
+			groups = append(groups, group.Email)
+		}
+		if r.NextPageToken == "" {
+			break
+		}
+		pageToken = r.NextPageToken
+	}
+	return groups, nil
+}
+
+// EnrichSession adds the email addresses of the Google groups the user is a
+// member of to the session. It requires an admin service to be configured.
+func (p *GoogleProvider) EnrichSession(s *SessionState) error {
+	if p.adminService == nil || s.Email == "" {
+		return nil
+	}
+	groups, err := fetchUserGroups(p.adminService, s.Email)
+	if err != nil {
+		return fmt.Errorf("error fetching groups for %s: %v", s.Email, err)
+	}
+	s.Groups = groups
+	return nil
+}
+
 // ValidateGroup validates that the provided email exists in the configured Google
 // group(s).
 func (p *GoogleProvider) ValidateGroup(email string) bool {
 	return p.GroupValidator(email)
 }
 
-func (p *GoogleProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
-	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+func (p *GoogleProvider) RefreshSession(s *SessionState) (bool, error) {
+	if s == nil || s.RefreshToken == "" {
 		return false, nil
 	}
 
-	newToken, duration, err := p.redeemRefreshToken(s.RefreshToken)
+	newToken, newRefreshToken, duration, err := p.redeemRefreshToken(s.RefreshToken)
 	if err != nil {
 		return false, err
 	}
@@ -273,12 +323,17 @@ func (p *GoogleProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 
 	origExpiration := s.ExpiresOn
 	s.AccessToken = newToken
+	if newRefreshToken != "" {
+		s.RefreshToken = newRefreshToken
+	}
 	s.ExpiresOn = time.Now().Add(duration).Truncate(time.Second)
 	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
 	return true, nil
 }
 
-func (p *GoogleProvider) redeemRefreshToken(refreshToken string) (token string, expires time.Duration, err error) {
+// redeemRefreshToken returns a new access token, and a new refresh token if
+// the old one was rotated
+func (p *GoogleProvider) redeemRefreshToken(refreshToken string) (token, newRefreshToken string, expires time.Duration, err error) {
 	// https://developers.google.com/identity/protocols/OAuth2WebServer#refresh
 	params := url.Values{}
 	params.Add("client_id", p.ClientID)
@@ -309,14 +364,16 @@ func (p *GoogleProvider) redeemRefreshToken(refreshToken string) (token string,
 	}
 
 	var data struct {
-		AccessToken string `json:"access_token"`
-		ExpiresIn   int64  `json:"expires_in"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
 	}
 	err = json.Unmarshal(body, &data)
 	if err != nil {
 		return
 	}
 	token = data.AccessToken
+	newRefreshToken = data.RefreshToken
 	expires = time.Duration(data.ExpiresIn) * time.Second
 	return
 }
@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/bmizerany/assert"
 )
@@ -97,7 +98,7 @@ func TestGoogleProviderGetEmailAddress(t *testing.T) {
 	p.RedeemURL, server = newRedeemServer(body)
 	defer server.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.Redeem("http://redirect/", "code1234", "")
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, session, nil)
 	assert.Equal(t, "michael.bland@gsa.gov", session.Email)
@@ -105,6 +106,36 @@ func TestGoogleProviderGetEmailAddress(t *testing.T) {
 	assert.Equal(t, "refresh12345", session.RefreshToken)
 }
 
+func TestGoogleProviderRefreshSession(t *testing.T) {
+	p := newGoogleProvider()
+	body, err := json.Marshal(redeemResponse{
+		AccessToken:  "a5678",
+		ExpiresIn:    3600,
+		RefreshToken: "refresh67890",
+	})
+	assert.Equal(t, nil, err)
+	var server *httptest.Server
+	p.RedeemURL, server = newRedeemServer(body)
+	defer server.Close()
+
+	session := &SessionState{
+		Email:        "michael.bland@gsa.gov",
+		AccessToken:  "a1234",
+		RefreshToken: "refresh12345",
+		ExpiresOn:    time.Now().Add(30 * time.Second),
+	}
+	refreshed, err := p.RefreshSession(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, "a5678", session.AccessToken)
+	assert.Equal(t, "refresh67890", session.RefreshToken)
+	assert.Equal(t, true, session.ExpiresOn.After(time.Now().Add(time.Hour-time.Minute)))
+
+	refreshed, err = p.RefreshSession(&SessionState{AccessToken: "a1234"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, refreshed)
+}
+
 func TestGoogleProviderValidateGroup(t *testing.T) {
 	p := newGoogleProvider()
 	p.GroupValidator = func(email string) bool {
@@ -122,7 +153,6 @@ func TestGoogleProviderWithoutValidateGroup(t *testing.T) {
 	assert.Equal(t, true, p.ValidateGroup("michael.bland@gsa.gov"))
 }
 
-//
 func TestGoogleProviderGetEmailAddressInvalidEncoding(t *testing.T) {
 	p := newGoogleProvider()
 	body, err := json.Marshal(redeemResponse{
@@ -134,7 +164,7 @@ func TestGoogleProviderGetEmailAddressInvalidEncoding(t *testing.T) {
 	p.RedeemURL, server = newRedeemServer(body)
 	defer server.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.Redeem("http://redirect/", "code1234", "")
 	assert.NotEqual(t, nil, err)
 	if session != nil {
 		t.Errorf("expect nill session %#v", session)
@@ -153,7 +183,7 @@ func TestGoogleProviderGetEmailAddressInvalidJson(t *testing.T) {
 	p.RedeemURL, server = newRedeemServer(body)
 	defer server.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.Redeem("http://redirect/", "code1234", "")
 	assert.NotEqual(t, nil, err)
 	if session != nil {
 		t.Errorf("expect nill session %#v", session)
@@ -172,7 +202,7 @@ func TestGoogleProviderGetEmailAddressEmailMissing(t *testing.T) {
 	p.RedeemURL, server = newRedeemServer(body)
 	defer server.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.Redeem("http://redirect/", "code1234", "")
 	assert.NotEqual(t, nil, err)
 	if session != nil {
 		t.Errorf("expect nill session %#v", session)
@@ -0,0 +1,120 @@
+package providers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// keycloakRolePrefix marks the groups of a session that are Keycloak roles
+const keycloakRolePrefix = "role:"
+
+// KeycloakProvider signs users in with a Keycloak realm. It's an OpenID
+// Connect provider that also adds the user's roles to the session's groups:
+// realm roles as role:<role> and client roles as role:<client>:<role>.
+// Keycloak puts roles in the access token rather than the id_token.
+type KeycloakProvider struct {
+	*OIDCProvider
+}
+
+func NewKeycloakProvider(p *ProviderData) *KeycloakProvider {
+	provider := &KeycloakProvider{OIDCProvider: NewOIDCProvider(p)}
+	p.ProviderName = "Keycloak"
+	return provider
+}
+
+// KeycloakIssuerURL returns the issuer of a realm on the Keycloak server at
+// baseURL, which includes the /auth path for versions that serve it there
+func KeycloakIssuerURL(baseURL, realm string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/realms/" + realm
+}
+
+// KeycloakRoleGroup returns the group a role is added to sessions as. role
+// is a realm role or a client role given as client:role.
+func KeycloakRoleGroup(role string) string {
+	return keycloakRolePrefix + role
+}
+
+func (p *KeycloakProvider) Redeem(redirectURL, code, codeVerifier string) (*SessionState, error) {
+	s, err := p.OIDCProvider.Redeem(redirectURL, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	if err := setKeycloakRoles(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RefreshSession refreshes the tokens and then the roles, which may have
+// changed since the user signed in
+func (p *KeycloakProvider) RefreshSession(s *SessionState) (bool, error) {
+	ok, err := p.OIDCProvider.RefreshSession(s)
+	if !ok || err != nil {
+		return ok, err
+	}
+	if err := setKeycloakRoles(s); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// setKeycloakRoles replaces the role groups of the session with the roles in
+// its access token. The token comes straight from the token endpoint, so its
+// signature isn't checked again here.
+func setKeycloakRoles(s *SessionState) error {
+	roles, err := keycloakRoles(s.AccessToken)
+	if err != nil {
+		return fmt.Errorf("could not read roles from access token: %v", err)
+	}
+	var groups []string
+	for _, g := range s.Groups {
+		if !strings.HasPrefix(g, keycloakRolePrefix) {
+			groups = append(groups, g)
+		}
+	}
+	for _, role := range roles {
+		groups = append(groups, KeycloakRoleGroup(role))
+	}
+	s.Groups = groups
+	return nil
+}
+
+// keycloakRoles returns the realm roles and the client roles, as
+// client:role, from the claims of an access token
+func keycloakRoles(accessToken string) ([]string, error) {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt, expected 3 parts got %d", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt payload: %v", err)
+	}
+	var claims struct {
+		RealmAccess struct {
+			Roles []string `json:"roles"`
+		} `json:"realm_access"`
+		ResourceAccess map[string]struct {
+			Roles []string `json:"roles"`
+		} `json:"resource_access"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+
+	roles := append([]string(nil), claims.RealmAccess.Roles...)
+	var clients []string
+	for client := range claims.ResourceAccess {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	for _, client := range clients {
+		for _, role := range claims.ResourceAccess[client].Roles {
+			roles = append(roles, client+":"+role)
+		}
+	}
+	return roles, nil
+}
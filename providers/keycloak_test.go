@@ -0,0 +1,60 @@
+package providers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func keycloakAccessToken(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+func TestKeycloakIssuerURL(t *testing.T) {
+	assert.Equal(t, "https://keycloak.example.com/realms/corp",
+		KeycloakIssuerURL("https://keycloak.example.com/", "corp"))
+	assert.Equal(t, "https://keycloak.example.com/auth/realms/corp",
+		KeycloakIssuerURL("https://keycloak.example.com/auth", "corp"))
+}
+
+func TestKeycloakProviderRedeemRoles(t *testing.T) {
+	issuer := newTestOIDCIssuer(t)
+	defer issuer.Close()
+	issuer.accessToken = keycloakAccessToken(map[string]interface{}{
+		"realm_access": map[string]interface{}{"roles": []string{"admin", "offline_access"}},
+		"resource_access": map[string]interface{}{
+			"wiki":    map[string]interface{}{"roles": []string{"editor"}},
+			"account": map[string]interface{}{"roles": []string{"view-profile"}},
+		},
+	})
+	p := NewKeycloakProvider(&ProviderData{ClientID: "bazquux", ClientSecret: "xyzzyplugh"})
+	if err := p.Configure(issuer.URL); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Keycloak", p.Data().ProviderName)
+
+	session, err := p.Redeem("http://redirect/", "code1234", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", session.Email)
+	assert.Equal(t, []string{"admins", "devs", "role:admin", "role:offline_access",
+		"role:account:view-profile", "role:wiki:editor"}, session.Groups)
+}
+
+func TestKeycloakRolesReplacedOnRefresh(t *testing.T) {
+	s := &SessionState{
+		Groups: []string{"admins", "role:admin", "role:wiki:editor"},
+		AccessToken: keycloakAccessToken(map[string]interface{}{
+			"realm_access": map[string]interface{}{"roles": []string{"viewer"}},
+		}),
+	}
+	assert.Equal(t, nil, setKeycloakRoles(s))
+	assert.Equal(t, []string{"admins", "role:viewer"}, s.Groups)
+
+	s.AccessToken = "opaque"
+	assert.NotEqual(t, nil, setKeycloakRoles(s))
+}
@@ -0,0 +1,244 @@
+package providers
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/api"
+)
+
+// LoginGovProvider signs users in with login.gov, which authenticates
+// clients with a JWT signed by their private key (private_key_jwt) rather
+// than a client secret
+type LoginGovProvider struct {
+	*ProviderData
+
+	// ACRValues is the identity assurance level to request
+	ACRValues  string
+	PrivateKey *rsa.PrivateKey
+}
+
+func NewLoginGovProvider(p *ProviderData) *LoginGovProvider {
+	const loginGovHost string = "secure.login.gov"
+
+	p.ProviderName = "login.gov"
+	if p.LoginURL.String() == "" {
+		p.LoginURL = &url.URL{Scheme: "https",
+			Host: loginGovHost,
+			Path: "/openid_connect/authorize"}
+	}
+	if p.RedeemURL.String() == "" {
+		p.RedeemURL = &url.URL{Scheme: "https",
+			Host: loginGovHost,
+			Path: "/api/openid_connect/token"}
+	}
+	if p.ProfileURL.String() == "" {
+		p.ProfileURL = &url.URL{Scheme: "https",
+			Host: loginGovHost,
+			Path: "/api/openid_connect/userinfo"}
+	}
+	if p.ValidateURL.String() == "" {
+		p.ValidateURL = p.ProfileURL
+	}
+	if p.LogoutURL == nil || p.LogoutURL.String() == "" {
+		p.LogoutURL = &url.URL{Scheme: "https",
+			Host: loginGovHost,
+			Path: "/openid_connect/logout"}
+	}
+	if p.Scope == "" {
+		p.Scope = "openid email"
+	}
+	return &LoginGovProvider{
+		ProviderData: p,
+		ACRValues:    "http://idmanagement.gov/ns/assurance/ial/1",
+	}
+}
+
+// ParseLoginGovPrivateKey reads the PEM encoded RSA key, in PKCS #1 or
+// PKCS #8 form, whose public key is registered with login.gov
+func ParseLoginGovPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA private key")
+	}
+	return rsaKey, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GetLoginURL adds the assurance level and the nonce login.gov requires.
+// The nonce isn't checked: the id_token comes straight from the token
+// endpoint, which is what it guards against.
+func (p *LoginGovProvider) GetLoginURL(redirectURI, state, codeChallenge string) string {
+	a, _ := url.Parse(p.ProviderData.GetLoginURL(redirectURI, state, codeChallenge))
+	params := a.Query()
+	params.Del("approval_prompt")
+	params.Set("acr_values", p.ACRValues)
+	params.Set("prompt", "select_account")
+	nonce, _ := randomHex(16)
+	params.Set("nonce", nonce)
+	a.RawQuery = params.Encode()
+	return a.String()
+}
+
+// clientAssertion returns a JWT, signed with the private key, that
+// authenticates the client to the token endpoint
+func (p *LoginGovProvider) clientAssertion(now time.Time) (string, error) {
+	if p.PrivateKey == nil {
+		return "", errors.New("login.gov requires a private key")
+	}
+	jti, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": p.ClientID,
+		"sub": p.ClientID,
+		"aud": p.RedeemURL.String(),
+		"jti": jti,
+		"exp": now.Add(5 * time.Minute).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.PrivateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Redeem exchanges the code for tokens, authenticating with a client
+// assertion instead of the client secret
+func (p *LoginGovProvider) Redeem(redirectURL, code, codeVerifier string) (s *SessionState, err error) {
+	if code == "" {
+		err = errors.New("missing code")
+		return
+	}
+	assertion, err := p.clientAssertion(time.Now())
+	if err != nil {
+		return
+	}
+
+	params := url.Values{}
+	params.Add("client_assertion", assertion)
+	params.Add("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
+
+	var req *http.Request
+	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	var body []byte
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+		return
+	}
+
+	var jsonResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		IDToken     string `json:"id_token"`
+	}
+	err = json.Unmarshal(body, &jsonResponse)
+	if err != nil {
+		return
+	}
+	if jsonResponse.AccessToken == "" {
+		err = fmt.Errorf("no access token found %s", body)
+		return
+	}
+	s = &SessionState{
+		AccessToken: jsonResponse.AccessToken,
+		IDToken:     jsonResponse.IDToken,
+	}
+	if jsonResponse.ExpiresIn > 0 {
+		s.ExpiresOn = time.Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second).Truncate(time.Second)
+	}
+	return
+}
+
+func getLoginGovHeader(accessToken string) http.Header {
+	header := make(http.Header)
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	return header
+}
+
+// GetEmailAddress returns the user's verified email address from the
+// userinfo endpoint
+func (p *LoginGovProvider) GetEmailAddress(s *SessionState) (string, error) {
+	if s.AccessToken == "" {
+		return "", errors.New("missing access token")
+	}
+	req, err := http.NewRequest("GET", p.ProfileURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = getLoginGovHeader(s.AccessToken)
+
+	json, err := api.Request(req)
+	if err != nil {
+		return "", err
+	}
+	email, err := json.Get("email").String()
+	if err != nil || email == "" {
+		return "", fmt.Errorf("no email address in userinfo: %v", err)
+	}
+	if verified, err := json.Get("email_verified").Bool(); err == nil && !verified {
+		return "", fmt.Errorf("email %s is not verified", email)
+	}
+	return email, nil
+}
+
+func (p *LoginGovProvider) ValidateSessionState(s *SessionState) bool {
+	return validateToken(p, s.AccessToken, getLoginGovHeader(s.AccessToken))
+}
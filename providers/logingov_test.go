@@ -0,0 +1,139 @@
+package providers
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func testLoginGovProvider(hostname string, key *rsa.PrivateKey) *LoginGovProvider {
+	p := NewLoginGovProvider(
+		&ProviderData{
+			ProviderName: "",
+			ClientID:     "urn:gov:gsa:openidconnect.profiles:sp:sso:agency:app",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	p.PrivateKey = key
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+	}
+	return p
+}
+
+func TestLoginGovProviderDefaults(t *testing.T) {
+	p := testLoginGovProvider("", nil)
+	assert.Equal(t, "login.gov", p.Data().ProviderName)
+	assert.Equal(t, "https://secure.login.gov/openid_connect/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://secure.login.gov/api/openid_connect/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://secure.login.gov/api/openid_connect/userinfo",
+		p.Data().ProfileURL.String())
+	assert.Equal(t, "https://secure.login.gov/openid_connect/logout",
+		p.Data().LogoutURL.String())
+	assert.Equal(t, "openid email", p.Data().Scope)
+}
+
+func TestLoginGovProviderGetLoginURL(t *testing.T) {
+	p := testLoginGovProvider("", nil)
+	u, _ := url.Parse(p.GetLoginURL("https://example.com/oauth2/callback", "nonce:/", "challenge"))
+	q := u.Query()
+	assert.Equal(t, "http://idmanagement.gov/ns/assurance/ial/1", q.Get("acr_values"))
+	assert.Equal(t, "select_account", q.Get("prompt"))
+	assert.Equal(t, 32, len(q.Get("nonce")))
+	assert.Equal(t, "challenge", q.Get("code_challenge"))
+	assert.Equal(t, "", q.Get("approval_prompt"))
+}
+
+func TestParseLoginGovPrivateKey(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	parsed, err := ParseLoginGovPrivateKey(pkcs1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, key.N, parsed.N)
+
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	parsed, err = ParseLoginGovPrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, key.N, parsed.N)
+
+	_, err = ParseLoginGovPrivateKey([]byte("not a key"))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestLoginGovProviderRedeem(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var form url.Values
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.Write([]byte(`{"access_token":"a1234","token_type":"Bearer","expires_in":900,"id_token":"id1234"}`))
+	}))
+	defer b.Close()
+	bURL, _ := url.Parse(b.URL)
+	p := testLoginGovProvider(bURL.Host, key)
+
+	s, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "verifier")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a1234", s.AccessToken)
+	assert.Equal(t, "id1234", s.IDToken)
+	assert.Equal(t, true, s.ExpiresOn.After(time.Now().Add(14*time.Minute)))
+
+	assert.Equal(t, "code1234", form.Get("code"))
+	assert.Equal(t, "verifier", form.Get("code_verifier"))
+	assert.Equal(t, "", form.Get("client_secret"))
+	assert.Equal(t, "urn:ietf:params:oauth:client-assertion-type:jwt-bearer", form.Get("client_assertion_type"))
+
+	// the client assertion is signed by the private key
+	parts := strings.Split(form.Get("client_assertion"), ".")
+	assert.Equal(t, 3, len(parts))
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	assert.Equal(t, nil, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig))
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]interface{}
+	assert.Equal(t, nil, json.Unmarshal(payload, &claims))
+	assert.Equal(t, p.ClientID, claims["iss"])
+	assert.Equal(t, p.ClientID, claims["sub"])
+	assert.Equal(t, p.RedeemURL.String(), claims["aud"])
+}
+
+func TestLoginGovProviderGetEmailAddress(t *testing.T) {
+	payload := `{"sub":"b2d2d115","email":"michael.bland@gsa.gov","email_verified":true}`
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(payload))
+	}))
+	defer b.Close()
+	bURL, _ := url.Parse(b.URL)
+	p := testLoginGovProvider(bURL.Host, nil)
+
+	email, err := p.GetEmailAddress(&SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	payload = `{"sub":"b2d2d115","email":"michael.bland@gsa.gov","email_verified":false}`
+	_, err = p.GetEmailAddress(&SessionState{AccessToken: "imaginary_access_token"})
+	assert.NotEqual(t, nil, err)
+}
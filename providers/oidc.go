@@ -0,0 +1,227 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCProvider is a generic OpenID Connect provider. Endpoints are taken from
+// the issuer's discovery document and id_tokens are verified against its JWKS.
+type OIDCProvider struct {
+	*ProviderData
+
+	Verifier    *oidc.IDTokenVerifier
+	EmailClaim  string
+	GroupsClaim string
+}
+
+func NewOIDCProvider(p *ProviderData) *OIDCProvider {
+	p.ProviderName = "OpenID Connect"
+	if p.Scope == "" {
+		p.Scope = "openid email profile"
+	}
+	return &OIDCProvider{
+		ProviderData: p,
+		EmailClaim:   "email",
+		GroupsClaim:  "groups",
+	}
+}
+
+// Configure performs discovery against issuerURL, filling in any endpoints
+// that were not explicitly configured and setting up id_token verification.
+func (p *OIDCProvider) Configure(issuerURL string) error {
+	provider, err := oidc.NewProvider(context.Background(), issuerURL)
+	if err != nil {
+		return err
+	}
+	var discovery struct {
+		UserInfoURL string `json:"userinfo_endpoint"`
+		LogoutURL   string `json:"end_session_endpoint"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		return err
+	}
+
+	endpoint := provider.Endpoint()
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		if p.LoginURL, err = url.Parse(endpoint.AuthURL); err != nil {
+			return err
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		if p.RedeemURL, err = url.Parse(endpoint.TokenURL); err != nil {
+			return err
+		}
+	}
+	if (p.ValidateURL == nil || p.ValidateURL.String() == "") && discovery.UserInfoURL != "" {
+		if p.ValidateURL, err = url.Parse(discovery.UserInfoURL); err != nil {
+			return err
+		}
+	}
+	if (p.LogoutURL == nil || p.LogoutURL.String() == "") && discovery.LogoutURL != "" {
+		if p.LogoutURL, err = url.Parse(discovery.LogoutURL); err != nil {
+			return err
+		}
+	}
+	p.Verifier = provider.Verifier(&oidc.Config{ClientID: p.ClientID})
+	return nil
+}
+
+func (p *OIDCProvider) oauth2Config(redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  p.LoginURL.String(),
+			TokenURL: p.RedeemURL.String(),
+		},
+		RedirectURL: redirectURL,
+	}
+}
+
+func (p *OIDCProvider) Redeem(redirectURL, code, codeVerifier string) (s *SessionState, err error) {
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+	var opts []oauth2.AuthCodeOption
+	if codeVerifier != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("code_verifier", codeVerifier))
+	}
+	ctx := context.Background()
+	token, err := p.oauth2Config(redirectURL).Exchange(ctx, code, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange: %v", err)
+	}
+	return p.createSessionState(ctx, token)
+}
+
+func (p *OIDCProvider) RefreshSession(s *SessionState) (bool, error) {
+	if s == nil || s.RefreshToken == "" {
+		return false, nil
+	}
+
+	origExpiration := s.ExpiresOn
+	ctx := context.Background()
+	t := &oauth2.Token{
+		RefreshToken: s.RefreshToken,
+		Expiry:       time.Now().Add(-time.Hour),
+	}
+	token, err := p.oauth2Config("").TokenSource(ctx, t).Token()
+	if err != nil {
+		return false, fmt.Errorf("failed to get token: %v", err)
+	}
+	if _, ok := token.Extra("id_token").(string); !ok {
+		// issuers needn't return a new id_token on refresh, in which case
+		// the claims from sign in still stand
+		s.AccessToken = token.AccessToken
+		if token.RefreshToken != "" {
+			s.RefreshToken = token.RefreshToken
+		}
+		s.ExpiresOn = token.Expiry
+		log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
+		return true, nil
+	}
+	refreshed, err := p.createSessionState(ctx, token)
+	if err != nil {
+		return false, err
+	}
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = s.RefreshToken
+	}
+	*s = *refreshed
+	log.Printf("refreshed id token %s (expired on %s)", s, origExpiration)
+	return true, nil
+}
+
+func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Token) (*SessionState, error) {
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response did not contain an id_token")
+	}
+	idToken, err := p.Verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("could not verify id_token: %v", err)
+	}
+
+	s, err := NewSessionFromIDToken(idToken, p.EmailClaim, p.GroupsClaim)
+	if err != nil {
+		return nil, err
+	}
+	s.AccessToken = token.AccessToken
+	s.IDToken = rawIDToken
+	s.RefreshToken = token.RefreshToken
+	return s, nil
+}
+
+// NewSessionFromIDToken creates a session from the claims of a verified
+// id_token, reading the email and groups from the named claims
+func NewSessionFromIDToken(idToken *oidc.IDToken, emailClaim, groupsClaim string) (*SessionState, error) {
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
+	}
+	email, err := emailFromClaims(claims, emailClaim)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionState{
+		ExpiresOn: idToken.Expiry,
+		Email:     email,
+		Groups:    groupsFromClaim(claims[groupsClaim]),
+	}, nil
+}
+
+func emailFromClaims(claims map[string]interface{}, emailClaim string) (string, error) {
+	email, _ := claims[emailClaim].(string)
+	if email == "" {
+		return "", fmt.Errorf("id_token did not contain a %q claim", emailClaim)
+	}
+	// email_verified only describes the standard email claim
+	if emailClaim == "email" {
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			return "", fmt.Errorf("email %s not listed as verified", email)
+		}
+	}
+	return email, nil
+}
+
+// groupsFromClaim accepts either a list of strings or a single string, as
+// identity providers differ in how they encode group membership
+func groupsFromClaim(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var groups []string
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+func getOIDCHeader(access_token string) http.Header {
+	header := make(http.Header)
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", access_token))
+	return header
+}
+
+// ValidateSessionState checks the access token against the userinfo endpoint.
+// Issuers that don't publish one are trusted until the id_token expires.
+func (p *OIDCProvider) ValidateSessionState(s *SessionState) bool {
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		return !s.IsExpired()
+	}
+	return validateToken(p, s.AccessToken, getOIDCHeader(s.AccessToken))
+}
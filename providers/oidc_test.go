@@ -0,0 +1,173 @@
+package providers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+type testOIDCIssuer struct {
+	*httptest.Server
+	key         *rsa.PrivateKey
+	published   *rsa.PublicKey
+	claims      map[string]interface{}
+	accessToken string
+}
+
+func newTestOIDCIssuer(t *testing.T) *testOIDCIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &testOIDCIssuer{key: key, published: &key.PublicKey, accessToken: "a1234"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 i.URL,
+			"authorization_endpoint": i.URL + "/auth",
+			"token_endpoint":         i.URL + "/token",
+			"userinfo_endpoint":      i.URL + "/userinfo",
+			"end_session_endpoint":   i.URL + "/logout",
+			"jwks_uri":               i.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: i.published, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "code1234" {
+			w.WriteHeader(400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  i.accessToken,
+			"refresh_token": "r1234",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"id_token":      i.idToken(t),
+		})
+	})
+	i.Server = httptest.NewServer(mux)
+	i.claims = map[string]interface{}{
+		"iss":            i.URL,
+		"aud":            "bazquux",
+		"sub":            "123456789",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"email":          "michael.bland@gsa.gov",
+		"email_verified": true,
+		"groups":         []string{"admins", "devs"},
+	}
+	return i
+}
+
+func (i *testOIDCIssuer) idToken(t *testing.T) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: i.key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(i.claims)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func testOIDCProvider(t *testing.T, issuer *testOIDCIssuer) *OIDCProvider {
+	p := NewOIDCProvider(&ProviderData{ClientID: "bazquux", ClientSecret: "xyzzyplugh"})
+	if err := p.Configure(issuer.URL); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestOIDCProviderDiscovery(t *testing.T) {
+	issuer := newTestOIDCIssuer(t)
+	defer issuer.Close()
+	p := testOIDCProvider(t, issuer)
+
+	assert.Equal(t, "OpenID Connect", p.Data().ProviderName)
+	assert.Equal(t, issuer.URL+"/auth", p.Data().LoginURL.String())
+	assert.Equal(t, issuer.URL+"/token", p.Data().RedeemURL.String())
+	assert.Equal(t, issuer.URL+"/userinfo", p.Data().ValidateURL.String())
+	assert.Equal(t, issuer.URL+"/logout", p.Data().LogoutURL.String())
+	assert.Equal(t, "openid email profile", p.Data().Scope)
+}
+
+func TestOIDCProviderRedeem(t *testing.T) {
+	issuer := newTestOIDCIssuer(t)
+	defer issuer.Close()
+	p := testOIDCProvider(t, issuer)
+
+	session, err := p.Redeem("http://redirect/", "code1234", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", session.Email)
+	assert.Equal(t, "a1234", session.AccessToken)
+	assert.Equal(t, "r1234", session.RefreshToken)
+	assert.Equal(t, []string{"admins", "devs"}, session.Groups)
+	assert.Equal(t, 2, strings.Count(session.IDToken, "."))
+}
+
+func TestOIDCProviderRedeemCustomClaims(t *testing.T) {
+	issuer := newTestOIDCIssuer(t)
+	defer issuer.Close()
+	issuer.claims["upn"] = "mbland@example.com"
+	issuer.claims["roles"] = "operators"
+	p := testOIDCProvider(t, issuer)
+	p.EmailClaim = "upn"
+	p.GroupsClaim = "roles"
+
+	session, err := p.Redeem("http://redirect/", "code1234", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland@example.com", session.Email)
+	assert.Equal(t, []string{"operators"}, session.Groups)
+}
+
+func TestOIDCProviderRedeemUnverifiedEmail(t *testing.T) {
+	issuer := newTestOIDCIssuer(t)
+	defer issuer.Close()
+	issuer.claims["email_verified"] = false
+	p := testOIDCProvider(t, issuer)
+
+	session, err := p.Redeem("http://redirect/", "code1234", "")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, (*SessionState)(nil), session)
+}
+
+func TestOIDCProviderRedeemWrongAudience(t *testing.T) {
+	issuer := newTestOIDCIssuer(t)
+	defer issuer.Close()
+	issuer.claims["aud"] = "someone-else"
+	p := testOIDCProvider(t, issuer)
+
+	_, err := p.Redeem("http://redirect/", "code1234", "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestOIDCProviderRedeemBadSignature(t *testing.T) {
+	issuer := newTestOIDCIssuer(t)
+	defer issuer.Close()
+	p := testOIDCProvider(t, issuer)
+	// sign with a key the issuer doesn't publish
+	issuer.key, _ = rsa.GenerateKey(rand.Reader, 2048)
+
+	_, err := p.Redeem("http://redirect/", "code1234", "")
+	assert.NotEqual(t, nil, err)
+}
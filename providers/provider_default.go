@@ -12,7 +12,9 @@ import (
 	"github.com/bitly/oauth2_proxy/cookie"
 )
 
-func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err error) {
+// Redeem exchanges the code for an access token. codeVerifier is sent when
+// the login URL carried a PKCE code challenge.
+func (p *ProviderData) Redeem(redirectURL, code, codeVerifier string) (s *SessionState, err error) {
 	if code == "" {
 		err = errors.New("missing code")
 		return
@@ -24,6 +26,9 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err er
 	params.Add("client_secret", p.ClientSecret)
 	params.Add("code", code)
 	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
 	if p.ProtectedResource != nil && p.ProtectedResource.String() != "" {
 		params.Add("resource", p.ProtectedResource.String())
 	}
@@ -77,8 +82,9 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err er
 	return
 }
 
-// GetLoginURL with typical oauth parameters
-func (p *ProviderData) GetLoginURL(redirectURI, state string) string {
+// GetLoginURL with typical oauth parameters, and a PKCE S256 code challenge
+// when codeChallenge is set
+func (p *ProviderData) GetLoginURL(redirectURI, state, codeChallenge string) string {
 	var a url.URL
 	a = *p.LoginURL
 	params, _ := url.ParseQuery(a.RawQuery)
@@ -88,6 +94,28 @@ func (p *ProviderData) GetLoginURL(redirectURI, state string) string {
 	params.Set("client_id", p.ClientID)
 	params.Set("response_type", "code")
 	params.Add("state", state)
+	if codeChallenge != "" {
+		params.Set("code_challenge", codeChallenge)
+		params.Set("code_challenge_method", "S256")
+	}
+	a.RawQuery = params.Encode()
+	return a.String()
+}
+
+// GetLogoutURL returns the provider's end session endpoint for RP-initiated
+// logout, or "" if it doesn't have one. s may be nil when the user has no
+// session; otherwise its id_token is passed as a hint of who to sign out.
+func (p *ProviderData) GetLogoutURL(s *SessionState, redirectURI string) string {
+	if p.LogoutURL == nil || p.LogoutURL.String() == "" {
+		return ""
+	}
+	a := *p.LogoutURL
+	params, _ := url.ParseQuery(a.RawQuery)
+	if s != nil && s.IDToken != "" {
+		params.Set("id_token_hint", s.IDToken)
+	}
+	params.Set("client_id", p.ClientID)
+	params.Set("post_logout_redirect_uri", redirectURI)
 	a.RawQuery = params.Encode()
 	return a.String()
 }
@@ -106,6 +134,12 @@ func (p *ProviderData) GetEmailAddress(s *SessionState) (string, error) {
 	return "", errors.New("not implemented")
 }
 
+// EnrichSession adds information such as group membership to a newly
+// redeemed session. Providers without anything to add leave it unchanged.
+func (p *ProviderData) EnrichSession(s *SessionState) error {
+	return nil
+}
+
 // ValidateGroup validates that the provided email exists in the configured provider
 // email group(s).
 func (p *ProviderData) ValidateGroup(email string) bool {
@@ -116,7 +150,9 @@ func (p *ProviderData) ValidateSessionState(s *SessionState) bool {
 	return validateToken(p, s.AccessToken, nil)
 }
 
-// RefreshSessionIfNeeded
-func (p *ProviderData) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
+// RefreshSession exchanges the session's refresh token for new tokens,
+// reporting whether the session was updated. Providers that don't support
+// refresh tokens leave it unchanged.
+func (p *ProviderData) RefreshSession(s *SessionState) (bool, error) {
 	return false, nil
 }
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"net/url"
 	"testing"
 	"time"
 
@@ -9,9 +10,36 @@ import (
 
 func TestRefresh(t *testing.T) {
 	p := &ProviderData{}
-	refreshed, err := p.RefreshSessionIfNeeded(&SessionState{
-		ExpiresOn: time.Now().Add(time.Duration(-11) * time.Minute),
+	refreshed, err := p.RefreshSession(&SessionState{
+		ExpiresOn:    time.Now().Add(time.Duration(-11) * time.Minute),
+		RefreshToken: "refresh1234",
 	})
 	assert.Equal(t, false, refreshed)
 	assert.Equal(t, nil, err)
 }
+
+func TestGetLogoutURL(t *testing.T) {
+	p := &ProviderData{ClientID: "bazquux"}
+	assert.Equal(t, "", p.GetLogoutURL(nil, "https://example.com/"))
+
+	p.LogoutURL, _ = url.Parse("https://idp.example.com/logout?foo=bar")
+	assert.Equal(t, "https://idp.example.com/logout?client_id=bazquux&foo=bar"+
+		"&post_logout_redirect_uri=https%3A%2F%2Fexample.com%2F",
+		p.GetLogoutURL(nil, "https://example.com/"))
+	assert.Equal(t, "https://idp.example.com/logout?client_id=bazquux&foo=bar"+
+		"&id_token_hint=id1234&post_logout_redirect_uri=https%3A%2F%2Fexample.com%2F",
+		p.GetLogoutURL(&SessionState{IDToken: "id1234"}, "https://example.com/"))
+}
+
+func TestGetLoginURLCodeChallenge(t *testing.T) {
+	p := &ProviderData{ClientID: "bazquux", Scope: "profile"}
+	p.LoginURL, _ = url.Parse("https://idp.example.com/authorize")
+
+	loginURL, _ := url.Parse(p.GetLoginURL("https://example.com/oauth2/callback", "nonce:/", ""))
+	assert.Equal(t, "", loginURL.Query().Get("code_challenge"))
+	assert.Equal(t, "", loginURL.Query().Get("code_challenge_method"))
+
+	loginURL, _ = url.Parse(p.GetLoginURL("https://example.com/oauth2/callback", "nonce:/", "challenge1234"))
+	assert.Equal(t, "challenge1234", loginURL.Query().Get("code_challenge"))
+	assert.Equal(t, "S256", loginURL.Query().Get("code_challenge_method"))
+}
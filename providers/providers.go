@@ -7,11 +7,13 @@ import (
 type Provider interface {
 	Data() *ProviderData
 	GetEmailAddress(*SessionState) (string, error)
-	Redeem(string, string) (*SessionState, error)
+	EnrichSession(*SessionState) error
+	Redeem(redirectURI, code, codeVerifier string) (*SessionState, error)
 	ValidateGroup(string) bool
 	ValidateSessionState(*SessionState) bool
-	GetLoginURL(redirectURI, finalRedirect string) string
-	RefreshSessionIfNeeded(*SessionState) (bool, error)
+	GetLoginURL(redirectURI, state, codeChallenge string) string
+	GetLogoutURL(s *SessionState, redirectURI string) string
+	RefreshSession(*SessionState) (bool, error)
 	SessionFromCookie(string, *cookie.Cipher) (*SessionState, error)
 	CookieForSession(*SessionState, *cookie.Cipher) (string, error)
 }
@@ -26,10 +28,18 @@ func New(provider string, p *ProviderData) Provider {
 		return NewFacebookProvider(p)
 	case "github":
 		return NewGitHubProvider(p)
+	case "bitbucket":
+		return NewBitbucketProvider(p)
 	case "azure":
 		return NewAzureProvider(p)
 	case "gitlab":
 		return NewGitLabProvider(p)
+	case "oidc":
+		return NewOIDCProvider(p)
+	case "keycloak":
+		return NewKeycloakProvider(p)
+	case "login.gov":
+		return NewLoginGovProvider(p)
 	default:
 		return NewGoogleProvider(p)
 	}
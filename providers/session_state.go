@@ -2,6 +2,7 @@ package providers
 
 import (
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -11,10 +12,21 @@ import (
 
 type SessionState struct {
 	AccessToken  string
+	IDToken      string
 	ExpiresOn    time.Time
 	RefreshToken string
 	Email        string
 	User         string
+
+	Groups []string
+
+	// Provider is the id of the [[provider]] the user signed in with, or
+	// empty for the default provider
+	Provider string
+
+	// Claims holds the JSON value of each claim mapped to a header by a
+	// [[claim_header]], keyed by claim name
+	Claims map[string]string
 }
 
 func (s *SessionState) IsExpired() bool {
@@ -32,17 +44,39 @@ func (s *SessionState) String() string {
 	if !s.ExpiresOn.IsZero() {
 		o += fmt.Sprintf(" expires:%s", s.ExpiresOn)
 	}
+	if s.IDToken != "" {
+		o += " id_token:true"
+	}
 	if s.RefreshToken != "" {
 		o += " refresh_token:true"
 	}
+	if len(s.Groups) != 0 {
+		o += fmt.Sprintf(" groups:%v", s.Groups)
+	}
+	if s.Provider != "" {
+		o += fmt.Sprintf(" provider:%s", s.Provider)
+	}
+	if len(s.Claims) != 0 {
+		o += fmt.Sprintf(" claims:%d", len(s.Claims))
+	}
 	return o + "}"
 }
 
 func (s *SessionState) EncodeSessionState(c *cookie.Cipher) (string, error) {
-	if c == nil || s.AccessToken == "" {
+	if len(s.Groups) == 0 && s.Provider == "" && len(s.Claims) == 0 && (c == nil || (s.AccessToken == "" && s.IDToken == "")) {
 		return s.userOrEmail(), nil
 	}
-	return s.EncryptedString(c)
+	if c == nil {
+		// tokens can't be stored without a cipher, but groups, the
+		// provider and claims can
+		return s.encode("", "", "")
+	}
+	v, err := s.encode(url.QueryEscape(s.AccessToken), url.QueryEscape(s.RefreshToken),
+		url.QueryEscape(s.IDToken))
+	if err != nil {
+		return "", err
+	}
+	return c.Seal(v)
 }
 
 func (s *SessionState) userOrEmail() string {
@@ -53,6 +87,9 @@ func (s *SessionState) userOrEmail() string {
 	return u
 }
 
+// EncryptedString serializes the session in the original format, with each
+// token encrypted separately by c.Encrypt. EncodeSessionState seals the
+// whole session instead; this is kept to test reading older sessions.
 func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
 	var err error
 	if c == nil {
@@ -72,10 +109,59 @@ func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
 			return "", err
 		}
 	}
-	return fmt.Sprintf("%s|%s|%d|%s", s.userOrEmail(), a, s.ExpiresOn.Unix(), r), nil
+	return s.encode(a, r, "")
+}
+
+// encode serializes the session with already encoded tokens. Groups, the
+// id token, the provider and claims are appended as a fifth to eighth field
+// only when present so that sessions without them keep the original format.
+func (s *SessionState) encode(accessToken, refreshToken, idToken string) (string, error) {
+	v := fmt.Sprintf("%s|%s|%d|%s", s.userOrEmail(), accessToken, s.ExpiresOn.Unix(), refreshToken)
+	if len(s.Groups) != 0 || idToken != "" || s.Provider != "" || len(s.Claims) != 0 {
+		groups := make([]string, len(s.Groups))
+		for i, g := range s.Groups {
+			groups[i] = url.QueryEscape(g)
+		}
+		v += "|" + strings.Join(groups, ",")
+	}
+	if idToken != "" || s.Provider != "" || len(s.Claims) != 0 {
+		v += "|" + idToken
+	}
+	if s.Provider != "" || len(s.Claims) != 0 {
+		v += "|" + url.QueryEscape(s.Provider)
+	}
+	if len(s.Claims) != 0 {
+		claims := make(url.Values, len(s.Claims))
+		for k, c := range s.Claims {
+			claims.Set(k, c)
+		}
+		v += "|" + claims.Encode()
+	}
+	return v, nil
+}
+
+func DecodeSessionState(v string, c *cookie.Cipher) (*SessionState, error) {
+	if !cookie.IsSealed(v) {
+		// sessions written before they were sealed
+		// tokens can't be read without a cipher
+		decrypt := func(string) (string, error) { return "", nil }
+		if c != nil {
+			decrypt = c.Decrypt
+		}
+		return decode(v, decrypt)
+	}
+	if c == nil {
+		return nil, fmt.Errorf("sealed session found without a cipher")
+	}
+	v, err := c.Open(v)
+	if err != nil {
+		return nil, err
+	}
+	return decode(v, url.QueryUnescape)
 }
 
-func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error) {
+// decode parses a serialized session, reading the tokens with decodeToken
+func decode(v string, decodeToken func(string) (string, error)) (s *SessionState, err error) {
 	chunks := strings.Split(v, "|")
 	if len(chunks) == 1 {
 		if strings.Contains(chunks[0], "@") {
@@ -85,20 +171,20 @@ func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error)
 		return &SessionState{User: v}, nil
 	}
 
-	if len(chunks) != 4 {
-		err = fmt.Errorf("invalid number of fields (got %d expected 4)", len(chunks))
+	if len(chunks) < 4 || len(chunks) > 8 {
+		err = fmt.Errorf("invalid number of fields (got %d expected 4 to 8)", len(chunks))
 		return
 	}
 
 	s = &SessionState{}
-	if c != nil && chunks[1] != "" {
-		s.AccessToken, err = c.Decrypt(chunks[1])
+	if chunks[1] != "" {
+		s.AccessToken, err = decodeToken(chunks[1])
 		if err != nil {
 			return nil, err
 		}
 	}
-	if c != nil && chunks[3] != "" {
-		s.RefreshToken, err = c.Decrypt(chunks[3])
+	if chunks[3] != "" {
+		s.RefreshToken, err = decodeToken(chunks[3])
 		if err != nil {
 			return nil, err
 		}
@@ -111,5 +197,36 @@ func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error)
 	}
 	ts, _ := strconv.Atoi(chunks[2])
 	s.ExpiresOn = time.Unix(int64(ts), 0)
+	if len(chunks) >= 6 && chunks[5] != "" {
+		s.IDToken, err = decodeToken(chunks[5])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(chunks) >= 5 && chunks[4] != "" {
+		for _, g := range strings.Split(chunks[4], ",") {
+			group, err := url.QueryUnescape(g)
+			if err != nil {
+				return nil, err
+			}
+			s.Groups = append(s.Groups, group)
+		}
+	}
+	if len(chunks) >= 7 {
+		s.Provider, err = url.QueryUnescape(chunks[6])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(chunks) == 8 {
+		claims, err := url.ParseQuery(chunks[7])
+		if err != nil {
+			return nil, err
+		}
+		s.Claims = make(map[string]string, len(claims))
+		for k := range claims {
+			s.Claims[k] = claims.Get(k)
+		}
+	}
 	return
 }
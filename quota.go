@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// quotaWindow is the period quotas are counted over
+const quotaWindow = time.Minute
+
+// statusQuotaExceeded is returned by Authenticate when the user is
+// authenticated but has used up their quota. Like statusPolicyDenied it is
+// never sent to clients.
+const statusQuotaExceeded = -http.StatusTooManyRequests
+
+// quota limits the requests each user can make a minute. Members of a
+// group with a quota get the largest of their groups' quotas, where 0 is
+// unlimited, and other users the user quota, if there is one.
+type quota struct {
+	store  RateLimitStore
+	user   int64
+	groups map[string]int64
+	now    func() time.Time
+}
+
+// limit returns the quota of the session's user, or 0 when they have none
+func (q *quota) limit(s *providers.SessionState) int64 {
+	limit, member := int64(0), false
+	for _, g := range s.Groups {
+		n, ok := q.groups[g]
+		if !ok {
+			continue
+		}
+		if n == 0 {
+			return 0
+		}
+		if !member || n > limit {
+			limit = n
+		}
+		member = true
+	}
+	if member {
+		return limit
+	}
+	return q.user
+}
+
+// Allow counts a request by the session's user and reports whether it is
+// within their quota. When it isn't, retryAfter is the time left until the
+// next minute. Requests are allowed if the store fails.
+func (q *quota) Allow(s *providers.SessionState) (ok bool, limit int64, retryAfter time.Duration) {
+	limit = q.limit(s)
+	if limit == 0 {
+		return true, 0, 0
+	}
+	now := q.now()
+	start := now.Truncate(quotaWindow)
+	h := sha256.Sum256([]byte(sessionIdentity(s)))
+	n, err := q.store.Incr("quota:"+hex.EncodeToString(h[:]), start, quotaWindow)
+	if err != nil {
+		log.Printf("error counting request for quota: %s", err)
+		return true, limit, 0
+	}
+	if n <= limit {
+		return true, limit, 0
+	}
+	return false, limit, start.Add(quotaWindow).Sub(now)
+}
+
+// checkQuota counts an authenticated request, setting Retry-After when the
+// user is over their quota
+func (p *OAuthProxy) checkQuota(rw http.ResponseWriter, req *http.Request, s *providers.SessionState) bool {
+	if p.quota == nil {
+		return true
+	}
+	ok, limit, retryAfter := p.quota.Allow(s)
+	if ok {
+		return true
+	}
+	quotaExceededTotal.Inc()
+	log.Printf("%s %s is over their quota of %d requests a minute", getRemoteAddr(req), sessionIdentity(s), limit)
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return false
+}
+
+// QuotaExceeded responds to a request from a user who is over their quota
+func (p *OAuthProxy) QuotaExceeded(rw http.ResponseWriter, req *http.Request) {
+	p.ErrorPage(rw, req, http.StatusTooManyRequests, "Too Many Requests", fmt.Sprintf(
+		"You have made too many requests, try again in %s seconds", rw.Header().Get("Retry-After")))
+}
+
+// Incr counts requests in memcached, so that quotas are shared by every
+// instance using the same session store
+func (m *memcachedSessionStore) Incr(key string, start time.Time, window time.Duration) (int64, error) {
+	k := m.key(key + ":" + strconv.FormatInt(start.Unix(), 10))
+	n, err := m.client.Increment(k, 1)
+	if err == memcache.ErrCacheMiss {
+		err = m.client.Add(&memcache.Item{
+			Key:        k,
+			Value:      []byte("1"),
+			Expiration: memcachedExpiration(window, time.Now()),
+		})
+		if err == nil {
+			return 1, nil
+		}
+		// another request counted first
+		if err == memcache.ErrNotStored {
+			n, err = m.client.Increment(k, 1)
+		}
+	}
+	return int64(n), err
+}
+
+func parseQuotas(o *Options, msgs []string) []string {
+	o.quota = nil
+	if o.UserQuota < 0 {
+		msgs = append(msgs, "user-quota must not be negative")
+	}
+	groups := make(map[string]int64)
+	for _, q := range o.GroupQuotas {
+		i := strings.LastIndex(q, "=")
+		if i <= 0 {
+			msgs = append(msgs, fmt.Sprintf("invalid group-quota=%q expected group=requests", q))
+			continue
+		}
+		n, err := strconv.ParseInt(q[i+1:], 10, 64)
+		if err != nil || n < 0 {
+			msgs = append(msgs, fmt.Sprintf("invalid group-quota=%q expected group=requests", q))
+			continue
+		}
+		groups[q[:i]] = n
+	}
+	if o.UserQuota <= 0 && len(groups) == 0 {
+		return msgs
+	}
+	var store RateLimitStore = newMemoryRateLimitStore()
+	if s, ok := o.sessionStore.(RateLimitStore); ok {
+		store = s
+	}
+	o.quota = &quota{store: store, user: int64(o.UserQuota), groups: groups, now: time.Now}
+	return msgs
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestQuotaOptions(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, (*quota)(nil), o.quota)
+
+	o = testOptions()
+	o.UserQuota = -1
+	o.GroupQuotas = []string{"ops", "=10", "devs=many", "batch=-1"}
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"user-quota must not be negative",
+		`invalid group-quota="ops" expected group=requests`,
+		`invalid group-quota="=10" expected group=requests`,
+		`invalid group-quota="devs=many" expected group=requests`,
+		`invalid group-quota="batch=-1" expected group=requests`,
+	}), err.Error())
+
+	o = testOptions()
+	o.UserQuota = 100
+	o.GroupQuotas = []string{"batch=10", "team=a=20"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, int64(100), o.quota.user)
+	assert.Equal(t, map[string]int64{"batch": 10, "team=a": 20}, o.quota.groups)
+}
+
+func TestQuotaLimit(t *testing.T) {
+	q := &quota{user: 100, groups: map[string]int64{"batch": 10, "ci": 50, "sre": 0}}
+	limit := func(groups ...string) int64 {
+		return q.limit(&providers.SessionState{Email: "user@example.com", Groups: groups})
+	}
+	assert.Equal(t, int64(100), limit())
+	assert.Equal(t, int64(100), limit("devs"))
+	assert.Equal(t, int64(10), limit("devs", "batch"))
+	assert.Equal(t, int64(50), limit("batch", "ci"))
+	assert.Equal(t, int64(0), limit("batch", "sre"))
+
+	q.user = 0
+	assert.Equal(t, int64(0), limit("devs"))
+}
+
+func TestQuotaAllow(t *testing.T) {
+	now := time.Date(2015, time.March, 19, 17, 20, 15, 0, time.UTC)
+	q := &quota{store: newMemoryRateLimitStore(), user: 2, now: func() time.Time { return now }}
+	user := &providers.SessionState{Email: "user@example.com"}
+
+	ok, _, _ := q.Allow(user)
+	assert.Equal(t, true, ok)
+	ok, _, _ = q.Allow(user)
+	assert.Equal(t, true, ok)
+	ok, limit, retryAfter := q.Allow(user)
+	assert.Equal(t, false, ok)
+	assert.Equal(t, int64(2), limit)
+	assert.Equal(t, 45*time.Second, retryAfter)
+
+	// other users have their own quota
+	ok, _, _ = q.Allow(&providers.SessionState{Email: "other@example.com"})
+	assert.Equal(t, true, ok)
+
+	now = now.Add(time.Minute)
+	ok, _, _ = q.Allow(user)
+	assert.Equal(t, true, ok)
+
+	q.store = failingRateLimitStore{}
+	q.user = 1
+	ok, _, _ = q.Allow(user)
+	assert.Equal(t, true, ok)
+}
+
+func TestAuthenticateOverQuota(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	test := func(path string, groups []string) *ProcessCookieTest {
+		pc_test := NewProcessCookieTestWithDefaults()
+		pc_test.proxy.quota = &quota{store: store, user: 1, groups: map[string]int64{"sre": 0}, now: time.Now}
+		pc_test.req, _ = http.NewRequest("GET", path, nil)
+		pc_test.SaveSession(&providers.SessionState{
+			Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+			Groups: groups}, time.Now())
+		pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+		return pc_test
+	}
+
+	assert.Equal(t, http.StatusAccepted, test("/oauth2/auth", nil).rw.Code)
+	over := test("/oauth2/auth", nil)
+	assert.Equal(t, http.StatusTooManyRequests, over.rw.Code)
+	assert.NotEqual(t, "", over.rw.Header().Get("Retry-After"))
+	assert.Equal(t, "", over.rw.Header().Get("Set-Cookie"))
+
+	over = test("/", nil)
+	assert.Equal(t, http.StatusTooManyRequests, over.rw.Code)
+	assert.Equal(t, true, strings.Contains(over.rw.Body.String(), "Too Many Requests"))
+
+	// members of a group without a quota aren't limited
+	assert.Equal(t, http.StatusAccepted, test("/oauth2/auth", []string{"sre"}).rw.Code)
+}
+
+func TestQuotaExceededPage(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	rw := httptest.NewRecorder()
+	rw.Header().Set("Retry-After", "30")
+	req, _ := http.NewRequest("GET", "/", nil)
+	pc_test.proxy.QuotaExceeded(rw, req)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, true, strings.Contains(rw.Body.String(), "try again in 30 seconds"))
+}
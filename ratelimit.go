@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// RateLimitStore counts requests in fixed time windows. Implementations
+// must be safe for concurrent use.
+type RateLimitStore interface {
+	// Incr counts a request for key in the window starting at start and
+	// returns the number of requests counted for it so far
+	Incr(key string, start time.Time, window time.Duration) (int64, error)
+}
+
+// rateLimiter limits the requests a client IP can make in each window
+type rateLimiter struct {
+	store   RateLimitStore
+	limit   int64
+	window  time.Duration
+	trusted []*net.IPNet
+	now     func() time.Time
+}
+
+func newRateLimiter(store RateLimitStore, limit int, window time.Duration, trusted []*net.IPNet) *rateLimiter {
+	return &rateLimiter{
+		store:   store,
+		limit:   int64(limit),
+		window:  window,
+		trusted: trusted,
+		now:     time.Now,
+	}
+}
+
+// Allow counts a request and reports whether it is within the limit. When
+// it isn't, retryAfter is the time left until the next window. Requests are
+// allowed if the store fails, so that an unavailable backend doesn't lock
+// everyone out.
+func (l *rateLimiter) Allow(req *http.Request) (ok bool, retryAfter time.Duration) {
+	ip := clientIP(req, l.trusted)
+	if ip == nil {
+		return true, 0
+	}
+	now := l.now()
+	start := now.Truncate(l.window)
+	n, err := l.store.Incr(ip.String(), start, l.window)
+	if err != nil {
+		log.Printf("error counting request for rate limit: %s", err)
+		return true, 0
+	}
+	if n <= l.limit {
+		return true, 0
+	}
+	return false, start.Add(l.window).Sub(now)
+}
+
+// allowRequest applies the rate limit, responding with 429 Too Many
+// Requests when a client has exceeded it
+func (p *OAuthProxy) allowRequest(rw http.ResponseWriter, req *http.Request) bool {
+	if p.rateLimiter == nil {
+		return true
+	}
+	ok, retryAfter := p.rateLimiter.Allow(req)
+	if ok {
+		return true
+	}
+	rateLimitedTotal.WithLabelValues(req.URL.Path).Inc()
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	rw.Header().Set("Retry-After", strconv.Itoa(seconds))
+	p.ErrorPage(rw, req, http.StatusTooManyRequests, "Too Many Requests", fmt.Sprintf(
+		"Too many sign in attempts from %s, try again in %d seconds",
+		clientIP(req, p.rateLimiter.trusted), seconds))
+	return false
+}
+
+type memoryRateLimitCount struct {
+	start time.Time
+	n     int64
+}
+
+// memoryRateLimitStore counts requests in memory, so limits apply to each
+// instance separately
+type memoryRateLimitStore struct {
+	mu     sync.Mutex
+	counts map[string]*memoryRateLimitCount
+	pruned time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{counts: make(map[string]*memoryRateLimitCount)}
+}
+
+func (m *memoryRateLimitStore) Incr(key string, start time.Time, window time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// counts from earlier windows are dropped once per window
+	if m.pruned.Before(start) {
+		for k, c := range m.counts {
+			if c.start.Before(start) {
+				delete(m.counts, k)
+			}
+		}
+		m.pruned = start
+	}
+	c, ok := m.counts[key]
+	if !ok || !c.start.Equal(start) {
+		c = &memoryRateLimitCount{start: start}
+		m.counts[key] = c
+	}
+	c.n++
+	return c.n, nil
+}
+
+// redisRateLimitStore counts requests in Redis, so that limits are shared by
+// every instance using the same server
+type redisRateLimitStore struct {
+	pool *redis.Pool
+}
+
+// newRedisPool returns a pool of connections to a redis:// or rediss:// URL
+func newRedisPool(rawurl string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 4 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(rawurl,
+				redis.DialConnectTimeout(time.Second),
+				redis.DialReadTimeout(time.Second),
+				redis.DialWriteTimeout(time.Second))
+		},
+	}
+}
+
+// sharedRedisPool returns the pool of connections to a Redis server, shared
+// by everything in the configuration that uses the server and kept across
+// reloads
+func sharedRedisPool(o *Options, rawurl string) *redis.Pool {
+	pool, _ := o.shared("redis "+rawurl, func() (interface{}, error) {
+		return newRedisPool(rawurl), nil
+	})
+	return pool.(*redis.Pool)
+}
+
+func (r *redisRateLimitStore) Incr(key string, start time.Time, window time.Duration) (int64, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	key = "oauth2_proxy:ratelimit:" + key + ":" + strconv.FormatInt(start.Unix(), 10)
+	conn.Send("MULTI")
+	conn.Send("INCR", key)
+	conn.Send("PEXPIRE", key, int64(window/time.Millisecond))
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int64(replies[0], nil)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, msgs := parseCIDRs([]string{"10.0.0.0/8", "192.168.1.1"}, "trusted-proxy", nil)
+	assert.Equal(t, 0, len(msgs))
+
+	clientIPFor := func(remoteAddr string, forwardedFor ...string) string {
+		req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+		req.RemoteAddr = remoteAddr
+		for _, h := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", h)
+		}
+		return clientIP(req, trusted).String()
+	}
+
+	assert.Equal(t, "203.0.113.7", clientIPFor("203.0.113.7:52000"))
+	// only trusted proxies can set the client address
+	assert.Equal(t, "203.0.113.7", clientIPFor("203.0.113.7:52000", "198.51.100.1"))
+	assert.Equal(t, "198.51.100.1", clientIPFor("10.1.2.3:52000", "198.51.100.1"))
+	assert.Equal(t, "198.51.100.1", clientIPFor("192.168.1.1:52000", "198.51.100.1, 10.1.2.3"))
+	// addresses added before an untrusted hop can't be relied on
+	assert.Equal(t, "198.51.100.1", clientIPFor("10.1.2.3:52000", "6.6.6.6", "198.51.100.1"))
+	assert.Equal(t, "10.1.2.3", clientIPFor("10.1.2.3:52000", "not an address"))
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, msgs := parseCIDRs([]string{"10.0.0.0/8", "::1", "10.0.0.0/33", "localhost"}, "trusted-proxy", nil)
+	assert.Equal(t, []string{
+		"trusted-proxy is not an address or CIDR range: \"10.0.0.0/33\"",
+		"trusted-proxy is not an address or CIDR range: \"localhost\"",
+	}, msgs)
+	assert.Equal(t, 2, len(nets))
+	assert.Equal(t, "::1/128", nets[1].String())
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2015, time.March, 19, 17, 20, 15, 0, time.UTC)
+	l := newRateLimiter(newMemoryRateLimitStore(), 2, time.Minute, nil)
+	l.now = func() time.Time { return now }
+
+	req := func(remoteAddr string) *http.Request {
+		req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+		req.RemoteAddr = remoteAddr
+		return req
+	}
+
+	ok, _ := l.Allow(req("203.0.113.7:52000"))
+	assert.Equal(t, true, ok)
+	ok, _ = l.Allow(req("203.0.113.7:52001"))
+	assert.Equal(t, true, ok)
+	ok, retryAfter := l.Allow(req("203.0.113.7:52002"))
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 45*time.Second, retryAfter)
+
+	// other clients have their own limit
+	ok, _ = l.Allow(req("198.51.100.1:52000"))
+	assert.Equal(t, true, ok)
+
+	now = now.Add(time.Minute)
+	ok, _ = l.Allow(req("203.0.113.7:52003"))
+	assert.Equal(t, true, ok)
+}
+
+func TestMemoryRateLimitStorePrunes(t *testing.T) {
+	m := newMemoryRateLimitStore()
+	start := time.Date(2015, time.March, 19, 17, 20, 0, 0, time.UTC)
+	m.Incr("203.0.113.7", start, time.Minute)
+	m.Incr("198.51.100.1", start, time.Minute)
+	n, err := m.Incr("203.0.113.7", start.Add(time.Minute), time.Minute)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, 1, len(m.counts))
+}
+
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Incr(string, time.Time, time.Duration) (int64, error) {
+	return 0, &net.OpError{Op: "dial", Err: net.UnknownNetworkError("tcp")}
+}
+
+func TestRateLimiterAllowsOnStoreError(t *testing.T) {
+	l := newRateLimiter(failingRateLimitStore{}, 1, time.Minute, nil)
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	req.RemoteAddr = "203.0.113.7:52000"
+	ok, _ := l.Allow(req)
+	assert.Equal(t, true, ok)
+}
+
+func TestSignInRateLimited(t *testing.T) {
+	opts := testOptions()
+	opts.RateLimit = 1
+	opts.TrustedProxies = []string{"127.0.0.1"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	signIn := func(forwardedFor string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+		req.RemoteAddr = "127.0.0.1:52000"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, http.StatusOK, signIn("203.0.113.7").Code)
+	rw := signIn("203.0.113.7")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.NotEqual(t, "", rw.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, signIn("198.51.100.1").Code)
+
+	// other endpoints aren't limited
+	req, _ := http.NewRequest("GET", "/oauth2/start", nil)
+	req.RemoteAddr = "127.0.0.1:52000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+}
@@ -1,10 +1,64 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
+// redirectorSkip matches requests the https redirector should answer
+// directly, such as plain-HTTP health checks. Either the host or the path
+// may be empty, in which case it matches anything.
+type redirectorSkip struct {
+	host string
+	path string
+}
+
+// newRedirectorSkip parses a pattern of the form "host", "/path" or
+// "host/path".
+func newRedirectorSkip(pattern string) (redirectorSkip, error) {
+	if pattern == "" {
+		return redirectorSkip{}, errors.New("empty pattern")
+	}
+	if strings.Contains(pattern, "://") {
+		return redirectorSkip{}, errors.New("must not include a scheme")
+	}
+	u, err := url.Parse("//" + pattern)
+	if err != nil {
+		return redirectorSkip{}, err
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return redirectorSkip{}, errors.New("must be of the form host, /path or host/path")
+	}
+	if strings.HasPrefix(pattern, "/") {
+		// url.Parse treats the first path segment as the host
+		return redirectorSkip{path: pattern}, nil
+	}
+	return redirectorSkip{host: strings.ToLower(u.Host), path: u.Path}, nil
+}
+
+func (s redirectorSkip) matches(req *http.Request) bool {
+	if s.host != "" {
+		host := strings.ToLower(req.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host != s.host {
+			return false
+		}
+	}
+	if s.path != "" && s.path != "/" {
+		prefix := strings.TrimSuffix(s.path, "/")
+		if req.URL.Path != prefix && !strings.HasPrefix(req.URL.Path, prefix+"/") {
+			return false
+		}
+	}
+	return true
+}
+
 type RedirectHandler struct {
 	Opts Options
 }
@@ -26,11 +80,25 @@ func (h RedirectHandler) buildRedirectURL(requestURL url.URL) (string, error) {
 	return requestURL.String(), nil
 }
 
+func (h RedirectHandler) isSkipped(r *http.Request) bool {
+	for _, s := range h.Opts.redirectorSkips {
+		if s.matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
 func (h RedirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.isSkipped(r) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "OK")
+		return
+	}
 	u, err := h.buildRedirectURL(*r.URL)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	http.Redirect(w, r, u, http.StatusMovedPermanently)
+	http.Redirect(w, r, u, h.Opts.HttpsRedirectorStatus)
 }
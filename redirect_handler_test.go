@@ -1,7 +1,11 @@
 package main
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/bmizerany/assert"
@@ -44,3 +48,89 @@ func TestBuildRedirectURLFragment(t *testing.T) {
 
 	assert.Equal(t, out, "https://external.com/boffin/#test")
 }
+
+func redirectPost(t *testing.T, status int) (method, body, uri string) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		method, body, uri = r.Method, string(b), r.URL.RequestURI()
+	}))
+	defer backend.Close()
+
+	opts := testRedirectorOptions()
+	opts.RedirectURL = backend.URL + "/oauth2/callback"
+	opts.HttpsRedirectorStatus = status
+	redirector := httptest.NewServer(NewRedirectHandler(*opts))
+	defer redirector.Close()
+
+	resp, err := http.Post(redirector.URL+"/api/items?a=1&b=2", "application/json",
+		strings.NewReader(`{"name":"barkis"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return
+}
+
+func TestRedirectPreservesMethodAndBody(t *testing.T) {
+	method, body, uri := redirectPost(t, http.StatusPermanentRedirect)
+	assert.Equal(t, "POST", method)
+	assert.Equal(t, `{"name":"barkis"}`, body)
+	assert.Equal(t, "/api/items?a=1&b=2", uri)
+}
+
+func TestRedirectMovedPermanentlyChangesMethod(t *testing.T) {
+	method, body, uri := redirectPost(t, http.StatusMovedPermanently)
+	assert.Equal(t, "GET", method)
+	assert.Equal(t, "", body)
+	assert.Equal(t, "/api/items?a=1&b=2", uri)
+}
+
+func TestRedirectDefaultStatus(t *testing.T) {
+	opts := testRedirectorOptions()
+	assert.Equal(t, nil, opts.Validate())
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "http://internal.com/boffin", nil)
+	NewRedirectHandler(*opts).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusPermanentRedirect, rw.Code)
+	assert.Equal(t, "https://external.com/boffin", rw.Header().Get("Location"))
+}
+
+func TestRedirectorSkip(t *testing.T) {
+	opts := testRedirectorOptions()
+	opts.HttpsRedirectorSkip = []string{"health.internal", "/healthz", "probe.internal/status/"}
+	assert.Equal(t, nil, opts.Validate())
+	h := NewRedirectHandler(*opts)
+
+	tests := []struct {
+		url  string
+		code int
+	}{
+		{"http://health.internal:8080/anything", 200},
+		{"http://internal.com/healthz", 200},
+		{"http://internal.com/healthz/deep", 200},
+		{"http://internal.com/healthzz", 308},
+		{"http://probe.internal/status", 200},
+		{"http://probe.internal/other", 308},
+		{"http://internal.com/status", 308},
+		{"http://internal.com/", 308},
+	}
+	for _, tt := range tests {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", tt.url, nil))
+		assert.Equal(t, tt.code, rw.Code)
+		if tt.code == 200 {
+			assert.Equal(t, "OK", rw.Body.String())
+		}
+	}
+}
+
+func TestRedirectorSkipInvalid(t *testing.T) {
+	opts := testRedirectorOptions()
+	opts.HttpsRedirectorSkip = []string{"", "http://health.internal", "health.internal/?a=1"}
+	err := opts.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"invalid https-redirector-skip=\"\" empty pattern",
+		"invalid https-redirector-skip=\"http://health.internal\" must not include a scheme",
+		"invalid https-redirector-skip=\"health.internal/?a=1\" must be of the form host, /path or host/path",
+	}), err.Error())
+}
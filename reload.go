@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+)
+
+// ReloadHandler serves requests with the most recently loaded handler, so a
+// new configuration can be swapped in without restarting the listeners
+type ReloadHandler struct {
+	load    func(done <-chan bool) (http.Handler, error)
+	handler atomic.Value
+
+	mu   sync.Mutex
+	done chan bool
+}
+
+type loadedHandler struct {
+	http.Handler
+}
+
+// NewReloadHandler serves requests with handler until the first reload.
+// done is closed once handler has been replaced.
+func NewReloadHandler(handler http.Handler, done chan bool, load func(done <-chan bool) (http.Handler, error)) *ReloadHandler {
+	h := &ReloadHandler{load: load, done: done}
+	h.handler.Store(loadedHandler{handler})
+	return h
+}
+
+func (h *ReloadHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.handler.Load().(loadedHandler).ServeHTTP(rw, req)
+}
+
+// Reload builds a new handler and swaps it in. If loading fails, or panics,
+// the current handler stays in use; otherwise the old handler's done channel
+// is closed to stop its background tasks. Requests already in flight finish
+// on the old handler.
+func (h *ReloadHandler) Reload() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	done := make(chan bool)
+	handler, err := h.safeLoad(done)
+	if err != nil {
+		close(done)
+		return err
+	}
+	h.handler.Store(loadedHandler{handler})
+	if h.done != nil {
+		close(h.done)
+	}
+	h.done = done
+	return nil
+}
+
+// safeLoad calls load, turning a panic into an error so that a configuration
+// the proxy can't be built from doesn't take down the running one
+func (h *ReloadHandler) safeLoad(done chan bool) (handler http.Handler, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			handler, err = nil, fmt.Errorf("building the new configuration failed: %v", r)
+		}
+	}()
+	return h.load(done)
+}
+
+// Close closes the current handler's done channel to stop its background
+// tasks, once the proxy has stopped serving requests
+func (h *ReloadHandler) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.done != nil {
+		close(h.done)
+		h.done = nil
+	}
+}
+
+// ReloadOnSignal reloads the handler whenever one of sigs is received
+func (h *ReloadHandler) ReloadOnSignal(sigs ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	go func() {
+		for sig := range c {
+			log.Printf("received %s, reloading configuration", sig)
+			if err := h.Reload(); err != nil {
+				log.Printf("ERROR: reload failed, keeping the current configuration - %s", err)
+				continue
+			}
+			log.Printf("configuration reloaded")
+		}
+	}()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func stringHandler(body string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(body))
+	})
+}
+
+func serveString(h http.Handler) string {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTP(rw, req)
+	return rw.Body.String()
+}
+
+func isClosed(done <-chan bool) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestReloadHandlerSwapsHandler(t *testing.T) {
+	initialDone := make(chan bool)
+	var loadedDone <-chan bool
+	h := NewReloadHandler(stringHandler("initial"), initialDone,
+		func(done <-chan bool) (http.Handler, error) {
+			loadedDone = done
+			return stringHandler("reloaded"), nil
+		})
+	assert.Equal(t, "initial", serveString(h))
+
+	assert.Equal(t, nil, h.Reload())
+	assert.Equal(t, "reloaded", serveString(h))
+	assert.Equal(t, true, isClosed(initialDone))
+	assert.Equal(t, false, isClosed(loadedDone))
+}
+
+func TestReloadHandlerKeepsHandlerOnError(t *testing.T) {
+	initialDone := make(chan bool)
+	var loadedDone <-chan bool
+	h := NewReloadHandler(stringHandler("initial"), initialDone,
+		func(done <-chan bool) (http.Handler, error) {
+			loadedDone = done
+			return nil, errors.New("invalid configuration")
+		})
+
+	assert.Equal(t, errors.New("invalid configuration"), h.Reload())
+	assert.Equal(t, "initial", serveString(h))
+	assert.Equal(t, false, isClosed(initialDone))
+	assert.Equal(t, true, isClosed(loadedDone))
+}
+
+func TestReloadHandlerKeepsHandlerOnPanic(t *testing.T) {
+	initialDone := make(chan bool)
+	var loadedDone <-chan bool
+	h := NewReloadHandler(stringHandler("initial"), initialDone,
+		func(done <-chan bool) (http.Handler, error) {
+			loadedDone = done
+			http.NewServeMux().Handle("", stringHandler("reloaded"))
+			return stringHandler("reloaded"), nil
+		})
+
+	err := h.Reload()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "initial", serveString(h))
+	assert.Equal(t, false, isClosed(initialDone))
+	assert.Equal(t, true, isClosed(loadedDone))
+}
+
+func TestReloadHandlerClose(t *testing.T) {
+	initialDone := make(chan bool)
+	var loadedDone <-chan bool
+	h := NewReloadHandler(stringHandler("initial"), initialDone,
+		func(done <-chan bool) (http.Handler, error) {
+			loadedDone = done
+			return stringHandler("reloaded"), nil
+		})
+	assert.Equal(t, nil, h.Reload())
+
+	h.Close()
+	assert.Equal(t, true, isClosed(loadedDone))
+	h.Close()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+)
+
+// maxRequestIDLength limits the size of an X-Request-Id accepted from a
+// trusted proxy
+const maxRequestIDLength = 128
+
+// requestID returns the request's X-Request-Id, setting a new random one
+// when it has none
+func requestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	id, err := cookie.Nonce()
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("X-Request-Id", id)
+	return id
+}
+
+// validRequestID reports whether an incoming request ID is safe to log and
+// forward: printable ASCII without spaces, and not too long
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDHandler gives every request an ID, sent upstream and returned to
+// the client in X-Request-Id, so that the proxy's logs can be matched to an
+// application's. An X-Request-Id set by one of the trusted proxies is kept;
+// one sent by anyone else is replaced, so that clients can't make their
+// requests look like someone else's.
+type requestIDHandler struct {
+	handler http.Handler
+	trusted []*net.IPNet
+}
+
+// RequestIDHandler gives each request served by h an ID
+func RequestIDHandler(h http.Handler, trustedProxies []*net.IPNet) http.Handler {
+	return requestIDHandler{h, trustedProxies}
+}
+
+func (h requestIDHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get("X-Request-Id")
+	if ip := remoteIP(req); ip == nil || !containsIP(h.trusted, ip) || !validRequestID(id) {
+		req.Header.Del("X-Request-Id")
+	}
+	if id = requestID(req); id != "" {
+		rw.Header().Set("X-Request-Id", id)
+	}
+	h.handler.ServeHTTP(rw, req)
+}
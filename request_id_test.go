@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestRequestIDHandler(t *testing.T) {
+	trusted, msgs := parseCIDRs([]string{"10.0.0.0/8"}, "trusted-proxy", nil)
+	assert.Equal(t, 0, len(msgs))
+	var upstreamID string
+	h := RequestIDHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		upstreamID = req.Header.Get("X-Request-Id")
+	}), trusted)
+	serve := func(remoteAddr, id string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		if id != "" {
+			req.Header.Set("X-Request-Id", id)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		assert.Equal(t, upstreamID, rw.Header().Get("X-Request-Id"))
+		return upstreamID
+	}
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	assert.Equal(t, true, generated.MatchString(serve("192.0.2.1:1234", "")))
+	assert.NotEqual(t, serve("192.0.2.1:1234", ""), serve("192.0.2.1:1234", ""))
+
+	// only trusted proxies choose the ID
+	assert.Equal(t, "lb-1234", serve("10.0.0.1:1234", "lb-1234"))
+	assert.Equal(t, true, generated.MatchString(serve("192.0.2.1:1234", "lb-1234")))
+
+	// and only IDs that are safe to log
+	assert.Equal(t, true, generated.MatchString(serve("10.0.0.1:1234", "lb 1234\n")))
+	assert.Equal(t, true, generated.MatchString(serve("10.0.0.1:1234", strings.Repeat("a", 129))))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+)
+
+// resources keeps log files, connection pools and other long-lived
+// resources across configuration reloads, so that a reload reuses the ones
+// its options name rather than opening them again
+var resources = newSharedResources()
+
+// sharedResources holds long-lived resources by a key that describes them,
+// such as the URL of a Redis server
+type sharedResources struct {
+	mu        sync.Mutex
+	resources map[string]interface{}
+}
+
+func newSharedResources() *sharedResources {
+	return &sharedResources{resources: make(map[string]interface{})}
+}
+
+// get returns the resource for key, opening it when there isn't one yet.
+// Resources that fail to open aren't kept.
+func (s *sharedResources) get(key string, open func() (interface{}, error)) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.resources[key]; ok {
+		return r, nil
+	}
+	r, err := open()
+	if err != nil {
+		return nil, err
+	}
+	s.resources[key] = r
+	return r, nil
+}
+
+// retire forgets the resources that aren't in keep and returns the ones
+// that need closing, which the caller closes once nothing uses them
+func (s *sharedResources) retire(keep []string) []io.Closer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := make(map[string]bool, len(keep))
+	for _, key := range keep {
+		kept[key] = true
+	}
+	var retired []io.Closer
+	for key, r := range s.resources {
+		if kept[key] {
+			continue
+		}
+		delete(s.resources, key)
+		if c, ok := r.(io.Closer); ok {
+			retired = append(retired, c)
+		}
+	}
+	return retired
+}
+
+// closeResources closes resources retired by a reload, logging errors
+func closeResources(retired []io.Closer) {
+	for _, c := range retired {
+		if err := c.Close(); err != nil {
+			log.Printf("error closing resource from previous configuration: %s", err)
+		}
+	}
+}
+
+// shared returns the long-lived resource for key, recording that o uses it
+func (o *Options) shared(key string, open func() (interface{}, error)) (interface{}, error) {
+	o.resourceKeys = append(o.resourceKeys, key)
+	return resources.get(key, open)
+}
+
+// usedResources returns the keys of every shared resource o and its
+// applications use
+func (o *Options) usedResources() []string {
+	keys := append([]string(nil), o.resourceKeys...)
+	for _, app := range o.applications {
+		keys = append(keys, app.opts.resourceKeys...)
+	}
+	return keys
+}
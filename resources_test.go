@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSharedResources(t *testing.T) {
+	s := newSharedResources()
+	opened := 0
+	open := func() (interface{}, error) {
+		opened++
+		return newRedisPool("redis://127.0.0.1:6379/0"), nil
+	}
+	a, _ := s.get("redis a", open)
+	b, _ := s.get("redis a", open)
+	assert.Equal(t, a, b)
+	assert.Equal(t, 1, opened)
+
+	_, err := s.get("redis b", func() (interface{}, error) { return nil, errors.New("unreachable") })
+	assert.Equal(t, errors.New("unreachable"), err)
+	s.get("redis c", open)
+	s.get("log", func() (interface{}, error) { return http.NotFoundHandler(), nil })
+
+	retired := s.retire([]string{"redis a"})
+	assert.Equal(t, 1, len(retired))
+	c, _ := s.get("redis a", open)
+	assert.Equal(t, a, c)
+	s.get("redis c", open)
+	assert.Equal(t, 3, opened)
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// maxCachedResponseSize is the largest response body that is cached
+const maxCachedResponseSize = 10 << 20
+
+// ResponseCacheStore keeps cached responses until they expire.
+// Implementations must be safe for concurrent use.
+type ResponseCacheStore interface {
+	// Get returns the value of key, and false if there is none
+	Get(key string) ([]byte, bool, error)
+	Set(key string, value []byte, ttl time.Duration) error
+}
+
+// responseCache serves GET responses from upstreams again for as long as
+// their Cache-Control allows. Responses to authenticated requests are cached
+// for each user unless they are public or have an s-maxage; responses to
+// requests that skip authentication are shared unless they are private.
+// Responses are also cached separately for each value of the request
+// headers they vary on.
+type responseCache struct {
+	store ResponseCacheStore
+	now   func() time.Time
+}
+
+// cachedResponse is a response as it was sent by the upstream
+type cachedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	Stored time.Time
+}
+
+// cacheVary is kept for each URL with cached responses: the request headers
+// they vary on, and whether they are cached for each user
+type cacheVary struct {
+	Headers []string
+	User    bool
+}
+
+func newResponseCache(store ResponseCacheStore) *responseCache {
+	return &responseCache{store: store, now: time.Now}
+}
+
+// handler serves cacheable requests to h from the cache when it can, and
+// caches h's responses to them
+func (c *responseCache) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !cacheableRequest(req) {
+			h.ServeHTTP(rw, req)
+			return
+		}
+		// the user is set by Authenticate, and is empty for requests that
+		// skip authentication
+		user := rw.Header().Get("GAP-Auth")
+		u := req.Host + req.URL.RequestURI()
+		if !cacheControl(req.Header).has("no-cache") && req.Header.Get("Pragma") != "no-cache" {
+			if r := c.lookup(u, req, user); r != nil {
+				responseCacheRequestsTotal.WithLabelValues("hit").Inc()
+				c.serve(rw, r)
+				return
+			}
+		}
+		responseCacheRequestsTotal.WithLabelValues("miss").Inc()
+		w := &cacheWriter{ResponseWriter: rw, before: cloneHeader(rw.Header())}
+		h.ServeHTTP(w, req)
+		c.save(u, req, user, w)
+	})
+}
+
+// cacheableRequest reports whether a response to req could be cached
+func cacheableRequest(req *http.Request) bool {
+	return req.Method == "GET" && req.Header.Get("Range") == "" &&
+		req.Header.Get("Upgrade") == "" && !cacheControl(req.Header).has("no-store")
+}
+
+func (c *responseCache) lookup(u string, req *http.Request, user string) *cachedResponse {
+	var vary cacheVary
+	if !c.get(cacheVaryKey(u), &vary) {
+		return nil
+	}
+	key, ok := cacheEntryKey(u, vary, req, user)
+	if !ok {
+		return nil
+	}
+	var r cachedResponse
+	if !c.get(key, &r) {
+		return nil
+	}
+	return &r
+}
+
+func (c *responseCache) serve(rw http.ResponseWriter, r *cachedResponse) {
+	h := rw.Header()
+	for k, v := range r.Header {
+		for _, value := range v {
+			h.Add(k, value)
+		}
+	}
+	h.Set("Age", strconv.Itoa(int(c.now().Sub(r.Stored)/time.Second)))
+	rw.WriteHeader(r.Status)
+	rw.Write(r.Body)
+}
+
+// save caches the response in w if its Cache-Control allows
+func (c *responseCache) save(u string, req *http.Request, user string, w *cacheWriter) {
+	if w.status != http.StatusOK || w.overflow {
+		return
+	}
+	ttl, vary, ok := cachePolicy(req, user, w.header)
+	if !ok {
+		return
+	}
+	key, ok := cacheEntryKey(u, vary, req, user)
+	if !ok {
+		return
+	}
+	r := &cachedResponse{Status: w.status, Header: w.header, Body: w.body.Bytes(), Stored: c.now()}
+	if c.set(cacheVaryKey(u), vary, ttl) {
+		c.set(key, r, ttl)
+	}
+}
+
+// cachePolicy returns how long a response with header h to req, made by
+// user, can be cached for, and how, or false if it can't be. user is empty
+// for requests that skip authentication.
+func cachePolicy(req *http.Request, user string, h http.Header) (time.Duration, cacheVary, bool) {
+	var vary cacheVary
+	cc := cacheControl(h)
+	if cc.has("no-store") || cc.has("no-cache") || len(h["Set-Cookie"]) != 0 {
+		return 0, vary, false
+	}
+	maxAge, ok := cc["s-maxage"]
+	if !ok {
+		maxAge = cc["max-age"]
+	}
+	seconds, err := strconv.Atoi(maxAge)
+	if err != nil || seconds <= 0 {
+		return 0, vary, false
+	}
+
+	// responses to authenticated requests, or requests with credentials,
+	// aren't shared unless they say they can be
+	credentials := user != "" || req.Header.Get("Authorization") != ""
+	vary.User = cc.has("private") || (credentials && !cc.has("public") && !cc.has("s-maxage"))
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return 0, vary, false
+			}
+			if name != "" {
+				vary.Headers = append(vary.Headers, name)
+			}
+		}
+	}
+	return time.Duration(seconds) * time.Second, vary, true
+}
+
+func cacheVaryKey(u string) string {
+	h := sha256.Sum256([]byte(u))
+	return "vary:" + hex.EncodeToString(h[:])
+}
+
+// cacheEntryKey returns the key of the response to req cached as vary
+// says, or false if it is cached for each user and there is none
+func cacheEntryKey(u string, vary cacheVary, req *http.Request, user string) (string, bool) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", u)
+	if vary.User {
+		if user == "" {
+			return "", false
+		}
+		fmt.Fprintf(h, "user: %s\n", user)
+	}
+	for _, name := range vary.Headers {
+		value := strings.Join(req.Header[name], ",")
+		if name == "Gap-Auth" {
+			// passed on to the upstream from the response header
+			value = user
+		}
+		fmt.Fprintf(h, "%s: %s\n", name, value)
+	}
+	return "response:" + hex.EncodeToString(h.Sum(nil)), true
+}
+
+func (c *responseCache) get(key string, v interface{}) bool {
+	b, ok, err := c.store.Get(key)
+	if err != nil {
+		log.Printf("error reading response cache: %s", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(v); err != nil {
+		log.Printf("error decoding cached response: %s", err)
+		return false
+	}
+	return true
+}
+
+func (c *responseCache) set(key string, v interface{}, ttl time.Duration) bool {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		log.Printf("error encoding cached response: %s", err)
+		return false
+	}
+	if err := c.store.Set(key, b.Bytes(), ttl); err != nil {
+		log.Printf("error writing response cache: %s", err)
+		return false
+	}
+	return true
+}
+
+// cacheDirectives are the directives of Cache-Control headers, by their
+// lower cased names
+type cacheDirectives map[string]string
+
+func cacheControl(h http.Header) cacheDirectives {
+	cc := make(cacheDirectives)
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			parts := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			name := strings.ToLower(parts[0])
+			if name == "" {
+				continue
+			}
+			value := ""
+			if len(parts) == 2 {
+				value = strings.Trim(parts[1], `"`)
+			}
+			cc[name] = value
+		}
+	}
+	return cc
+}
+
+func (cc cacheDirectives) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// cacheWriter passes on a response while keeping a copy of it, and of the
+// headers the upstream added to those already set by the proxy
+type cacheWriter struct {
+	http.ResponseWriter
+	before   http.Header
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *cacheWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.header = addedHeader(w.before, w.ResponseWriter.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if w.body.Len()+len(b) > maxCachedResponseSize {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *cacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("webserver doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// addedHeader returns the values in after that were not in before, except
+// for the upstream address, which isn't cached
+func addedHeader(before, after http.Header) http.Header {
+	added := make(http.Header)
+	for k, v := range after {
+		b := before[k]
+		if len(v) >= len(b) && equalValues(v[:len(b)], b) {
+			v = v[len(b):]
+		}
+		if len(v) != 0 {
+			added[k] = append([]string(nil), v...)
+		}
+	}
+	added.Del("GAP-Upstream-Address")
+	return added
+}
+
+func equalValues(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// memoryResponseCacheStore keeps responses in memory up to a total size,
+// dropping the least recently used first
+type memoryResponseCacheStore struct {
+	mu      sync.Mutex
+	max     int
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryResponseCacheStore(max int) *memoryResponseCacheStore {
+	return &memoryResponseCacheStore{
+		max:     max,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func (m *memoryResponseCacheStore) Get(key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := e.Value.(*memoryCacheEntry)
+	if !m.now().Before(entry.expires) {
+		m.remove(e)
+		return nil, false, nil
+	}
+	m.lru.MoveToFront(e)
+	return entry.value, true, nil
+}
+
+func (m *memoryResponseCacheStore) Set(key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[key]; ok {
+		m.remove(e)
+	}
+	if len(value) > m.max {
+		return nil
+	}
+	entry := &memoryCacheEntry{key: key, value: value, expires: m.now().Add(ttl)}
+	m.entries[key] = m.lru.PushFront(entry)
+	m.size += len(value)
+	for m.size > m.max {
+		m.remove(m.lru.Back())
+	}
+	return nil
+}
+
+func (m *memoryResponseCacheStore) remove(e *list.Element) {
+	entry := m.lru.Remove(e).(*memoryCacheEntry)
+	delete(m.entries, entry.key)
+	m.size -= len(entry.value)
+}
+
+// redisResponseCacheStore keeps responses in Redis, so that they are shared
+// by every instance using the same server
+type redisResponseCacheStore struct {
+	pool *redis.Pool
+}
+
+func (r *redisResponseCacheStore) Get(key string) ([]byte, bool, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	b, err := redis.Bytes(conn.Do("GET", "oauth2_proxy:cache:"+key))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	return b, err == nil, err
+}
+
+func (r *redisResponseCacheStore) Set(key string, value []byte, ttl time.Duration) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SET", "oauth2_proxy:cache:"+key, value, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+func parseResponseCache(o *Options, msgs []string) []string {
+	o.responseCache = nil
+	if !o.ResponseCache {
+		if o.ResponseCacheRedisURL != "" {
+			msgs = append(msgs, "response-cache-redis-url requires response-cache")
+		}
+		return msgs
+	}
+	if o.ResponseCacheRedisURL != "" {
+		u, err := url.Parse(o.ResponseCacheRedisURL)
+		if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") {
+			return append(msgs, fmt.Sprintf(
+				"response-cache-redis-url must be a redis:// or rediss:// URL: %q", o.ResponseCacheRedisURL))
+		}
+		o.responseCache = newResponseCache(&redisResponseCacheStore{pool: sharedRedisPool(o, o.ResponseCacheRedisURL)})
+		return msgs
+	}
+	if o.ResponseCacheSize <= 0 {
+		return append(msgs, "response-cache-size must be positive")
+	}
+	o.responseCache = newResponseCache(newMemoryResponseCacheStore(o.ResponseCacheSize << 20))
+	return msgs
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestResponseCacheOptions(t *testing.T) {
+	o := testOptions()
+	o.ResponseCacheRedisURL = "redis://127.0.0.1:6379/0"
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{"response-cache-redis-url requires response-cache"}), err.Error())
+
+	o = testOptions()
+	o.ResponseCache = true
+	o.ResponseCacheSize = 0
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{"response-cache-size must be positive"}), err.Error())
+
+	o = testOptions()
+	o.ResponseCache = true
+	o.ResponseCacheRedisURL = "http://127.0.0.1:6379/"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`response-cache-redis-url must be a redis:// or rediss:// URL: "http://127.0.0.1:6379/"`}), err.Error())
+
+	o = testOptions()
+	o.ResponseCache = true
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 64<<20, o.responseCache.store.(*memoryResponseCacheStore).max)
+}
+
+func TestCachePolicy(t *testing.T) {
+	policy := func(auth, user string, header ...string) (time.Duration, cacheVary, bool) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		h := make(http.Header)
+		for i := 0; i < len(header); i += 2 {
+			h.Add(header[i], header[i+1])
+		}
+		return cachePolicy(req, user, h)
+	}
+
+	ttl, vary, ok := policy("", "", "Cache-Control", "max-age=60")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, time.Minute, ttl)
+	assert.Equal(t, cacheVary{}, vary)
+
+	ttl, _, _ = policy("", "", "Cache-Control", "public, max-age=60, s-maxage=30")
+	assert.Equal(t, 30*time.Second, ttl)
+
+	_, vary, _ = policy("", "", "Cache-Control", "private, max-age=60", "Vary", "Accept-Encoding, x-forwarded-email")
+	assert.Equal(t, cacheVary{Headers: []string{"Accept-Encoding", "X-Forwarded-Email"}, User: true}, vary)
+
+	// responses to requests with credentials are only shared when public
+	_, vary, _ = policy("Bearer token", "", "Cache-Control", "max-age=60")
+	assert.Equal(t, true, vary.User)
+	_, vary, _ = policy("Bearer token", "", "Cache-Control", "public, max-age=60")
+	assert.Equal(t, false, vary.User)
+
+	// and so are responses to authenticated requests
+	_, vary, _ = policy("", "a@example.com", "Cache-Control", "max-age=60")
+	assert.Equal(t, true, vary.User)
+	_, vary, _ = policy("", "a@example.com", "Cache-Control", "max-age=60, s-maxage=60")
+	assert.Equal(t, false, vary.User)
+	_, vary, _ = policy("", "a@example.com", "Cache-Control", "public, max-age=60")
+	assert.Equal(t, false, vary.User)
+
+	for _, header := range [][]string{
+		{},
+		{"Cache-Control", "max-age=0"},
+		{"Cache-Control", "no-store, max-age=60"},
+		{"Cache-Control", "no-cache, max-age=60"},
+		{"Cache-Control", "max-age=60", "Set-Cookie", "a=b"},
+		{"Cache-Control", "max-age=60", "Vary", "*"},
+	} {
+		_, _, ok = policy("", "", header...)
+		assert.Equal(t, false, ok)
+	}
+}
+
+func TestMemoryResponseCacheStore(t *testing.T) {
+	now := time.Date(2015, time.March, 19, 17, 20, 15, 0, time.UTC)
+	m := newMemoryResponseCacheStore(10)
+	m.now = func() time.Time { return now }
+
+	m.Set("a", []byte("aaaa"), time.Minute)
+	m.Set("b", []byte("bbbb"), 2*time.Minute)
+	_, ok, _ := m.Get("a")
+	assert.Equal(t, true, ok)
+	// b is dropped as the least recently used
+	m.Set("c", []byte("cccc"), time.Minute)
+	_, ok, _ = m.Get("b")
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 8, m.size)
+
+	// values larger than the cache aren't kept
+	m.Set("d", []byte("ddddddddddd"), time.Minute)
+	_, ok, _ = m.Get("d")
+	assert.Equal(t, false, ok)
+
+	now = now.Add(time.Minute)
+	_, ok, _ = m.Get("a")
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 1, len(m.entries))
+}
+
+func TestResponseCacheHandler(t *testing.T) {
+	requests := 0
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/shared":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/user":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "X-Forwarded-Email")
+		case "/uncached":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Header().Set("GAP-Upstream-Address", "127.0.0.1:8080")
+		fmt.Fprintf(w, "%s %d", r.Header.Get("X-Forwarded-Email"), requests)
+	})
+	now := time.Date(2015, time.March, 19, 17, 20, 15, 0, time.UTC)
+	store := newMemoryResponseCacheStore(1 << 20)
+	store.now = func() time.Time { return now }
+	c := newResponseCache(store)
+	c.now = store.now
+	h := c.handler(upstream)
+
+	get := func(path, email string, header ...string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Host = "app.example.com"
+		req.Header.Set("X-Forwarded-Email", email)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rw := httptest.NewRecorder()
+		if email != "" {
+			rw.Header().Set("GAP-Auth", email)
+		}
+		rw.Header().Set("X-Frame-Options", "DENY")
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, "a@example.com 1", get("/shared", "a@example.com").Body.String())
+	now = now.Add(5 * time.Second)
+	rw := get("/shared", "b@example.com")
+	assert.Equal(t, "a@example.com 1", rw.Body.String())
+	assert.Equal(t, "5", rw.Header().Get("Age"))
+	assert.Equal(t, "public, max-age=60", rw.Header().Get("Cache-Control"))
+	assert.Equal(t, []string{"DENY"}, rw.Header()["X-Frame-Options"])
+	assert.Equal(t, "", rw.Header().Get("GAP-Upstream-Address"))
+
+	// clients can ask for a fresh response, which replaces the cached one
+	assert.Equal(t, "b@example.com 2", get("/shared", "b@example.com", "Cache-Control", "no-cache").Body.String())
+	assert.Equal(t, "b@example.com 2", get("/shared", "a@example.com").Body.String())
+
+	// private responses, responses that aren't public and responses that
+	// vary on user headers are cached for each user
+	assert.Equal(t, "a@example.com 3", get("/private", "a@example.com").Body.String())
+	assert.Equal(t, "b@example.com 4", get("/private", "b@example.com").Body.String())
+	assert.Equal(t, "a@example.com 3", get("/private", "a@example.com").Body.String())
+	assert.Equal(t, " 5", get("/private", "").Body.String())
+	assert.Equal(t, "a@example.com 6", get("/user", "a@example.com").Body.String())
+	assert.Equal(t, "b@example.com 7", get("/user", "b@example.com").Body.String())
+	assert.Equal(t, "a@example.com 6", get("/user", "a@example.com").Body.String())
+	assert.Equal(t, "a@example.com 8", get("/vary", "a@example.com").Body.String())
+	assert.Equal(t, "b@example.com 9", get("/vary", "b@example.com").Body.String())
+	assert.Equal(t, "b@example.com 9", get("/vary", "b@example.com").Body.String())
+
+	assert.Equal(t, "a@example.com 10", get("/uncached", "a@example.com").Body.String())
+	assert.Equal(t, "a@example.com 11", get("/uncached", "a@example.com").Body.String())
+	assert.Equal(t, "a@example.com 12", get("/shared", "a@example.com", "Range", "bytes=0-1").Body.String())
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, "a@example.com 13", get("/shared", "a@example.com").Body.String())
+}
+
+func TestResponseCacheProxy(t *testing.T) {
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("dashboard.js"))
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"^/static/"}
+	opts.ResponseCache = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/static/dashboard.js", nil))
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "dashboard.js", rw.Body.String())
+	}
+	assert.Equal(t, 1, requests)
+}
+
+func TestResponseCacheProxySessions(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("report for " + r.Header.Get("X-Forwarded-Email")))
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.PassBasicAuth = false
+	opts.ResponseCache = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	get := func(email string) string {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/report", nil)
+		assert.Equal(t, nil, proxy.SaveSession(rw, req, &providers.SessionState{Email: email}))
+		req.AddCookie(rw.Result().Cookies()[0])
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		return rw.Body.String()
+	}
+	// cookie sessions don't send credentials upstream, but their responses
+	// are still cached for each user
+	assert.Equal(t, "report for a@example.com", get("a@example.com"))
+	assert.Equal(t, "report for b@example.com", get("b@example.com"))
+	assert.Equal(t, "report for a@example.com", get("a@example.com"))
+}
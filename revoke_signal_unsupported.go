@@ -0,0 +1,8 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+var revokeSessionsSignals []os.Signal
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// RouteOptions describes an upstream from a [[route]] table in the config
+// file. Unlike --upstream, routes can match on host and rewrite the path
+// before it is proxied.
+type RouteOptions struct {
+	Host          string `toml:"host" yaml:"host"`
+	Path          string `toml:"path" yaml:"path"`
+	Upstream      string `toml:"upstream" yaml:"upstream"`
+	StripPrefix   string `toml:"strip_prefix" yaml:"strip_prefix"`
+	RewriteRegex  string `toml:"rewrite_regex" yaml:"rewrite_regex"`
+	RewriteTarget string `toml:"rewrite_target" yaml:"rewrite_target"`
+	FlushInterval string `toml:"flush_interval" yaml:"flush_interval"`
+	TLSCert       string `toml:"tls_cert" yaml:"tls_cert"`
+	TLSKey        string `toml:"tls_key" yaml:"tls_key"`
+	CAFile        string `toml:"ca_file" yaml:"ca_file"`
+
+	DialTimeout     string `toml:"dial_timeout" yaml:"dial_timeout"`
+	ResponseTimeout string `toml:"response_timeout" yaml:"response_timeout"`
+
+	Upstreams           []string `toml:"upstreams" yaml:"upstreams"`
+	LoadBalancing       string   `toml:"load_balancing" yaml:"load_balancing"`
+	HealthCheckPath     string   `toml:"health_check_path" yaml:"health_check_path"`
+	HealthCheckInterval string   `toml:"health_check_interval" yaml:"health_check_interval"`
+}
+
+type route struct {
+	name          string
+	pattern       string
+	upstreams     []*url.URL
+	stripPrefix   string
+	rewriteRegex  *regexp.Regexp
+	rewriteTarget string
+	flushInterval time.Duration
+	tlsConfig     *tls.Config
+	timeouts      upstreamTimeouts
+	healthCheck   healthCheck
+	failover      bool
+	discovery     *upstreamDiscovery
+}
+
+// loadRoutes reads the [[route]] tables from a config file
+func loadRoutes(path string) ([]RouteOptions, error) {
+	var cfg struct {
+		Routes []RouteOptions `toml:"route"`
+	}
+	_, err := toml.DecodeFile(path, &cfg)
+	return cfg.Routes, err
+}
+
+// routeUpstreams returns the upstreams of a route, which may be given as
+// upstream, upstreams or both
+func routeUpstreams(r RouteOptions) []string {
+	var upstreams []string
+	if r.Upstream != "" {
+		upstreams = append(upstreams, r.Upstream)
+	}
+	return append(upstreams, r.Upstreams...)
+}
+
+// anyDiscovered reports whether any of a route's upstreams is discovered
+func anyDiscovered(urls []*url.URL) bool {
+	for _, u := range urls {
+		if isDiscoveryScheme(u.Scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRouteUpstream checks one of a route's upstreams
+func parseRouteUpstream(name, upstream string) (*url.URL, []string) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, []string{fmt.Sprintf(
+			"error parsing %s upstream=%q %s", name, upstream, err)}
+	}
+	switch {
+	case isDiscoveryScheme(u.Scheme):
+		u.Path = ""
+	case u.Scheme == "unix":
+		if m := parseUnixSocketURL(u, name+" upstream", nil); len(m) != 0 {
+			return nil, m
+		}
+	case (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "h2c") || u.Host == "":
+		return nil, []string{fmt.Sprintf(
+			"%s upstream must be an http, https, h2c, unix, srv or k8s URL: %q", name, upstream)}
+	default:
+		u.Path = ""
+	}
+	return u, nil
+}
+
+func parseRoutes(o *Options, msgs []string) []string {
+	o.routes = nil
+	for i, r := range o.Routes {
+		name := fmt.Sprintf("route[%d]", i)
+		upstreams := routeUpstreams(r)
+		if len(upstreams) == 0 {
+			msgs = append(msgs, fmt.Sprintf("%s missing setting: upstream", name))
+			continue
+		}
+		var urls []*url.URL
+		for _, upstream := range upstreams {
+			u, m := parseRouteUpstream(name, upstream)
+			msgs = append(msgs, m...)
+			if u != nil {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) != len(upstreams) {
+			continue
+		}
+		var discovery *upstreamDiscovery
+		if anyDiscovered(urls) {
+			if len(urls) > 1 {
+				msgs = append(msgs, fmt.Sprintf(
+					"%s srv and k8s upstreams must be the route's only upstream", name))
+				continue
+			}
+			var err error
+			if discovery, err = newUpstreamDiscovery(o, urls[0]); err != nil {
+				msgs = append(msgs, fmt.Sprintf("invalid %s upstream=%q %s", name, upstreams[0], err))
+				continue
+			}
+		}
+
+		path := r.Path
+		if path == "" {
+			path = "/"
+		}
+		if !strings.HasPrefix(path, "/") {
+			msgs = append(msgs, fmt.Sprintf(
+				"%s path must begin with /: %q", name, r.Path))
+			continue
+		}
+		if strings.ContainsAny(r.Host, "/:") {
+			msgs = append(msgs, fmt.Sprintf(
+				"%s host must be a bare hostname: %q", name, r.Host))
+			continue
+		}
+
+		rt := &route{
+			name:          name,
+			pattern:       strings.ToLower(r.Host) + path,
+			upstreams:     urls,
+			discovery:     discovery,
+			stripPrefix:   r.StripPrefix,
+			rewriteTarget: r.RewriteTarget,
+		}
+		var err error
+		if r.RewriteRegex != "" {
+			rt.rewriteRegex, err = regexp.Compile(r.RewriteRegex)
+			if err != nil {
+				msgs = append(msgs, fmt.Sprintf(
+					"error compiling %s rewrite_regex=%q %s", name, r.RewriteRegex, err))
+				continue
+			}
+		} else if r.RewriteTarget != "" {
+			msgs = append(msgs, fmt.Sprintf(
+				"%s rewrite_target requires rewrite_regex", name))
+			continue
+		}
+		if r.FlushInterval != "" {
+			rt.flushInterval, err = time.ParseDuration(r.FlushInterval)
+			if err != nil {
+				msgs = append(msgs, fmt.Sprintf(
+					"error parsing %s flush_interval=%q %s", name, r.FlushInterval, err))
+				continue
+			}
+		}
+		rt.timeouts, err = parseRouteTimeouts(o, name, r)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		rt.healthCheck, rt.failover, err = parseRouteHealthCheck(o, name, r)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		rt.tlsConfig, err = parseRouteTLS(o, name, r)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		o.routes = append(o.routes, rt)
+	}
+	return msgs
+}
+
+// upstreamPattern returns the pattern an --upstream is served on: the
+// path of http, https, h2c and discovered upstreams, the fragment of unix
+// socket and file upstreams, or / for a unix socket and the directory for
+// a file upstream without one
+func upstreamPattern(u *url.URL) string {
+	switch {
+	case (u.Scheme == "unix" || u.Scheme == "file") && u.Fragment != "":
+		return u.Fragment
+	case u.Scheme == "unix":
+		return "/"
+	}
+	return u.Path
+}
+
+// checkServePatterns reports upstreams and routes that would be served on
+// the same pattern, which http.ServeMux refuses
+func checkServePatterns(o *Options, msgs []string) []string {
+	served := make(map[string]string)
+	serve := func(pattern, name string) {
+		if other, ok := served[pattern]; ok {
+			msgs = append(msgs, fmt.Sprintf("%s and %s are both served on %q", other, name, pattern))
+			return
+		}
+		served[pattern] = name
+	}
+	for _, u := range o.proxyURLs {
+		serve(upstreamPattern(u), fmt.Sprintf("upstream=%q", u))
+	}
+	for _, r := range o.routes {
+		serve(r.pattern, r.name)
+	}
+	return msgs
+}
+
+// parseRouteTimeouts returns the upstream timeouts for a route. dial_timeout
+// and response_timeout replace upstream-dial-timeout and
+// upstream-response-timeout.
+func parseRouteTimeouts(o *Options, name string, r RouteOptions) (upstreamTimeouts, error) {
+	timeouts := o.upstreamTimeouts
+	for _, t := range []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"dial_timeout", r.DialTimeout, &timeouts.dial},
+		{"response_timeout", r.ResponseTimeout, &timeouts.responseHeader},
+	} {
+		if t.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(t.value)
+		if err != nil || d < 0 {
+			return timeouts, fmt.Errorf("invalid %s %s=%q", name, t.name, t.value)
+		}
+		*t.d = d
+	}
+	return timeouts, nil
+}
+
+// parseRouteTLS returns the upstream tls config for a route. tls_cert and
+// tls_key replace upstream-tls-cert and upstream-tls-key, and ca_file
+// replaces upstream-ca-file.
+func parseRouteTLS(o *Options, name string, r RouteOptions) (*tls.Config, error) {
+	if r.TLSCert == "" && r.TLSKey == "" && r.CAFile == "" {
+		return o.upstreamTLSConfig, nil
+	}
+	files := upstreamTLSFiles{o.UpstreamTLSCert, o.UpstreamTLSKey, o.UpstreamCAFile}
+	names := upstreamTLSFiles{"upstream-tls-cert", "upstream-tls-key", "upstream-ca-file"}
+	if r.TLSCert != "" || r.TLSKey != "" {
+		files.certFile, files.keyFile = r.TLSCert, r.TLSKey
+		names.certFile, names.keyFile = name+" tls_cert", name+" tls_key"
+	}
+	if r.CAFile != "" {
+		files.caFile = r.CAFile
+		names.caFile = name + " ca_file"
+	}
+	return loadUpstreamTLSConfig(files, names)
+}
+
+// rewrite applies the route's strip prefix and regex rewrite to the escaped
+// request path. RequestURI is updated too, as the proxy director forwards it
+// verbatim to preserve encoded slashes.
+func (r *route) rewrite(req *http.Request) {
+	if r.stripPrefix == "" && r.rewriteRegex == nil {
+		return
+	}
+	path := req.URL.EscapedPath()
+	if r.stripPrefix != "" {
+		path = strings.TrimPrefix(path, r.stripPrefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	if r.rewriteRegex != nil {
+		path = r.rewriteRegex.ReplaceAllString(path, r.rewriteTarget)
+	}
+
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		unescaped = path
+	}
+	req.URL.Path = unescaped
+	req.URL.RawPath = path
+	req.RequestURI = req.URL.RequestURI()
+}
+
+type routeHandler struct {
+	route   *route
+	handler http.Handler
+}
+
+func (h *routeHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.route.rewrite(req)
+	h.handler.ServeHTTP(rw, req)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func testRoute(t *testing.T, r RouteOptions) *route {
+	o := testOptions()
+	o.Upstreams = nil
+	o.Routes = []RouteOptions{r}
+	assert.Equal(t, nil, o.Validate())
+	return o.routes[0]
+}
+
+func rewrittenPath(rt *route, path string) string {
+	req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+	req.RequestURI = path
+	rt.rewrite(req)
+	return req.RequestURI
+}
+
+func TestRouteRewriteStripPrefix(t *testing.T) {
+	rt := testRoute(t, RouteOptions{
+		Path: "/api/", Upstream: "http://127.0.0.1:8080/", StripPrefix: "/api"})
+	assert.Equal(t, "/api/", rt.pattern)
+	assert.Equal(t, "/v1/users?page=2", rewrittenPath(rt, "/api/v1/users?page=2"))
+	assert.Equal(t, "/", rewrittenPath(rt, "/api"))
+}
+
+func TestRouteRewriteRegex(t *testing.T) {
+	rt := testRoute(t, RouteOptions{
+		Path: "/legacy/", Upstream: "http://127.0.0.1:8080/",
+		RewriteRegex: "^/legacy/(.*)$", RewriteTarget: "/v2/$1"})
+	assert.Equal(t, "/v2/a%2Fb", rewrittenPath(rt, "/legacy/a%2Fb"))
+}
+
+func TestRouteWithoutRewrite(t *testing.T) {
+	rt := testRoute(t, RouteOptions{Upstream: "http://127.0.0.1:8080/"})
+	assert.Equal(t, "/", rt.pattern)
+	assert.Equal(t, "/a%2Fb?c=1", rewrittenPath(rt, "/a%2Fb?c=1"))
+}
+
+func TestRouteHostPattern(t *testing.T) {
+	rt := testRoute(t, RouteOptions{
+		Host: "API.example.com", Path: "/v1/", Upstream: "http://127.0.0.1:8080/",
+		FlushInterval: "100ms"})
+	assert.Equal(t, "api.example.com/v1/", rt.pattern)
+	assert.Equal(t, 100*time.Millisecond, rt.flushInterval)
+}
+
+func TestRoutesReplaceUpstreams(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = nil
+	o.Routes = []RouteOptions{{Upstream: "http://127.0.0.1:8080/"}}
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestInvalidRoutes(t *testing.T) {
+	o := testOptions()
+	o.Routes = []RouteOptions{
+		{Upstream: "file:///var/www"},
+		{Path: "api/", Upstream: "http://127.0.0.1:8080/"},
+		{Host: "example.com:8080", Upstream: "http://127.0.0.1:8080/"},
+		{Upstream: "http://127.0.0.1:8080/", RewriteRegex: "("},
+		{Upstream: "http://127.0.0.1:8080/", RewriteTarget: "/foo"},
+		{Upstream: "http://127.0.0.1:8080/", FlushInterval: "soon"},
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"route[0] upstream must be an http, https, h2c, unix, srv or k8s URL: \"file:///var/www\"",
+		"route[1] path must begin with /: \"api/\"",
+		"route[2] host must be a bare hostname: \"example.com:8080\"",
+		"error compiling route[3] rewrite_regex=\"(\" error parsing regexp: missing closing ): `(`",
+		"route[4] rewrite_target requires rewrite_regex",
+		"error parsing route[5] flush_interval=\"soon\" time: invalid duration \"soon\"",
+	})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestDuplicateServePatterns(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:8080/", "http://127.0.0.1:8081/", "http://127.0.0.1:8082/api/"}
+	o.Routes = []RouteOptions{
+		{Path: "/api/", Upstream: "http://127.0.0.1:9000/"},
+		{Host: "example.com", Upstream: "http://127.0.0.1:9001/"},
+		{Host: "Example.com", Upstream: "http://127.0.0.1:9002/"},
+	}
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`upstream="http://127.0.0.1:8080/" and upstream="http://127.0.0.1:8081/" are both served on "/"`,
+		`upstream="http://127.0.0.1:8082/api/" and route[0] are both served on "/api/"`,
+		`route[1] and route[2] are both served on "example.com/"`,
+	}), err.Error())
+}
+
+func TestDuplicateUnixSocketPatterns(t *testing.T) {
+	// unix socket upstreams without a path prefix are served on /
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:8080/", "unix:///var/run/app.sock"}
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`upstream="http://127.0.0.1:8080/" and upstream="unix:///var/run/app.sock" are both served on "/"`,
+	}), err.Error())
+
+	o = testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:8080/", "unix:///var/run/app.sock#/app/"}
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestLoadRoutes(t *testing.T) {
+	file, err := ioutil.TempFile("", "oauth2_proxy.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`
+upstreams = ["http://127.0.0.1:8080/"]
+
+[[route]]
+host = "api.example.com"
+path = "/"
+upstream = "http://127.0.0.1:9000/"
+flush_interval = "1s"
+
+[[route]]
+path = "/static/"
+upstream = "http://127.0.0.1:9001/"
+strip_prefix = "/static"
+`)
+	file.Close()
+
+	routes, err := loadRoutes(file.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []RouteOptions{
+		{Host: "api.example.com", Path: "/", Upstream: "http://127.0.0.1:9000/", FlushInterval: "1s"},
+		{Path: "/static/", Upstream: "http://127.0.0.1:9001/", StripPrefix: "/static"},
+	}, routes)
+}
+
+func TestRoutesProxyRequests(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.RequestURI))
+		}))
+	}
+	api := newBackend("api")
+	defer api.Close()
+	static := newBackend("static")
+	defer static.Close()
+	fallback := newBackend("fallback")
+	defer fallback.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = []string{fallback.URL}
+	opts.Routes = []RouteOptions{
+		{Host: "api.example.com", Upstream: api.URL},
+		{Path: "/static/", Upstream: static.URL, StripPrefix: "/static"},
+	}
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.SkipAuthRegex = []string{"^/"}
+	assert.Equal(t, nil, opts.Validate())
+	frontend := httptest.NewServer(NewOAuthProxy(opts, func(string) bool { return true }))
+	defer frontend.Close()
+	f, _ := url.Parse(frontend.URL)
+
+	get := func(host, path string) string {
+		req := &http.Request{
+			Host: host,
+			URL:  &url.URL{Scheme: "http", Host: f.Host, Opaque: path},
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(body)
+	}
+
+	assert.Equal(t, "api /static/app.js", get("api.example.com", "/static/app.js"))
+	assert.Equal(t, "static /app.js", get("www.example.com", "/static/app.js"))
+	assert.Equal(t, "fallback /index.html", get("www.example.com", "/index.html"))
+}
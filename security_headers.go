@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// securityHeaders are set on every response, proxied or generated by the
+// proxy, unless the upstream already set them
+type securityHeaders struct {
+	hsts         string
+	frameOptions string
+	nosniff      bool
+}
+
+func (h securityHeaders) empty() bool {
+	return h.hsts == "" && h.frameOptions == "" && !h.nosniff
+}
+
+// parseSecurityHeaders checks the security header options and builds the
+// headers they enable
+func parseSecurityHeaders(o *Options, msgs []string) []string {
+	o.securityHeaders = securityHeaders{nosniff: o.ContentTypeNosniff}
+	if o.HSTSMaxAge < 0 {
+		msgs = append(msgs, fmt.Sprintf("hsts-max-age must not be negative: %s", o.HSTSMaxAge))
+	} else if o.HSTSMaxAge > 0 {
+		o.securityHeaders.hsts = fmt.Sprintf("max-age=%d", int64(o.HSTSMaxAge/time.Second))
+		if o.HSTSIncludeSubdomains {
+			o.securityHeaders.hsts += "; includeSubDomains"
+		}
+	} else if o.HSTSIncludeSubdomains {
+		msgs = append(msgs, "hsts-include-subdomains requires hsts-max-age")
+	}
+	switch v := strings.ToUpper(o.FrameOptions); v {
+	case "":
+	case "DENY", "SAMEORIGIN":
+		o.securityHeaders.frameOptions = v
+	default:
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid frame-options=%q expected DENY or SAMEORIGIN", o.FrameOptions))
+	}
+	return msgs
+}
+
+// SecurityHeadersHandler adds the security headers to responses from h.
+// Strict-Transport-Security is only sent over HTTPS, as browsers ignore it
+// otherwise; X-Forwarded-Proto is only honoured from trustedProxies.
+func SecurityHeadersHandler(headers securityHeaders, trustedProxies []*net.IPNet, h http.Handler) http.Handler {
+	if headers.empty() {
+		return h
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		w := &securityHeadersWriter{ResponseWriter: rw, headers: headers}
+		w.https = requestScheme(req, trustedProxies) == "https"
+		h.ServeHTTP(w, req)
+	})
+}
+
+type securityHeadersWriter struct {
+	http.ResponseWriter
+	headers securityHeaders
+	https   bool
+	written bool
+}
+
+func (w *securityHeadersWriter) setHeaders() {
+	if w.written {
+		return
+	}
+	w.written = true
+	h := w.Header()
+	setDefault := func(name, value string) {
+		if value != "" && h.Get(name) == "" {
+			h.Set(name, value)
+		}
+	}
+	if w.https {
+		setDefault("Strict-Transport-Security", w.headers.hsts)
+	}
+	setDefault("X-Frame-Options", w.headers.frameOptions)
+	if w.headers.nosniff {
+		setDefault("X-Content-Type-Options", "nosniff")
+	}
+}
+
+func (w *securityHeadersWriter) WriteHeader(code int) {
+	w.setHeaders()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *securityHeadersWriter) Write(b []byte) (int, error) {
+	w.setHeaders()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *securityHeadersWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("webserver doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func (w *securityHeadersWriter) Flush() {
+	w.setHeaders()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestParseSecurityHeaders(t *testing.T) {
+	o := testOptions()
+	o.HSTSMaxAge = 365 * 24 * time.Hour
+	o.HSTSIncludeSubdomains = true
+	o.FrameOptions = "sameorigin"
+	o.ContentTypeNosniff = true
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, securityHeaders{
+		hsts:         "max-age=31536000; includeSubDomains",
+		frameOptions: "SAMEORIGIN",
+		nosniff:      true,
+	}, o.securityHeaders)
+
+	o = testOptions()
+	o.HSTSIncludeSubdomains = true
+	o.FrameOptions = "ALLOW-FROM https://example.com"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"hsts-include-subdomains requires hsts-max-age",
+		`invalid frame-options="ALLOW-FROM https://example.com" expected DENY or SAMEORIGIN`}), err.Error())
+}
+
+func TestSecurityHeadersHandler(t *testing.T) {
+	headers := securityHeaders{hsts: "max-age=3600", frameOptions: "DENY", nosniff: true}
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	h := SecurityHeadersHandler(headers, []*net.IPNet{trusted}, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/embeddable" {
+			rw.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		}
+		rw.Write([]byte("ok"))
+	}))
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.2:4000"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, "max-age=3600", rw.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, "DENY", rw.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "nosniff", rw.Header().Get("X-Content-Type-Options"))
+
+	// upstreams can set their own value, and HSTS is only sent over https
+	req, _ = http.NewRequest("GET", "/embeddable", nil)
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, "", rw.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, []string{"SAMEORIGIN"}, rw.Header()["X-Frame-Options"])
+
+	// X-Forwarded-Proto isn't trusted from other clients
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.7:4000"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, "", rw.Header().Get("Strict-Transport-Security"))
+}
+
+func TestSignInPageContentSecurityPolicy(t *testing.T) {
+	opts := testOptions()
+	opts.SignInContentSecurityPolicy = "default-src 'self'"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "default-src 'self'", rw.Header().Get("Content-Security-Policy"))
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+var errSessionSignedOut = errors.New("session was signed out from another device")
+
+// sessionDeviceSeenInterval limits how often the last seen time of a device
+// is written to the session store
+const sessionDeviceSeenInterval = time.Minute
+
+// sessionDevice is a browser or client a user is signed in on. With session
+// management, a session's tickets start with the ID of its device, so that
+// signing out a device rejects every ticket it was issued, not only the
+// latest. The devices of a user are kept in the session store next to their
+// sessions.
+type sessionDevice struct {
+	ID         string    `json:"id"`
+	Ticket     string    `json:"ticket"`
+	CreatedAt  time.Time `json:"created_at"`
+	SavedAt    time.Time `json:"saved_at"`
+	LastSeen   time.Time `json:"last_seen"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+}
+
+// SessionInfo describes one of a user's sessions on the sessions page
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeen   time.Time `json:"last_seen"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Current    bool      `json:"current"`
+}
+
+// tracksDevices reports whether sessions are tracked by device, for
+// session-limit or session-management
+func (p *OAuthProxy) tracksDevices() bool {
+	return p.sessionStore != nil && (p.sessionLimit > 0 || p.sessionManagement)
+}
+
+// newDeviceTicket returns a new ticket for device, or for a new device when
+// it is ""
+func newDeviceTicket(device string) (string, error) {
+	if device == "" {
+		id, err := newSessionTicket()
+		if err != nil {
+			return "", err
+		}
+		device = id[:16]
+	}
+	ticket, err := newSessionTicket()
+	if err != nil {
+		return "", err
+	}
+	return device + "." + ticket, nil
+}
+
+// ticketDevice returns the device of a ticket, or "" for tickets issued
+// without session management
+func ticketDevice(ticket string) string {
+	if i := strings.Index(ticket, "."); i > 0 {
+		return ticket[:i]
+	}
+	return ""
+}
+
+// devicesKey is where the user's devices are kept in the session store
+func devicesKey(s *providers.SessionState) string {
+	h := sha256.Sum256([]byte(sessionIdentity(s)))
+	return "devices-" + hex.EncodeToString(h[:])
+}
+
+func decodeDevices(value string) ([]sessionDevice, error) {
+	var devices []sessionDevice
+	if value == "" {
+		return devices, nil
+	}
+	err := json.Unmarshal([]byte(value), &devices)
+	return devices, err
+}
+
+// loadDevices returns the devices the user is signed in on
+func (p *OAuthProxy) loadDevices(s *providers.SessionState) ([]sessionDevice, error) {
+	value, err := p.sessionStore.Load(devicesKey(s))
+	if err == errSessionNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeDevices(value)
+}
+
+// updateDevices changes the user's devices with update, after forgetting
+// those whose sessions have expired
+func (p *OAuthProxy) updateDevices(s *providers.SessionState, update func([]sessionDevice) []sessionDevice) error {
+	return p.sessionStore.Update(devicesKey(s), p.CookieExpire, func(value string) (string, error) {
+		devices, err := decodeDevices(value)
+		if err != nil {
+			return "", err
+		}
+		cutoff := time.Now().Add(-p.CookieExpire)
+		current := devices[:0]
+		for _, d := range devices {
+			if d.SavedAt.After(cutoff) {
+				current = append(current, d)
+			}
+		}
+		b, err := json.Marshal(update(current))
+		return string(b), err
+	})
+}
+
+// saveDevice records that device id was issued the session kept under
+// ticket in the session store, signing out the user's least recently seen
+// devices beyond session-limit
+func (p *OAuthProxy) saveDevice(req *http.Request, s *providers.SessionState, id, ticket string) error {
+	now := time.Now()
+	var evicted []sessionDevice
+	err := p.updateDevices(s, func(devices []sessionDevice) []sessionDevice {
+		evicted = nil
+		var d *sessionDevice
+		for i := range devices {
+			if devices[i].ID == id {
+				d = &devices[i]
+			}
+		}
+		if d == nil {
+			devices = append(devices, sessionDevice{ID: id, CreatedAt: now})
+			d = &devices[len(devices)-1]
+		}
+		d.Ticket, d.SavedAt, d.LastSeen = ticket, now, now
+		d.UserAgent = req.UserAgent()
+		if ip := clientIP(req, p.trustedProxies); ip != nil {
+			d.RemoteAddr = ip.String()
+		}
+		if p.sessionLimit == 0 || len(devices) <= p.sessionLimit {
+			return devices
+		}
+
+		sort.SliceStable(devices, func(i, j int) bool {
+			if devices[i].ID == id || devices[j].ID == id {
+				return devices[i].ID == id
+			}
+			return devices[i].LastSeen.After(devices[j].LastSeen)
+		})
+		evicted = append(evicted, devices[p.sessionLimit:]...)
+		return devices[:p.sessionLimit]
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range evicted {
+		p.clearDevice(d)
+		p.audit(req, auditSessionRevoked, sessionIdentity(s),
+			"signed out session %s from %s, over the session limit of %d", d.ID, d.RemoteAddr, p.sessionLimit)
+	}
+	return nil
+}
+
+// clearDevice removes the device's latest session from the session store.
+// Its earlier tickets are rejected once the device is gone from the user's
+// devices.
+func (p *OAuthProxy) clearDevice(d sessionDevice) {
+	if err := p.sessionStore.Clear(d.Ticket); err != nil {
+		log.Printf("error removing session from session store: %s", err)
+	}
+}
+
+// checkDevice rejects a session whose device id has been signed out, and
+// otherwise records when the device was last seen
+func (p *OAuthProxy) checkDevice(s *providers.SessionState, id string) error {
+	devices, err := p.loadDevices(s)
+	if err != nil {
+		return err
+	}
+	var found *sessionDevice
+	for i := range devices {
+		if devices[i].ID == id {
+			found = &devices[i]
+		}
+	}
+	if found == nil {
+		return errSessionSignedOut
+	}
+	if time.Since(found.LastSeen) < sessionDeviceSeenInterval {
+		return nil
+	}
+	err = p.updateDevices(s, func(devices []sessionDevice) []sessionDevice {
+		for i := range devices {
+			if devices[i].ID == id {
+				devices[i].LastSeen = time.Now()
+			}
+		}
+		return devices
+	})
+	if err != nil {
+		log.Printf("error updating session devices: %s", err)
+	}
+	return nil
+}
+
+// forgetDevice removes a device that has signed out from the user's devices
+func (p *OAuthProxy) forgetDevice(s *providers.SessionState, id string) {
+	err := p.updateDevices(s, func(devices []sessionDevice) []sessionDevice {
+		var kept []sessionDevice
+		for _, d := range devices {
+			if d.ID != id {
+				kept = append(kept, d)
+			}
+		}
+		return kept
+	})
+	if err != nil {
+		log.Printf("error updating session devices: %s", err)
+	}
+}
+
+// revokeDevices signs out the user's devices that revoke returns true for
+func (p *OAuthProxy) revokeDevices(req *http.Request, s *providers.SessionState, revoke func(sessionDevice) bool) error {
+	var revoked []sessionDevice
+	err := p.updateDevices(s, func(devices []sessionDevice) []sessionDevice {
+		revoked = nil
+		var kept []sessionDevice
+		for _, d := range devices {
+			if revoke(d) {
+				revoked = append(revoked, d)
+			} else {
+				kept = append(kept, d)
+			}
+		}
+		return kept
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range revoked {
+		p.clearDevice(d)
+		p.audit(req, auditSessionRevoked, sessionIdentity(s), "signed out session %s from %s", d.ID, d.RemoteAddr)
+	}
+	return nil
+}
+
+// sessionsCSRFToken is sent with requests to sign out sessions. It is
+// derived from the session ticket, which other sites can't read from the
+// cookie.
+func sessionsCSRFToken(ticket string) string {
+	h := sha256.Sum256([]byte("sessions:" + ticket))
+	return hex.EncodeToString(h[:16])
+}
+
+// Sessions lists the signed in user's sessions, and signs out the one given
+// by a POST with revoke=<id>, or all but the current one with revoke=others
+func (p *OAuthProxy) Sessions(rw http.ResponseWriter, req *http.Request) {
+	if !p.sessionManagement || p.sessionStore == nil {
+		p.ErrorPage(rw, req, http.StatusNotFound, "Not Found", "Session management is not enabled")
+		return
+	}
+	session, _, err := p.LoadCookiedSession(req)
+	ticket := p.sessionTicket(req)
+	if err != nil || ticketDevice(ticket) == "" {
+		if p.isAPIRequest(req) {
+			p.Unauthorized(rw, req)
+		} else {
+			p.SignInPage(rw, req, http.StatusForbidden)
+		}
+		return
+	}
+	current := ticketDevice(ticket)
+
+	switch req.Method {
+	case "GET", "HEAD":
+	case "POST":
+		token := req.FormValue("csrf")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(sessionsCSRFToken(ticket))) != 1 {
+			p.ErrorPage(rw, req, http.StatusForbidden, "Permission Denied", "Invalid request token")
+			return
+		}
+		id := req.FormValue("revoke")
+		if id == current {
+			p.ErrorPage(rw, req, http.StatusBadRequest, "Bad Request", "Sign out to end the current session")
+			return
+		}
+		err := p.revokeDevices(req, session, func(d sessionDevice) bool {
+			return d.ID == id || (id == "others" && d.ID != current)
+		})
+		if err != nil {
+			log.Printf("error signing out sessions: %s", err)
+			p.ErrorPage(rw, req, http.StatusInternalServerError, "Internal Error", "Internal Error")
+			return
+		}
+		if !p.isAPIRequest(req) {
+			http.Redirect(rw, req, p.SessionsPath, http.StatusSeeOther)
+			return
+		}
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, POST")
+		p.ErrorPage(rw, req, http.StatusMethodNotAllowed, "Method Not Allowed", "Method Not Allowed")
+		return
+	}
+
+	devices, err := p.loadDevices(session)
+	if err != nil {
+		log.Printf("error loading sessions: %s", err)
+		p.ErrorPage(rw, req, http.StatusInternalServerError, "Internal Error", "Internal Error")
+		return
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].LastSeen.After(devices[j].LastSeen) })
+	sessions := make([]SessionInfo, len(devices))
+	for i, d := range devices {
+		sessions[i] = SessionInfo{
+			ID:         d.ID,
+			CreatedAt:  d.CreatedAt,
+			LastSeen:   d.LastSeen,
+			UserAgent:  d.UserAgent,
+			RemoteAddr: d.RemoteAddr,
+			Current:    d.ID == current,
+		}
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	if p.isAPIRequest(req) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(struct {
+			Sessions []SessionInfo `json:"sessions"`
+			CSRF     string        `json:"csrf"`
+		}{sessions, sessionsCSRFToken(ticket)})
+		return
+	}
+	t := struct {
+		pageBranding
+		User     string
+		Sessions []SessionInfo
+		CSRF     string
+		Action   string
+	}{
+		pageBranding: p.branding(),
+		User:         sessionIdentity(session),
+		Sessions:     sessions,
+		CSRF:         sessionsCSRFToken(ticket),
+		Action:       p.SessionsPath,
+	}
+	p.templates.ExecuteTemplate(rw, "sessions.html", t)
+}
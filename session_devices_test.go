@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func newSessionDevicesTest(limit int) (*ProcessCookieTest, *memorySessionStore) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	store := &memorySessionStore{sessions: make(map[string]string)}
+	pc_test.proxy.sessionStore = store
+	pc_test.proxy.sessionLimit = limit
+	pc_test.proxy.sessionManagement = true
+	return pc_test, store
+}
+
+// signInDevice saves a session from a new browser and returns a request
+// carrying its cookie
+func signInDevice(t *testing.T, p *OAuthProxy, userAgent string) *http.Request {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", userAgent)
+	rw := httptest.NewRecorder()
+	s := &providers.SessionState{Email: "user@example.com", AccessToken: "token"}
+	assert.Equal(t, nil, p.SaveSession(rw, req, s))
+	req.AddCookie(rw.Result().Cookies()[0])
+	return req
+}
+
+func listSessions(t *testing.T, p *OAuthProxy, req *http.Request) ([]SessionInfo, string) {
+	list, _ := http.NewRequest("GET", p.SessionsPath, nil)
+	list.Header.Set("Accept", "application/json")
+	for _, c := range req.Cookies() {
+		list.AddCookie(c)
+	}
+	rw := httptest.NewRecorder()
+	p.Sessions(rw, list)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var body struct {
+		Sessions []SessionInfo `json:"sessions"`
+		CSRF     string        `json:"csrf"`
+	}
+	assert.Equal(t, nil, json.NewDecoder(rw.Body).Decode(&body))
+	return body.Sessions, body.CSRF
+}
+
+func TestSessionDeviceTickets(t *testing.T) {
+	pc_test, _ := newSessionDevicesTest(0)
+	p := pc_test.proxy
+	req := signInDevice(t, p, "laptop")
+	ticket := p.sessionTicket(req)
+	device := ticketDevice(ticket)
+	assert.Equal(t, 16, len(device))
+
+	// refreshing the session keeps the device
+	rw := httptest.NewRecorder()
+	session, _, err := p.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, p.SaveSession(rw, req, session))
+	req2, _ := http.NewRequest("GET", "/", nil)
+	req2.AddCookie(rw.Result().Cookies()[0])
+	assert.NotEqual(t, ticket, p.sessionTicket(req2))
+	assert.Equal(t, device, ticketDevice(p.sessionTicket(req2)))
+
+	sessions, _ := listSessions(t, p, req2)
+	assert.Equal(t, 1, len(sessions))
+	assert.Equal(t, device, sessions[0].ID)
+	assert.Equal(t, "laptop", sessions[0].UserAgent)
+	assert.Equal(t, true, sessions[0].Current)
+
+	assert.Equal(t, "", ticketDevice("0123456789abcdef0123456789abcdef"))
+}
+
+func TestSessionLimit(t *testing.T) {
+	pc_test, store := newSessionDevicesTest(2)
+	p := pc_test.proxy
+	first := signInDevice(t, p, "first")
+	second := signInDevice(t, p, "second")
+
+	// the first device was seen most recently, so the second is signed out
+	devices, err := p.loadDevices(&providers.SessionState{Email: "user@example.com"})
+	assert.Equal(t, nil, err)
+	devices[0].LastSeen = time.Now().Add(time.Minute)
+	b, _ := json.Marshal(devices)
+	store.sessions[devicesKey(&providers.SessionState{Email: "user@example.com"})] = string(b)
+
+	third := signInDevice(t, p, "third")
+	_, _, err = p.LoadCookiedSession(first)
+	assert.Equal(t, nil, err)
+	_, _, err = p.LoadCookiedSession(second)
+	assert.Equal(t, errSessionNotFound, err)
+	_, _, err = p.LoadCookiedSession(third)
+	assert.Equal(t, nil, err)
+
+	sessions, _ := listSessions(t, p, third)
+	assert.Equal(t, 2, len(sessions))
+}
+
+func TestSessionsRevoke(t *testing.T) {
+	pc_test, _ := newSessionDevicesTest(0)
+	p := pc_test.proxy
+	laptop := signInDevice(t, p, "laptop")
+	phone := signInDevice(t, p, "phone")
+	tablet := signInDevice(t, p, "tablet")
+	sessions, csrf := listSessions(t, p, laptop)
+	assert.Equal(t, 3, len(sessions))
+
+	revoke := func(value, token string) *httptest.ResponseRecorder {
+		form := url.Values{"revoke": {value}, "csrf": {token}}
+		req, _ := http.NewRequest("POST", p.SessionsPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range laptop.Cookies() {
+			req.AddCookie(c)
+		}
+		rw := httptest.NewRecorder()
+		p.Sessions(rw, req)
+		return rw
+	}
+
+	rw := revoke("others", "bad")
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	rw = revoke(ticketDevice(p.sessionTicket(phone)), csrf)
+	assert.Equal(t, http.StatusSeeOther, rw.Code)
+	assert.Equal(t, p.SessionsPath, rw.Header().Get("Location"))
+	_, _, err := p.LoadCookiedSession(phone)
+	assert.Equal(t, errSessionNotFound, err)
+	_, _, err = p.LoadCookiedSession(tablet)
+	assert.Equal(t, nil, err)
+
+	rw = revoke("others", csrf)
+	assert.Equal(t, http.StatusSeeOther, rw.Code)
+	_, _, err = p.LoadCookiedSession(tablet)
+	assert.Equal(t, errSessionNotFound, err)
+	sessions, _ = listSessions(t, p, laptop)
+	assert.Equal(t, 1, len(sessions))
+
+	// signing out forgets the device
+	p.SignOut(httptest.NewRecorder(), laptop)
+	devices, _ := p.loadDevices(&providers.SessionState{Email: "user@example.com"})
+	assert.Equal(t, 0, len(devices))
+}
+
+func TestSessionsRejectsSignedOutDevice(t *testing.T) {
+	pc_test, _ := newSessionDevicesTest(0)
+	p := pc_test.proxy
+	req := signInDevice(t, p, "laptop")
+
+	// a ticket that is still in the store, but whose device was signed out,
+	// as earlier tickets of a revoked device are
+	session := &providers.SessionState{Email: "user@example.com"}
+	p.forgetDevice(session, ticketDevice(p.sessionTicket(req)))
+
+	_, _, err := p.LoadCookiedSession(req)
+	assert.Equal(t, errSessionSignedOut, err)
+}
+
+func TestSessionsPage(t *testing.T) {
+	pc_test, _ := newSessionDevicesTest(0)
+	p := pc_test.proxy
+	req := signInDevice(t, p, "laptop")
+
+	rw := httptest.NewRecorder()
+	p.Sessions(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, true, strings.Contains(rw.Body.String(), "Sessions for user@example.com"))
+	assert.Equal(t, true, strings.Contains(rw.Body.String(), sessionsCSRFToken(p.sessionTicket(req))))
+
+	anonymous, _ := http.NewRequest("GET", p.SessionsPath, nil)
+	anonymous.Header.Set("Accept", "application/json")
+	rw = httptest.NewRecorder()
+	p.Sessions(rw, anonymous)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	p.sessionManagement = false
+	rw = httptest.NewRecorder()
+	p.Sessions(rw, req)
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func TestSessionLimitOptions(t *testing.T) {
+	o := testOptions()
+	o.SessionLimit = 3
+	o.SessionManagement = true
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"session-limit requires session-memcached-server",
+		"session-management requires session-memcached-server",
+	}), err.Error())
+
+	o.SessionMemcachedServers = []string{"127.0.0.1:11211"}
+	o.SessionLimit = -1
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{"session-limit must not be negative"}), err.Error())
+
+	o.SessionLimit = 3
+	assert.Equal(t, nil, o.Validate())
+}
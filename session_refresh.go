@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// accessTokenRefreshMargin is how long before the access token expires that
+// a session with a refresh token is refreshed
+const accessTokenRefreshMargin = time.Minute
+
+// refreshResultTTL is how long the outcome of a refresh is reused for
+// requests still carrying the old cookie, such as those sent by other tabs
+// before the new cookie arrived
+const refreshResultTTL = 30 * time.Second
+
+type refreshCall struct {
+	done      chan struct{}
+	session   providers.SessionState
+	refreshed bool
+	err       error
+	expires   time.Time
+}
+
+// sessionRefresher makes sure a refresh token is only redeemed once.
+// Concurrent refreshes of the same session wait for the first to finish and
+// share its result, as providers that rotate refresh tokens reject the old
+// token once it has been used.
+type sessionRefresher struct {
+	mu    sync.Mutex
+	calls map[string]*refreshCall
+	now   func() time.Time
+}
+
+func newSessionRefresher() *sessionRefresher {
+	return &sessionRefresher{
+		calls: make(map[string]*refreshCall),
+		now:   time.Now,
+	}
+}
+
+// Refresh updates s using refresh, or with the result of a refresh of the
+// same session that is in progress or recently completed
+func (r *sessionRefresher) Refresh(s *providers.SessionState, refresh func(*providers.SessionState) (bool, error)) (bool, error) {
+	key := s.RefreshToken
+	now := r.now()
+
+	r.mu.Lock()
+	for k, c := range r.calls {
+		if !c.expires.IsZero() && now.After(c.expires) {
+			delete(r.calls, k)
+		}
+	}
+	c, ok := r.calls[key]
+	if !ok {
+		c = &refreshCall{done: make(chan struct{})}
+		r.calls[key] = c
+	}
+	r.mu.Unlock()
+
+	if ok {
+		<-c.done
+	} else {
+		c.session = *s
+		c.refreshed, c.err = refresh(&c.session)
+		r.mu.Lock()
+		c.expires = r.now().Add(refreshResultTTL)
+		r.mu.Unlock()
+		close(c.done)
+	}
+
+	if c.err != nil || !c.refreshed {
+		return false, c.err
+	}
+	*s = c.session
+	return true, nil
+}
+
+// needsRefresh reports whether a session should be refreshed before it is
+// used: when its access token is about to expire, or when the cookie is
+// older than cookie-refresh
+func (p *OAuthProxy) needsRefresh(s *providers.SessionState, sessionAge time.Duration) bool {
+	if s.RefreshToken == "" {
+		return false
+	}
+	if !s.ExpiresOn.IsZero() && s.ExpiresOn.Before(time.Now().Add(accessTokenRefreshMargin)) {
+		return true
+	}
+	return p.CookieRefresh != time.Duration(0) && sessionAge > p.CookieRefresh
+}
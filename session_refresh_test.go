@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func rotatingRefresh(calls *int32, release <-chan struct{}) func(*providers.SessionState) (bool, error) {
+	return func(s *providers.SessionState) (bool, error) {
+		n := atomic.AddInt32(calls, 1)
+		if release != nil {
+			<-release
+		}
+		s.AccessToken = fmt.Sprintf("access%d", n)
+		s.RefreshToken = fmt.Sprintf("refresh%d", n)
+		return true, nil
+	}
+}
+
+func TestSessionRefresherSharesConcurrentRefresh(t *testing.T) {
+	r := newSessionRefresher()
+	var calls int32
+	release := make(chan struct{})
+	refresh := rotatingRefresh(&calls, release)
+
+	var wg sync.WaitGroup
+	sessions := make([]*providers.SessionState, 5)
+	for i := range sessions {
+		sessions[i] = &providers.SessionState{AccessToken: "access0", RefreshToken: "refresh0"}
+		wg.Add(1)
+		go func(s *providers.SessionState) {
+			defer wg.Done()
+			ok, err := r.Refresh(s, refresh)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, true, ok)
+		}(sessions[i])
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls)
+	for _, s := range sessions {
+		assert.Equal(t, "access1", s.AccessToken)
+		assert.Equal(t, "refresh1", s.RefreshToken)
+	}
+}
+
+func TestSessionRefresherReusesRecentResult(t *testing.T) {
+	r := newSessionRefresher()
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	var calls int32
+	refresh := rotatingRefresh(&calls, nil)
+
+	first := &providers.SessionState{RefreshToken: "refresh0"}
+	r.Refresh(first, refresh)
+	late := &providers.SessionState{RefreshToken: "refresh0"}
+	ok, err := r.Refresh(late, refresh)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, int32(1), calls)
+	assert.Equal(t, "refresh1", late.RefreshToken)
+
+	now = now.Add(refreshResultTTL + time.Second)
+	stale := &providers.SessionState{RefreshToken: "refresh0"}
+	r.Refresh(stale, refresh)
+	assert.Equal(t, int32(2), calls)
+	assert.Equal(t, "refresh2", stale.RefreshToken)
+}
+
+func TestSessionRefresherSharesErrors(t *testing.T) {
+	r := newSessionRefresher()
+	refreshErr := errors.New("invalid_grant")
+	refresh := func(s *providers.SessionState) (bool, error) {
+		s.AccessToken = "partial"
+		return false, refreshErr
+	}
+
+	for i := 0; i < 2; i++ {
+		s := &providers.SessionState{AccessToken: "access0", RefreshToken: "refresh0"}
+		ok, err := r.Refresh(s, refresh)
+		assert.Equal(t, refreshErr, err)
+		assert.Equal(t, false, ok)
+		assert.Equal(t, "access0", s.AccessToken)
+	}
+}
+
+func TestNeedsRefresh(t *testing.T) {
+	p := &OAuthProxy{CookieRefresh: time.Hour}
+	s := &providers.SessionState{RefreshToken: "refresh0", ExpiresOn: time.Now().Add(time.Hour)}
+	assert.Equal(t, false, p.needsRefresh(s, time.Minute))
+	assert.Equal(t, true, p.needsRefresh(s, 2*time.Hour))
+
+	s.ExpiresOn = time.Now().Add(30 * time.Second)
+	assert.Equal(t, true, p.needsRefresh(s, time.Minute))
+
+	s.RefreshToken = ""
+	assert.Equal(t, false, p.needsRefresh(s, 2*time.Hour))
+
+	p.CookieRefresh = 0
+	s = &providers.SessionState{RefreshToken: "refresh0"}
+	assert.Equal(t, false, p.needsRefresh(s, 2*time.Hour))
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+var errSessionRevoked = errors.New("session revoked by an administrator")
+
+// revocationRefresh is how long revocations read from the session store are
+// trusted before they are read again, which is how long a revocation made on
+// another instance can take to be seen
+const revocationRefresh = 5 * time.Second
+
+// registeredSessions outlives configuration reloads so that revocations stay
+// in force and the admin listener sees sessions from every handler
+var registeredSessions = newSessionRegistry()
+
+// SessionEntry describes the most recent session cookie seen for a user
+type SessionEntry struct {
+	User     string    `json:"user"`
+	Email    string    `json:"email,omitempty"`
+	IssuedAt time.Time `json:"issued_at"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// sessionRegistry tracks the sessions this instance has seen and the
+// sessions revoked by an administrator. Session cookies can't be deleted
+// from the browser, so a revocation rejects every cookie for the user that
+// was issued at or before the time it was revoked. Cookie timestamps only
+// have second precision, so a cookie issued in the same second as a
+// revocation is rejected too.
+//
+// With a session store, revocations are also saved there, so that they
+// survive restarts and every instance sharing the store honours them.
+type sessionRegistry struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	sessions   map[string]*SessionEntry
+	revoked    map[string]time.Time
+	revokedAll time.Time
+	store      SessionStore
+	stored     map[string]storedRevocation
+	now        func() time.Time
+}
+
+// storedRevocation is a revocation read from the session store, or the
+// lack of one, as of when it was read
+type storedRevocation struct {
+	at   time.Time
+	read time.Time
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		ttl:      time.Duration(168) * time.Hour,
+		sessions: make(map[string]*SessionEntry),
+		revoked:  make(map[string]time.Time),
+		stored:   make(map[string]storedRevocation),
+		now:      time.Now,
+	}
+}
+
+// revocationKey returns the session store key for the revocation of id, or
+// of every session when id is ""
+func revocationKey(id string) string {
+	if id == "" {
+		return "revoked_all"
+	}
+	sum := sha256.Sum256([]byte(id))
+	return "revoked_" + hex.EncodeToString(sum[:16])
+}
+
+func sessionIdentity(s *providers.SessionState) string {
+	if s.Email != "" {
+		return s.Email
+	}
+	return s.User
+}
+
+// SetTTL sets how long sessions and revocations are remembered; it should
+// match the cookie expiry, after which cookies are rejected anyway
+func (r *sessionRegistry) SetTTL(ttl time.Duration) {
+	r.mu.Lock()
+	r.ttl = ttl
+	r.mu.Unlock()
+}
+
+// SetStore saves revocations to store, and reads those made by other
+// instances from it. store may be nil to keep them in memory only.
+func (r *sessionRegistry) SetStore(store SessionStore) {
+	r.mu.Lock()
+	r.store = store
+	r.stored = make(map[string]storedRevocation)
+	r.mu.Unlock()
+}
+
+// prune forgets expired sessions and revocations. r.mu must be held.
+func (r *sessionRegistry) prune() {
+	cutoff := r.now().Add(-r.ttl)
+	for id, e := range r.sessions {
+		if e.IssuedAt.Before(cutoff) {
+			delete(r.sessions, id)
+		}
+	}
+	for id, ts := range r.revoked {
+		if ts.Before(cutoff) {
+			delete(r.revoked, id)
+		}
+	}
+	now := r.now()
+	for key, s := range r.stored {
+		if now.Sub(s.read) >= revocationRefresh {
+			delete(r.stored, key)
+		}
+	}
+}
+
+// Seen records an authenticated request with a session cookie issued at
+// issuedAt
+func (r *sessionRegistry) Seen(s *providers.SessionState, issuedAt time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := sessionIdentity(s)
+	e, ok := r.sessions[id]
+	if !ok {
+		e = &SessionEntry{}
+		r.sessions[id] = e
+	}
+	e.User, e.Email, e.LastSeen = s.User, s.Email, r.now()
+	if issuedAt.After(e.IssuedAt) {
+		e.IssuedAt = issuedAt
+	}
+}
+
+// IsRevoked reports whether a session cookie issued at issuedAt has been
+// revoked
+func (r *sessionRegistry) IsRevoked(s *providers.SessionState, issuedAt time.Time) bool {
+	r.mu.Lock()
+	revokedAt := r.revokedAll
+	if ts, ok := r.revoked[s.Email]; ok && ts.After(revokedAt) {
+		revokedAt = ts
+	}
+	if ts, ok := r.revoked[s.User]; ok && ts.After(revokedAt) {
+		revokedAt = ts
+	}
+	store := r.store
+	r.mu.Unlock()
+
+	if store != nil {
+		for i, id := range []string{"", s.Email, s.User} {
+			if i > 0 && id == "" {
+				continue
+			}
+			if ts := r.storedRevocation(store, id); ts.After(revokedAt) {
+				revokedAt = ts
+			}
+		}
+	}
+	return !revokedAt.IsZero() && !issuedAt.After(revokedAt.Truncate(time.Second))
+}
+
+// storedRevocation returns when id was revoked according to the session
+// store, reading it again once it is older than revocationRefresh. If the
+// store can't be reached the error is logged and only revocations already
+// known are enforced.
+func (r *sessionRegistry) storedRevocation(store SessionStore, id string) time.Time {
+	key := revocationKey(id)
+	r.mu.Lock()
+	s, ok := r.stored[key]
+	now := r.now()
+	r.mu.Unlock()
+	if ok && now.Sub(s.read) < revocationRefresh {
+		return s.at
+	}
+
+	value, err := store.Load(key)
+	if err != nil && err != errSessionNotFound {
+		log.Printf("error reading session revocations from session store: %s", err)
+		return s.at
+	}
+	s = storedRevocation{read: now}
+	if ns, err := strconv.ParseInt(value, 10, 64); err == nil {
+		s.at = time.Unix(0, ns)
+	}
+	r.mu.Lock()
+	r.stored[key] = s
+	r.mu.Unlock()
+	return s.at
+}
+
+// saveRevocation records a revocation in the session store, if there is one
+func (r *sessionRegistry) saveRevocation(id string, at time.Time) {
+	r.mu.Lock()
+	store, ttl := r.store, r.ttl
+	r.stored[revocationKey(id)] = storedRevocation{at: at, read: at}
+	r.mu.Unlock()
+	if store == nil {
+		return
+	}
+	if err := store.Save(revocationKey(id), strconv.FormatInt(at.UnixNano(), 10), ttl); err != nil {
+		log.Printf("error saving session revocation to session store: %s", err)
+	}
+}
+
+// List returns the sessions seen within the ttl, ordered by user
+func (r *sessionRegistry) List() []SessionEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune()
+	entries := make([]SessionEntry, 0, len(r.sessions))
+	for _, e := range r.sessions {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].User+entries[i].Email < entries[j].User+entries[j].Email
+	})
+	return entries
+}
+
+// Revoke rejects the existing sessions of a user, identified by email or
+// user name, and reports whether a session was known for them
+func (r *sessionRegistry) Revoke(id string) bool {
+	r.mu.Lock()
+	r.prune()
+	now := r.now()
+	r.revoked[id] = now
+	known := false
+	for key, e := range r.sessions {
+		if e.Email == id || e.User == id {
+			delete(r.sessions, key)
+			known = true
+		}
+	}
+	r.mu.Unlock()
+	r.saveRevocation(id, now)
+	return known
+}
+
+// RevokeAll rejects every existing session
+func (r *sessionRegistry) RevokeAll() {
+	r.mu.Lock()
+	now := r.now()
+	r.revokedAll = now
+	r.sessions = make(map[string]*SessionEntry)
+	r.mu.Unlock()
+	r.saveRevocation("", now)
+}
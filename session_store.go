@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// sessionTicketPrefix marks session cookies that hold a ticket for a
+// session in the session store rather than the session itself
+const sessionTicketPrefix = "ticket:"
+
+var errSessionNotFound = errors.New("session not found in session store")
+
+// SessionStore keeps sessions server side, so that the session cookie only
+// has to hold a ticket for them. Implementations must be safe for
+// concurrent use.
+type SessionStore interface {
+	// Save stores the encoded session for ticket until it expires
+	Save(ticket string, value string, expiration time.Duration) error
+	// Load returns the session saved for ticket, or errSessionNotFound
+	Load(ticket string) (string, error)
+	// Clear removes the session saved for ticket
+	Clear(ticket string) error
+	// Update replaces the value saved for key with the result of update,
+	// which is given "" when there is none. Concurrent updates of a key
+	// must not overwrite each other.
+	Update(key string, expiration time.Duration, update func(value string) (string, error)) error
+}
+
+func newSessionTicket() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sessionTicket returns the ticket in the request's session cookie, or ""
+// when it doesn't have a validly signed one
+func (p *OAuthProxy) sessionTicket(req *http.Request) string {
+	c, err := req.Cookie(p.CookieName)
+	if err != nil {
+		return ""
+	}
+	for _, secret := range p.cookieSecrets() {
+		if val, _, ok := cookie.Validate(c, secret.seed, p.CookieExpire); ok {
+			if strings.HasPrefix(val, sessionTicketPrefix) {
+				return strings.TrimPrefix(val, sessionTicketPrefix)
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// memcachedSessionStore keeps sessions in memcached, spread across its
+// servers by consistent hashing so that adding or removing a server only
+// moves the sessions on it
+type memcachedSessionStore struct {
+	client *memcache.Client
+}
+
+func newMemcachedSessionStore(servers []string) (*memcachedSessionStore, error) {
+	ring, err := newHashRing(servers)
+	if err != nil {
+		return nil, err
+	}
+	return &memcachedSessionStore{client: memcache.NewFromSelector(ring)}, nil
+}
+
+func (m *memcachedSessionStore) Close() error {
+	return m.client.Close()
+}
+
+func (m *memcachedSessionStore) key(ticket string) string {
+	return "oauth2_proxy_session_" + ticket
+}
+
+func (m *memcachedSessionStore) Save(ticket string, value string, expiration time.Duration) error {
+	return m.client.Set(&memcache.Item{
+		Key:        m.key(ticket),
+		Value:      []byte(value),
+		Expiration: memcachedExpiration(expiration, time.Now()),
+	})
+}
+
+func (m *memcachedSessionStore) Load(ticket string) (string, error) {
+	item, err := m.client.Get(m.key(ticket))
+	if err == memcache.ErrCacheMiss {
+		return "", errSessionNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(item.Value), nil
+}
+
+func (m *memcachedSessionStore) Clear(ticket string) error {
+	err := m.client.Delete(m.key(ticket))
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+// memcachedUpdateAttempts limits how often an update is retried when
+// another one changes the value first
+const memcachedUpdateAttempts = 10
+
+func (m *memcachedSessionStore) Update(key string, expiration time.Duration, update func(value string) (string, error)) error {
+	for i := 0; i < memcachedUpdateAttempts; i++ {
+		item, err := m.client.Get(m.key(key))
+		found := err == nil
+		if err == memcache.ErrCacheMiss {
+			item = &memcache.Item{Key: m.key(key)}
+		} else if err != nil {
+			return err
+		}
+		value, err := update(string(item.Value))
+		if err != nil {
+			return err
+		}
+		item.Value = []byte(value)
+		item.Expiration = memcachedExpiration(expiration, time.Now())
+		if found {
+			err = m.client.CompareAndSwap(item)
+		} else {
+			err = m.client.Add(item)
+		}
+		if err != memcache.ErrNotStored && err != memcache.ErrCASConflict {
+			return err
+		}
+	}
+	return fmt.Errorf("updating %s: too many concurrent updates", key)
+}
+
+// memcachedExpiration converts expiration to memcached's form, which is a
+// number of seconds up to 30 days and a unix time beyond that
+func memcachedExpiration(expiration time.Duration, now time.Time) int32 {
+	seconds := int64(expiration / time.Second)
+	if seconds > 30*24*60*60 {
+		return int32(now.Unix() + seconds)
+	}
+	return int32(seconds)
+}
+
+// hashRingReplicas is the number of points each server has on the ring,
+// which evens out the share of keys each one gets
+const hashRingReplicas = 160
+
+// hashRing is a memcache.ServerSelector that picks servers by consistent
+// hashing
+type hashRing struct {
+	addrs  []net.Addr
+	points []uint32
+	owners map[uint32]net.Addr
+}
+
+func newHashRing(servers []string) (*hashRing, error) {
+	r := &hashRing{owners: make(map[uint32]net.Addr)}
+	for _, server := range servers {
+		var addr net.Addr
+		var err error
+		if strings.Contains(server, "/") {
+			addr, err = net.ResolveUnixAddr("unix", server)
+		} else {
+			addr, err = net.ResolveTCPAddr("tcp", server)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("resolving memcached server %q: %s", server, err)
+		}
+		r.addrs = append(r.addrs, addr)
+		for i := 0; i < hashRingReplicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(server + "-" + strconv.Itoa(i)))
+			if _, taken := r.owners[point]; taken {
+				continue
+			}
+			r.owners[point] = addr
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r, nil
+}
+
+func (r *hashRing) PickServer(key string) (net.Addr, error) {
+	if len(r.points) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]], nil
+}
+
+func (r *hashRing) Each(f func(net.Addr) error) error {
+	for _, addr := range r.addrs {
+		if err := f(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
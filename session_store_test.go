@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]string
+}
+
+func (m *memorySessionStore) Save(ticket string, value string, expiration time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[ticket] = value
+	return nil
+}
+
+func (m *memorySessionStore) Load(ticket string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.sessions[ticket]
+	if !ok {
+		return "", errSessionNotFound
+	}
+	return value, nil
+}
+
+func (m *memorySessionStore) Clear(ticket string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, ticket)
+	return nil
+}
+
+func (m *memorySessionStore) Update(key string, expiration time.Duration, update func(string) (string, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, err := update(m.sessions[key])
+	if err != nil {
+		return err
+	}
+	m.sessions[key] = value
+	return nil
+}
+
+func TestSessionStore(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	store := &memorySessionStore{sessions: make(map[string]string)}
+	pc_test.proxy.sessionStore = store
+
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	rw := httptest.NewRecorder()
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(rw, pc_test.req, startSession))
+	assert.Equal(t, 1, len(store.sessions))
+	c := rw.Result().Cookies()[0]
+	assert.Equal(t, false, strings.Contains(c.Value, "my_access_token"))
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(c)
+	ticket := pc_test.proxy.sessionTicket(req)
+	assert.Equal(t, 32, len(ticket))
+	session, _, err := pc_test.proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, startSession.Email, session.Email)
+	assert.Equal(t, startSession.AccessToken, session.AccessToken)
+
+	// saving again issues a new ticket and clears the previous one
+	rw = httptest.NewRecorder()
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(rw, req, session))
+	assert.Equal(t, 1, len(store.sessions))
+	assert.NotEqual(t, c.Value, rw.Result().Cookies()[0].Value)
+	_, err = store.Load(ticket)
+	assert.Equal(t, errSessionNotFound, err)
+
+	// signing out removes the session from the store
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(rw.Result().Cookies()[0])
+	ticket = pc_test.proxy.sessionTicket(req)
+	pc_test.proxy.ClearSessionCookie(httptest.NewRecorder(), req)
+	_, err = store.Load(ticket)
+	assert.Equal(t, errSessionNotFound, err)
+	_, _, err = pc_test.proxy.LoadCookiedSession(req)
+	assert.Equal(t, errSessionNotFound, err)
+}
+
+func TestSessionStoreAcceptsCookieSessions(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.sessionStore = &memorySessionStore{sessions: make(map[string]string)}
+
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, time.Now())
+	session, _, err := pc_test.LoadCookiedSession()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, startSession.Email, session.Email)
+}
+
+func TestHashRing(t *testing.T) {
+	servers := []string{"127.0.0.1:11211", "127.0.0.1:11212", "127.0.0.1:11213"}
+	ring, err := newHashRing(servers)
+	assert.Equal(t, nil, err)
+	larger, err := newHashRing(append(servers, "127.0.0.1:11214"))
+	assert.Equal(t, nil, err)
+
+	counts := make(map[string]int)
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("oauth2_proxy_session_%d", i)
+		addr, err := ring.PickServer(key)
+		assert.Equal(t, nil, err)
+		counts[addr.String()]++
+		if addr2, _ := larger.PickServer(key); addr2.String() != addr.String() {
+			assert.Equal(t, "127.0.0.1:11214", addr2.String())
+			moved++
+		}
+	}
+	for _, server := range servers {
+		if counts[server] < 500 {
+			t.Errorf("expected keys to be spread evenly, got %v", counts)
+		}
+	}
+	// about a quarter of the keys move to the new server, and only those
+	if moved < 300 || moved > 1200 {
+		t.Errorf("expected about 750 keys to move, got %d", moved)
+	}
+
+	_, err = newHashRing([]string{"not a host"})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestMemcachedExpiration(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	assert.Equal(t, int32(7*24*60*60), memcachedExpiration(7*24*time.Hour, now))
+	assert.Equal(t, int32(1500000000+60*24*60*60), memcachedExpiration(60*24*time.Hour, now))
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/logger"
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// With bearer-sessions, clients that can't keep cookies exchange a provider
+// code on /oauth2/token for a session token of the proxy's own, and send it
+// as an "Authorization: Bearer" header in place of the session cookie. The
+// token is random; the session is kept in the session store under its
+// hash, signed like a session cookie with the time it was last saved, after
+// the time the token was issued and, when sessions are tracked by device,
+// the device the token is tracked as.
+
+var errSessionTokenExpired = errors.New("session token has expired")
+
+// sessionTokenKey is where the session of a token is kept in the session
+// store
+func sessionTokenKey(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return "token-" + hex.EncodeToString(h[:])
+}
+
+// tokenDevice returns the device a session token is tracked as for
+// session-limit and session-management
+func tokenDevice(token string) string {
+	h := sha256.Sum256([]byte("device:" + token))
+	return hex.EncodeToString(h[:8])
+}
+
+// parseTokenRecord splits the session store record of a token into the time
+// the token was issued, its device, and the signed session
+func parseTokenRecord(record string) (time.Time, string, string, error) {
+	parts := strings.SplitN(record, "|", 2)
+	header := strings.SplitN(parts[0], ":", 2)
+	issued, err := strconv.ParseInt(header[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		return time.Time{}, "", "", errors.New("invalid session token record")
+	}
+	device := ""
+	if len(header) == 2 {
+		device = header[1]
+	}
+	return time.Unix(issued, 0), device, parts[1], nil
+}
+
+// sessionToken returns the session token in the request's Authorization
+// header, or "" when it has none, such as for a JWT bearer token
+func (p *OAuthProxy) sessionToken(req *http.Request) string {
+	if !p.bearerSessions {
+		return ""
+	}
+	s := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(s) != 2 || s[0] != "Bearer" {
+		return ""
+	}
+	token := strings.TrimSpace(s[1])
+	if _, err := hex.DecodeString(token); err != nil || len(token) != 32 {
+		return ""
+	}
+	return token
+}
+
+// saveTokenSession saves the session of a token issued at issuedAt, and
+// tracked as device unless it is "", until the token expires
+func (p *OAuthProxy) saveTokenSession(token string, s *providers.SessionState, issuedAt time.Time, device string) error {
+	secret := p.cookieSecrets()[0]
+	value, err := p.provider.CookieForSession(s, secret.cipher)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expiration := issuedAt.Add(p.CookieExpire).Sub(now)
+	if expiration <= 0 {
+		return errSessionTokenExpired
+	}
+	signed := cookie.SignedValue(secret.seed, p.CookieName, value, now)
+	header := strconv.FormatInt(issuedAt.Unix(), 10)
+	if device != "" {
+		header += ":" + device
+	}
+	return p.sessionStore.Save(sessionTokenKey(token), header+"|"+signed, expiration)
+}
+
+// LoadTokenSession returns the session of a token, and how long ago it was
+// last saved
+func (p *OAuthProxy) LoadTokenSession(token string) (*providers.SessionState, time.Duration, error) {
+	var age time.Duration
+	record, err := p.sessionStore.Load(sessionTokenKey(token))
+	if err != nil {
+		return nil, age, err
+	}
+	issued, device, signed, err := parseTokenRecord(record)
+	if err != nil {
+		return nil, age, err
+	}
+	c := &http.Cookie{Name: p.CookieName, Value: signed}
+	for _, secret := range p.cookieSecrets() {
+		val, timestamp, ok := cookie.Validate(c, secret.seed, p.CookieExpire)
+		if !ok {
+			continue
+		}
+		session, err := p.provider.SessionFromCookie(val, secret.cipher)
+		if err != nil {
+			return nil, age, err
+		}
+		if p.sessions.IsRevoked(session, issued) {
+			return nil, age, errSessionRevoked
+		}
+		// tokens issued before sessions were tracked by device aren't
+		if p.tracksDevices() && device != "" {
+			if err := p.checkDevice(session, device); err != nil {
+				return nil, age, err
+			}
+		}
+		age = time.Now().Truncate(time.Second).Sub(timestamp)
+		return session, age, nil
+	}
+	return nil, age, errors.New("session token signature not valid")
+}
+
+// refreshTokenSession saves a session that was refreshed or revalidated in
+// place, so the client keeps using the same token
+func (p *OAuthProxy) refreshTokenSession(token string, s *providers.SessionState) error {
+	record, err := p.sessionStore.Load(sessionTokenKey(token))
+	if err != nil {
+		return err
+	}
+	issued, device, _, err := parseTokenRecord(record)
+	if err != nil {
+		return err
+	}
+	return p.saveTokenSession(token, s, issued, device)
+}
+
+func (p *OAuthProxy) clearTokenSession(token string) {
+	if err := p.sessionStore.Clear(sessionTokenKey(token)); err != nil && err != errSessionNotFound {
+		log.Printf("error removing session token from session store: %s", err)
+	}
+}
+
+// tokenError responds to a token request with an error as in RFC 6749
+// section 5.2
+func tokenError(rw http.ResponseWriter, code int, err, description string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+	}{err, description})
+}
+
+// Token exchanges a code from the provider for a session token with a POST
+// of grant_type=authorization_code, and signs out the session of the token
+// in the Authorization header with a DELETE.
+//
+// The code is redeemed with redirect_uri, which must be the one it was
+// requested with, and defaults to the proxy's callback. code_verifier is
+// passed on to the provider for PKCE, and provider selects one of the
+// sign in providers.
+func (p *OAuthProxy) Token(rw http.ResponseWriter, req *http.Request) {
+	if !p.bearerSessions || p.sessionStore == nil {
+		p.ErrorPage(rw, req, http.StatusNotFound, "Not Found", "Bearer sessions are not enabled")
+		return
+	}
+	switch req.Method {
+	case "POST":
+	case "DELETE":
+		token := p.sessionToken(req)
+		if token == "" {
+			tokenError(rw, http.StatusUnauthorized, "invalid_token", "missing session token")
+			return
+		}
+		if session, _, err := p.LoadTokenSession(token); err == nil {
+			p.audit(req, auditSignOut, session.Email, "signed out session token %s", session)
+			if p.tracksDevices() {
+				p.forgetDevice(session, tokenDevice(token))
+			}
+		}
+		p.clearTokenSession(token)
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		rw.Header().Set("Allow", "POST, DELETE")
+		tokenError(rw, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		tokenError(rw, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if grantType := req.PostForm.Get("grant_type"); grantType != "authorization_code" {
+		tokenError(rw, http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("unsupported grant_type %q", grantType))
+		return
+	}
+	sp := p.signInProvider(req.PostForm.Get("provider"))
+	if sp == nil {
+		tokenError(rw, http.StatusBadRequest, "invalid_request", "unknown provider")
+		return
+	}
+	redirectURI := req.PostForm.Get("redirect_uri")
+	if redirectURI == "" {
+		redirectURI = p.GetRedirectURI(req.Host)
+	}
+
+	session, err := p.redeemCode(sp.provider, redirectURI, req.PostForm.Get("code"), req.PostForm.Get("code_verifier"))
+	if err != nil {
+		logger.PrintAuthf("", req, logger.AuthError, "error redeeming code %s", err)
+		p.auditFor(req, sp.provider, auditLoginFailure, "", "error redeeming code %s", err)
+		recordAuthentication("token", false)
+		tokenError(rw, http.StatusBadRequest, "invalid_grant", "error redeeming code")
+		return
+	}
+	if err := sp.provider.EnrichSession(session); err != nil {
+		logger.PrintAuthf(session.Email, req, logger.AuthError, "error enriching session %s", err)
+		p.auditFor(req, sp.provider, auditLoginFailure, session.Email, "error enriching session %s", err)
+		recordAuthentication("token", false)
+		tokenError(rw, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	session.Provider = sp.id
+	p.mapClaims(sp.provider, session, session.IDToken)
+
+	if !sp.validator(session.Email) || !sp.provider.ValidateGroup(session.Email) || !p.hasAllowedGroup(session) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Permission Denied: %q is unauthorized", session.Email)
+		p.auditFor(req, sp.provider, auditAuthorizationDenied, session.Email, "%q is unauthorized", session.Email)
+		recordAuthentication("token", false)
+		tokenError(rw, http.StatusForbidden, "access_denied", "Invalid Account")
+		return
+	}
+
+	// tokens count towards session-limit and are listed on the sessions
+	// page like the browsers a user is signed in on
+	token, err := newSessionTicket()
+	device := ""
+	if err == nil && p.tracksDevices() {
+		device = tokenDevice(token)
+	}
+	if err == nil {
+		err = p.saveTokenSession(token, session, time.Now(), device)
+	}
+	if err == nil && device != "" {
+		if err = p.saveDevice(req, session, device, sessionTokenKey(token)); err != nil {
+			p.clearTokenSession(token)
+		}
+	}
+	if err != nil {
+		log.Printf("%s %s", getRemoteAddr(req), err)
+		tokenError(rw, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "authentication complete, issued session token %s", session)
+	p.auditFor(req, sp.provider, auditLoginSuccess, session.Email, "authentication complete, issued session token %s", session)
+	recordAuthentication("token", true)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{token, "Bearer", int64(p.CookieExpire / time.Second)})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// ProviderOptions describes a provider from a [[provider]] table in the
+// config file. Users can sign in with it as well as with the provider set
+// at the top level, choosing between them on the sign in page.
+type ProviderOptions struct {
+	ID            string   `toml:"id" yaml:"id"`
+	Name          string   `toml:"name" yaml:"name"`
+	Provider      string   `toml:"provider" yaml:"provider"`
+	ClientID      string   `toml:"client_id" yaml:"client_id"`
+	ClientSecret  string   `toml:"client_secret" yaml:"client_secret"`
+	OIDCIssuerURL string   `toml:"oidc_issuer_url" yaml:"oidc_issuer_url"`
+	LoginURL      string   `toml:"login_url" yaml:"login_url"`
+	RedeemURL     string   `toml:"redeem_url" yaml:"redeem_url"`
+	ProfileURL    string   `toml:"profile_url" yaml:"profile_url"`
+	ValidateURL   string   `toml:"validate_url" yaml:"validate_url"`
+	Scope         string   `toml:"scope" yaml:"scope"`
+	EmailDomains  []string `toml:"email_domains" yaml:"email_domains"`
+}
+
+// signInProvider is a provider users can choose to sign in with. The
+// default provider has an empty id. validator is nil when the provider
+// shares the top level email restrictions.
+type signInProvider struct {
+	id        string
+	name      string
+	provider  providers.Provider
+	validator func(string) bool
+}
+
+// providerChoice is a button on the sign in page for one of the [[provider]]
+// tables, which starts sign in with that provider
+type providerChoice struct {
+	ID   string
+	Name string
+}
+
+var providerIDRegex = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// loadProviders reads the [[provider]] tables from a config file
+func loadProviders(path string) ([]ProviderOptions, error) {
+	var cfg struct {
+		Providers []ProviderOptions `toml:"provider"`
+	}
+	_, err := toml.DecodeFile(path, &cfg)
+	return cfg.Providers, err
+}
+
+// options returns a copy of base with the provider's settings in place of
+// the top level provider's. Endpoints and scope aren't inherited, as they
+// belong to the top level provider. Providers without a logout endpoint
+// simply skip provider-logout.
+func (p ProviderOptions) options(base Options) *Options {
+	o := &base
+	o.Provider = p.Provider
+	o.ClientID = p.ClientID
+	o.ClientSecret = p.ClientSecret
+	o.OIDCIssuerURL = p.OIDCIssuerURL
+	o.LoginURL = p.LoginURL
+	o.RedeemURL = p.RedeemURL
+	o.ProfileURL = p.ProfileURL
+	o.ValidateURL = p.ValidateURL
+	o.LogoutURL = ""
+	o.ProtectedResource = ""
+	o.Scope = p.Scope
+	o.KeycloakRoles = nil
+	o.ProviderLogout = false
+	return o
+}
+
+func parseSignInProviders(o *Options, base Options, msgs []string) []string {
+	o.signInProviders = nil
+	ids := make(map[string]int)
+	for i, p := range o.Providers {
+		name := fmt.Sprintf("provider[%d]", i)
+		if !providerIDRegex.MatchString(p.ID) {
+			msgs = append(msgs, fmt.Sprintf(
+				"%s id must be lower case letters, digits, - and _: %q", name, p.ID))
+			continue
+		}
+		if j, ok := ids[p.ID]; ok {
+			msgs = append(msgs, fmt.Sprintf(
+				"%s id %q is already used by provider[%d]", name, p.ID, j))
+			continue
+		}
+		ids[p.ID] = i
+		if p.ClientID == "" {
+			msgs = append(msgs, fmt.Sprintf("%s missing setting: client_id", name))
+		}
+		if p.ClientSecret == "" && p.Provider != "login.gov" {
+			msgs = append(msgs, fmt.Sprintf("%s missing setting: client_secret", name))
+		}
+
+		po := p.options(base)
+		providerMsgs := parseProviderInfo(po, nil)
+		for _, msg := range providerMsgs {
+			msgs = append(msgs, name+" "+msg)
+		}
+		if len(providerMsgs) != 0 {
+			continue
+		}
+		sp := &signInProvider{id: p.ID, name: p.Name, provider: po.provider}
+		if sp.name == "" {
+			sp.name = po.provider.Data().ProviderName
+		}
+		if len(p.EmailDomains) != 0 {
+			sp.validator = NewValidator(append([]string(nil), p.EmailDomains...), "")
+		}
+		o.signInProviders = append(o.signInProviders, sp)
+	}
+	return msgs
+}
+
+// signInProvider returns the provider with the given id, the default
+// provider for an empty id, or nil if there is none
+func (p *OAuthProxy) signInProvider(id string) *signInProvider {
+	if id == "" {
+		return &signInProvider{provider: p.provider, validator: p.Validator}
+	}
+	for _, sp := range p.signInProviders {
+		if sp.id == id {
+			if sp.validator == nil {
+				return &signInProvider{sp.id, sp.name, sp.provider, p.Validator}
+			}
+			return sp
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestSignInProvidersOptions(t *testing.T) {
+	o := testOptions()
+	o.Providers = []ProviderOptions{
+		{ID: "github", Name: "GitHub (contractors)", Provider: "github",
+			ClientID: "gh-client", ClientSecret: "gh-secret", EmailDomains: []string{"contractors.example.com"}},
+		{ID: "linkedin", Provider: "linkedin", ClientID: "li-client", ClientSecret: "li-secret"},
+	}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.signInProviders))
+	assert.Equal(t, "GitHub (contractors)", o.signInProviders[0].name)
+	assert.Equal(t, "gh-client", o.signInProviders[0].provider.Data().ClientID)
+	assert.Equal(t, true, o.signInProviders[0].validator("alice@contractors.example.com"))
+	assert.Equal(t, false, o.signInProviders[0].validator("alice@example.com"))
+	assert.Equal(t, "LinkedIn", o.signInProviders[1].name)
+	assert.Equal(t, (func(string) bool)(nil), o.signInProviders[1].validator)
+}
+
+func TestInvalidSignInProviders(t *testing.T) {
+	o := testOptions()
+	o.Providers = []ProviderOptions{
+		{ID: "GitHub", Provider: "github", ClientID: "a", ClientSecret: "b"},
+		{ID: "github", Provider: "github"},
+		{ID: "github", Provider: "github", ClientID: "a", ClientSecret: "b"},
+	}
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`provider[0] id must be lower case letters, digits, - and _: "GitHub"`,
+		"provider[1] missing setting: client_id",
+		"provider[1] missing setting: client_secret",
+		`provider[2] id "github" is already used by provider[1]`,
+	}), err.Error())
+}
+
+// newMultiProviderTest returns a proxy whose default provider signs in
+// employee@example.com and whose "contractors" provider signs in the given
+// email, restricted to the contractors.example.com domain
+func newMultiProviderTest(t *testing.T, contractor string) (*OAuthProxy, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	providerURL, _ := url.Parse(server.URL)
+
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	opts.provider = NewTestProvider(providerURL, "employee@example.com")
+	contractors := NewTestProvider(providerURL, contractor)
+	contractors.ProviderName = "Contractor SSO"
+	opts.signInProviders = []*signInProvider{{
+		id:        "contractors",
+		name:      "Contractor SSO",
+		provider:  contractors,
+		validator: NewValidator([]string{"contractors.example.com"}, ""),
+	}}
+	proxy := NewOAuthProxy(opts, func(email string) bool {
+		return strings.HasSuffix(email, "@example.com")
+	})
+	return proxy, server.Close
+}
+
+func TestSignInPageListsProviders(t *testing.T) {
+	proxy, done := newMultiProviderTest(t, "bob@contractors.example.com")
+	defer done()
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	proxy.ServeHTTP(rw, req)
+	body := rw.Body.String()
+	assert.Equal(t, true, strings.Contains(body, "Sign in with a Test Provider Account"))
+	assert.Equal(t, true, strings.Contains(body, `<input type="hidden" name="provider" value="contractors">`))
+	assert.Equal(t, true, strings.Contains(body, "Sign in with a Contractor SSO Account"))
+}
+
+func TestOAuthStartWithProvider(t *testing.T) {
+	proxy, done := newMultiProviderTest(t, "bob@contractors.example.com")
+	defer done()
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?provider=contractors&rd=/docs", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	_, _, providerID := parseCSRFCookieValue(rw.Result().Cookies()[0].Value)
+	assert.Equal(t, "contractors", providerID)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/start?provider=unknown", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 400, rw.Code)
+}
+
+func multiProviderCallback(proxy *OAuthProxy, providerID string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	c := proxy.MakeCSRFCookie(req, csrfCookieValue("nonce", "", providerID), proxy.CookieExpire, time.Now())
+	req.AddCookie(c)
+	proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestCallbackRecordsProvider(t *testing.T) {
+	proxy, done := newMultiProviderTest(t, "bob@contractors.example.com")
+	defer done()
+
+	rw := multiProviderCallback(proxy, "contractors")
+	assert.Equal(t, 302, rw.Code)
+	var session *providers.SessionState
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == proxy.CookieName {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.AddCookie(c)
+			session, _, _ = proxy.LoadCookiedSession(req)
+		}
+	}
+	assert.NotEqual(t, (*providers.SessionState)(nil), session)
+	assert.Equal(t, "bob@contractors.example.com", session.Email)
+	assert.Equal(t, "contractors", session.Provider)
+}
+
+func TestCallbackAppliesProviderEmailDomains(t *testing.T) {
+	// allowed by the top level validator, but not by the provider's domains
+	proxy, done := newMultiProviderTest(t, "bob@example.com")
+	defer done()
+
+	rw := multiProviderCallback(proxy, "contractors")
+	assert.Equal(t, 403, rw.Code)
+
+	rw = multiProviderCallback(proxy, "removed")
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestSessionFromRemovedProvider(t *testing.T) {
+	proxy, done := newMultiProviderTest(t, "bob@contractors.example.com")
+	defer done()
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	proxy.SaveSession(rw, req, &providers.SessionState{
+		Email: "bob@contractors.example.com", Provider: "removed"})
+	req.AddCookie(rw.Result().Cookies()[0])
+	assert.Equal(t, http.StatusForbidden, proxy.Authenticate(httptest.NewRecorder(), req))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	proxy.SaveSession(rw, req, &providers.SessionState{
+		Email: "bob@contractors.example.com", Provider: "contractors"})
+	req.AddCookie(rw.Result().Cookies()[0])
+	assert.Equal(t, http.StatusAccepted, proxy.Authenticate(httptest.NewRecorder(), req))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// parseStreamContentTypes checks the stream-content-type media types, which
+// are either type/subtype or type/*
+func parseStreamContentTypes(o *Options, msgs []string) []string {
+	o.streamContentTypes = nil
+	for _, t := range o.StreamContentTypes {
+		mediaType, _, err := mime.ParseMediaType(t)
+		if err != nil || !strings.Contains(mediaType, "/") {
+			msgs = append(msgs, fmt.Sprintf(
+				"stream-content-type must be a media type such as application/x-ndjson or text/*: %q", t))
+			continue
+		}
+		o.streamContentTypes = append(o.streamContentTypes, mediaType)
+	}
+	if o.FlushInterval < 0 {
+		msgs = append(msgs, "flush-interval must not be negative")
+	}
+	return msgs
+}
+
+// isStreamContentType reports whether a Content-Type header matches one of
+// the stream-content-type media types
+func isStreamContentType(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if t == mediaType ||
+			(strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamResponses flushes each write of responses from h with one of types
+// straight to the client, instead of buffering them. gRPC responses are
+// always streamed, as are server-sent events (text/event-stream) by the
+// reverse proxy.
+func streamResponses(h http.Handler, types []string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(&streamingResponseWriter{ResponseWriter: rw, types: types}, req)
+	})
+}
+
+type streamingResponseWriter struct {
+	http.ResponseWriter
+	types     []string
+	streaming bool
+}
+
+func (w *streamingResponseWriter) WriteHeader(code int) {
+	contentType := w.Header().Get("Content-Type")
+	w.streaming = isGRPCContentType(contentType) || isStreamContentType(contentType, w.types)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *streamingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if w.streaming {
+		w.Flush()
+	}
+	return n, err
+}
+
+func (w *streamingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
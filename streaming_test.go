@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestParseStreamContentTypes(t *testing.T) {
+	o := testOptions()
+	o.StreamContentTypes = []string{"Application/X-NDJSON", "text/*", "ndjson"}
+	o.FlushInterval = -time.Second
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"stream-content-type must be a media type such as application/x-ndjson or text/*: \"ndjson\"",
+		"flush-interval must not be negative"}),
+		err.Error())
+	assert.Equal(t, []string{"application/x-ndjson", "text/*"}, o.streamContentTypes)
+}
+
+func TestIsStreamContentType(t *testing.T) {
+	types := []string{"application/x-ndjson", "text/*"}
+	assert.Equal(t, true, isStreamContentType("application/x-ndjson; charset=utf-8", types))
+	assert.Equal(t, true, isStreamContentType("text/plain", types))
+	assert.Equal(t, false, isStreamContentType("application/json", types))
+	assert.Equal(t, false, isStreamContentType("textual/plain", types))
+	assert.Equal(t, false, isStreamContentType("", types))
+}
+
+func TestStreamContentTypeFlushesWrites(t *testing.T) {
+	release := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		// a length, so that the reverse proxy doesn't flush by itself
+		w.Header().Set("Content-Length", "22")
+		w.Write([]byte("{\"n\":1}\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("{\"n\":2}\n{\"n\":3}\n"))
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"^/"}
+	opts.StreamContentTypes = []string{"application/x-ndjson"}
+	assert.Equal(t, nil, opts.Validate())
+	frontend := httptest.NewServer(LoggingHandler(NewOAuthProxy(opts, func(string) bool { return true })))
+	defer frontend.Close()
+
+	defer close(release)
+	lines := make(chan string, 1)
+	go func() {
+		res, err := http.Get(frontend.URL + "/events")
+		if err != nil {
+			lines <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		line, _ := bufio.NewReader(res.Body).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		assert.Equal(t, "{\"n\":1}\n", line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first line was not streamed to the client")
+	}
+}
@@ -3,27 +3,65 @@ package main
 import (
 	"html/template"
 	"log"
+	"os"
 	"path"
 )
 
+// pageBranding holds the values the sign in and error pages share, so that
+// custom templates can match the rest of a site
+type pageBranding struct {
+	AppName     string
+	LogoURL     string
+	Footer      template.HTML
+	Version     string
+	ProxyPrefix string
+	StaticPath  string
+}
+
+// loadTemplates returns the built in templates, replaced by sign_in.html,
+// error.html, sessions.html and maintenance.html from dir for those that it
+// has
 func loadTemplates(dir string) *template.Template {
+	t := getTemplates()
 	if dir == "" {
-		return getTemplates()
+		return t
 	}
 	log.Printf("using custom template directory %q", dir)
-	t, err := template.New("").ParseFiles(path.Join(dir, "sign_in.html"), path.Join(dir, "error.html"))
+	var files []string
+	for _, name := range []string{"sign_in.html", "error.html", "sessions.html", "maintenance.html"} {
+		if _, err := os.Stat(path.Join(dir, name)); err == nil {
+			files = append(files, path.Join(dir, name))
+		}
+	}
+	if len(files) == 0 {
+		log.Fatalf("failed parsing template: no sign_in.html, error.html, sessions.html or maintenance.html in %s", dir)
+	}
+	t, err := t.ParseFiles(files...)
 	if err != nil {
 		log.Fatalf("failed parsing template %s", err)
 	}
 	return t
 }
 
+// staticDir is the directory of assets for custom templates, served at
+// {{.StaticPath}}, or "" when there isn't one
+func staticDir(templatesDir string) string {
+	if templatesDir == "" {
+		return ""
+	}
+	dir := path.Join(templatesDir, "static")
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return ""
+	}
+	return dir
+}
+
 func getTemplates() *template.Template {
 	t, err := template.New("foo").Parse(`{{define "sign_in.html"}}
 <!DOCTYPE html>
 <html lang="en" charset="utf-8">
 <head>
-	<title>Sign In</title>
+	<title>{{ if .AppName }}{{.AppName}}{{ else }}Sign In{{ end }}</title>
 	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
 	<style>
 	body {
@@ -45,6 +83,11 @@ func getTemplates() *template.Template {
 	.center {
 		text-align:center;
 	}
+	.logo {
+		max-width:100%;
+		max-height:80px;
+		margin-bottom:10px;
+	}
 	.btn {
 		color: #fff;
 		background-color: #428bca;
@@ -110,13 +153,26 @@ func getTemplates() *template.Template {
 </head>
 <body>
 	<div class="signin center">
+	{{ if .LogoURL }}
+	<img class="logo" src="{{.LogoURL}}" alt="{{.AppName}}"><br/>
+	{{ end }}
+	{{ if .AppName }}
+	<h2>{{.AppName}}</h2>
+	{{ end }}
 	<form method="GET" action="{{.ProxyPrefix}}/start">
 	<input type="hidden" name="rd" value="{{.Redirect}}">
 	{{ if .SignInMessage }}
 	<p>{{.SignInMessage}}</p>
 	{{ end}}
-	<button type="submit" class="btn">Sign in with a {{.ProviderName}} Account</button><br/>
+	<button type="submit" class="btn">{{ if .ProviderButtonText }}{{.ProviderButtonText}}{{ else }}Sign in with a {{.ProviderName}} Account{{ end }}</button><br/>
+	</form>
+	{{ range .Providers }}
+	<form method="GET" action="{{$.ProxyPrefix}}/start">
+	<input type="hidden" name="rd" value="{{$.Redirect}}">
+	<input type="hidden" name="provider" value="{{.ID}}">
+	<button type="submit" class="btn">Sign in with a {{.Name}} Account</button><br/>
 	</form>
+	{{ end }}
 	</div>
 
 	{{ if .CustomLogin }}
@@ -162,11 +218,75 @@ func getTemplates() *template.Template {
 	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
 </head>
 <body>
+	{{ if .LogoURL }}
+	<img src="{{.LogoURL}}" alt="{{.AppName}}" style="max-height:80px">
+	{{ end }}
 	<h2>{{.Title}}</h2>
 	<p>{{.Message}}</p>
+	{{ if .RequestID }}<p><small>Request ID: {{.RequestID}}</small></p>{{ end }}
 	<hr>
 	<p><a href="{{.ProxyPrefix}}/sign_in">Sign In</a></p>
 </body>
+</html>{{end}}`)
+	if err != nil {
+		log.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "sessions.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>Sessions</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+</head>
+<body>
+	{{ if .LogoURL }}
+	<img src="{{.LogoURL}}" alt="{{.AppName}}" style="max-height:80px">
+	{{ end }}
+	<h2>Sessions for {{.User}}</h2>
+	<table>
+	<tr><th>Signed in</th><th>Last seen</th><th>Address</th><th>Browser</th><th></th></tr>
+	{{ range .Sessions }}
+	<tr>
+		<td>{{.CreatedAt.Format "2006-01-02 15:04 MST"}}</td>
+		<td>{{.LastSeen.Format "2006-01-02 15:04 MST"}}</td>
+		<td>{{.RemoteAddr}}</td>
+		<td>{{.UserAgent}}</td>
+		<td>{{ if .Current }}This session{{ else }}
+		<form method="POST" action="{{$.Action}}">
+			<input type="hidden" name="csrf" value="{{$.CSRF}}">
+			<button type="submit" name="revoke" value="{{.ID}}">Sign out</button>
+		</form>
+		{{ end }}</td>
+	</tr>
+	{{ end }}
+	</table>
+	<form method="POST" action="{{.Action}}">
+		<input type="hidden" name="csrf" value="{{.CSRF}}">
+		<button type="submit" name="revoke" value="others">Sign out all other sessions</button>
+	</form>
+	<hr>
+	<p><a href="{{.ProxyPrefix}}/sign_out">Sign Out</a></p>
+</body>
+</html>{{end}}`)
+	if err != nil {
+		log.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "maintenance.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>{{ if .AppName }}{{.AppName}}{{ else }}Down for Maintenance{{ end }}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+</head>
+<body>
+	{{ if .LogoURL }}
+	<img src="{{.LogoURL}}" alt="{{.AppName}}" style="max-height:80px">
+	{{ end }}
+	<h2>Down for Maintenance</h2>
+	<p>{{.Message}}</p>
+</body>
 </html>{{end}}`)
 	if err != nil {
 		log.Fatalf("failed parsing template %s", err)
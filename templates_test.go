@@ -1,11 +1,56 @@
 package main
 
 import (
-	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/bmizerany/assert"
 )
 
 func TestTemplatesCompile(t *testing.T) {
 	templates := getTemplates()
 	assert.NotEqual(t, templates, nil)
 }
+
+func TestCustomTemplatesAndBranding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(dir, "error.html"),
+		[]byte(`{{define "error.html"}}{{.AppName}}: {{.Title}} <link href="{{.StaticPath}}/site.css">{{end}}`), 0644))
+	assert.Equal(t, nil, os.MkdirAll(filepath.Join(dir, "static"), 0755))
+	assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(dir, "static", "site.css"), []byte("body {}"), 0644))
+
+	opts := testOptions()
+	opts.CustomTemplatesDir = dir
+	opts.AppName = "Example Corp"
+	opts.LogoURL = "https://example.com/logo.png"
+	opts.ProviderButtonText = "Sign in with Example SSO"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	// the built in sign_in.html is kept, with the branding
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	body := rw.Body.String()
+	assert.Equal(t, true, strings.Contains(body, "<title>Example Corp</title>"))
+	assert.Equal(t, true, strings.Contains(body, `<img class="logo" src="https://example.com/logo.png"`))
+	assert.Equal(t, true, strings.Contains(body, ">Sign in with Example SSO</button>"))
+
+	rw = httptest.NewRecorder()
+	proxy.ErrorPage(rw, req, 500, "Internal Error", "oops")
+	assert.Equal(t, `Example Corp: 500 Internal Error <link href="/oauth2/static/site.css">`, rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/static/site.css", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "body {}", rw.Body.String())
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/bitly/oauth2_proxy"
+
+// tracerShutdownTimeout limits how long exporting the remaining spans may
+// take when a tracer provider is shut down
+const tracerShutdownTimeout = 5 * time.Second
+
+// tracersRunning counts the tracer providers that haven't been shut down
+// yet, so that their spans are exported before the proxy exits
+var tracersRunning sync.WaitGroup
+
+// traces are continued from and passed on with W3C traceparent headers
+var tracePropagator = propagation.TraceContext{}
+
+// newTracerProvider exports spans over OTLP/HTTP to endpoint, sampling
+// sampleRate of new traces. Requests that arrive as part of a trace follow
+// the caller's sampling decision. An endpoint without a path is sent to the
+// standard /v1/traces.
+func newTracerProvider(endpoint string, sampleRate float64) (*sdktrace.TracerProvider, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRate))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "oauth2_proxy"),
+			attribute.String("service.version", VERSION),
+		)),
+	), nil
+}
+
+// shutdownTracerOnDone shuts tp down once done is closed, exporting the
+// spans it still holds
+func shutdownTracerOnDone(tp *sdktrace.TracerProvider, done <-chan bool) {
+	tracersRunning.Add(1)
+	go func() {
+		defer tracersRunning.Done()
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), tracerShutdownTimeout)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			log.Printf("error shutting down tracing: %s", err)
+		}
+	}()
+}
+
+type tracingHandler struct {
+	handler http.Handler
+	tracer  trace.Tracer
+}
+
+// TracingHandler records a span for each request served by h
+func TracingHandler(tp trace.TracerProvider, h http.Handler) http.Handler {
+	return tracingHandler{handler: h, tracer: tp.Tracer(tracerName)}
+}
+
+func (h tracingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := tracePropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := h.tracer.Start(ctx, req.Method+" "+req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.path", req.URL.Path),
+			attribute.String("server.address", req.Host),
+			attribute.String("client.address", req.RemoteAddr),
+		))
+	defer span.End()
+
+	recorder := &statusRecorder{ResponseWriter: w}
+	h.handler.ServeHTTP(recorder, req.WithContext(ctx))
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, strconv.Itoa(status))
+	}
+}
+
+// startUpstreamSpan records a span for a request to an upstream, and sets
+// the traceparent header so that the upstream continues the trace. Without
+// tracing the span does nothing and the header is left as the client sent
+// it.
+func startUpstreamSpan(req *http.Request, upstream string) (*http.Request, trace.Span) {
+	span := trace.SpanFromContext(req.Context())
+	if !span.SpanContext().IsValid() {
+		return req, span
+	}
+	ctx, span := span.TracerProvider().Tracer(tracerName).Start(req.Context(), "upstream "+upstream,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("oauth2_proxy.upstream", upstream)))
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req.WithContext(ctx), span
+}
+
+// authOutcome describes the status returned by Authenticate for spans
+func authOutcome(status int) string {
+	switch status {
+	case http.StatusAccepted:
+		return "authenticated"
+	case http.StatusForbidden:
+		return "unauthenticated"
+	case statusPolicyDenied:
+		return "denied"
+	case statusQuotaExceeded:
+		return "over_quota"
+	case statusMaintenance:
+		return "maintenance"
+	default:
+		return "error"
+	}
+}
+
+// traceAuthentication tags the request's span with the provider and the
+// outcome of authenticating it, or "skipped" for requests that don't
+// require it
+func (p *OAuthProxy) traceAuthentication(req *http.Request, outcome string) {
+	span := trace.SpanFromContext(req.Context())
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(
+		attribute.String("oauth2_proxy.provider", p.provider.Data().ProviderName),
+		attribute.String("oauth2_proxy.auth", outcome),
+	)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) string {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTracingHandler(t *testing.T) {
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("Traceparent")
+		w.Write([]byte("response"))
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"^/public"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	handler := TracingHandler(tp, proxy)
+
+	// a request that is part of a trace is traced to the upstream
+	req, _ := http.NewRequest("GET", "/public/index.html", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+
+	spans := recorder.Ended()
+	assert.Equal(t, 2, len(spans))
+	upstreamSpan, serverSpan := spans[0], spans[1]
+	assert.Equal(t, trace.SpanKindServer, serverSpan.SpanKind())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", serverSpan.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", serverSpan.Parent().SpanID().String())
+	assert.Equal(t, "skipped", spanAttribute(serverSpan, "oauth2_proxy.auth"))
+	assert.Equal(t, "Google", spanAttribute(serverSpan, "oauth2_proxy.provider"))
+	assert.Equal(t, "200", spanAttribute(serverSpan, "http.response.status_code"))
+
+	assert.Equal(t, trace.SpanKindClient, upstreamSpan.SpanKind())
+	assert.Equal(t, serverSpan.SpanContext().SpanID(), upstreamSpan.Parent().SpanID())
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+
+		upstreamSpan.SpanContext().SpanID().String()+"-01", upstreamTraceparent)
+
+	// requests without a session aren't proxied
+	req, _ = http.NewRequest("GET", "/private", nil)
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	spans = recorder.Ended()
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, "unauthenticated", spanAttribute(spans[2], "oauth2_proxy.auth"))
+}
+
+func TestTracingOptions(t *testing.T) {
+	o := testOptions()
+	o.TracingEndpoint = "localhost:4318"
+	o.TracingSampleRate = 1.5
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"tracing-endpoint must be an http or https URL: \"localhost:4318\"",
+		"tracing-sample-rate must be between 0 and 1: 1.5"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestShutdownTracerOnDone(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	done := make(chan bool)
+	shutdownTracerOnDone(tp, done)
+
+	_, span := tp.Tracer(tracerName).Start(context.Background(), "before")
+	assert.Equal(t, true, span.IsRecording())
+	span.End()
+
+	close(done)
+	tracersRunning.Wait()
+	_, span = tp.Tracer(tracerName).Start(context.Background(), "after")
+	assert.Equal(t, false, span.IsRecording())
+	assert.Equal(t, 1, len(recorder.Ended()))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// parseAPIRoutes compiles the api-route regexes, for paths that get a 401
+// rather than the sign in page
+func parseAPIRoutes(o *Options, msgs []string) []string {
+	o.apiRoutes = nil
+	for _, r := range o.APIRoutes {
+		regex, err := regexp.Compile(r)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"error compiling api-route=%q %s", r, err))
+			continue
+		}
+		o.apiRoutes = append(o.apiRoutes, regex)
+	}
+	return msgs
+}
+
+// isAPIRequest reports whether an unauthenticated request should get a 401
+// instead of being sent to sign in: its path matches an api-route, it was
+// made with XMLHttpRequest or gRPC, or the client accepts JSON but not HTML.
+func (p *OAuthProxy) isAPIRequest(req *http.Request) bool {
+	for _, r := range p.apiRoutes {
+		if r.MatchString(req.URL.Path) {
+			return true
+		}
+	}
+	if req.Header.Get("X-Requested-With") == "XMLHttpRequest" || isGRPCRequest(req) {
+		return true
+	}
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") &&
+		!strings.Contains(accept, "text/html")
+}
+
+// Unauthorized responds to API clients that need to sign in with a 401 and
+// a JSON body giving the sign in URL, which returns to the request
+// afterwards
+func (p *OAuthProxy) Unauthorized(rw http.ResponseWriter, req *http.Request) {
+	rd := req.URL.RequestURI()
+	if req.Header.Get("X-Auth-Request-Redirect") != "" {
+		rd = req.Header.Get("X-Auth-Request-Redirect")
+	}
+	body := struct {
+		Error     string `json:"error"`
+		SignInURL string `json:"sign_in_url"`
+	}{
+		Error:     "unauthorized",
+		SignInURL: p.SignInPath + "?rd=" + url.QueryEscape(rd),
+	}
+	rw.Header().Set("WWW-Authenticate", `Bearer realm="oauth2_proxy"`)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(rw).Encode(body)
+}
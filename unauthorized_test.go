@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestParseAPIRoutes(t *testing.T) {
+	o := testOptions()
+	o.APIRoutes = []string{"^/api/", "(foo"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"error compiling api-route=\"(foo\" error parsing regexp: missing closing ): `(foo`"}),
+		err.Error())
+	assert.Equal(t, 1, len(o.apiRoutes))
+}
+
+func TestUnauthenticatedResponse(t *testing.T) {
+	opts := testOptions()
+	opts.APIRoutes = []string{"^/api/"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	tests := []struct {
+		path   string
+		header string
+		value  string
+		code   int
+	}{
+		{"/dashboard", "Accept", "text/html,application/xhtml+xml,*/*;q=0.8", 403},
+		{"/dashboard", "", "", 403},
+		{"/dashboard", "Accept", "application/json", 401},
+		{"/dashboard", "Accept", "application/json, text/html", 403},
+		{"/dashboard", "X-Requested-With", "XMLHttpRequest", 401},
+		{"/api/items", "Accept", "text/html", 401},
+	}
+	for _, tc := range tests {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, tc.code, rw.Code)
+		if tc.code != 401 {
+			continue
+		}
+		assert.Equal(t, `Bearer realm="oauth2_proxy"`, rw.HeaderMap.Get("WWW-Authenticate"))
+		assert.Equal(t, "application/json", rw.HeaderMap.Get("Content-Type"))
+		var body map[string]string
+		assert.Equal(t, nil, json.NewDecoder(rw.Body).Decode(&body))
+		assert.Equal(t, "unauthorized", body["error"])
+		assert.Equal(t, "/oauth2/sign_in?rd="+url.QueryEscape(tc.path), body["sign_in_url"])
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kubernetesServiceAccountDir holds the credentials of a pod's service
+// account
+var kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// upstreamResolver finds the current endpoints (host:port) of a discovered
+// upstream
+type upstreamResolver interface {
+	// watch calls update with the endpoints whenever they change, until done
+	// is closed
+	watch(done <-chan bool, update func([]string))
+}
+
+// upstreamDiscovery is an upstream like srv://_http._tcp.app.example.com/
+// or k8s://app.namespace/, whose endpoints are discovered at runtime and
+// proxied to as a pool
+type upstreamDiscovery struct {
+	source   *url.URL
+	target   url.URL
+	resolver upstreamResolver
+	build    func(target url.URL) (*UpstreamProxy, *httputil.ReverseProxy)
+}
+
+// isDiscoveryScheme reports whether an upstream's endpoints are discovered:
+// srv:// and k8s://, or srv+https:// etc. to proxy to them with a scheme
+// other than http
+func isDiscoveryScheme(scheme string) bool {
+	kind := strings.SplitN(scheme, "+", 2)[0]
+	return kind == "srv" || kind == "k8s"
+}
+
+// newUpstreamDiscovery returns the discovery of an srv:// or k8s://
+// upstream. It makes no requests; endpoints are looked up once watched.
+func newUpstreamDiscovery(o *Options, u *url.URL) (*upstreamDiscovery, error) {
+	parts := strings.SplitN(u.Scheme, "+", 2)
+	d := &upstreamDiscovery{source: u, target: url.URL{Scheme: "http"}}
+	if len(parts) == 2 {
+		d.target.Scheme = parts[1]
+	}
+	switch d.target.Scheme {
+	case "http", "https", "h2c":
+	default:
+		return nil, fmt.Errorf("%s upstreams are proxied to with http, https or h2c, not %q", parts[0], d.target.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing %s upstream name", parts[0])
+	}
+
+	if parts[0] == "srv" {
+		if u.Port() != "" {
+			return nil, errors.New("srv upstreams take their ports from the SRV records")
+		}
+		d.resolver = &srvResolver{name: u.Hostname(), interval: o.UpstreamDiscoveryInterval, lookup: net.LookupSRV}
+		return d, nil
+	}
+
+	if o.kubernetesAPI == nil {
+		api, err := newKubernetesAPI(o.KubernetesAPIURL)
+		if err != nil {
+			return nil, err
+		}
+		o.kubernetesAPI = api
+	}
+	r := &kubernetesResolver{
+		api:      o.kubernetesAPI,
+		service:  u.Hostname(),
+		port:     u.Port(),
+		interval: o.UpstreamDiscoveryInterval,
+	}
+	if i := strings.Index(r.service, "."); i != -1 {
+		r.service, r.namespace = r.service[:i], r.service[i+1:]
+	}
+	if r.namespace == "" {
+		r.namespace = o.kubernetesAPI.namespace
+	}
+	if name := u.Query().Get("port"); name != "" {
+		if r.port != "" {
+			return nil, errors.New("k8s upstreams select a port by number or by name, not both")
+		}
+		r.port = name
+	}
+	d.resolver = r
+	return d, nil
+}
+
+// parseDiscoveryURL checks an srv:// or k8s:// upstream
+func parseDiscoveryURL(o *Options, u *url.URL, name string, msgs []string) []string {
+	if _, err := newUpstreamDiscovery(o, u); err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid %s=%q %s", name, u, err))
+	}
+	return msgs
+}
+
+func parseUpstreamDiscovery(o *Options, msgs []string) []string {
+	o.kubernetesAPI = nil
+	if o.UpstreamDiscoveryInterval <= 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"upstream-discovery-interval must be positive: %s", o.UpstreamDiscoveryInterval))
+	}
+	return msgs
+}
+
+// newDiscoveredUpstreamPool returns a pool with no upstreams, which are
+// added as they are discovered once CheckUpstreams is called
+func newDiscoveredUpstreamPool(d *upstreamDiscovery, failover bool, check healthCheck) *upstreamPool {
+	return &upstreamPool{failover: failover, check: check, discovery: d}
+}
+
+// setEndpoints replaces the upstreams of a discovered pool. Upstreams that
+// remain keep their health.
+func (p *upstreamPool) setEndpoints(endpoints []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	existing := make(map[string]*upstreamBackend)
+	for _, b := range p.backends {
+		existing[b.handler.upstream.Host] = b
+	}
+	var backends []*upstreamBackend
+	changed := len(endpoints) != len(p.backends)
+	for i, endpoint := range endpoints {
+		b, ok := existing[endpoint]
+		if !ok {
+			target := p.discovery.target
+			target.Host = endpoint
+			up, proxy := p.discovery.build(target)
+			b = p.newBackend(up, proxy)
+			if p.check.path != "" {
+				go b.check()
+			}
+		}
+		delete(existing, endpoint)
+		changed = changed || b != p.backends[i]
+		backends = append(backends, b)
+	}
+	p.backends = backends
+	if changed {
+		log.Printf("upstream %q resolved to %s", p.discovery.source, strings.Join(endpoints, ", "))
+	}
+}
+
+// discover keeps the pool's upstreams up to date until done is closed
+func (p *upstreamPool) discover(done <-chan bool) {
+	p.discovery.resolver.watch(done, func(endpoints []string) {
+		p.setEndpoints(uniqueEndpoints(endpoints))
+	})
+}
+
+func uniqueEndpoints(endpoints []string) []string {
+	seen := make(map[string]bool)
+	unique := endpoints[:0]
+	for _, e := range endpoints {
+		if !seen[e] {
+			seen[e] = true
+			unique = append(unique, e)
+		}
+	}
+	return unique
+}
+
+// srvResolver looks up the SRV records of name every interval. Targets are
+// ordered by priority, which failover load balancing follows, then by
+// weight. When a lookup fails, the previous targets are kept.
+type srvResolver struct {
+	name     string
+	interval time.Duration
+	lookup   func(service, proto, name string) (string, []*net.SRV, error)
+}
+
+func (r *srvResolver) resolve() ([]string, error) {
+	_, records, err := r.lookup("", "", r.name)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Priority != records[j].Priority {
+			return records[i].Priority < records[j].Priority
+		}
+		return records[i].Weight > records[j].Weight
+	})
+	var endpoints []string
+	for _, srv := range records {
+		host := strings.TrimSuffix(srv.Target, ".")
+		endpoints = append(endpoints, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+	}
+	return endpoints, nil
+}
+
+func (r *srvResolver) watch(done <-chan bool, update func([]string)) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if endpoints, err := r.resolve(); err != nil {
+			log.Printf("error looking up SRV records for %q: %s", r.name, err)
+		} else {
+			update(endpoints)
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// kubernetesAPI makes requests to the Kubernetes API server, by default as
+// the pod's service account
+type kubernetesAPI struct {
+	url       *url.URL
+	client    *http.Client
+	tokenFile string
+	namespace string
+}
+
+// newKubernetesAPI returns a client of the API server at apiURL, or of the
+// cluster the proxy is running in when it is ""
+func newKubernetesAPI(apiURL string) (*kubernetesAPI, error) {
+	api := &kubernetesAPI{client: &http.Client{}, namespace: "default"}
+	if ns, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "namespace")); err == nil {
+		api.namespace = strings.TrimSpace(string(ns))
+	}
+	if apiURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("k8s upstreams require kubernetes-api-url when not running in a Kubernetes pod")
+		}
+		apiURL = "https://" + net.JoinHostPort(host, port)
+		api.tokenFile = filepath.Join(kubernetesServiceAccountDir, "token")
+		pem, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "ca.crt"))
+		if err != nil {
+			return nil, fmt.Errorf("error loading the service account CA %s", err)
+		}
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(pem)
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		api.client.Transport = transport
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid kubernetes-api-url=%q", apiURL)
+	}
+	api.url = u
+	return api, nil
+}
+
+// get requests an API path. The service account token is read for each
+// request, as the kubelet rotates it.
+func (api *kubernetesAPI) get(ctx context.Context, path string, params url.Values) (*http.Response, error) {
+	u := *api.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if api.tokenFile != "" {
+		token, err := ioutil.ReadFile(api.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, u.String(), body)
+	}
+	return resp, nil
+}
+
+// kubernetesEndpoints is the part of a v1 Endpoints object that is used
+type kubernetesEndpoints struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// kubernetesResolver watches the endpoints of a service, which are the
+// addresses of its ready pods. port selects one of the service's ports by
+// number or name, and is otherwise its first.
+type kubernetesResolver struct {
+	api       *kubernetesAPI
+	namespace string
+	service   string
+	port      string
+	interval  time.Duration
+}
+
+func (r *kubernetesResolver) path() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/endpoints", url.PathEscape(r.namespace))
+}
+
+// endpoints returns the ready addresses of the service on the selected port
+func (r *kubernetesResolver) endpoints(e *kubernetesEndpoints) []string {
+	var endpoints []string
+	for _, subset := range e.Subsets {
+		for i, port := range subset.Ports {
+			if (r.port == "" && i == 0) || r.port == port.Name || r.port == strconv.Itoa(port.Port) {
+				for _, address := range subset.Addresses {
+					endpoints = append(endpoints, net.JoinHostPort(address.IP, strconv.Itoa(port.Port)))
+				}
+				break
+			}
+		}
+	}
+	sort.Strings(endpoints)
+	return endpoints
+}
+
+// list returns the service's endpoints, and the resource version to watch
+// for changes from
+func (r *kubernetesResolver) list(ctx context.Context) ([]string, string, error) {
+	resp, err := r.api.get(ctx, r.path()+"/"+url.PathEscape(r.service), url.Values{})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var e kubernetesEndpoints
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return nil, "", err
+	}
+	return r.endpoints(&e), e.Metadata.ResourceVersion, nil
+}
+
+// watchFrom calls update as the service's endpoints change after version,
+// until the API server ends the watch or ctx is cancelled
+func (r *kubernetesResolver) watchFrom(ctx context.Context, version string, update func([]string)) error {
+	resp, err := r.api.get(ctx, r.path(), url.Values{
+		"watch":           {"true"},
+		"resourceVersion": {version},
+		"fieldSelector":   {"metadata.name=" + r.service},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			var e kubernetesEndpoints
+			if err := json.Unmarshal(event.Object, &e); err != nil {
+				return err
+			}
+			update(r.endpoints(&e))
+		case "DELETED":
+			update(nil)
+		case "ERROR":
+			// most often the resource version has expired; list again
+			return fmt.Errorf("watch error %s", event.Object)
+		}
+	}
+}
+
+func (r *kubernetesResolver) watch(done <-chan bool, update func([]string)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+	name := r.namespace + "/" + r.service
+	for {
+		endpoints, version, err := r.list(ctx)
+		if err == nil {
+			update(endpoints)
+			err = r.watchFrom(ctx, version, update)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == io.EOF {
+			// the API server ended the watch; list again straight away
+			continue
+		}
+		log.Printf("error watching kubernetes endpoints %q: %s", name, err)
+		select {
+		case <-done:
+			return
+		case <-time.After(r.interval):
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestUpstreamDiscoveryOptions(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"srv+ftp://_ftp._tcp.example.com/ftp/",
+		"srv://_http._tcp.example.com:8080/srv/",
+		"k8s://app.default/",
+	}
+	o.UpstreamDiscoveryInterval = 0
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"upstream-discovery-interval must be positive: 0s",
+		`invalid upstream="srv+ftp://_ftp._tcp.example.com/ftp/" srv upstreams are proxied to with http, https or h2c, not "ftp"`,
+		`invalid upstream="srv://_http._tcp.example.com:8080/srv/" srv upstreams take their ports from the SRV records`,
+		`invalid upstream="k8s://app.default/" k8s upstreams require kubernetes-api-url when not running in a Kubernetes pod`,
+	}), err.Error())
+
+	o = testOptions()
+	o.KubernetesAPIURL = "http://127.0.0.1:8001"
+	o.Upstreams = []string{"k8s+https://app.web:8443/api/", "srv://_http._tcp.example.com"}
+	o.Routes = []RouteOptions{
+		{Path: "/a/", Upstream: "k8s://app/?port=http"},
+		{Path: "/b/", Upstreams: []string{"k8s://app/", "http://127.0.0.1:8080/"}},
+		{Path: "/c/", Upstream: "k8s://app:8080/?port=http"},
+	}
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"route[1] srv and k8s upstreams must be the route's only upstream",
+		`invalid route[2] upstream="k8s://app:8080/?port=http" k8s upstreams select a port by number or by name, not both`,
+	}), err.Error())
+	assert.Equal(t, "/api/", o.proxyURLs[0].Path)
+	assert.Equal(t, "/", o.proxyURLs[1].Path)
+
+	r := o.routes[0].discovery.resolver.(*kubernetesResolver)
+	assert.Equal(t, "default", r.namespace)
+	assert.Equal(t, "app", r.service)
+	assert.Equal(t, "http", r.port)
+	d, err := newUpstreamDiscovery(o, o.proxyURLs[0])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "https", d.target.Scheme)
+	assert.Equal(t, "web", d.resolver.(*kubernetesResolver).namespace)
+	assert.Equal(t, "8443", d.resolver.(*kubernetesResolver).port)
+}
+
+func TestSRVResolver(t *testing.T) {
+	r := &srvResolver{name: "_http._tcp.app.example.com", lookup: func(service, proto, name string) (string, []*net.SRV, error) {
+		assert.Equal(t, "_http._tcp.app.example.com", name)
+		return name, []*net.SRV{
+			{Target: "standby.example.com.", Port: 8080, Priority: 20, Weight: 10},
+			{Target: "b.example.com.", Port: 8081, Priority: 10, Weight: 5},
+			{Target: "a.example.com.", Port: 8080, Priority: 10, Weight: 10},
+		}, nil
+	}}
+	endpoints, err := r.resolve()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"a.example.com:8080", "b.example.com:8081", "standby.example.com:8080"}, endpoints)
+}
+
+// kubernetesEndpointsJSON returns an Endpoints object for the servers
+func kubernetesEndpointsJSON(version string, servers ...*httptest.Server) map[string]interface{} {
+	var addresses []map[string]string
+	port := 0
+	for _, s := range servers {
+		u, _ := url.Parse(s.URL)
+		addresses = append(addresses, map[string]string{"ip": u.Hostname()})
+		port, _ = strconv.Atoi(u.Port())
+	}
+	return map[string]interface{}{
+		"metadata": map[string]string{"resourceVersion": version},
+		"subsets": []map[string]interface{}{{
+			"addresses": addresses,
+			"ports": []map[string]interface{}{
+				{"name": "metrics", "port": 9090},
+				{"name": "http", "port": port},
+			},
+		}},
+	}
+}
+
+func TestKubernetesDiscoveredUpstream(t *testing.T) {
+	healthy := true
+	a := newPoolBackend("a", &healthy)
+	defer a.Close()
+	b := newPoolBackend("b", &healthy)
+	defer b.Close()
+
+	watching := make(chan bool)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/web/endpoints/app":
+			json.NewEncoder(w).Encode(kubernetesEndpointsJSON("1", a))
+		case "/api/v1/namespaces/web/endpoints":
+			assert.Equal(t, "true", r.URL.Query().Get("watch"))
+			assert.Equal(t, "1", r.URL.Query().Get("resourceVersion"))
+			assert.Equal(t, "metadata.name=app", r.URL.Query().Get("fieldSelector"))
+			select {
+			case <-watching:
+			case <-r.Context().Done():
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"type": "MODIFIED", "object": kubernetesEndpointsJSON("2", b),
+			})
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	opts := testOptions()
+	opts.Upstreams = nil
+	opts.SkipAuthRegex = []string{"/"}
+	opts.KubernetesAPIURL = api.URL
+	opts.Routes = []RouteOptions{{Upstream: "k8s://app.web/?port=http"}}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	// until the endpoints are listed there is nothing to proxy to
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+
+	done := make(chan bool)
+	defer close(done)
+	proxy.CheckUpstreams(done)
+	waitFor(t, func() bool { return poolResponse(proxy) == "a" })
+	close(watching)
+	waitFor(t, func() bool { return poolResponse(proxy) == "b" })
+}
+
+// waitFor polls until f returns true, failing the test after a few seconds
+func waitFor(t *testing.T, f func() bool) {
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// contentTypes are registered for static files when the system's MIME
+// tables, which minimal container images often lack, don't know them
+var contentTypes = map[string]string{
+	".ico":   "image/x-icon",
+	".map":   "application/json",
+	".md":    "text/markdown; charset=utf-8",
+	".mp4":   "video/mp4",
+	".txt":   "text/plain; charset=utf-8",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+}
+
+func init() {
+	for ext, contentType := range contentTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, contentType)
+		}
+	}
+}
+
+// NewFileServer serves the directory filesystemPath at path. Directories
+// are served by their index.html, and files and directories whose names
+// begin with a dot, such as .git or .htpasswd, are not served at all.
+func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
+	return http.StripPrefix(path, http.FileServer(dotFileHidingFileSystem{http.Dir(filesystemPath)}))
+}
+
+type dotFileHidingFileSystem struct {
+	http.FileSystem
+}
+
+func (fs dotFileHidingFileSystem) Open(name string) (http.File, error) {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return dotFileHidingFile{f}, nil
+}
+
+// dotFileHidingFile leaves dot files out of directory listings
+type dotFileHidingFile struct {
+	http.File
+}
+
+func (f dotFileHidingFile) Readdir(n int) ([]os.FileInfo, error) {
+	files, err := f.File.Readdir(n)
+	visible := files[:0]
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), ".") {
+			visible = append(visible, fi)
+		}
+	}
+	return visible, err
+}
+
+// parseFileURL checks an upstream like file:///var/www/static/, which may be
+// mounted under a path given as the fragment: file:///var/www/static/#/docs/
+func parseFileURL(u *url.URL, name string, msgs []string) []string {
+	if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return append(msgs, fmt.Sprintf(
+			"%s file path must be an absolute path, ie: file:///var/www/static/: %q", name, u))
+	}
+	if fi, err := os.Stat(u.Path); err != nil || !fi.IsDir() {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s file path must be an existing directory: %q", name, u.Path))
+	}
+	if u.Fragment != "" && !strings.HasPrefix(u.Fragment, "/") {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s file path prefix must begin with /: %q", name, u.Fragment))
+	}
+	return msgs
+}
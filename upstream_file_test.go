@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestFileServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth2_proxy_file_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"index.html":      "<h1>docs</h1>",
+		"fonts/a.woff2":   "font",
+		"build/app.tar":   "artifact",
+		".htpasswd":       "secret",
+		".git/config":     "secret",
+		"build/.env":      "secret",
+		"notes/readme.md": "# notes",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(content), 0644)
+	}
+	server := NewFileServer("/docs/", dir)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		rw := httptest.NewRecorder()
+		server.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := get("/docs/")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "<h1>docs</h1>", rw.Body.String())
+	assert.Equal(t, "text/html; charset=utf-8", rw.Header().Get("Content-Type"))
+
+	rw = get("/docs/fonts/a.woff2")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "font/woff2", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "text/markdown; charset=utf-8", get("/docs/notes/readme.md").Header().Get("Content-Type"))
+
+	for _, path := range []string{"/docs/.htpasswd", "/docs/.git/config", "/docs/build/.env"} {
+		assert.Equal(t, 404, get(path).Code)
+	}
+	rw = get("/docs/build/")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, true, strings.Contains(rw.Body.String(), "app.tar"))
+	assert.Equal(t, false, strings.Contains(rw.Body.String(), ".env"))
+}
+
+func TestParseFileURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth2_proxy_file_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	parse := func(rawurl string) []string {
+		u, _ := url.Parse(rawurl)
+		return parseFileURL(u, "upstream", nil)
+	}
+	assert.Equal(t, 0, len(parse("file://"+dir+"/#/docs/")))
+	assert.Equal(t, []string{
+		"upstream file path must be an absolute path, ie: file:///var/www/static/: \"file://var/www\""},
+		parse("file://var/www"))
+	assert.Equal(t, []string{
+		"upstream file path must be an existing directory: \"" + dir + "/missing\"",
+		"upstream file path prefix must begin with /: \"docs\""},
+		parse("file://"+dir+"/missing#docs"))
+}
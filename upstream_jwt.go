@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// upstreamJWTSigner mints the short lived tokens that carry the user's
+// identity to upstreams with upstream-jwt-key-file. Unlike the
+// X-Forwarded-* headers, they can't be forged by anything between the proxy
+// and the upstream, which checks them against the public key published at
+// /oauth2/jwks.json.
+type upstreamJWTSigner struct {
+	signer   jose.Signer
+	jwks     jose.JSONWebKeySet
+	header   string
+	issuer   string
+	audience string
+	expiry   time.Duration
+	now      func() time.Time
+}
+
+// upstreamJWTClaims are the claims of an upstream token. The subject is
+// the user name.
+type upstreamJWTClaims struct {
+	jwt.Claims
+	Email  string   `json:"email,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// loadSigningKey reads a PEM encoded RSA or ECDSA private key
+func loadSigningKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported key type %q", block.Type)
+}
+
+// signingAlgorithm picks the JWS algorithm for a key
+func signingAlgorithm(key crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+	}
+	return "", errors.New("key must be RSA or ECDSA with a P-256, P-384 or P-521 curve")
+}
+
+func newUpstreamJWTSigner(o *Options) (*upstreamJWTSigner, error) {
+	key, err := loadSigningKey(o.UpstreamJWTKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	alg, err := signingAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	public := jose.JSONWebKey{Key: key.Public(), Algorithm: string(alg), Use: "sig"}
+	thumbprint, err := public.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	public.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", public.KeyID))
+	if err != nil {
+		return nil, err
+	}
+	return &upstreamJWTSigner{
+		signer:   signer,
+		jwks:     jose.JSONWebKeySet{Keys: []jose.JSONWebKey{public}},
+		header:   o.UpstreamJWTHeader,
+		issuer:   o.UpstreamJWTIssuer,
+		audience: o.UpstreamJWTAudience,
+		expiry:   o.UpstreamJWTExpiry,
+		now:      time.Now,
+	}, nil
+}
+
+// Token returns a token for the session's identity. Its audience is
+// upstream-jwt-audience, or the host the request was made to.
+func (s *upstreamJWTSigner) Token(session *providers.SessionState, host string) (string, error) {
+	now := s.now()
+	audience := s.audience
+	if audience == "" {
+		audience = host
+	}
+	claims := upstreamJWTClaims{
+		Claims: jwt.Claims{
+			Issuer:    s.issuer,
+			Subject:   session.User,
+			Audience:  jwt.Audience{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(now.Add(s.expiry)),
+		},
+		Email:  session.Email,
+		Groups: session.Groups,
+	}
+	return jwt.Signed(s.signer).Claims(claims).CompactSerialize()
+}
+
+// JWKS serves the public key upstreams verify tokens with
+func (p *OAuthProxy) JWKS(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "max-age=300")
+	json.NewEncoder(rw).Encode(p.upstreamJWT.jwks)
+}
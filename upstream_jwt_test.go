@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// writeSigningKey writes a new P-256 key to dir and returns its path
+func writeSigningKey(t *testing.T, dir string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalECPrivateKey(key)
+	path := filepath.Join(dir, "jwt.pem")
+	ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	return path
+}
+
+func TestUpstreamJWTOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream_jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := testOptions()
+	o.UpstreamJWTKeyFile = filepath.Join(dir, "missing.pem")
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	ioutil.WriteFile(o.UpstreamJWTKeyFile, []byte("not a key"), 0600)
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`invalid upstream-jwt-key-file="` + o.UpstreamJWTKeyFile + `" no PEM encoded key found`,
+	}), err.Error())
+
+	o.UpstreamJWTKeyFile = writeSigningKey(t, dir)
+	o.UpstreamJWTHeader = "x-identity"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "X-Identity", o.upstreamJWT.header)
+	assert.Equal(t, "ES256", o.upstreamJWT.jwks.Keys[0].Algorithm)
+
+	o.SignatureHeaders = []string{"x-forwarded-email"}
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{"signature-header requires signature-key"}), err.Error())
+	o.SignatureKey = "sha256:secret"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, []string{"X-Forwarded-Email"}, o.signatureData.headers)
+}
+
+func TestUpstreamJWT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream_jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var upstreamHeaders http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders = r.Header
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.UpstreamJWTKeyFile = writeSigningKey(t, dir)
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	now := time.Unix(1500000000, 0)
+	proxy.upstreamJWT.now = func() time.Time { return now }
+
+	session := &providers.SessionState{User: "user", Email: "user@example.com", Groups: []string{"admins"}}
+	req, _ := http.NewRequest("GET", "http://app.example.com/", nil)
+	rw := httptest.NewRecorder()
+	assert.Equal(t, nil, proxy.SaveSession(rw, req, session))
+	req.AddCookie(rw.Result().Cookies()[0])
+	req.Header.Set("GAP-Identity", "forged")
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	// verify the token the way an upstream would, with the published keys
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/jwks.json", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var jwks jose.JSONWebKeySet
+	assert.Equal(t, nil, json.NewDecoder(rw.Body).Decode(&jwks))
+
+	token, err := jwt.ParseSigned(upstreamHeaders.Get("GAP-Identity"))
+	assert.Equal(t, nil, err)
+	keys := jwks.Key(token.Headers[0].KeyID)
+	assert.Equal(t, 1, len(keys))
+	var claims upstreamJWTClaims
+	assert.Equal(t, nil, token.Claims(keys[0].Key, &claims))
+	assert.Equal(t, nil, claims.Validate(jwt.Expected{
+		Issuer:   "oauth2_proxy",
+		Audience: jwt.Audience{"app.example.com"},
+		Time:     now.Add(30 * time.Second),
+	}))
+	assert.Equal(t, "user", claims.Subject)
+	assert.Equal(t, "user@example.com", claims.Email)
+	assert.Equal(t, []string{"admins"}, claims.Groups)
+	assert.Equal(t, jwt.ErrExpired, claims.Validate(jwt.Expected{Time: now.Add(3 * time.Minute)}))
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	loadBalanceRoundRobin = "round_robin"
+	loadBalanceFailover   = "failover"
+)
+
+// healthCheck describes how upstreams are checked: a GET of path on each
+// upstream every interval, which fails on a connection error or a response
+// other than 2xx or 3xx. An empty path disables checking.
+type healthCheck struct {
+	path     string
+	interval time.Duration
+}
+
+// upstreamBackend is one upstream of a pool
+type upstreamBackend struct {
+	handler  *UpstreamProxy
+	checkURL string
+	client   *http.Client
+	healthy  int32
+}
+
+func (b *upstreamBackend) isHealthy() bool {
+	return atomic.LoadInt32(&b.healthy) == 1
+}
+
+func (b *upstreamBackend) setHealthy(healthy bool, reason string) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	if atomic.SwapInt32(&b.healthy, v) != v {
+		state := "unhealthy"
+		if healthy {
+			state = "healthy"
+		}
+		log.Printf("upstream %q is %s%s", b.handler.metricsLabel(), state, reason)
+	}
+	upstreamHealthy.WithLabelValues(b.handler.metricsLabel()).Set(float64(v))
+}
+
+func (b *upstreamBackend) check() {
+	resp, err := b.client.Get(b.checkURL)
+	if err != nil {
+		b.setHealthy(false, fmt.Sprintf(": %s", err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		b.setHealthy(false, fmt.Sprintf(": %s returned %d", b.checkURL, resp.StatusCode))
+		return
+	}
+	b.setHealthy(true, "")
+}
+
+// upstreamPool proxies each request to one of several interchangeable
+// upstreams, skipping those that are failing health checks. A pool with a
+// single upstream simply proxies to it.
+type upstreamPool struct {
+	mu        sync.RWMutex
+	backends  []*upstreamBackend
+	failover  bool
+	check     healthCheck
+	next      uint32
+	discovery *upstreamDiscovery
+}
+
+// newUpstreamPool returns a pool over the given upstreams. proxies holds the
+// reverse proxy behind each upstream so that failed requests can mark it
+// unhealthy until it passes a health check again.
+func newUpstreamPool(upstreams []*UpstreamProxy, proxies []*httputil.ReverseProxy, failover bool, check healthCheck) *upstreamPool {
+	p := &upstreamPool{failover: failover, check: check}
+	for i, up := range upstreams {
+		p.backends = append(p.backends, p.newBackend(up, proxies[i]))
+	}
+	return p
+}
+
+// newBackend returns a healthy backend for an upstream of the pool
+func (p *upstreamPool) newBackend(up *UpstreamProxy, proxy *httputil.ReverseProxy) *upstreamBackend {
+	b := &upstreamBackend{handler: up, healthy: 1}
+	if p.check.path == "" {
+		return b
+	}
+	target := up.upstream
+	switch target.Scheme {
+	case "unix":
+		target = *unixSocketTarget()
+	case "h2c":
+		target = *h2cTarget(&target)
+	}
+	b.checkURL = target.Scheme + "://" + target.Host + p.check.path
+	b.client = &http.Client{Transport: proxy.Transport, Timeout: p.check.interval}
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		// requests cancelled by the client say nothing about the upstream
+		if req.Context().Err() == nil {
+			b.setHealthy(false, fmt.Sprintf(": %s", err))
+		}
+		log.Printf("http: proxy error: %v", err)
+		rw.WriteHeader(http.StatusBadGateway)
+	}
+	return b
+}
+
+func (p *upstreamPool) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	b := p.pick()
+	if b == nil {
+		log.Printf("no upstreams discovered for %q", p.discovery.source)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	b.handler.ServeHTTP(rw, req)
+}
+
+// upstreams returns the pool's current upstreams. Discovery replaces the
+// slice rather than changing it, so it can be used without the lock.
+func (p *upstreamPool) upstreams() []*upstreamBackend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.backends
+}
+
+// pick returns the next healthy upstream, in turn for round robin or in
+// order of preference for failover. When none are healthy requests are
+// spread over all of them rather than refused. A discovered pool may have
+// none, when pick returns nil.
+func (p *upstreamPool) pick() *upstreamBackend {
+	backends := p.upstreams()
+	n := len(backends)
+	if n == 0 {
+		return nil
+	}
+	start := 0
+	if !p.failover && n > 1 {
+		start = int((atomic.AddUint32(&p.next, 1) - 1) % uint32(n))
+	}
+	for i := 0; i < n; i++ {
+		if b := backends[(start+i)%n]; b.isHealthy() {
+			return b
+		}
+	}
+	return backends[start]
+}
+
+// checkHealth checks every upstream of the pool each interval until done is
+// closed
+func (p *upstreamPool) checkHealth(done <-chan bool) {
+	if p.check.path == "" {
+		return
+	}
+	ticker := time.NewTicker(p.check.interval)
+	defer ticker.Stop()
+	for {
+		p.checkAll()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll checks every upstream of the pool at once
+func (p *upstreamPool) checkAll() {
+	var wg sync.WaitGroup
+	for _, b := range p.upstreams() {
+		wg.Add(1)
+		go func(b *upstreamBackend) {
+			defer wg.Done()
+			b.check()
+		}(b)
+	}
+	wg.Wait()
+}
+
+// CheckUpstreams starts discovering and health checking the proxy's
+// upstreams, stopping when done is closed
+func (p *OAuthProxy) CheckUpstreams(done <-chan bool) {
+	for _, pool := range p.upstreamPools {
+		if pool.discovery != nil {
+			go pool.discover(done)
+		}
+		if pool.check.path != "" {
+			go pool.checkHealth(done)
+		}
+	}
+}
+
+func parseHealthCheckPath(name, path string) error {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("%s must begin with /: %q", name, path)
+	}
+	return nil
+}
+
+func parseUpstreamHealthCheck(o *Options, msgs []string) []string {
+	if err := parseHealthCheckPath("upstream-health-check-path", o.UpstreamHealthCheckPath); err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	if o.UpstreamHealthCheckInterval <= 0 {
+		msgs = append(msgs, fmt.Sprintf(
+			"upstream-health-check-interval must be positive: %s", o.UpstreamHealthCheckInterval))
+	}
+	o.upstreamHealthCheck = healthCheck{o.UpstreamHealthCheckPath, o.UpstreamHealthCheckInterval}
+	return msgs
+}
+
+// parseRouteHealthCheck returns the upstream health check and load balancing
+// for a route. health_check_path and health_check_interval replace
+// upstream-health-check-path and upstream-health-check-interval.
+func parseRouteHealthCheck(o *Options, name string, r RouteOptions) (healthCheck, bool, error) {
+	check := o.upstreamHealthCheck
+	if r.HealthCheckPath != "" {
+		if err := parseHealthCheckPath(name+" health_check_path", r.HealthCheckPath); err != nil {
+			return check, false, err
+		}
+		check.path = r.HealthCheckPath
+	}
+	if r.HealthCheckInterval != "" {
+		d, err := time.ParseDuration(r.HealthCheckInterval)
+		if err != nil || d <= 0 {
+			return check, false, fmt.Errorf(
+				"invalid %s health_check_interval=%q", name, r.HealthCheckInterval)
+		}
+		check.interval = d
+	}
+	switch r.LoadBalancing {
+	case "", loadBalanceRoundRobin:
+		return check, false, nil
+	case loadBalanceFailover:
+		return check, true, nil
+	}
+	return check, false, fmt.Errorf(
+		"invalid %s load_balancing=%q expected %s or %s",
+		name, r.LoadBalancing, loadBalanceRoundRobin, loadBalanceFailover)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func newPoolBackend(name string, healthy *bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && !*healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(name))
+	}))
+}
+
+func newPoolTest(t *testing.T, r RouteOptions) *OAuthProxy {
+	opts := testOptions()
+	opts.Upstreams = nil
+	opts.SkipAuthRegex = []string{"/"}
+	opts.Routes = []RouteOptions{r}
+	assert.Equal(t, nil, opts.Validate())
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+func poolResponse(proxy *OAuthProxy) string {
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	return rw.Body.String()
+}
+
+func TestRouteUpstreamPoolOptions(t *testing.T) {
+	rt := testRoute(t, RouteOptions{
+		Upstream:      "http://127.0.0.1:8080/",
+		Upstreams:     []string{"http://127.0.0.1:8081/", "unix:///var/run/app.sock"},
+		LoadBalancing: "failover", HealthCheckPath: "/healthz", HealthCheckInterval: "5s"})
+	assert.Equal(t, 3, len(rt.upstreams))
+	assert.Equal(t, "127.0.0.1:8081", rt.upstreams[1].Host)
+	assert.Equal(t, true, rt.failover)
+	assert.Equal(t, healthCheck{"/healthz", 5 * time.Second}, rt.healthCheck)
+
+	o := testOptions()
+	o.UpstreamHealthCheckPath = "/ping"
+	o.Upstreams = nil
+	o.Routes = []RouteOptions{{Upstream: "http://127.0.0.1:8080/"}}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, false, o.routes[0].failover)
+	assert.Equal(t, healthCheck{"/ping", 10 * time.Second}, o.routes[0].healthCheck)
+}
+
+func TestInvalidUpstreamPools(t *testing.T) {
+	o := testOptions()
+	o.UpstreamHealthCheckPath = "healthz"
+	o.UpstreamHealthCheckInterval = 0
+	o.Routes = []RouteOptions{
+		{Path: "/a/"},
+		{Upstreams: []string{"http://127.0.0.1:8080/", "ftp://127.0.0.1/"}},
+		{Upstream: "http://127.0.0.1:8080/", LoadBalancing: "random"},
+		{Upstream: "http://127.0.0.1:8080/", HealthCheckPath: "ping"},
+		{Upstream: "http://127.0.0.1:8080/", HealthCheckInterval: "0s"},
+	}
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		`upstream-health-check-path must begin with /: "healthz"`,
+		"upstream-health-check-interval must be positive: 0s",
+		"route[0] missing setting: upstream",
+		`route[1] upstream must be an http, https, h2c, unix, srv or k8s URL: "ftp://127.0.0.1/"`,
+		`invalid route[2] load_balancing="random" expected round_robin or failover`,
+		`route[3] health_check_path must begin with /: "ping"`,
+		`invalid route[4] health_check_interval="0s"`,
+	}), err.Error())
+}
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	healthy := true
+	a := newPoolBackend("a", &healthy)
+	defer a.Close()
+	b := newPoolBackend("b", &healthy)
+	defer b.Close()
+
+	proxy := newPoolTest(t, RouteOptions{Upstreams: []string{a.URL, b.URL}})
+	assert.Equal(t, "a", poolResponse(proxy))
+	assert.Equal(t, "b", poolResponse(proxy))
+	assert.Equal(t, "a", poolResponse(proxy))
+}
+
+func TestUpstreamPoolFailover(t *testing.T) {
+	primaryHealthy, secondaryHealthy := true, true
+	primary := newPoolBackend("primary", &primaryHealthy)
+	defer primary.Close()
+	secondary := newPoolBackend("secondary", &secondaryHealthy)
+	defer secondary.Close()
+
+	proxy := newPoolTest(t, RouteOptions{
+		Upstreams: []string{primary.URL, secondary.URL}, LoadBalancing: "failover",
+		HealthCheckPath: "/healthz"})
+	pool := proxy.upstreamPools[0]
+	assert.Equal(t, "primary", poolResponse(proxy))
+	assert.Equal(t, "primary", poolResponse(proxy))
+
+	primaryHealthy = false
+	pool.checkAll()
+	assert.Equal(t, "secondary", poolResponse(proxy))
+
+	// with nothing healthy requests are still tried
+	secondaryHealthy = false
+	pool.checkAll()
+	assert.Equal(t, "primary", poolResponse(proxy))
+
+	primaryHealthy = true
+	pool.checkAll()
+	assert.Equal(t, "primary", poolResponse(proxy))
+}
+
+func TestUpstreamPoolMarksFailedUpstream(t *testing.T) {
+	healthy := true
+	a := newPoolBackend("a", &healthy)
+	b := newPoolBackend("b", &healthy)
+	defer b.Close()
+
+	proxy := newPoolTest(t, RouteOptions{
+		Upstreams: []string{a.URL, b.URL}, HealthCheckPath: "/healthz"})
+	a.Close()
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	assert.Equal(t, "b", poolResponse(proxy))
+	assert.Equal(t, "b", poolResponse(proxy))
+}
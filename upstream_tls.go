@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// upstreamTLSFiles are the client certificate and CA bundle presented to and
+// used to verify https upstreams
+type upstreamTLSFiles struct {
+	certFile string
+	keyFile  string
+	caFile   string
+}
+
+// loadUpstreamTLSConfig builds the client tls config for upstreams. It
+// returns nil when no files are configured so the default transport is used.
+func loadUpstreamTLSConfig(f upstreamTLSFiles, names upstreamTLSFiles) (*tls.Config, error) {
+	if f.certFile == "" && f.keyFile == "" && f.caFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if f.certFile != "" || f.keyFile != "" {
+		if f.certFile == "" || f.keyFile == "" {
+			return nil, fmt.Errorf("%s and %s must be set together", names.certFile, names.keyFile)
+		}
+		cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading %s=%q %s", names.certFile, f.certFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if f.caFile != "" {
+		pem, err := ioutil.ReadFile(f.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading %s=%q %s", names.caFile, f.caFile, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s=%q", names.caFile, f.caFile)
+		}
+	}
+	return config, nil
+}
+
+// newUpstreamTransport returns a transport with the same defaults as
+// http.DefaultTransport that uses config for https upstreams and the given
+// timeouts
+func newUpstreamTransport(config *tls.Config, timeouts upstreamTimeouts) http.RoundTripper {
+	if config == nil && timeouts.empty() {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	timeouts.apply(transport)
+	return transport
+}
+
+func parseUpstreamTLS(o *Options, msgs []string) []string {
+	var err error
+	o.upstreamTLSConfig, err = loadUpstreamTLSConfig(
+		upstreamTLSFiles{o.UpstreamTLSCert, o.UpstreamTLSKey, o.UpstreamCAFile},
+		upstreamTLSFiles{"upstream-tls-cert", "upstream-tls-key", "upstream-ca-file"})
+	if err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	return msgs
+}
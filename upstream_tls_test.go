@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// writeClientCertificate writes a self signed client certificate and key to
+// dir, returning their paths and the parsed certificate
+func writeClientCertificate(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "oauth2_proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile, cert
+}
+
+// newMutualTLSUpstream starts an https upstream that requires clients to
+// present clientCert, and writes its certificate to a CA file in dir
+func newMutualTLSUpstream(t *testing.T, dir string, clientCert *x509.Certificate) (*httptest.Server, string) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello " + r.TLS.PeerCertificates[0].Subject.CommonName))
+		}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	upstream.StartTLS()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600)
+	return upstream, caFile
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, clientCert := writeClientCertificate(t, dir)
+	upstream, caFile := newMutualTLSUpstream(t, dir, clientCert)
+	defer upstream.Close()
+
+	proxyGet := func(o *Options) int {
+		o.Upstreams = []string{upstream.URL}
+		o.SkipAuthRegex = []string{"^/"}
+		assert.Equal(t, nil, o.Validate())
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RequestURI = "/"
+		NewOAuthProxy(o, func(string) bool { return true }).ServeHTTP(rw, req)
+		if rw.Code == http.StatusOK {
+			assert.Equal(t, "hello oauth2_proxy", rw.Body.String())
+		}
+		return rw.Code
+	}
+
+	o := testOptions()
+	o.UpstreamCAFile = caFile
+	assert.Equal(t, http.StatusBadGateway, proxyGet(o))
+
+	o = testOptions()
+	o.UpstreamTLSCert = certFile
+	o.UpstreamTLSKey = keyFile
+	o.UpstreamCAFile = caFile
+	assert.Equal(t, http.StatusOK, proxyGet(o))
+}
+
+func TestRouteMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, _ := writeClientCertificate(t, dir)
+
+	o := testOptions()
+	o.UpstreamCAFile = filepath.Join(dir, "missing.pem")
+	o.Routes = []RouteOptions{{Upstream: "https://127.0.0.1:8443/", TLSCert: certFile, TLSKey: keyFile}}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	o = testOptions()
+	o.UpstreamTLSCert = certFile
+	o.UpstreamTLSKey = keyFile
+	o.Routes = []RouteOptions{
+		{Path: "/a/", Upstream: "https://127.0.0.1:8443/"},
+		{Path: "/b/", Upstream: "https://127.0.0.1:8443/", CAFile: certFile},
+	}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, o.upstreamTLSConfig, o.routes[0].tlsConfig)
+	assert.Equal(t, 1, len(o.routes[1].tlsConfig.Certificates))
+	assert.NotEqual(t, nil, o.routes[1].tlsConfig.RootCAs)
+}
+
+func TestInvalidUpstreamTLSOptions(t *testing.T) {
+	o := testOptions()
+	o.UpstreamTLSCert = "/etc/ssl/client.pem"
+	o.UpstreamCAFile = "/nonexistent/ca.pem"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"upstream-tls-cert and upstream-tls-key must be set together",
+	}), err.Error())
+
+	o = testOptions()
+	o.Routes = []RouteOptions{
+		{Upstream: "https://127.0.0.1:8443/", TLSKey: "/etc/ssl/client.key"},
+		{Upstream: "https://127.0.0.1:8443/", CAFile: "/nonexistent/ca.pem"},
+	}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"route[0] tls_cert and route[0] tls_key must be set together",
+		"error loading route[1] ca_file=\"/nonexistent/ca.pem\" open /nonexistent/ca.pem: no such file or directory",
+	}), err.Error())
+}
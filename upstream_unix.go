@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// unixSocketTarget is the URL that requests to a unix socket upstream are
+// made to. Its host is only sent when pass-host-header is false.
+func unixSocketTarget() *url.URL {
+	return &url.URL{Scheme: "http", Host: "localhost"}
+}
+
+// newUnixSocketTransport returns a transport that makes every connection to
+// the unix socket at path
+func newUnixSocketTransport(path string, timeouts upstreamTimeouts) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	timeouts.apply(transport)
+	return transport
+}
+
+// parseUnixSocketURL checks an upstream like unix:///var/run/app.sock, which
+// may be mounted under a path given as the fragment:
+// unix:///var/run/app.sock#/app/
+func parseUnixSocketURL(u *url.URL, name string, msgs []string) []string {
+	if u.Host != "" || !strings.HasPrefix(u.Path, "/") || u.Path == "/" {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s unix socket must be an absolute path, ie: unix:///var/run/app.sock: %q", name, u))
+	}
+	if u.Fragment != "" && !strings.HasPrefix(u.Fragment, "/") {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s unix socket path prefix must begin with /: %q", name, u.Fragment))
+	}
+	return msgs
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/gorilla/websocket"
+)
+
+// newUnixSocketBackend serves handler on a unix socket in a temporary
+// directory, returning the socket's path
+func newUnixSocketBackend(t *testing.T, handler http.Handler) (string, func()) {
+	dir, err := ioutil.TempDir("", "oauth2_proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "app.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	return socket, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUnixSocketUpstreams(t *testing.T) {
+	newBackend := func(name string) (string, func()) {
+		return newUnixSocketBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.Host + " " + r.RequestURI))
+		}))
+	}
+	app, closeApp := newBackend("app")
+	defer closeApp()
+	api, closeAPI := newBackend("api")
+	defer closeAPI()
+	admin, closeAdmin := newBackend("admin")
+	defer closeAdmin()
+
+	opts := testOptions()
+	opts.Upstreams = []string{"unix://" + app, "unix://" + api + "#/api/"}
+	opts.Routes = []RouteOptions{{Host: "admin.example.com", Upstream: "unix://" + admin}}
+	opts.SkipAuthRegex = []string{"^/"}
+	assert.Equal(t, nil, opts.Validate())
+	frontend := httptest.NewServer(NewOAuthProxy(opts, func(string) bool { return true }))
+	defer frontend.Close()
+	f, _ := url.Parse(frontend.URL)
+
+	get := func(host, path string) string {
+		req := &http.Request{
+			Host: host,
+			URL:  &url.URL{Scheme: "http", Host: f.Host, Opaque: path},
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(body)
+	}
+
+	assert.Equal(t, "app www.example.com /index.html", get("www.example.com", "/index.html"))
+	assert.Equal(t, "api www.example.com /api/users?id=1", get("www.example.com", "/api/users?id=1"))
+	assert.Equal(t, "admin admin.example.com /", get("admin.example.com", "/"))
+}
+
+func TestUnixSocketWebsocketProxy(t *testing.T) {
+	socket, closeBackend := newUnixSocketBackend(t, websocketEchoHandler())
+	defer closeBackend()
+	u, _ := url.Parse("unix://" + socket)
+	proxy := NewReverseProxy(unixSocketTarget())
+	proxy.Transport = newUnixSocketTransport(socket, upstreamTimeouts{})
+	frontend := httptest.NewServer(&UpstreamProxy{*u, proxy, nil, true, nil})
+	defer frontend.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(
+		strings.Replace(frontend.URL, "http", "ws", 1)+"/socket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assert.Equal(t, nil, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	_, msg, err := conn.ReadMessage()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hello", string(msg))
+}
+
+func TestInvalidUnixSocketUpstreams(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"unix://var/run/app.sock", "unix:///var/run/app.sock#api"}
+	o.Routes = []RouteOptions{{Upstream: "unix://"}}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"upstream unix socket must be an absolute path, ie: unix:///var/run/app.sock: \"unix://var/run/app.sock\"",
+		"upstream unix socket path prefix must begin with /: \"api\"",
+		"route[0] upstream unix socket must be an absolute path, ie: unix:///var/run/app.sock: \"unix:\"",
+	}), err.Error())
+}
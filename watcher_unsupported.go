@@ -1,3 +1,4 @@
+//go:build !go1.3 || plan9 || solaris
 // +build !go1.3 plan9 solaris
 
 package main
@@ -3,6 +3,7 @@ package main
 import (
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -42,7 +43,21 @@ func (u *UpstreamProxy) handleWebsocket(w http.ResponseWriter, r *http.Request)
 
 	// Connect upstream
 	upstreamAddr := u.upstreamWSURL(*r.URL).String()
-	upstream, upstreamResp, err := websocket.DefaultDialer.Dial(upstreamAddr, upstreamHeader)
+	dialer := websocket.DefaultDialer
+	if u.tlsConfig != nil {
+		d := *websocket.DefaultDialer
+		d.TLSClientConfig = u.tlsConfig
+		dialer = &d
+	}
+	if u.upstream.Scheme == "unix" {
+		d := *dialer
+		socket := u.upstream.Path
+		d.NetDial = func(string, string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		}
+		dialer = &d
+	}
+	upstream, upstreamResp, err := dialer.Dial(upstreamAddr, upstreamHeader)
 	if err != nil {
 		if upstreamResp != nil {
 			log.Printf("dialing upstream websocket failed with code %d: %v", upstreamResp.StatusCode, err)
@@ -98,10 +113,13 @@ func (u *UpstreamProxy) upstreamWSURL(r url.URL) *url.URL {
 	ws.Host = u.upstream.Host
 	ws.Fragment = ""
 	switch u.upstream.Scheme {
-	case "http":
+	case "http", "h2c":
 		ws.Scheme = "ws"
 	case "https":
 		ws.Scheme = "wss"
+	case "unix":
+		ws.Scheme = "ws"
+		ws.Host = unixSocketTarget().Host
 	}
 	return &ws
 }
@@ -2,9 +2,13 @@ package main
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/bmizerany/assert"
+	"github.com/gorilla/websocket"
 )
 
 func TestCopyHeader(t *testing.T) {
@@ -45,3 +49,61 @@ func TestUpgrade(t *testing.T) {
 		assert.Equal(t, tt.upgrade, isWebsocketRequest(req))
 	}
 }
+
+func newWebsocketEchoBackend() *httptest.Server {
+	return httptest.NewServer(websocketEchoHandler())
+}
+
+func websocketEchoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(mt, msg)
+		}
+	})
+}
+
+func newWebsocketFrontend(backendURL string, websockets bool) *httptest.Server {
+	u, _ := url.Parse(backendURL)
+	proxy := NewReverseProxy(u)
+	return httptest.NewServer(&UpstreamProxy{*u, proxy, nil, websockets, nil})
+}
+
+func TestWebsocketProxy(t *testing.T) {
+	backend := newWebsocketEchoBackend()
+	defer backend.Close()
+	frontend := newWebsocketFrontend(backend.URL, true)
+	defer frontend.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(
+		strings.Replace(frontend.URL, "http", "ws", 1)+"/socket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assert.Equal(t, nil, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	_, msg, err := conn.ReadMessage()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hello", string(msg))
+}
+
+func TestWebsocketProxyDisabled(t *testing.T) {
+	backend := newWebsocketEchoBackend()
+	defer backend.Close()
+	frontend := newWebsocketFrontend(backend.URL, false)
+	defer frontend.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial(
+		strings.Replace(frontend.URL, "http", "ws", 1)+"/socket", nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
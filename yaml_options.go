@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// yamlConfig is a config file in YAML, used when its name ends in .yaml or
+// .yml. Options are named as in the TOML config file, and the tables that
+// TOML repeats, such as [[route]], are lists under plural names instead.
+type yamlConfig struct {
+	Routes       []RouteOptions       `yaml:"routes"`
+	Policies     []PolicyOptions      `yaml:"policies"`
+	Providers    []ProviderOptions    `yaml:"providers"`
+	Applications []ApplicationOptions `yaml:"applications"`
+	ClaimHeaders []ClaimHeaderOptions `yaml:"claim_headers"`
+
+	Options map[string]interface{} `yaml:",inline"`
+}
+
+// yamlLists are the names of the TOML tables, by the YAML lists that
+// replace them
+var yamlLists = map[string]string{
+	"route":        "routes",
+	"policy":       "policies",
+	"provider":     "providers",
+	"application":  "applications",
+	"claim_header": "claim_headers",
+}
+
+func isYAMLConfig(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// loadYAMLConfig reads a YAML config file, setting the lists in opts and
+// returning the options to resolve with the environment and command line
+// flags
+func loadYAMLConfig(path string, opts *Options) (EnvOptions, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c yamlConfig
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, err
+	}
+
+	cfg := make(EnvOptions)
+	var msgs []string
+	types, flags := configOptions(opts)
+	names := make([]string, 0, len(c.Options))
+	for name := range c.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := c.Options[name]
+		typ, ok := types[name]
+		if !ok {
+			msg := fmt.Sprintf("unknown option %q", name)
+			if n, ok := flags[name]; ok {
+				msg += fmt.Sprintf(", did you mean %q?", n)
+			} else if n, ok := yamlLists[name]; ok {
+				msg += fmt.Sprintf(", did you mean %q?", n)
+			}
+			msgs = append(msgs, msg)
+			continue
+		}
+		if v == nil {
+			continue
+		}
+		v, err := coerceOption(v, typ)
+		if err != nil {
+			msg := fmt.Sprintf("invalid %s: %s", name, err)
+			if n, ok := yamlLists[name]; ok {
+				msg += fmt.Sprintf(", did you mean %q?", n)
+			}
+			msgs = append(msgs, msg)
+			continue
+		}
+		cfg[name] = v
+	}
+	if len(msgs) != 0 {
+		return nil, fmt.Errorf("invalid options:\n  %s", strings.Join(msgs, "\n  "))
+	}
+
+	opts.Routes = c.Routes
+	opts.Policies = c.Policies
+	opts.Providers = c.Providers
+	opts.Applications = c.Applications
+	opts.ClaimHeaders = c.ClaimHeaders
+	return cfg, nil
+}
+
+// configOptions returns the types of the options a config file can set by
+// name, and those names by their flags, such as cookie_secret for
+// cookie-secret
+func configOptions(opts *Options) (map[string]reflect.Type, map[string]string) {
+	types := make(map[string]reflect.Type)
+	flags := make(map[string]string)
+	typ := reflect.TypeOf(opts).Elem()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		flagName := field.Tag.Get("flag")
+		if flagName == "" {
+			continue
+		}
+		cfgName := field.Tag.Get("cfg")
+		if cfgName == "" {
+			cfgName = strings.Replace(flagName, "-", "_", -1)
+		}
+		types[cfgName] = field.Type
+		if flagName != cfgName {
+			flags[flagName] = cfgName
+			flags[strings.Replace(flagName, "-", "_", -1)] = cfgName
+		}
+	}
+	for name := range types {
+		delete(flags, name)
+	}
+	return types, flags
+}
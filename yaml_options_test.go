@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func writeYAMLConfig(t *testing.T, config string) string {
+	file, err := ioutil.TempFile("", "oauth2_proxy*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(config)
+	file.Close()
+	return file.Name()
+}
+
+func TestLoadYAMLConfig(t *testing.T) {
+	path := writeYAMLConfig(t, `
+client_id: default
+cookie_expire: 12h
+cookie_secure: false
+user_quota: 600
+tracing_sample_rate: 1
+upstreams:
+  - http://127.0.0.1:8080/
+email_domains: example.com
+skip_provider_button:
+
+routes:
+  - path: /api/
+    upstreams: [http://127.0.0.1:9000/, http://127.0.0.1:9001/]
+    load_balancing: least_connections
+policies:
+  - path: /admin/
+    allowed_groups: [ops]
+providers:
+  - id: github
+    provider: github
+    client_id: gh
+applications:
+  - hosts: [wiki.example.com]
+    upstreams: [http://127.0.0.1:9002/]
+claim_headers:
+  - header: X-Employee-Id
+    claim: employee_id
+`)
+	defer os.Remove(path)
+	assert.Equal(t, true, isYAMLConfig(path))
+
+	opts := NewOptions()
+	cfg, err := loadYAMLConfig(path, opts)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, EnvOptions{
+		"client_id":           "default",
+		"cookie_expire":       "12h",
+		"cookie_secure":       false,
+		"user_quota":          600,
+		"tracing_sample_rate": float64(1),
+		"upstreams":           []string{"http://127.0.0.1:8080/"},
+		"email_domains":       "example.com",
+	}, cfg)
+	assert.Equal(t, []RouteOptions{{
+		Path:          "/api/",
+		Upstreams:     []string{"http://127.0.0.1:9000/", "http://127.0.0.1:9001/"},
+		LoadBalancing: "least_connections",
+	}}, opts.Routes)
+	assert.Equal(t, []PolicyOptions{{Path: "/admin/", AllowedGroups: []string{"ops"}}}, opts.Policies)
+	assert.Equal(t, []ProviderOptions{{ID: "github", Provider: "github", ClientID: "gh"}}, opts.Providers)
+	assert.Equal(t, []ApplicationOptions{{
+		Hosts: []string{"wiki.example.com"}, Upstreams: []string{"http://127.0.0.1:9002/"},
+	}}, opts.Applications)
+	assert.Equal(t, []ClaimHeaderOptions{{Header: "X-Employee-Id", Claim: "employee_id"}}, opts.ClaimHeaders)
+}
+
+func TestLoadYAMLConfigErrors(t *testing.T) {
+	path := writeYAMLConfig(t, `
+cookie-secret: secret
+upstream: http://127.0.0.1:8080/
+route:
+  - path: /
+cookie_expire: 3600
+cookie_secure: maybe
+provider:
+  - id: github
+email_domains:
+  - domain: example.com
+`)
+	defer os.Remove(path)
+
+	_, err := loadYAMLConfig(path, NewOptions())
+	assert.Equal(t, "invalid options:\n"+
+		"  unknown option \"cookie-secret\", did you mean \"cookie_secret\"?\n"+
+		"  invalid cookie_expire: expected a duration such as \"1h30m\", not 3600\n"+
+		"  invalid cookie_secure: expected true or false, not \"maybe\"\n"+
+		"  invalid email_domains: expected a list of strings, not a list containing a mapping\n"+
+		"  invalid provider: expected a string, not a list, did you mean \"providers\"?\n"+
+		"  unknown option \"route\", did you mean \"routes\"?\n"+
+		"  unknown option \"upstream\", did you mean \"upstreams\"?", err.Error())
+
+	// settings of the lists are checked by the YAML decoder
+	path = writeYAMLConfig(t, `
+routes:
+  - path: /
+    upstraem: http://127.0.0.1:8080/
+`)
+	defer os.Remove(path)
+	_, err = loadYAMLConfig(path, NewOptions())
+	assert.Equal(t, true, strings.Contains(err.Error(), "line 4: field upstraem not found"))
+}